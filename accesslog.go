@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"database/jsondb"
+)
+
+// accessLogSeries is the system time series holding the access log, in
+// hourly buckets dropped past the retention.
+const accessLogSeries = "access-log"
+
+// AccessLogConfig configures the access log: one entry per request, who
+// made it, what it was, how it ended and how long it took.
+type AccessLogConfig struct {
+	// Enabled turns the access log on.
+	Enabled bool
+
+	// Retention is how long entries are kept, such as "30d", the default.
+	Retention string
+}
+
+// accessEntry is one request of the access log.
+type accessEntry struct {
+	Method    string
+	Path      string
+	Status    int
+	LatencyMS float64
+	User      string `json:",omitempty"`
+	Admin     bool   `json:",omitempty"`
+	IP        string
+}
+
+// accessLog writes entries to the access log series in the background, so
+// requests do not wait for the disk.
+type accessLog struct {
+	entries chan jsondb.Point
+	done    chan struct{}
+	once    sync.Once
+}
+
+// startAccessLog configures the access log series of db and starts its
+// writer.
+func startAccessLog(db *jsondb.Driver, cfg AccessLogConfig) (*accessLog, error) {
+	retention := cfg.Retention
+	if retention == "" {
+		retention = "30d"
+	}
+
+	sys := db.System()
+	err := sys.ConfigureCollection(accessLogSeries, jsondb.CollectionConfig{
+		Series: &jsondb.SeriesConfig{Bucket: "hour", Retention: retention},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error configuring the access log: %v", err)
+	}
+
+	l := &accessLog{entries: make(chan jsondb.Point, 1024), done: make(chan struct{})}
+	go func() {
+		defer close(l.done)
+		for p := range l.entries {
+			if err := sys.Append(accessLogSeries, p.Time, p.Value); err != nil {
+				fmt.Println("Error writing the access log:", err)
+			}
+		}
+	}()
+	return l, nil
+}
+
+// close writes the pending entries and stops the writer.
+func (l *accessLog) close() {
+	l.once.Do(func() {
+		close(l.entries)
+		<-l.done
+	})
+}
+
+// auditRequests records every request in the access log. It runs before
+// authenticate and reads the identity it stored once the request is done.
+func (s *Server) auditRequests(c *fiber.Ctx) error {
+	start := time.Now()
+	err := c.Next()
+
+	status := c.Response().StatusCode()
+	if e, ok := err.(*fiber.Error); ok {
+		status = e.Code
+	} else if err != nil {
+		status = http.StatusInternalServerError
+	}
+
+	user, _ := c.Locals(userLocal).(string)
+	s.accessLog.entries <- jsondb.Point{Time: start, Value: accessEntry{
+		Method:    strings.Clone(c.Method()),
+		Path:      strings.Clone(c.Path()),
+		Status:    status,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+		User:      user,
+		Admin:     s.isAdmin(c),
+		IP:        strings.Clone(c.IP()),
+	}}
+	return err
+}
+
+// readAccessLog returns the entries between ?from= and ?to= (RFC 3339, the
+// last hour by default), optionally only those of ?user=, ?status= or
+// paths starting with ?path=, the newest ?limit= of them.
+func (s *Server) readAccessLog(c *fiber.Ctx) error {
+	if s.accessLog == nil {
+		return c.Status(404).SendString("The access log is not enabled")
+	}
+
+	to := time.Now()
+	from := to.Add(-time.Hour)
+	for key, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := c.Query(key); v != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339Nano, v); err != nil {
+				return c.Status(400).SendString(fmt.Sprintf("Invalid %s '%s'", key, v))
+			}
+		}
+	}
+
+	points, err := s.db.System().ReadRange(accessLogSeries, from, to)
+	if err != nil {
+		return c.Status(500).SendString(fmt.Sprintf("Error reading the access log: %v", err))
+	}
+
+	type entry struct {
+		Time time.Time
+		accessEntry
+	}
+	entries := []entry{}
+	for _, p := range points {
+		var e accessEntry
+		if err := jsondb.FromGeneric(p.Value, &e); err != nil {
+			continue
+		}
+		if (c.Query("user") != "" && e.User != c.Query("user")) ||
+			(c.QueryInt("status") != 0 && e.Status != c.QueryInt("status")) ||
+			!strings.HasPrefix(e.Path, c.Query("path")) {
+			continue
+		}
+		entries = append(entries, entry{p.Time, e})
+	}
+
+	if limit := c.QueryInt("limit"); limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return respond(c, entries)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+
+	"database/jsondb"
+)
+
+// installAttachments adds the attachments of records to api, before the
+// routes reading paths inside records:
+//
+//	GET    /:collection/:resource/~attachments        lists them
+//	POST   /:collection/:resource/~attachments        stores the files of a multipart form, by file name
+//	GET    /:collection/:resource/~attachments/:name  streams one
+//	DELETE /:collection/:resource/~attachments/:name
+func (s *Server) installAttachments(api fiber.Router) {
+	api.Get("/:collection/:resource/~attachments", s.partition, s.toLeader, func(c *fiber.Ctx) error {
+		store, collection, err := s.collection(c)
+		if err != nil {
+			return err
+		}
+
+		list, err := store.Attachments(collection, param(c, "resource"))
+		if err != nil {
+			return attachmentError(c, err)
+		}
+		if list == nil {
+			list = []jsondb.Attachment{}
+		}
+		return respond(c, list)
+	})
+
+	api.Post("/:collection/:resource/~attachments", s.partition, s.toLeader, func(c *fiber.Ctx) error {
+		store, collection, err := s.collection(c)
+		if err != nil {
+			return err
+		}
+
+		form, err := c.MultipartForm()
+		if err != nil {
+			return c.Status(400).SendString(fmt.Sprintf("Error parsing multipart form: %v", err))
+		}
+
+		stored := []jsondb.Attachment{}
+		for _, files := range form.File {
+			for _, fh := range files {
+				f, err := fh.Open()
+				if err != nil {
+					return c.Status(400).SendString(fmt.Sprintf("Error reading '%s': %v", fh.Filename, err))
+				}
+				a, err := store.PutAttachment(collection, param(c, "resource"), fh.Filename, f)
+				f.Close()
+				if err != nil {
+					return attachmentError(c, err)
+				}
+				stored = append(stored, a)
+			}
+		}
+		if len(stored) == 0 {
+			return c.Status(400).SendString("Missing files in multipart form")
+		}
+		c.Status(201)
+		return respond(c, stored)
+	})
+
+	api.Get("/:collection/:resource/~attachments/:name", s.partition, s.toLeader, func(c *fiber.Ctx) error {
+		store, collection, err := s.collection(c)
+		if err != nil {
+			return err
+		}
+
+		r, a, err := store.GetAttachment(collection, param(c, "resource"), param(c, "name"))
+		if err != nil {
+			return attachmentError(c, err)
+		}
+
+		c.Set(fiber.HeaderContentType, a.ContentType)
+		c.Set(fiber.HeaderETag, `"`+a.SHA256+`"`)
+		c.Set(fiber.HeaderLastModified, a.Written.Format(http.TimeFormat))
+		// fasthttp closes r once it is sent.
+		return c.SendStream(r, int(a.Size))
+	})
+
+	api.Delete("/:collection/:resource/~attachments/:name", s.partition, s.toLeader, func(c *fiber.Ctx) error {
+		store, collection, err := s.collection(c)
+		if err != nil {
+			return err
+		}
+
+		if err := store.DeleteAttachment(collection, param(c, "resource"), param(c, "name")); err != nil {
+			return attachmentError(c, err)
+		}
+		return c.SendStatus(204)
+	})
+}
+
+// attachmentError answers a failed attachment request.
+func attachmentError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, jsondb.ErrNoAttachment):
+		return c.Status(404).SendString(err.Error())
+	case os.IsNotExist(err):
+		return c.Status(404).SendString("Record not found")
+	}
+	return writeError(c, err)
+}
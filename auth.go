@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+
+	"database/jsondb"
+)
+
+// Accounts and sessions live in system collections of the main database:
+// an account per user name holding the bcrypt hash of its password, and a
+// session per login named after the SHA-256 of its token, so the tokens
+// themselves are never stored.
+const (
+	accountsCollection = "accounts"
+	sessionsCollection = "sessions"
+)
+
+// sessionCookie is the cookie login sets; the same token is accepted as a
+// bearer token.
+const sessionCookie = "session"
+
+// userLocal and rolesLocal are the keys under which authenticate stores
+// the user name and roles of a request with a valid session or token.
+const (
+	userLocal  = "user"
+	rolesLocal = "roles"
+)
+
+// adminRole grants admin scope.
+const adminRole = "admin"
+
+// minPasswordLength is the shortest password register accepts.
+const minPasswordLength = 8
+
+// AuthConfig configures the accounts and sessions of the /auth routes.
+type AuthConfig struct {
+	// Required rejects requests without a valid session, except those to
+	// /auth and those with admin scope.
+	Required bool
+
+	// OpenRegistration lets anyone register an account; otherwise only
+	// admins can.
+	OpenRegistration bool
+
+	// SessionTTL is the lifetime of a session, such as "12h" or "30d";
+	// 7 days by default.
+	SessionTTL string
+}
+
+func (c AuthConfig) sessionTTL() time.Duration {
+	if ttl, err := jsondb.ParseAge(c.SessionTTL); err == nil && ttl > 0 {
+		return ttl
+	}
+	return 7 * 24 * time.Hour
+}
+
+// account is the stored form of a user.
+type account struct {
+	Username     string
+	PasswordHash string
+	Created      time.Time
+}
+
+// session is the stored form of a login. Roles are those of single
+// sign-on users; accounts have none.
+type session struct {
+	Username string
+	Roles    []string `json:",omitempty"`
+	Created  time.Time
+	Expires  time.Time
+}
+
+// credentials is the body of register and login.
+type credentials struct {
+	Username string
+	Password string
+}
+
+// sessionName is the record name of the session of token.
+func sessionName(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sessionToken returns the token a request presents, from the session
+// cookie or a bearer token that is not the admin token.
+func (s *Server) sessionToken(c *fiber.Ctx) string {
+	if token := c.Cookies(sessionCookie); token != "" {
+		return token
+	}
+	token := strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if token == "" || token == s.config().AdminToken {
+		return ""
+	}
+	return token
+}
+
+// authenticate resolves the session or OIDC token of every request,
+// storing its user name and roles under userLocal and rolesLocal, and
+// turns away requests without one when sessions are required. Requests to
+// signed URLs have admin scope once their signature is checked.
+func (s *Server) authenticate(c *fiber.Ctx) error {
+	if c.Query("sig") != "" {
+		if err := s.checkSignature(c); err != nil {
+			return err
+		}
+		c.Locals(rolesLocal, []string{adminRole})
+		return c.Next()
+	}
+
+	if token := s.sessionToken(c); token != "" {
+		var sess session
+		err := s.db.System().Read(sessionsCollection, sessionName(token), &sess)
+		if err == nil && time.Now().Before(sess.Expires) {
+			c.Locals(userLocal, sess.Username)
+			c.Locals(rolesLocal, sess.Roles)
+		} else if user, roles, ok := s.verifyBearer(c, token); ok {
+			c.Locals(userLocal, user)
+			c.Locals(rolesLocal, roles)
+		}
+	}
+
+	if s.config().Auth.Required && c.Locals(userLocal) == nil &&
+		!strings.HasPrefix(c.Path(), "/auth/") && !s.isAdmin(c) {
+		return fiber.NewError(401, "Login required")
+	}
+	return c.Next()
+}
+
+func (s *Server) register(c *fiber.Ctx) error {
+	if !s.config().Auth.OpenRegistration && !s.isAdmin(c) {
+		return fiber.NewError(403, "Admin scope required to register accounts")
+	}
+
+	var cred credentials
+	if err := parseBody(c, &cred); err != nil {
+		return c.Status(400).SendString(fmt.Sprintf("Error parsing request body: %v", err))
+	}
+	if cred.Username == "" || strings.HasPrefix(cred.Username, "_") {
+		return c.Status(400).SendString("Invalid user name")
+	}
+	if len(cred.Password) < minPasswordLength {
+		return c.Status(400).SendString(fmt.Sprintf("Password must be at least %d characters", minPasswordLength))
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(cred.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return c.Status(400).SendString(fmt.Sprintf("Invalid password: %v", err))
+	}
+
+	s.authMutex.Lock()
+	defer s.authMutex.Unlock()
+
+	sys := s.db.System()
+	if err := sys.Read(accountsCollection, cred.Username, &account{}); err == nil {
+		return c.Status(409).SendString(fmt.Sprintf("User '%s' already exists", cred.Username))
+	}
+
+	a := account{Username: cred.Username, PasswordHash: string(hash), Created: time.Now().UTC()}
+	if err := sys.Write(accountsCollection, cred.Username, a); err != nil {
+		return writeError(c, err)
+	}
+	return c.Status(201).JSON(fiber.Map{"Username": a.Username})
+}
+
+// dummyHash is compared against when the user does not exist, so a login
+// takes as long whether or not it does.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("no such user"), bcrypt.DefaultCost)
+
+func (s *Server) login(c *fiber.Ctx) error {
+	var cred credentials
+	if err := parseBody(c, &cred); err != nil {
+		return c.Status(400).SendString(fmt.Sprintf("Error parsing request body: %v", err))
+	}
+
+	var a account
+	hash := dummyHash
+	err := s.db.System().Read(accountsCollection, cred.Username, &a)
+	if err == nil {
+		hash = []byte(a.PasswordHash)
+	} else if !os.IsNotExist(err) && err != jsondb.ErrInvalidName {
+		return c.Status(500).SendString(fmt.Sprintf("Error reading account: %v", err))
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(cred.Password)) != nil || err != nil {
+		return c.Status(401).SendString("Invalid user name or password")
+	}
+
+	token, sess, err := s.startSession(c, a.Username, nil)
+	if err != nil {
+		return writeError(c, err)
+	}
+	return c.JSON(fiber.Map{"Token": token, "Username": sess.Username, "Expires": sess.Expires})
+}
+
+// startSession stores a new session for user and sets its cookie.
+func (s *Server) startSession(c *fiber.Ctx, user string, roles []string) (string, session, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", session{}, err
+	}
+	token := hex.EncodeToString(b)
+
+	now := time.Now().UTC()
+	sess := session{Username: user, Roles: roles, Created: now, Expires: now.Add(s.config().Auth.sessionTTL())}
+	if err := s.db.System().Write(sessionsCollection, sessionName(token), sess); err != nil {
+		return "", sess, err
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  sess.Expires,
+		HTTPOnly: true,
+		Secure:   c.Protocol() == "https",
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+	return token, sess, nil
+}
+
+// hasRole reports whether the session or token of the request has role.
+func hasRole(c *fiber.Ctx, role string) bool {
+	roles, _ := c.Locals(rolesLocal).([]string)
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) logout(c *fiber.Ctx) error {
+	if token := s.sessionToken(c); token != "" {
+		err := s.db.System().Delete(sessionsCollection, sessionName(token))
+		if err != nil && c.Locals(userLocal) != nil {
+			return c.Status(500).SendString(fmt.Sprintf("Error ending session: %v", err))
+		}
+	}
+
+	c.ClearCookie(sessionCookie)
+	return c.SendStatus(204)
+}
+
+// whoami returns the user of the request's session.
+func (s *Server) whoami(c *fiber.Ctx) error {
+	user, ok := c.Locals(userLocal).(string)
+	if !ok {
+		return fiber.NewError(401, "Login required")
+	}
+	roles, _ := c.Locals(rolesLocal).([]string)
+	return c.JSON(fiber.Map{"Username": user, "Roles": roles})
+}
+
+// expireSessions deletes the sessions past their expiry; it runs as the
+// "expire-sessions" job.
+func (s *Server) expireSessions() error {
+	sys := s.db.System()
+	docs, err := sys.Query(sessionsCollection, jsondb.Query{})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, doc := range docs {
+		var sess session
+		if err := jsondb.FromGeneric(doc.Data, &sess); err != nil || sess.Expires.After(now) {
+			continue
+		}
+		if err := sys.Delete(sessionsCollection, doc.Resource); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRegister(t *testing.T) {
+	s := newTestServer(t, Config{})
+	cred := credentials{Username: "alice", Password: "correct horse"}
+
+	if r := do(t, s, "POST", "/auth/register", cred); r.Status != 403 {
+		t.Errorf("Registering without admin scope: %d, want 403", r.Status)
+	}
+	if r := do(t, s, "POST", "/auth/register", cred, bearer(testAdminToken)...); r.Status != 201 {
+		t.Fatalf("Registering: %d %s", r.Status, r.Body)
+	}
+	if r := do(t, s, "POST", "/auth/register", cred, bearer(testAdminToken)...); r.Status != 409 {
+		t.Errorf("Registering again: %d, want 409", r.Status)
+	}
+
+	var a account
+	if err := s.db.System().Read(accountsCollection, "alice", &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.PasswordHash == "" || a.PasswordHash == cred.Password {
+		t.Errorf("Stored password hash %q", a.PasswordHash)
+	}
+
+	for _, bad := range []credentials{
+		{Username: "", Password: "correct horse"},
+		{Username: "_system", Password: "correct horse"},
+		{Username: "bob", Password: "short"},
+	} {
+		if r := do(t, s, "POST", "/auth/register", bad, bearer(testAdminToken)...); r.Status != 400 {
+			t.Errorf("Registering %+v: %d, want 400", bad, r.Status)
+		}
+	}
+}
+
+func TestOpenRegistration(t *testing.T) {
+	s := newTestServer(t, Config{Auth: AuthConfig{OpenRegistration: true}})
+	if r := do(t, s, "POST", "/auth/register", credentials{Username: "alice", Password: "correct horse"}); r.Status != 201 {
+		t.Errorf("Registering: %d %s", r.Status, r.Body)
+	}
+}
+
+// login registers user and logs in, returning the session token.
+func login(t *testing.T, s *Server, user, password string) string {
+	t.Helper()
+	cred := credentials{Username: user, Password: password}
+	if r := do(t, s, "POST", "/auth/register", cred, bearer(testAdminToken)...); r.Status != 201 {
+		t.Fatalf("Registering: %d %s", r.Status, r.Body)
+	}
+	r := do(t, s, "POST", "/auth/login", cred)
+	if r.Status != 200 {
+		t.Fatalf("Logging in: %d %s", r.Status, r.Body)
+	}
+	var body struct{ Token, Username string }
+	r.decode(t, &body)
+	if body.Token == "" || body.Username != user {
+		t.Fatalf("Login returned %s", r.Body)
+	}
+	return body.Token
+}
+
+func TestLogin(t *testing.T) {
+	s := newTestServer(t, Config{})
+	token := login(t, s, "alice", "correct horse")
+
+	for _, cred := range []credentials{
+		{Username: "alice", Password: "wrong horse"},
+		{Username: "nobody", Password: "correct horse"},
+		{Username: "../accounts", Password: "correct horse"},
+	} {
+		if r := do(t, s, "POST", "/auth/login", cred); r.Status != 401 {
+			t.Errorf("Logging in as %+v: %d, want 401", cred, r.Status)
+		}
+	}
+
+	// The token is accepted as a bearer token and as the session cookie,
+	// and only its hash is stored.
+	for _, h := range [][]string{bearer(token), {"Cookie", sessionCookie + "=" + token}} {
+		r := do(t, s, "GET", "/auth/me", nil, h...)
+		var me struct{ Username string }
+		if r.Status == 200 {
+			r.decode(t, &me)
+		}
+		if me.Username != "alice" {
+			t.Errorf("/auth/me with %s: %d %s, want alice", h[0], r.Status, r.Body)
+		}
+	}
+	if err := s.db.System().Read(sessionsCollection, token, &session{}); !os.IsNotExist(err) {
+		t.Errorf("Reading the session by its token: %v, want not found", err)
+	}
+
+	if r := do(t, s, "POST", "/auth/logout", nil, bearer(token)...); r.Status != 204 {
+		t.Fatalf("Logging out: %d %s", r.Status, r.Body)
+	}
+	if r := do(t, s, "GET", "/auth/me", nil, bearer(token)...); r.Status != 401 {
+		t.Errorf("/auth/me after logout: %d, want 401", r.Status)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	s := newTestServer(t, Config{Auth: AuthConfig{Required: true, SessionTTL: "1h"}})
+	token := login(t, s, "alice", "correct horse")
+
+	sys := s.db.System()
+	var sess session
+	if err := sys.Read(sessionsCollection, sessionName(token), &sess); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := sess.Expires.Sub(sess.Created); ttl != time.Hour {
+		t.Errorf("Session lasts %v, want 1h", ttl)
+	}
+	if r := do(t, s, "GET", "/v1/healthz", nil, bearer(token)...); r.Status == 401 {
+		t.Fatalf("Request with a session: 401 %s", r.Body)
+	}
+	if r := do(t, s, "GET", "/v1/healthz", nil); r.Status != 401 {
+		t.Errorf("Request without a session: %d, want 401", r.Status)
+	}
+
+	sess.Expires = time.Now().Add(-time.Minute)
+	if err := sys.Write(sessionsCollection, sessionName(token), sess); err != nil {
+		t.Fatal(err)
+	}
+	if r := do(t, s, "GET", "/v1/healthz", nil, bearer(token)...); r.Status != 401 {
+		t.Errorf("Request with an expired session: %d, want 401", r.Status)
+	}
+	if r := do(t, s, "GET", "/auth/me", nil, bearer(token)...); r.Status != 401 {
+		t.Errorf("/auth/me with an expired session: %d, want 401", r.Status)
+	}
+
+	if err := s.expireSessions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sys.Read(sessionsCollection, sessionName(token), &session{}); !os.IsNotExist(err) {
+		t.Errorf("Reading the expired session after expire-sessions: %v, want not found", err)
+	}
+}
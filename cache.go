@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"database/jsondb"
+)
+
+// CachePolicy is what GET responses of a collection tell browsers and
+// CDNs in their Cache-Control header.
+type CachePolicy struct {
+	// MaxAge ("10m", "7d") is how long a response may be reused without
+	// asking the server again; when empty caches revalidate every time,
+	// which costs little thanks to ETags.
+	MaxAge string `json:",omitempty"`
+
+	// Private keeps shared caches, such as CDNs, from storing responses.
+	Private bool `json:",omitempty"`
+
+	// NoStore forbids storing responses at all, for sensitive collections.
+	NoStore bool `json:",omitempty"`
+}
+
+// anyCollection is the key of Config.Cache applying to collections without
+// a policy of their own.
+const anyCollection = "*"
+
+// header returns the Cache-Control value of p.
+func (p CachePolicy) header() (string, error) {
+	if p.NoStore {
+		return "no-store", nil
+	}
+
+	scope := "public"
+	if p.Private {
+		scope = "private"
+	}
+	if p.MaxAge == "" {
+		return scope + ", no-cache", nil
+	}
+
+	maxAge, err := jsondb.ParseAge(p.MaxAge)
+	if err != nil {
+		return "", fmt.Errorf("Invalid MaxAge '%s': %v", p.MaxAge, err)
+	}
+	return fmt.Sprintf("%s, max-age=%d", scope, int64(maxAge.Seconds())), nil
+}
+
+// cacheControl returns the Cache-Control value configured for collection,
+// or "" when there is none.
+func (s *Server) cacheControl(collection string) string {
+	cache := s.config().Cache
+	p, ok := cache[collection]
+	if !ok {
+		if p, ok = cache[anyCollection]; !ok {
+			return ""
+		}
+	}
+	h, _ := p.header() // checked when the config was loaded
+	return h
+}
+
+// cacheHeaders gives successful GET responses of the collection API the
+// Cache-Control header of their collection and a strong ETag, answering
+// 304 Not Modified when If-None-Match names the current one. Streamed
+// responses, such as spilled listings, get no ETag: hashing them would
+// read them into memory.
+func (s *Server) cacheHeaders(c *fiber.Ctx) error {
+	if err := c.Next(); err != nil {
+		return err
+	}
+
+	resp := c.Response()
+	if resp.StatusCode() != fiber.StatusOK {
+		return nil
+	}
+
+	if h := s.cacheControl(param(c, "collection")); h != "" {
+		c.Set(fiber.HeaderCacheControl, h)
+	}
+	c.Vary(fiber.HeaderAccept)
+
+	if resp.IsBodyStream() {
+		return nil
+	}
+
+	sum := sha256.Sum256(resp.Body())
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	c.Set(fiber.HeaderETag, etag)
+
+	if etagMatches(c.Get(fiber.HeaderIfNoneMatch), etag) {
+		c.Status(fiber.StatusNotModified)
+		resp.ResetBody()
+	}
+	return nil
+}
+
+// etagMatches reports whether the If-None-Match header lists etag, which
+// it does weakly, as RFC 9110 has it compare.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
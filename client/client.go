@@ -0,0 +1,193 @@
+// Package client talks to the database server's generic collection API.
+// With a ring it sends every record request straight to the node owning
+// the record, and fans listings out to every node:
+//
+//	ring, _ := jsondb.NewRing(jsondb.RingConfig{Nodes: []string{"http://db1:3000", "http://db2:3000"}})
+//	c := client.NewPartitioned(ring)
+//	err := c.Put(ctx, "users", "John", user)
+//
+// Requests carry the trace context of their ctx through the global
+// OpenTelemetry propagator.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+
+	"database/jsondb"
+)
+
+// Client is a client of one server or of the nodes of a ring.
+type Client struct {
+	// BaseURL is the server of a client without a ring, such as
+	// "http://localhost:3000".
+	BaseURL string
+
+	// Ring, when set, routes each record to its owner.
+	Ring *jsondb.Ring
+
+	// Token is sent as a bearer token, for admin scope or a session.
+	Token string
+
+	// HTTP is the client requests are made with; http.DefaultClient by
+	// default.
+	HTTP *http.Client
+
+	// Instance, when set, is sent in the jsondb.InstanceHeader of every
+	// request: the InstanceID of a database the client acts for.
+	Instance string
+}
+
+// New returns a client of the server at baseURL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// NewPartitioned returns a client of the nodes of ring.
+func NewPartitioned(ring *jsondb.Ring) *Client {
+	return &Client{Ring: ring}
+}
+
+// StatusError is returned for responses that are not successful.
+type StatusError struct {
+	Status  int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Server responded %d: %s", e.Status, e.Message)
+}
+
+// node returns the server holding the record resource of collection.
+func (c *Client) node(collection, resource string) string {
+	if c.Ring == nil {
+		return c.BaseURL
+	}
+	return strings.TrimSuffix(c.Ring.Owner(collection, resource), "/")
+}
+
+func recordPath(collection, resource string) string {
+	return "/v2/collections/" + url.PathEscape(collection) + "/" + url.PathEscape(resource)
+}
+
+// Get reads the record resource of collection into v. A missing record
+// yields an error satisfying os.IsNotExist.
+func (c *Client) Get(ctx context.Context, collection, resource string, v interface{}) error {
+	return c.do(ctx, http.MethodGet, c.node(collection, resource)+recordPath(collection, resource), nil, v)
+}
+
+// Load returns the record resource of collection as JSON; with it a
+// client is the jsondb.Loader of read-through collections, such as those
+// of an edge cache of the server.
+func (c *Client) Load(ctx context.Context, collection, resource string) ([]byte, error) {
+	var raw json.RawMessage
+	if err := c.Get(ctx, collection, resource, &raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// Put writes v as the record resource of collection.
+func (c *Client) Put(ctx context.Context, collection, resource string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPut, c.node(collection, resource)+recordPath(collection, resource), b, nil)
+}
+
+// Delete deletes the record resource of collection.
+func (c *Client) Delete(ctx context.Context, collection, resource string) error {
+	return c.do(ctx, http.MethodDelete, c.node(collection, resource)+recordPath(collection, resource), nil, nil)
+}
+
+// List returns the records of collection. With a ring it asks every node
+// and concatenates their answers, except for colocated collections, which
+// only their node holds.
+func (c *Client) List(ctx context.Context, collection string) ([]json.RawMessage, error) {
+	nodes := []string{c.BaseURL}
+	if c.Ring != nil {
+		nodes = c.Ring.Nodes()
+		if c.Ring.Colocated(collection) {
+			nodes = []string{c.Ring.Owner(collection, "")}
+		}
+	}
+
+	records := []json.RawMessage{}
+	for _, node := range nodes {
+		var part []json.RawMessage
+		err := c.do(ctx, http.MethodGet, strings.TrimSuffix(node, "/")+"/v2/collections/"+url.PathEscape(collection), nil, &part)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, part...)
+	}
+	return records, nil
+}
+
+// MerkleNode returns the node at prefix of the Merkle tree of collection
+// on the server of a client without a ring, which needs admin scope; with
+// it a client is the jsondb.MerkleFunc of a remote collection.
+func (c *Client) MerkleNode(ctx context.Context, collection, prefix string) (jsondb.MerkleNode, error) {
+	var node jsondb.MerkleNode
+	u := c.BaseURL + "/v2/admin/merkle/" + url.PathEscape(collection) + "?prefix=" + url.QueryEscape(prefix)
+	err := c.do(ctx, http.MethodGet, u, nil, &node)
+	return node, err
+}
+
+func (c *Client) do(ctx context.Context, method, u string, body []byte, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if c.Instance != "" {
+		req.Header.Set(jsondb.InstanceHeader, c.Instance)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	httpClient := c.HTTP
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return os.ErrNotExist
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &StatusError{Status: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+
+	"database/jsondb"
+)
+
+// syncPeers is the system collection of the local database holding the
+// checkpoints of every synced collection.
+const syncPeers = "sync-peers"
+
+// syncServer names the server in the version vectors of synced records.
+const syncServer = "server"
+
+// Syncer keeps collections of a local database in step with the server,
+// for apps that work offline: they read and write Local as usual, and call
+// Sync when connected. Conflicts are settled by the resolvers set on Local
+// with SetConflictResolver, and by those of the server for its side.
+type Syncer struct {
+	Local *jsondb.Driver
+
+	// Remote is a client of one server; collections partitioned over a
+	// ring cannot be synced.
+	Remote *Client
+
+	// Replica names this copy in version vectors; it must differ between
+	// devices and stay the same across restarts.
+	Replica string
+}
+
+// syncCheckpoints is how far a collection was synced: the local changes
+// up to Pushed were sent, and the server's up to Pulled taken.
+type syncCheckpoints struct {
+	Pushed uint64
+	Pulled uint64
+}
+
+// Sync sends the local changes of collection made since the last sync and
+// applies those of the server. It returns how many changes went each way.
+func (s *Syncer) Sync(ctx context.Context, collection string) (pushed, pulled int, err error) {
+	sys := s.Local.System()
+	name := jsondb.NewKey(collection).String()
+
+	var cp syncCheckpoints
+	if err := sys.Read(syncPeers, name, &cp); err != nil && !os.IsNotExist(err) {
+		return 0, 0, err
+	}
+
+	// The local changes not taken from the server
+	local, err := s.Local.Sync(collection, s.Replica, jsondb.SyncRequest{Replica: syncServer, Checkpoint: cp.Pushed})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var remote jsondb.SyncResponse
+	req := jsondb.SyncRequest{Replica: s.Replica, Checkpoint: cp.Pulled, Changes: local.Changes}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := s.Remote.do(ctx, http.MethodPost, s.Remote.BaseURL+"/v2/sync/"+url.PathEscape(collection), b, &remote); err != nil {
+		return 0, 0, err
+	}
+
+	// Changes made locally while the server answered have later sequence
+	// numbers than local.Checkpoint, so the next sync sends them
+	_, err = s.Local.Sync(collection, s.Replica, jsondb.SyncRequest{Replica: syncServer, Checkpoint: local.Checkpoint, Changes: remote.Changes})
+	if err != nil {
+		return len(local.Changes), 0, err
+	}
+
+	cp = syncCheckpoints{Pushed: local.Checkpoint, Pulled: remote.Checkpoint}
+	if err := sys.Write(syncPeers, name, cp); err != nil {
+		return len(local.Changes), len(remote.Changes), err
+	}
+	return len(local.Changes), len(remote.Changes), nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/proxy"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"database/jsondb"
+)
+
+// ClusterConfig makes the server one node of several partitioning records
+// between them by consistent hashing. Requests for records another node
+// owns are redirected or proxied to it; listings only cover the records
+// of this node, except for colocated collections.
+type ClusterConfig struct {
+	// Self is the URL of this node as listed in Ring.Nodes; empty serves
+	// every record locally.
+	Self string
+
+	// Ring lists the nodes and how records are spread over them.
+	Ring jsondb.RingConfig
+
+	// Proxy forwards requests for records of other nodes instead of
+	// redirecting the client to them.
+	Proxy bool
+}
+
+// forwardedHeader marks proxied requests, so a node whose ring disagrees
+// answers 421 instead of proxying them again.
+const forwardedHeader = "X-Partition-Forwarded"
+
+// newRing builds the ring of cfg, checking this node is on it.
+func newRing(cfg ClusterConfig) (*jsondb.Ring, error) {
+	ring, err := jsondb.NewRing(cfg.Ring)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range ring.Nodes() {
+		if node == cfg.Self {
+			return ring, nil
+		}
+	}
+	return nil, fmt.Errorf("Cluster node '%s' is not on the ring", cfg.Self)
+}
+
+// partition sends requests for records of other nodes, and listings of
+// colocated collections of other nodes, to their owner. System collections
+// are never partitioned.
+func (s *Server) partition(c *fiber.Ctx) error {
+	if s.ring == nil {
+		return c.Next()
+	}
+
+	collection, resource := param(c, "collection"), param(c, "resource")
+	if strings.HasPrefix(collection, "_") || (resource == "" && !s.ring.Colocated(collection)) {
+		return c.Next()
+	}
+
+	cfg := s.config().Cluster
+	owner := s.ring.Owner(collection, resource)
+	if owner == cfg.Self {
+		return c.Next()
+	}
+	if c.Get(forwardedHeader) != "" {
+		return fiber.NewError(fiber.StatusMisdirectedRequest, fmt.Sprintf("Record belongs to %s", owner))
+	}
+
+	target := strings.TrimSuffix(owner, "/") + c.OriginalURL()
+	if !cfg.Proxy {
+		return c.Redirect(target, fiber.StatusTemporaryRedirect)
+	}
+
+	ctx, span := otel.Tracer("database").Start(c.UserContext(), "forward",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("server.address", owner)))
+	defer span.End()
+
+	c.Request().Header.Set(forwardedHeader, cfg.Self)
+	outgoing(ctx, s.store(c), c.Request().Header.Set)
+	if err := proxy.Do(c, target); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return c.Status(502).SendString(fmt.Sprintf("Error forwarding to %s: %v", owner, err))
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"database/jsondb"
+)
+
+// recordDiff is how a record differs between two databases.
+type recordDiff struct {
+	Collection string
+	Resource   string
+	Change     string           // added, removed or changed
+	Patch      jsondb.JSONPatch `json:",omitempty"`
+
+	data map[string]interface{} // the record in the second database
+}
+
+// Kinds of recordDiff, from the first database to the second.
+const (
+	diffAdded   = "added"
+	diffRemoved = "removed"
+	diffChanged = "changed"
+)
+
+// diffDatabases compares the collections of two databases, all those of
+// either when collections is empty, and returns what changes from a to b,
+// by collection and resource.
+func diffDatabases(a, b *jsondb.Driver, collections []string) ([]recordDiff, error) {
+	if len(collections) == 0 {
+		seen := make(map[string]bool)
+		for _, db := range []*jsondb.Driver{a, b} {
+			names, err := db.Collections()
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range names {
+				if !seen[name] {
+					seen[name] = true
+					collections = append(collections, name)
+				}
+			}
+		}
+		sort.Strings(collections)
+	}
+
+	var diffs []recordDiff
+	for _, collection := range collections {
+		// Only the records the Merkle trees of the collection disagree on
+		// are read and compared
+		resources, err := jsondb.DiffMerkle(merkle(a, collection), merkle(b, collection))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, resource := range resources {
+			old, inA, err := record(a, collection, resource)
+			if err != nil {
+				return nil, err
+			}
+			data, inB, err := record(b, collection, resource)
+			if err != nil {
+				return nil, err
+			}
+			d := recordDiff{Collection: collection, Resource: resource, data: data}
+			switch {
+			case !inB:
+				d.Change = diffRemoved
+			case !inA:
+				d.Change = diffAdded
+			default:
+				if d.Patch, err = jsondb.DiffDocuments(old, data); err != nil {
+					return nil, err
+				}
+				if len(d.Patch) == 0 {
+					continue
+				}
+				d.Change = diffChanged
+			}
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs, nil
+}
+
+// merkle walks the Merkle tree of collection in db.
+func merkle(db *jsondb.Driver, collection string) jsondb.MerkleFunc {
+	return func(prefix string) (jsondb.MerkleNode, error) {
+		return db.MerkleNode(collection, prefix)
+	}
+}
+
+// record reads the record collection/resource of db, reporting whether it
+// exists.
+func record(db *jsondb.Driver, collection, resource string) (map[string]interface{}, bool, error) {
+	var data map[string]interface{}
+	err := db.Read(collection, resource, &data)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	return data, err == nil, err
+}
+
+// openPair opens the databases in two directories.
+func openPair(dirA, dirB string) (*jsondb.Driver, *jsondb.Driver, error) {
+	a, err := jsondb.Open(dirA)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := jsondb.Open(dirB)
+	if err != nil {
+		a.Close()
+		return nil, nil, err
+	}
+	return a, b, nil
+}
+
+// splitList reads a comma-separated list flag.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// diff reports the records added, removed and changed from the database in
+// one directory to that in another, with the JSON Patch of each change.
+func diff(_ string, args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	collections := flags.String("collections", "", "comma-separated collections to compare, all by default")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 2 {
+		return fmt.Errorf("Missing directories to compare")
+	}
+
+	a, b, err := openPair(flags.Arg(0), flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	defer b.Close()
+
+	diffs, err := diffDatabases(a, b, splitList(*collections))
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if diffs == nil {
+			diffs = []recordDiff{}
+		}
+		return enc.Encode(diffs)
+	}
+
+	counts := make(map[string]int)
+	for _, d := range diffs {
+		counts[d.Change]++
+		fmt.Printf("%-8s %s/%s\n", d.Change, d.Collection, d.Resource)
+		for _, op := range d.Patch {
+			b, err := json.Marshal(op)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("         %s\n", b)
+		}
+	}
+	fmt.Printf("%d added, %d removed, %d changed\n", counts[diffAdded], counts[diffRemoved], counts[diffChanged])
+	return nil
+}
+
+// syncDirs makes the database of one directory match that of another:
+// records added or changed in the source are written to the target and
+// records missing from the source are deleted from it.
+func syncDirs(_ string, args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+	from := flags.String("from", "", "source database directory")
+	to := flags.String("to", "", "target database directory")
+	collections := flags.String("collections", "", "comma-separated collections to sync, all by default")
+	dryRun := flags.Bool("dry-run", false, "only print the changes")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" {
+		return fmt.Errorf("Missing -from or -to")
+	}
+
+	target, source, err := openPair(*to, *from)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	defer source.Close()
+
+	diffs, err := diffDatabases(target, source, splitList(*collections))
+	if err != nil {
+		return err
+	}
+
+	for _, d := range diffs {
+		verb := map[string]string{diffAdded: "write", diffChanged: "update", diffRemoved: "delete"}[d.Change]
+		if *dryRun {
+			fmt.Printf("Would %s %s/%s\n", verb, d.Collection, d.Resource)
+			continue
+		}
+
+		if d.Change == diffRemoved {
+			err = target.Delete(d.Collection, d.Resource)
+		} else {
+			err = target.Write(d.Collection, d.Resource, d.data)
+		}
+		if err != nil {
+			return fmt.Errorf("Error syncing '%s/%s': %v", d.Collection, d.Resource, err)
+		}
+	}
+
+	verb := "Applied"
+	if *dryRun {
+		verb = "Would apply"
+	}
+	fmt.Printf("%s %d changes from '%s' to '%s'\n", verb, len(diffs), *from, *to)
+	return nil
+}
@@ -0,0 +1,407 @@
+// Command dbctl administers a jsondb database directory from the shell.
+//
+//	dbctl [-dir path] export-parquet [-transform file] <collection> [file]
+//	dbctl [-dir path] import-parquet <collection> <file>
+//	dbctl [-dir path] archive <collection> <age>
+//	dbctl [-dir path] restore <collection> [resource]
+//	dbctl [-dir path] upgrade [-yes] [-no-backup]
+//	dbctl [-dir path] rebalance [-config file] [-self url] [-token token] [-dry-run]
+//	dbctl [-dir path] shell [dir]
+//	dbctl [-dir path] stats [-json]
+//	dbctl [-dir path] schema [-sample n] [-json] <collection>
+//	dbctl [-dir path] quality [-json] <collection>
+//	dbctl [-dir path] clone [-transform file] <dir> [collection...]
+//	dbctl [-dir path] export-signed -key file [-transform file] <dir> [collection...]
+//	dbctl verify-export [-key file] [-json] <dir>
+//	dbctl oplog [-url url] [-token token] [-collection c] [-ops a,b] [-reads] [-n count] [-follow] [-json]
+//	dbctl diff [-collections a,b] [-json] <dirA> <dirB>
+//	dbctl sync -from <dir> -to <dir> [-collections a,b] [-dry-run]
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"database/client"
+	"database/jsondb"
+)
+
+// command runs one dbctl subcommand with its arguments.
+type command struct {
+	usage string
+	run   func(db *jsondb.Driver, args []string) error
+
+	// runDir, when set, runs instead of run, on a directory that is not
+	// opened as a database.
+	runDir func(dir string, args []string) error
+}
+
+var commands = map[string]command{
+	"export-parquet": {"[-transform file] <collection> [file]", exportParquet, nil},
+	"import-parquet": {"<collection> <file>", importParquet, nil},
+	"archive":        {"<collection> <age>", archive, nil},
+	"restore":        {"<collection> [resource]", restore, nil},
+	"upgrade":        {"[-yes] [-no-backup]", nil, upgrade},
+	"rebalance":      {"[-config file] [-self url] [-token token] [-dry-run]", rebalance, nil},
+	"shell":          {"[dir]", nil, shell},
+	"stats":          {"[-json]", stats, nil},
+	"schema":         {"[-sample n] [-json] <collection>", schema, nil},
+	"quality":        {"[-json] <collection>", quality, nil},
+	"clone":          {"[-transform file] <dir> [collection...]", clone, nil},
+	"export-signed":  {"-key file [-transform file] <dir> [collection...]", exportSigned, nil},
+	"verify-export":  {"[-key file] [-json] <dir>", nil, verifyExport},
+	"oplog":          {"[-url url] [-token token] [-collection c] [-ops a,b] [-reads] [-n count] [-follow] [-json]", nil, oplog},
+	"diff":           {"[-collections a,b] [-json] <dirA> <dirB>", nil, diff},
+	"sync":           {"-from <dir> -to <dir> [-collections a,b] [-dry-run]", nil, syncDirs},
+}
+
+func main() {
+	dir := flag.String("dir", "./", "database directory")
+	flag.Usage = usage
+	flag.Parse()
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	if cmd.runDir != nil {
+		if err := cmd.runDir(*dir, flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, "Error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	db, err := jsondb.Open(*dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error", err)
+		os.Exit(1)
+	}
+
+	err = cmd.run(db, flag.Args()[1:])
+	db.Close()
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: dbctl [-dir path] <command> [arguments]\n\nCommands:\n")
+
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", name, commands[name].usage)
+	}
+	flag.PrintDefaults()
+}
+
+// exportParquet writes a collection as Parquet to a file or stdout.
+func exportParquet(db *jsondb.Driver, args []string) error {
+	db, args, err := withTransform(db, "export-parquet", args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		return fmt.Errorf("Missing collection")
+	}
+
+	var w io.Writer = os.Stdout
+	if len(args) > 1 {
+		f, err := os.Create(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	return db.ExportParquet(args[0], w)
+}
+
+// withTransform parses the -transform flag of a command, returning db
+// bound to the transform of the file it names, if any, and the arguments
+// left.
+func withTransform(db *jsondb.Driver, name string, args []string) (*jsondb.Driver, []string, error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := flags.String("transform", "", "JSON file of the field rules scrubbing the records, by collection")
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	db, err := transformed(db, *path)
+	return db, flags.Args(), err
+}
+
+// transformed binds db to the transform in the file at path, if any.
+func transformed(db *jsondb.Driver, path string) (*jsondb.Driver, error) {
+	if path == "" {
+		return db, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := jsondb.ParseTransform(b)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading '%s': %v", path, err)
+	}
+	return db.WithTransform(t)
+}
+
+// importParquet writes the rows of a Parquet file into a collection.
+func importParquet(db *jsondb.Driver, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("Missing collection or file")
+	}
+
+	f, err := os.Open(args[1])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	n, err := db.ImportParquet(args[0], f, fi.Size())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %d records into '%s'\n", n, args[0])
+	return nil
+}
+
+// archive moves records older than an age ("180d") into the archive.
+func archive(db *jsondb.Driver, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("Missing collection or age")
+	}
+
+	maxAge, err := jsondb.ParseAge(args[1])
+	if err != nil {
+		return err
+	}
+
+	n, err := db.Archive(args[0], maxAge)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Archived %d records of '%s'\n", n, args[0])
+	return nil
+}
+
+// clone copies collections, or the whole database, into a new directory.
+func clone(db *jsondb.Driver, args []string) error {
+	db, args, err := withTransform(db, "clone", args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		return fmt.Errorf("Missing destination directory")
+	}
+	if err := db.CloneTo(args[0], args[1:]...); err != nil {
+		return err
+	}
+
+	fmt.Printf("Cloned into '%s'\n", args[0])
+	return nil
+}
+
+// stats prints the size of the collections and what else the database
+// takes on disk, with the free space left.
+func stats(db *jsondb.Driver, args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	st, err := db.DBStats()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(st)
+	}
+
+	fmt.Printf("%-30s %10s %12s\n", "COLLECTION", "RECORDS", "BYTES")
+	for _, cs := range st.Collections {
+		fmt.Printf("%-30s %10d %12d\n", cs.Collection, cs.Records, cs.Bytes)
+	}
+	fmt.Printf("%-30s %10d %12d\n\n", "total", st.Records, st.Bytes)
+
+	fmt.Printf("Indexes:  %d bytes\n", st.IndexBytes)
+	fmt.Printf("System:   %d bytes, %d in the journal\n", st.SystemBytes, st.JournalBytes)
+	if st.DiskTotal > 0 {
+		fmt.Printf("Disk:     %d of %d bytes free (%.1f%%)\n", st.DiskFree, st.DiskTotal, float64(st.DiskFree)*100/float64(st.DiskTotal))
+	}
+	return nil
+}
+
+// restore moves archived records back into their collection.
+func restore(db *jsondb.Driver, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Missing collection")
+	}
+
+	var resource string
+	if len(args) > 1 {
+		resource = args[1]
+	}
+
+	n, err := db.Restore(args[0], resource)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored %d records of '%s'\n", n, args[0])
+	return nil
+}
+
+// upgrade migrates the database directory to the current layout, after
+// asking unless -yes is given.
+func upgrade(dir string, args []string) error {
+	flags := flag.NewFlagSet("upgrade", flag.ContinueOnError)
+	yes := flags.Bool("yes", false, "do not ask for confirmation")
+	noBackup := flags.Bool("no-backup", false, "do not copy the directory before migrating")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	version, err := jsondb.LayoutOf(dir)
+	if err != nil {
+		return err
+	}
+	switch {
+	case version == 0:
+		return fmt.Errorf("No database in '%s'", dir)
+	case version > jsondb.LayoutVersion:
+		return jsondb.ErrLayoutTooNew
+	case version == jsondb.LayoutVersion:
+		fmt.Printf("'%s' already has layout %d\n", dir, version)
+		return nil
+	}
+
+	if !*yes {
+		fmt.Printf("Migrate '%s' from layout %d to %d? [y/N] ", dir, version, jsondb.LayoutVersion)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			return fmt.Errorf("Upgrade cancelled")
+		}
+	}
+
+	if _, err := jsondb.Upgrade(dir, nil, *noBackup); err != nil {
+		return err
+	}
+	fmt.Printf("Upgraded '%s' to layout %d\n", dir, jsondb.LayoutVersion)
+	return nil
+}
+
+// rebalance moves the records this node does not own under the ring of the
+// server config to their owners, after a node joined or left the ring.
+func rebalance(db *jsondb.Driver, args []string) error {
+	flags := flag.NewFlagSet("rebalance", flag.ContinueOnError)
+	configPath := flags.String("config", "config.json", "server config file holding the Cluster section")
+	self := flags.String("self", "", "URL of this node, overriding Cluster.Self")
+	token := flags.String("token", "", "admin token of the other nodes")
+	dryRun := flags.Bool("dry-run", false, "only count the records to move")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var cfg struct {
+		Cluster struct {
+			Self string
+			Ring jsondb.RingConfig
+		}
+	}
+	b, err := os.ReadFile(*configPath)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return fmt.Errorf("Error reading '%s': %v", *configPath, err)
+	}
+	if *self != "" {
+		cfg.Cluster.Self = *self
+	}
+	if cfg.Cluster.Self == "" {
+		return fmt.Errorf("Missing Cluster.Self or -self")
+	}
+
+	ring, err := jsondb.NewRing(cfg.Cluster.Ring)
+	if err != nil {
+		return err
+	}
+
+	collections, err := db.Collections()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	var total int
+	for _, collection := range collections {
+		docs, err := db.Query(collection, jsondb.Query{})
+		if err != nil {
+			return err
+		}
+
+		var moved int
+		for _, doc := range docs {
+			owner := ring.Owner(collection, doc.Resource)
+			if owner == cfg.Cluster.Self {
+				continue
+			}
+			moved++
+			if *dryRun {
+				continue
+			}
+
+			c := client.New(owner)
+			c.Token = *token
+			c.Instance = db.InstanceID()
+			if err := c.Put(ctx, collection, doc.Resource, doc.Data); err != nil {
+				return fmt.Errorf("Error moving '%s' of '%s' to %s: %v", doc.Resource, collection, owner, err)
+			}
+			if err := db.Delete(collection, doc.Resource); err != nil {
+				return err
+			}
+		}
+
+		if moved > 0 {
+			verb := "Moved"
+			if *dryRun {
+				verb = "Would move"
+			}
+			fmt.Printf("%s %d of %d records of '%s'\n", verb, moved, len(docs), collection)
+		}
+		total += moved
+	}
+
+	fmt.Printf("%d records belong to other nodes\n", total)
+	return nil
+}
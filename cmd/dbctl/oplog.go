@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"database/jsondb"
+)
+
+// oplog prints the operations of a running server, from its /admin/oplog,
+// one per line: its latest changes, or with -follow its operations as they
+// happen, like tail -f.
+func oplog(dir string, args []string) error {
+	flags := flag.NewFlagSet("oplog", flag.ContinueOnError)
+	server := flags.String("url", "http://localhost:3000", "URL of the server")
+	token := flags.String("token", "", "admin token of the server")
+	collection := flags.String("collection", "", "only the operations on this collection")
+	ops := flags.String("ops", "", "only these operations, such as create,delete,Read")
+	reads := flags.Bool("reads", false, "also follow reads")
+	n := flags.Int("n", -1, "number of recent changes to print first")
+	follow := flags.Bool("follow", false, "keep printing operations as they happen")
+	asJSON := flags.Bool("json", false, "print JSON lines")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	if *collection != "" {
+		q.Set("collection", *collection)
+	}
+	if *ops != "" {
+		q.Set("ops", *ops)
+	}
+	if *reads {
+		q.Set("reads", "true")
+	}
+	if *n >= 0 {
+		q.Set("n", strconv.Itoa(*n))
+	}
+	if *follow {
+		q.Set("follow", "true")
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(*server, "/")+"/admin/oplog?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	print := func(e jsondb.OpEntry) error {
+		if *asJSON {
+			return json.NewEncoder(os.Stdout).Encode(e)
+		}
+		_, err := fmt.Println(formatOp(e))
+		return err
+	}
+
+	if !*follow {
+		var entries []jsondb.OpEntry
+		if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := print(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Server-sent events: only the data lines of operations matter.
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var event string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: ") && event != "heartbeat":
+			var e jsondb.OpEntry
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+				return err
+			}
+			if err := print(e); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// formatOp renders e as a line such as
+//
+//	12:04:05.123  update  users/john
+//	12:04:05.130  Read    users/john  412µs
+func formatOp(e jsondb.OpEntry) string {
+	target := e.Collection
+	if e.Resource != "" {
+		target += "/" + e.Resource
+	}
+	line := fmt.Sprintf("%s  %-8s  %s", e.Time.Local().Format("15:04:05.000"), e.Op, target)
+	if e.Elapsed > 0 {
+		line += "  " + e.Elapsed.Round(time.Microsecond).String()
+	}
+	if e.Error != "" {
+		line += "  error: " + e.Error
+	}
+	return line
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"database/jsondb"
+)
+
+// quality checks the records of a collection against its data quality
+// rules, failing if any is violated.
+func quality(db *jsondb.Driver, args []string) error {
+	flags := flag.NewFlagSet("quality", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 {
+		return fmt.Errorf("Missing collection")
+	}
+
+	cfg := db.CollectionConfig(flags.Arg(0))
+	if cfg.Quality == nil {
+		return fmt.Errorf("Collection '%s' has no quality rules", flags.Arg(0))
+	}
+	report, err := db.CheckQuality(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("%d records of '%s' checked\n\n", report.Records, report.Collection)
+		fmt.Printf("%-30s %-6s %10s %10s %s\n", "RULE", "RESULT", "CHECKED", "VIOLATIONS", "EXAMPLES")
+		for _, res := range report.Results {
+			result := "pass"
+			if !res.Passed {
+				result = "FAIL"
+			}
+			fmt.Printf("%-30s %-6s %10d %10d %s\n", res.Rule, result, res.Checked, res.Violations, strings.Join(res.Examples, ", "))
+		}
+	}
+
+	if !report.Passed {
+		return fmt.Errorf("Data quality checks of '%s' failed", report.Collection)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"database/jsondb"
+)
+
+// schema reports the fields the records of a collection have, with their
+// types and coverage.
+func schema(db *jsondb.Driver, args []string) error {
+	flags := flag.NewFlagSet("schema", flag.ContinueOnError)
+	sample := flags.Int("sample", 0, "read a random sample of this many records instead of all")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 {
+		return fmt.Errorf("Missing collection")
+	}
+
+	report, err := db.InferSchemaSample(flags.Arg(0), *sample)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	if report.Sampled {
+		fmt.Printf("%d of %d records of '%s' sampled\n\n", report.Records, report.Total, report.Collection)
+	} else {
+		fmt.Printf("%d records of '%s'\n\n", report.Records, report.Collection)
+	}
+	fmt.Printf("%-30s %-24s %8s %-8s %s\n", "FIELD", "TYPES", "COVERAGE", "NULLABLE", "EXAMPLES")
+	for _, f := range report.Fields {
+		var types []string
+		for t, n := range f.Types {
+			types = append(types, fmt.Sprintf("%s:%d", t, n))
+		}
+		sort.Strings(types)
+
+		var examples []string
+		for _, e := range f.Examples {
+			b, _ := json.Marshal(e)
+			examples = append(examples, string(b))
+		}
+
+		nullable := ""
+		if f.Nullable {
+			nullable = "yes"
+		}
+		fmt.Printf("%-30s %-24s %7.1f%% %-8s %s\n", f.Path, strings.Join(types, ","), f.Coverage*100, nullable, strings.Join(examples, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/term"
+
+	"database/jsondb"
+)
+
+// session is the state of a dbctl shell: the database and the collection
+// selected with use.
+type session struct {
+	db         *jsondb.Driver
+	out        io.Writer
+	collection string
+}
+
+// shellCommand is a command of the shell; run gets the rest of the line.
+type shellCommand struct {
+	usage string
+	help  string
+	run   func(s *session, args string) error
+}
+
+var shellCommands map[string]shellCommand
+
+func init() {
+	shellCommands = map[string]shellCommand{
+		"collections": {"", "list the collections", (*session).collections},
+		"use":         {"<collection>", "select the collection the other commands act on", (*session).use},
+		"keys":        {"[prefix]", "list the records of the collection", (*session).keys},
+		"get":         {"<resource>", "print a record", (*session).get},
+		"find":        {"[field=value ...]", "print the records matching every condition (=, !=, >, >=, <, <=)", (*session).find},
+		"put":         {"<resource> <json>", "store a JSON object as a record", (*session).put},
+		"del":         {"<resource>", "delete a record", (*session).del},
+		"help":        {"", "list the commands", (*session).help},
+		"exit":        {"", "leave the shell", nil},
+	}
+}
+
+// shell runs an interactive session on the database in dir, or in the
+// directory given as argument. On a terminal it edits lines and completes
+// commands, collections and resources with Tab; otherwise it reads one
+// command per line, for scripts.
+func shell(dir string, args []string) error {
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	db, err := jsondb.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	s := &session{db: db, out: os.Stdout}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Buffer(nil, 16<<20)
+		for scanner.Scan() {
+			if !s.exec(scanner.Text()) {
+				return nil
+			}
+		}
+		return scanner.Err()
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "")
+	t.AutoCompleteCallback = s.complete
+	s.out = t
+
+	fmt.Fprintf(t, "Connected to '%s'. Type help for the commands, Tab to complete.\n", dir)
+	for {
+		t.SetPrompt(s.prompt())
+		line, err := t.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !s.exec(line) {
+			return nil
+		}
+	}
+}
+
+func (s *session) prompt() string {
+	if s.collection == "" {
+		return "dbctl> "
+	}
+	return s.collection + "> "
+}
+
+// exec runs a line, reporting whether the session goes on.
+func (s *session) exec(line string) bool {
+	name, args := cut(line)
+	if name == "" || strings.HasPrefix(name, "#") {
+		return true
+	}
+	if name == "exit" || name == "quit" {
+		return false
+	}
+
+	cmd, ok := shellCommands[name]
+	if !ok {
+		fmt.Fprintf(s.out, "Unknown command '%s', type help for the commands\n", name)
+		return true
+	}
+	if err := cmd.run(s, args); err != nil {
+		fmt.Fprintln(s.out, "Error", err)
+	}
+	return true
+}
+
+// cut splits the first word off line.
+func cut(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		return line[:i], strings.TrimSpace(line[i+1:])
+	}
+	return line, ""
+}
+
+// selected returns the collection selected with use.
+func (s *session) selected() (string, error) {
+	if s.collection == "" {
+		return "", fmt.Errorf("No collection selected, type use <collection>")
+	}
+	return s.collection, nil
+}
+
+func (s *session) help(string) error {
+	var names []string
+	for name := range shellCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		cmd := shellCommands[name]
+		fmt.Fprintf(s.out, "  %-30s %s\n", strings.TrimSpace(name+" "+cmd.usage), cmd.help)
+	}
+	return nil
+}
+
+func (s *session) collections(string) error {
+	collections, err := s.db.Collections()
+	if err != nil {
+		return err
+	}
+	for _, collection := range collections {
+		fmt.Fprintln(s.out, collection)
+	}
+	return nil
+}
+
+func (s *session) use(args string) error {
+	if args == "" {
+		return fmt.Errorf("Missing collection")
+	}
+	if _, err := s.db.ListKeys(args, jsondb.ListOptions{Limit: 1}); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.collection = args
+	return nil
+}
+
+func (s *session) keys(args string) error {
+	collection, err := s.selected()
+	if err != nil {
+		return err
+	}
+	keys, err := s.db.ListKeys(collection, jsondb.ListOptions{Prefix: args})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		fmt.Fprintln(s.out, key)
+	}
+	fmt.Fprintf(s.out, "(%d records)\n", len(keys))
+	return nil
+}
+
+func (s *session) get(args string) error {
+	collection, err := s.selected()
+	if err != nil {
+		return err
+	}
+	if args == "" {
+		return fmt.Errorf("Missing resource")
+	}
+	b, err := s.db.ReadRaw(collection, args)
+	if err != nil {
+		return err
+	}
+	return s.print(b)
+}
+
+func (s *session) find(args string) error {
+	collection, err := s.selected()
+	if err != nil {
+		return err
+	}
+
+	var q jsondb.Query
+	for _, arg := range strings.Fields(args) {
+		cond, err := parseCondition(arg)
+		if err != nil {
+			return err
+		}
+		q.Where = append(q.Where, cond)
+	}
+
+	docs, err := s.db.Query(collection, q)
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		b, err := json.Marshal(doc.Data)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(s.out, "%s:\n", doc.Resource)
+		if err := s.print(b); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(s.out, "(%d records)\n", len(docs))
+	return nil
+}
+
+// parseCondition reads a find condition, such as Company=Google or
+// Age>=30.
+func parseCondition(arg string) (jsondb.Condition, error) {
+	for _, op := range []string{"!=", ">=", "<=", "=", ">", "<"} {
+		if i := strings.Index(arg, op); i > 0 {
+			cond := jsondb.Condition{Field: arg[:i], Op: op, Value: arg[i+len(op):]}
+			return cond, cond.Validate()
+		}
+	}
+	return jsondb.Condition{}, fmt.Errorf("Invalid condition '%s', expected field=value", arg)
+}
+
+func (s *session) put(args string) error {
+	collection, err := s.selected()
+	if err != nil {
+		return err
+	}
+	resource, data := cut(args)
+	if resource == "" || data == "" {
+		return fmt.Errorf("Missing resource or JSON")
+	}
+	return s.db.WriteRaw(collection, resource, []byte(data))
+}
+
+func (s *session) del(args string) error {
+	collection, err := s.selected()
+	if err != nil {
+		return err
+	}
+	if args == "" {
+		return fmt.Errorf("Missing resource")
+	}
+	return s.db.Delete(collection, args)
+}
+
+// print writes a JSON document indented.
+func (s *session) print(b []byte) error {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, bytes.TrimSpace(b), "", "  "); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	_, err := s.out.Write(buf.Bytes())
+	return err
+}
+
+// complete completes, on Tab, the word before the cursor: a command, the
+// collection of use, or a resource of the selected collection. It extends
+// the word as far as the candidates agree.
+func (s *session) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+
+	before := line[:pos]
+	start := strings.LastIndexAny(before, " \t") + 1
+	word := before[start:]
+
+	var candidates []string
+	if name, _ := cut(before); start == 0 {
+		for name := range shellCommands {
+			candidates = append(candidates, name)
+		}
+	} else if strings.TrimSpace(before[:start]) != name {
+		return "", 0, false // only the first argument is completed
+	} else {
+		switch name {
+		case "use":
+			candidates, _ = s.db.Collections()
+		case "get", "put", "del", "keys":
+			if s.collection != "" {
+				candidates, _ = s.db.ListKeys(s.collection, jsondb.ListOptions{Prefix: word})
+			}
+		}
+	}
+
+	completion, matches := "", 0
+	for _, c := range candidates {
+		if !strings.HasPrefix(c, word) {
+			continue
+		}
+		if matches++; matches == 1 {
+			completion = c
+			continue
+		}
+		for !strings.HasPrefix(c, completion) {
+			completion = completion[:len(completion)-1]
+		}
+	}
+	if matches == 1 {
+		completion += " "
+	}
+	if matches == 0 || completion == word {
+		return "", 0, false
+	}
+	return line[:start] + completion + line[pos:], start + len(completion), true
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"os"
+	"text/template"
+)
+
+// generate writes the code tmpl generates for m of pkg to path, formatted.
+func generate(tmpl *template.Template, pkg *modelPackage, m model, path string) error {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, map[string]interface{}{"Package": pkg, "Model": m}); err != nil {
+		return err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("Error formatting %s: %v", path, err)
+	}
+	return os.WriteFile(path, src, 0644)
+}
+
+var repoTemplate = template.Must(template.New("repo").Parse(`// Code generated by dbgen. DO NOT EDIT.
+
+package {{.Package.Name}}
+
+import (
+	"fmt"
+	"os"
+
+	"{{.Package.Import}}"
+)
+{{with .Model}}
+// {{.Type}}Collection is the collection holding {{.Type}} records.
+const {{.Type}}Collection = {{printf "%q" .Collection}}
+
+// {{.Type}}Repo reads and writes {{.Type}} records, named after their {{.Key.Selector}}.
+type {{.Type}}Repo struct {
+	db *jsondb.Driver
+}
+
+// New{{.Type}}Repo registers {{.Type}} as the model of its collection in db,
+// configuring it from its db tags, and returns its repository.
+func New{{.Type}}Repo(db *jsondb.Driver) (*{{.Type}}Repo, error) {
+	if err := db.RegisterModel({{.Type}}Collection, &{{.Type}}{}); err != nil {
+		return nil, err
+	}
+	return &{{.Type}}Repo{db: db}, nil
+}
+
+// Get reads the {{.Type}} of the given {{.Key.Selector}}.
+func (r *{{.Type}}Repo) Get(key {{.Key.Type}}) (*{{.Type}}, error) {
+	var v {{.Type}}
+	if err := r.db.Read({{.Type}}Collection, fmt.Sprint(key), &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Save writes v, replacing the {{.Type}} of the same {{.Key.Selector}}.
+func (r *{{.Type}}Repo) Save(v *{{.Type}}) error {
+	return r.db.Save({{.Type}}Collection, v)
+}
+
+// Delete deletes the {{.Type}} of the given {{.Key.Selector}}.
+func (r *{{.Type}}Repo) Delete(key {{.Key.Type}}) error {
+	return r.db.Delete({{.Type}}Collection, fmt.Sprint(key))
+}
+
+// All returns every {{.Type}}, ordered by {{.Key.Selector}} as a string.
+func (r *{{.Type}}Repo) All() ([]{{.Type}}, error) {
+	return r.find(jsondb.Query{})
+}
+{{range .Unique}}
+// GetBy{{.Name}} returns the {{$.Model.Type}} of the given {{.Selector}}, failing
+// with an error os.IsNotExist reports on when there is none.
+func (r *{{$.Model.Type}}Repo) GetBy{{.Name}}(value {{.Type}}) (*{{$.Model.Type}}, error) {
+	found, err := r.find(jsondb.Query{Where: []jsondb.Condition{ {Field: {{printf "%q" .Path}}, Value: value} }, Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return &found[0], nil
+}
+{{end}}{{range .Indexes}}
+// FindBy{{.Name}} returns the {{$.Model.Type}} records of the given {{.Selector}}.
+func (r *{{$.Model.Type}}Repo) FindBy{{.Name}}(value {{.Type}}) ([]{{$.Model.Type}}, error) {
+	return r.find(jsondb.Query{Where: []jsondb.Condition{ {Field: {{printf "%q" .Path}}, Value: value} }})
+}
+{{end}}
+func (r *{{.Type}}Repo) find(q jsondb.Query) ([]{{.Type}}, error) {
+	docs, err := r.db.Query({{.Type}}Collection, q)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	found := make([]{{.Type}}, len(docs))
+	for i, doc := range docs {
+		if err := r.db.DecodeDocument({{.Type}}Collection, doc, &found[i]); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+{{end}}`))
+
+var testTemplate = template.Must(template.New("test").Parse(`// Code generated by dbgen. DO NOT EDIT.
+
+package {{.Package.Name}}
+
+import (
+	"os"
+	"testing"
+
+	"{{.Package.Import}}"
+)
+{{with .Model}}
+func Test{{.Type}}Repo(t *testing.T) {
+	db, err := jsondb.New(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	repo, err := New{{.Type}}Repo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var v {{.Type}}
+	v.{{.Key.Selector}} = {{.Key.TestValue}}
+{{- range .Unique}}{{if not .Pointer}}
+	v.{{.Selector}} = {{.TestValue}}
+{{- end}}{{end}}
+{{- range .Indexes}}{{if not .Pointer}}
+	v.{{.Selector}} = {{.TestValue}}
+{{- end}}{{end}}
+	if err := repo.Save(&v); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := repo.Get(v.{{.Key.Selector}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.{{.Key.Selector}} != v.{{.Key.Selector}} {
+		t.Errorf("Get: got {{.Key.Selector}} %v, want %v", got.{{.Key.Selector}}, v.{{.Key.Selector}})
+	}
+
+	all, err := repo.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 {
+		t.Errorf("All: got %d records, want 1", len(all))
+	}
+{{range .Unique}}{{if not .Pointer}}
+	if got, err := repo.GetBy{{.Name}}(v.{{.Selector}}); err != nil {
+		t.Errorf("GetBy{{.Name}}: %v", err)
+	} else if got.{{$.Model.Key.Selector}} != v.{{$.Model.Key.Selector}} {
+		t.Errorf("GetBy{{.Name}}: got %v, want %v", got.{{$.Model.Key.Selector}}, v.{{$.Model.Key.Selector}})
+	}
+{{end}}{{end}}
+{{- range .Indexes}}{{if not .Pointer}}
+	if found, err := repo.FindBy{{.Name}}(v.{{.Selector}}); err != nil {
+		t.Errorf("FindBy{{.Name}}: %v", err)
+	} else if len(found) != 1 {
+		t.Errorf("FindBy{{.Name}}: got %d records, want 1", len(found))
+	}
+{{end}}{{end}}
+	if err := repo.Delete(v.{{.Key.Selector}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Get(v.{{.Key.Selector}}); !os.IsNotExist(err) {
+		t.Errorf("Get after Delete: got %v, want a not-exist error", err)
+	}
+}
+{{end}}`))
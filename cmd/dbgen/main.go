@@ -0,0 +1,78 @@
+// Command dbgen generates typed repositories over a jsondb database for
+// the structs of a Go package that ask for one with a comment:
+//
+//	//dbgen:collection users
+//	type User struct {
+//		Name    string `json:"name" db:"key"`
+//		Email   string `json:"email" db:"unique"`
+//		Company string `json:"company" db:"index"`
+//	}
+//
+// For each such struct, it writes user_repo.go, holding a UserRepo that
+// registers User as the model of the collection, see
+// jsondb.Driver.RegisterModel, with Get, Save, Delete and All, a GetBy
+// method for every unique field and a FindBy method for every other
+// indexed field of a basic type: UserRepo.GetByEmail,
+// UserRepo.FindByCompany. It writes user_repo_test.go too, exercising the
+// repository on a temporary database. The struct must have a key field.
+// Repositories read and write through the driver, which calls the
+// BeforeSave and AfterLoad methods of models that have them, see
+// jsondb.BeforeSaver and jsondb.AfterLoader.
+//
+//	dbgen [-dir path] [-jsondb import] [-tests=false] [type...]
+//
+// Only the given types are generated when any are, which need no comment
+// then, but for their collection, named after them: the lowercase plural.
+// It is meant to be run by go generate:
+//
+//	//go:generate go run database/cmd/dbgen
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	dir := flag.String("dir", ".", "directory of the package holding the models")
+	importPath := flag.String("jsondb", "database/jsondb", "import path of the jsondb package")
+	tests := flag.Bool("tests", true, "also generate tests of the repositories")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: dbgen [-dir path] [-jsondb import] [-tests=false] [type...]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if err := run(*dir, *importPath, *tests, flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "Error", err)
+		os.Exit(1)
+	}
+}
+
+func run(dir, importPath string, tests bool, types []string) error {
+	pkg, err := parseModels(dir, types)
+	if err != nil {
+		return err
+	}
+	if len(pkg.Models) == 0 {
+		return fmt.Errorf("No model in '%s': mark structs with //dbgen:collection <name>", dir)
+	}
+
+	pkg.Import = importPath
+	for _, m := range pkg.Models {
+		base := filepath.Join(dir, strings.ToLower(m.Type)+"_repo")
+		if err := generate(repoTemplate, pkg, m, base+".go"); err != nil {
+			return err
+		}
+		if tests {
+			if err := generate(testTemplate, pkg, m, base+"_test.go"); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("Generated %sRepo over '%s' in %s.go\n", m.Type, m.Collection, base)
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/fs"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// collectionMarker is the comment asking for a repository of a struct.
+const collectionMarker = "//dbgen:collection"
+
+// basicTypes are the field types repositories look up records by.
+var basicTypes = map[string]bool{
+	"string": true, "bool": true,
+	"int": true, "int8": true, "int16": true, "int32": true, "int64": true,
+	"uint": true, "uint8": true, "uint16": true, "uint32": true, "uint64": true,
+	"float32": true, "float64": true,
+}
+
+// modelPackage is the package holding the models to generate.
+type modelPackage struct {
+	Name   string
+	Import string // of the jsondb package
+	Models []model
+}
+
+// model is a struct to generate a repository of.
+type model struct {
+	Type       string
+	Collection string
+	Key        field
+	Unique     []field
+	Indexes    []field // not unique
+}
+
+// field is a field of a model tagged in its db tag.
+type field struct {
+	Name     string // of the methods looking records up by it: Email, AddressCity
+	Path     string // in the records, as jsondb has it: email, address.city
+	Selector string // in Go: Email, Address.City
+	Type     string
+
+	// Pointer is set when the field is in a struct pointed to, which the
+	// generated tests leave nil.
+	Pointer bool
+}
+
+// TestValue is a Go literal of the field's type the generated tests store.
+func (f field) TestValue() string {
+	switch {
+	case f.Type == "string":
+		return strconv.Quote("test-" + strings.ToLower(f.Name))
+	case f.Type == "bool":
+		return "true"
+	}
+	return "7"
+}
+
+// parseModels reads the package in dir for the structs marked with
+// collectionMarker, or the given types.
+func parseModels(dir string, names []string) (*modelPackage, error) {
+	fset := token.NewFileSet()
+	notTest := func(fi fs.FileInfo) bool { return !strings.HasSuffix(fi.Name(), "_test.go") }
+	pkgs, err := parser.ParseDir(fset, dir, notTest, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	if len(pkgs) != 1 {
+		return nil, fmt.Errorf("Expected one package in '%s', found %d", dir, len(pkgs))
+	}
+
+	var pkg *ast.Package
+	for _, p := range pkgs {
+		pkg = p
+	}
+
+	// Every struct of the package, as nested structs may be declared
+	// anywhere in it, and the collections of those marked.
+	structs := make(map[string]*ast.StructType)
+	marked := make(map[string]string)
+	var order []string
+	for _, file := range pkg.Files {
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				ts := spec.(*ast.TypeSpec)
+				st, ok := ts.Type.(*ast.StructType)
+				if !ok {
+					continue
+				}
+				structs[ts.Name.Name] = st
+				doc := ts.Doc
+				if doc == nil && len(gen.Specs) == 1 {
+					doc = gen.Doc
+				}
+				if collection, ok := markedCollection(doc); ok {
+					marked[ts.Name.Name] = collection
+					order = append(order, ts.Name.Name)
+				}
+			}
+		}
+	}
+
+	if len(names) > 0 {
+		order = names
+	} else {
+		sort.Strings(order)
+	}
+
+	mp := &modelPackage{Name: pkg.Name}
+	for _, name := range order {
+		st, ok := structs[name]
+		if !ok {
+			return nil, fmt.Errorf("No struct '%s' in '%s'", name, dir)
+		}
+		m := model{Type: name, Collection: marked[name]}
+		if m.Collection == "" {
+			m.Collection = plural(strings.ToLower(name))
+		}
+		if err := m.read(structs, st, "", "", "", false, map[string]bool{name: true}); err != nil {
+			return nil, fmt.Errorf("Invalid model %s: %v", name, err)
+		}
+		if m.Key.Path == "" {
+			return nil, fmt.Errorf("Invalid model %s: no field is tagged db:\"key\"", name)
+		}
+		mp.Models = append(mp.Models, m)
+	}
+	return mp, nil
+}
+
+// markedCollection returns the collection a doc comment names after
+// collectionMarker.
+func markedCollection(doc *ast.CommentGroup) (string, bool) {
+	if doc == nil {
+		return "", false
+	}
+	for _, c := range doc.List {
+		if rest, ok := strings.CutPrefix(c.Text, collectionMarker); ok {
+			return strings.TrimSpace(rest), true
+		}
+	}
+	return "", false
+}
+
+// read reads the tagged fields of st, naming them after name, path and
+// selector; open holds the structs being read, which st may nest again.
+// Fields are named as jsondb.Driver.RegisterModel names them.
+func (m *model) read(structs map[string]*ast.StructType, st *ast.StructType, name, path, selector string, pointer bool, open map[string]bool) error {
+	for _, f := range st.Fields.List {
+		var tag reflect.StructTag
+		if f.Tag != nil {
+			s, err := strconv.Unquote(f.Tag.Value)
+			if err != nil {
+				return err
+			}
+			tag = reflect.StructTag(s)
+		}
+		jsonName, _, _ := strings.Cut(tag.Get("json"), ",")
+		if jsonName == "-" {
+			continue
+		}
+
+		typ, ptr := f.Type, pointer
+		if star, ok := typ.(*ast.StarExpr); ok {
+			typ, ptr = star.X, true
+		}
+		ident, _ := typ.(*ast.Ident)
+		var nested *ast.StructType
+		if ident != nil && !open[ident.Name] {
+			nested = structs[ident.Name]
+		}
+
+		goNames := make([]string, 0, len(f.Names))
+		for _, n := range f.Names {
+			goNames = append(goNames, n.Name)
+		}
+		if len(f.Names) == 0 {
+			if ident == nil {
+				continue // embedded from another package
+			}
+			if jsonName == "" && nested != nil {
+				open[ident.Name] = true
+				err := m.read(structs, nested, name, path, selector+ident.Name+".", ptr, open)
+				delete(open, ident.Name)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			goNames = append(goNames, ident.Name)
+		}
+
+		for _, goName := range goNames {
+			if !ast.IsExported(goName) {
+				continue
+			}
+			fd := field{
+				Name:     name + goName,
+				Path:     path + goName,
+				Selector: selector + goName,
+				Type:     types.ExprString(f.Type),
+				Pointer:  pointer,
+			}
+			if jsonName != "" {
+				fd.Path = path + jsonName
+			}
+			if err := m.add(fd, tag.Get("db")); err != nil {
+				return err
+			}
+
+			if nested != nil {
+				open[ident.Name] = true
+				err := m.read(structs, nested, fd.Name, fd.Path+".", fd.Selector+".", ptr, open)
+				delete(open, ident.Name)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// add adds f to m as its db tag has it. Unique and indexed fields of other
+// than basic types are left to RegisterModel, without methods.
+func (m *model) add(f field, tag string) error {
+	opts := make(map[string]bool)
+	for _, opt := range strings.Split(tag, ",") {
+		opts[strings.TrimSpace(opt)] = true
+	}
+
+	if opts["key"] {
+		if m.Key.Path != "" {
+			return fmt.Errorf("both '%s' and '%s' are tagged key", m.Key.Path, f.Path)
+		}
+		if !basicTypes[f.Type] || f.Type == "bool" || strings.HasPrefix(f.Type, "float") {
+			return fmt.Errorf("key field '%s' is not a string or an integer", f.Path)
+		}
+		if f.Pointer {
+			return fmt.Errorf("key field '%s' is in a struct pointed to", f.Path)
+		}
+		m.Key = f
+	}
+	if !basicTypes[f.Type] {
+		return nil
+	}
+	switch {
+	case opts["unique"]:
+		m.Unique = append(m.Unique, f)
+	case opts["index"]:
+		m.Indexes = append(m.Indexes, f)
+	}
+	return nil
+}
+
+// plural returns the English plural of the lowercase noun s.
+func plural(s string) string {
+	switch {
+	case strings.HasSuffix(s, "s"), strings.HasSuffix(s, "x"), strings.HasSuffix(s, "ch"), strings.HasSuffix(s, "sh"):
+		return s + "es"
+	case strings.HasSuffix(s, "y") && len(s) > 1 && !strings.ContainsRune("aeiou", rune(s[len(s)-2])):
+		return s[:len(s)-1] + "ies"
+	}
+	return s + "s"
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"database/jsondb"
+)
+
+// Config is the server configuration, read from a JSON file.
+type Config struct {
+	// Dir is the database directory.
+	Dir string
+
+	// Addr is the address the HTTP server listens on.
+	Addr string
+
+	// AdminToken grants admin scope to requests sending it as a bearer
+	// token. Without it only requests from loopback addresses are admins.
+	AdminToken string
+
+	// Jobs maps job names to schedules (see ParseSchedule), overriding the
+	// schedule the job was registered with.
+	Jobs map[string]string
+
+	// Archive maps collections to the age ("180d", "720h") after which
+	// records that were not written are moved to the archive.
+	Archive map[string]string
+
+	// Cache maps collections to the Cache-Control policy of their GET
+	// responses, which also carry ETags; "*" applies to collections
+	// without a policy of their own.
+	Cache map[string]CachePolicy
+
+	// LogLevel is one of trace, debug, info (the default), warn, error and
+	// fatal.
+	LogLevel string
+
+	// SlowOp is a duration such as "250ms"; driver operations taking at
+	// least as long are logged. Empty disables slow-operation logging.
+	SlowOp string
+
+	// Limits bounds the size, nesting depth and field count of records.
+	Limits jsondb.Limits
+
+	// Retry is how transient filesystem errors are retried, for databases
+	// on NFS and similar filesystems. Its Backoff is given in nanoseconds.
+	Retry jsondb.RetryPolicy
+
+	// DiskWatermark rejects writes with 503 while free disk space is below
+	// it. Its CheckInterval is given in nanoseconds.
+	DiskWatermark jsondb.DiskWatermark
+
+	// Upgrade migrates database directories of an older layout on startup,
+	// backing them up first unless NoBackup is set; without Auto the server
+	// refuses to start on them until dbctl upgrade has run.
+	Upgrade jsondb.UpgradePolicy
+
+	// Corrupt is what listings do with records that cannot be read or are
+	// not valid JSON: "" fails them, "skip" leaves the records out and
+	// "quarantine" moves them into the .corrupt directory. Both report them
+	// under /admin/corrupt/<collection>.
+	Corrupt jsondb.CorruptPolicy
+
+	// QueryCache caches the results of filtered listings until a change
+	// may alter them; its statistics are served under /admin/querycache.
+	// Its TTL is given in nanoseconds.
+	QueryCache jsondb.QueryCacheConfig
+
+	// QueryLimits bounds the work of filtered listings; requests may ask
+	// for lower limits and partial results. Its Timeout is given in
+	// nanoseconds.
+	QueryLimits jsondb.QueryLimits
+
+	// LockTimeout, in nanoseconds, is how long requests wait for the lock
+	// of a collection before failing with 503; zero waits as long as it
+	// takes. Requests that would deadlock fail with 409 at once.
+	LockTimeout time.Duration
+
+	// MemoryBudget bounds, in bytes, the records listings hold at once;
+	// larger JSON listings are spooled, spilling to temporary files in
+	// SpillDir, and streamed. Its use is served under /admin/memory.
+	MemoryBudget int64
+	SpillDir     string
+
+	// Databases maps names to the directories of further databases, served
+	// under /db/<name>/ with the same options as the main one.
+	Databases map[string]string
+
+	// Raft replicates the main database between several servers.
+	Raft RaftConfig
+
+	// Cluster partitions records between several servers.
+	Cluster ClusterConfig
+
+	// Tracing configures the export of OpenTelemetry spans.
+	Tracing TracingConfig
+
+	// Auth configures the accounts and sessions of the /auth routes.
+	Auth AuthConfig
+
+	// OIDC configures single sign-on through an OpenID Connect provider.
+	OIDC OIDCConfig
+
+	// SignedURLs configures the time-limited links of /admin/sign.
+	SignedURLs SignedURLConfig
+
+	// Sunset is the date, such as "2027-06-30", after which the
+	// unversioned routes may be removed in favour of /v1 and /v2. It is
+	// sent in their Sunset header.
+	Sunset string
+
+	// AccessLog turns on the log of API requests kept in the database.
+	AccessLog AccessLogConfig
+
+	// ReadThrough serves records missing here from another server.
+	ReadThrough ReadThroughConfig
+
+	// Policy is the path of a policy file allowing or denying operations
+	// on collections by role, as jsondb.Policy has it, for every database;
+	// it is read again on reload. System collections are spelled with a
+	// leading "_", and requests with admin scope have the "admin" role.
+	Policy string
+
+	// ExportKey is the path of the PEM file of the Ed25519 private key
+	// signing the exports of /admin/exports, as written by
+	// "openssl genpkey -algorithm ed25519".
+	ExportKey string
+
+	// Breaker is when calls to the archive store, Raft and the ReadThrough
+	// upstream start failing fast, for how long (in nanoseconds), before a
+	// probe call is let through; their state is served under /healthz and
+	// /admin/breakers.
+	Breaker jsondb.BreakerConfig
+
+	// Preload lists the collections, or the records of them with a name
+	// prefix, read in the background on startup so the first requests
+	// after a deploy do not wait on a cold disk; see jsondb.Driver.Preload.
+	Preload jsondb.PreloadConfig
+
+	// HotKeys counts a sample of the accesses to records, for
+	// /admin/hotkeys/:collection to report the most accessed ones.
+	HotKeys jsondb.HotKeyConfig
+
+	// Thumbnails is the size, in pixels, of the PNG thumbnails made in the
+	// background of the images uploaded as attachments, and served as
+	// their "<name>~thumb.png" attachments; 0 makes none.
+	Thumbnails int
+}
+
+// DefaultConfig is used for anything the config file leaves out.
+var DefaultConfig = Config{
+	Dir:  "./",
+	Addr: ":3000",
+}
+
+// LoadConfig reads the config file at path. A missing file yields the
+// defaults.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
@@ -0,0 +1,62 @@
+package dbtest
+
+import (
+	"testing"
+
+	"database/jsondb"
+)
+
+// CheckCrashRecovery crashes a write at every jsondb.FaultPoint in turn and
+// asserts that the reopened database is consistent: the interrupted record
+// holds either its old or its new value, its neighbours are untouched and
+// no temporary files are left behind.
+func CheckCrashRecovery(t testing.TB) {
+	t.Helper()
+
+	for _, point := range jsondb.FaultPoints {
+		dir := t.TempDir()
+		crashing := false
+
+		db, err := jsondb.Open(dir, jsondb.WithLogger(logger{t}),
+			jsondb.WithFault(func(p jsondb.FaultPoint, path string) bool {
+				return p == point && crashing
+			}))
+		if err != nil {
+			t.Fatalf("dbtest: creating database: %v", err)
+		}
+
+		crashing = false
+		Load(t, db, "items", map[string]interface{}{
+			"a": map[string]int{"N": 1},
+			"b": map[string]int{"N": 1},
+		})
+
+		crashing = true
+		if err := db.Write("items", "a", map[string]int{"N": 2}); err != jsondb.ErrInjectedFault {
+			t.Fatalf("%s: write returned %v, want the injected fault", point, err)
+		}
+		crashing = false
+
+		db, err = jsondb.Open(dir, jsondb.WithLogger(logger{t}))
+		if err != nil {
+			t.Fatalf("%s: reopening after crash: %v", point, err)
+		}
+
+		var a, b map[string]int
+		if err := db.Read("items", "a", &a); err != nil {
+			t.Fatalf("%s: reading interrupted record: %v", point, err)
+		}
+		if a["N"] != 1 && a["N"] != 2 {
+			t.Fatalf("%s: interrupted record holds %v", point, a)
+		}
+		if err := db.Read("items", "b", &b); err != nil || b["N"] != 1 {
+			t.Fatalf("%s: neighbouring record holds %v, %v", point, b, err)
+		}
+
+		if records, err := db.ReadAll("items"); err != nil || len(records) != 2 {
+			t.Fatalf("%s: collection holds %d records after recovery, %v", point, len(records), err)
+		}
+
+		CheckClean(t, dir)
+	}
+}
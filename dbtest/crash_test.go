@@ -0,0 +1,11 @@
+package dbtest_test
+
+import (
+	"testing"
+
+	"database/dbtest"
+)
+
+func TestCrashRecovery(t *testing.T) {
+	dbtest.CheckCrashRecovery(t)
+}
@@ -0,0 +1,182 @@
+// Package dbtest helps applications test code built on jsondb: it creates
+// throwaway databases, loads fixture documents and compares collections
+// against golden JSON files.
+//
+//	func TestSignup(t *testing.T) {
+//		db := dbtest.New(t)
+//		dbtest.Load(t, db, "users", map[string]interface{}{"John": User{Name: "John"}})
+//
+//		signup(db, "Paul")
+//
+//		dbtest.AssertGolden(t, db, "users", "testdata/users.golden.json")
+//	}
+//
+// Golden files are rewritten instead of compared when the DBTEST_UPDATE
+// environment variable is set.
+package dbtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"database/jsondb"
+)
+
+// New returns an in-memory database that lives for the duration of the test.
+func New(t testing.TB) *jsondb.Driver {
+	t.Helper()
+
+	db, err := jsondb.Open(jsondb.MemoryDir, jsondb.WithLogger(logger{t}))
+	if err != nil {
+		t.Fatalf("dbtest: creating in-memory database: %v", err)
+	}
+	return db
+}
+
+// NewDir returns a database in a temporary directory that is removed after
+// the test. The test fails if temporary files are left behind in it.
+func NewDir(t testing.TB) *jsondb.Driver {
+	t.Helper()
+
+	dir := t.TempDir()
+	db, err := jsondb.Open(dir, jsondb.WithLogger(logger{t}))
+	if err != nil {
+		t.Fatalf("dbtest: creating database in %s: %v", dir, err)
+	}
+
+	t.Cleanup(func() { CheckClean(t, dir) })
+	return db
+}
+
+// Load writes fixture records, keyed by resource name, into collection.
+func Load(t testing.TB, db *jsondb.Driver, collection string, records map[string]interface{}) {
+	t.Helper()
+
+	for resource, record := range records {
+		if err := db.Write(collection, resource, record); err != nil {
+			t.Fatalf("dbtest: loading %s/%s: %v", collection, resource, err)
+		}
+	}
+}
+
+// LoadDir loads fixtures from a directory laid out like a database: one
+// subdirectory per collection holding <resource>.json files.
+func LoadDir(t testing.TB, db *jsondb.Driver, dir string) {
+	t.Helper()
+
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.HasSuffix(path, ".json") {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var record interface{}
+		if record, err = jsondb.DecodeValue(b); err != nil {
+			t.Fatalf("dbtest: fixture %s: %v", path, err)
+		}
+
+		collection := filepath.ToSlash(filepath.Dir(rel))
+		resource := strings.TrimSuffix(filepath.Base(rel), ".json")
+		return db.Write(collection, resource, record)
+	})
+
+	if err != nil {
+		t.Fatalf("dbtest: loading fixtures from %s: %v", dir, err)
+	}
+}
+
+// Snapshot returns the records of collection as indented JSON keyed by
+// resource name, with object keys sorted, suitable for golden files.
+func Snapshot(t testing.TB, db *jsondb.Driver, collection string) []byte {
+	t.Helper()
+
+	docs, err := db.Query(collection, jsondb.Query{})
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("dbtest: reading %s: %v", collection, err)
+	}
+
+	records := make(map[string]interface{}, len(docs))
+	for _, doc := range docs {
+		records[doc.Resource] = doc.Data
+	}
+
+	b, err := json.MarshalIndent(records, "", "\t")
+	if err != nil {
+		t.Fatalf("dbtest: encoding %s: %v", collection, err)
+	}
+	return append(b, '\n')
+}
+
+// AssertGolden fails the test unless the records of collection match the
+// golden file. With DBTEST_UPDATE set the golden file is written instead.
+func AssertGolden(t testing.TB, db *jsondb.Driver, collection, golden string) {
+	t.Helper()
+
+	got := Snapshot(t, db, collection)
+
+	if os.Getenv("DBTEST_UPDATE") != "" {
+		if err := os.MkdirAll(filepath.Dir(golden), 0755); err != nil {
+			t.Fatalf("dbtest: %v", err)
+		}
+		if err := os.WriteFile(golden, got, 0644); err != nil {
+			t.Fatalf("dbtest: writing golden file: %v", err)
+		}
+		return
+	}
+
+	b, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("dbtest: reading golden file (set DBTEST_UPDATE=1 to create it): %v", err)
+	}
+
+	// Normalize the golden file so formatting differences don't matter.
+	var want interface{}
+	if want, err = jsondb.DecodeValue(b); err != nil {
+		t.Fatalf("dbtest: golden file %s: %v", golden, err)
+	}
+	wantJSON, _ := json.MarshalIndent(want, "", "\t")
+	wantJSON = append(wantJSON, '\n')
+
+	if !bytes.Equal(got, wantJSON) {
+		t.Errorf("dbtest: collection %s does not match %s\n--- got\n%s--- want\n%s", collection, golden, got, wantJSON)
+	}
+}
+
+// CheckClean fails the test if dir contains temporary files left over by
+// interrupted writes.
+func CheckClean(t testing.TB, dir string) {
+	t.Helper()
+
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() && strings.HasSuffix(path, ".tmp") {
+			t.Errorf("dbtest: leftover temporary file %s", path)
+		}
+		return nil
+	})
+}
+
+// logger sends driver logs to the test log.
+type logger struct {
+	t testing.TB
+}
+
+func (l logger) Fatal(format string, v ...interface{}) { l.t.Logf("FATAL "+format, v...) }
+func (l logger) Error(format string, v ...interface{}) { l.t.Logf("ERROR "+format, v...) }
+func (l logger) Warn(format string, v ...interface{})  { l.t.Logf("WARN "+format, v...) }
+func (l logger) Info(format string, v ...interface{})  { l.t.Logf("INFO "+format, v...) }
+func (l logger) Debug(format string, v ...interface{}) { l.t.Logf("DEBUG "+format, v...) }
+func (l logger) Trace(format string, v ...interface{}) {}
@@ -0,0 +1,255 @@
+package dbtest
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"database/jsondb"
+	_ "database/jsondb/codecs"
+)
+
+// The Fuzz* functions are bodies for Go native fuzz targets. They fail the
+// test when an invariant is broken and return quietly for inputs the driver
+// rightly rejects:
+//
+//	func FuzzResourceName(f *testing.F) {
+//		f.Add("John")
+//		f.Add("../etc/passwd")
+//		f.Fuzz(dbtest.FuzzResourceName)
+//	}
+
+// FuzzResourceName checks that a resource name either is rejected or
+// round-trips through Write, Read, ReadAll and Delete without leaving its
+// collection.
+func FuzzResourceName(t *testing.T, name string) {
+	dir := t.TempDir()
+	db, err := jsondb.Open(filepath.Join(dir, "db"), jsondb.WithLogger(logger{t}))
+	if err != nil {
+		t.Fatalf("dbtest: creating database: %v", err)
+	}
+
+	record := map[string]string{"Name": name}
+	if err := db.Write("users", name, record); err != nil {
+		if errors.Is(err, jsondb.ErrInvalidName) {
+			return
+		}
+		t.Skipf("write %q: %v", name, err) // e.g. names too long for the filesystem
+	}
+
+	var got map[string]string
+	if err := db.Read("users", name, &got); err != nil {
+		t.Fatalf("read %q after write: %v", name, err)
+	}
+	if got["Name"] != name {
+		t.Fatalf("read %q: got %q", name, got["Name"])
+	}
+
+	records, err := db.ReadAll("users")
+	if err != nil || len(records) != 1 {
+		t.Fatalf("readall after writing %q: %d records, %v", name, len(records), err)
+	}
+
+	outside, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(outside) != 1 {
+		t.Fatalf("write %q escaped the database directory: %v", name, outside)
+	}
+
+	if err := db.Delete("users", name); err != nil {
+		t.Fatalf("delete %q: %v", name, err)
+	}
+	CheckClean(t, filepath.Join(dir, "db"))
+}
+
+// FuzzCodecRoundTrip checks that any JSON document survives encoding and
+// decoding with every registered codec. Documents holding numbers beyond
+// the range of a float64, which the binary formats cannot carry, are left
+// out.
+func FuzzCodecRoundTrip(t *testing.T, data []byte) {
+	want, err := jsondb.DecodeValue(data)
+	if err != nil {
+		return
+	}
+	var float interface{}
+	if json.Unmarshal(data, &float) != nil {
+		return
+	}
+
+	for _, codec := range jsondb.Codecs() {
+		b, err := codec.Marshal(want)
+		if err != nil {
+			t.Fatalf("%s: marshal %s: %v", codec.Name(), data, err)
+		}
+
+		var got interface{}
+		if err := codec.Unmarshal(b, &got); err != nil {
+			t.Fatalf("%s: unmarshal %q: %v", codec.Name(), b, err)
+		}
+		if !sameJSON(got, want) {
+			t.Fatalf("%s: round trip of %s gave %v", codec.Name(), data, got)
+		}
+	}
+}
+
+// FuzzSetValue checks that a value set at a "/"-separated path can be read
+// back from the patched document.
+func FuzzSetValue(t *testing.T, doc []byte, path, value string) {
+	v, err := jsondb.DecodeValue(doc)
+	if err != nil {
+		return
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	segs := strings.Split(path, "/")
+	if err := jsondb.SetValueAt(m, segs, value); err != nil {
+		return
+	}
+
+	if segs[len(segs)-1] == "-" {
+		return // appended; the index is not known up front
+	}
+	if got, ok := jsondb.ValueAt(m, segs); !ok || got != value {
+		t.Fatalf("set %q in %s: read back %v, %v", path, doc, got, ok)
+	}
+}
+
+// FuzzQuery checks that the SQL parser and the path extractor reject bad
+// input with an error instead of panicking.
+func FuzzQuery(t *testing.T, query string) {
+	db, err := sql.Open("jsondb", jsondb.MemoryDir)
+	if err != nil {
+		t.Fatalf("dbtest: opening sql database: %v", err)
+	}
+	defer db.Close()
+
+	if rows, err := db.Query(query); err == nil {
+		rows.Close()
+	}
+
+	store := New(t)
+	Load(t, store, "users", map[string]interface{}{"John": map[string]interface{}{"Name": "John"}})
+	store.Extract("users", "John", query)
+}
+
+// CheckOperations is a property-based harness: it applies steps random
+// Write, Read, Delete and simulated crash operations, chosen by seed, to a
+// database in dir and checks after each one that the database agrees with
+// an in-memory model. A crash leaves a half-written temporary file behind
+// and reopens the database, as a restart after power loss would.
+func CheckOperations(t testing.TB, dir string, seed int64, steps int) {
+	t.Helper()
+
+	rnd := rand.New(rand.NewSource(seed))
+	open := func() *jsondb.Driver {
+		db, err := jsondb.Open(dir, jsondb.WithLogger(logger{t}))
+		if err != nil {
+			t.Fatalf("dbtest: opening %s: %v", dir, err)
+		}
+		return db
+	}
+
+	db := open()
+	model := map[string]int{}
+	names := []string{"a", "b", "c", "John Doe", "a%20b", "x+y", "ünï", "d.json"}
+
+	for step := 0; step < steps; step++ {
+		name := names[rnd.Intn(len(names))]
+
+		switch op := rnd.Intn(10); {
+		case op < 4:
+			n := rnd.Int()
+			if err := db.Write("items", name, map[string]int{"N": n}); err != nil {
+				t.Fatalf("step %d: write %q: %v", step, name, err)
+			}
+			model[name] = n
+
+		case op < 7:
+			var got map[string]int
+			err := db.Read("items", name, &got)
+			want, ok := model[name]
+			switch {
+			case !ok && err == nil:
+				t.Fatalf("step %d: read %q: found deleted record", step, name)
+			case ok && err != nil:
+				t.Fatalf("step %d: read %q: %v", step, name, err)
+			case ok && got["N"] != want:
+				t.Fatalf("step %d: read %q: got %d, want %d", step, name, got["N"], want)
+			}
+
+		case op < 9:
+			err := db.Delete("items", name)
+			if _, ok := model[name]; ok && err != nil {
+				t.Fatalf("step %d: delete %q: %v", step, name, err)
+			}
+			delete(model, name)
+
+		default:
+			tmp := filepath.Join(dir, "items", name+".json.tmp")
+			os.MkdirAll(filepath.Dir(tmp), 0755)
+			if err := os.WriteFile(tmp, []byte(`{"N": `), 0644); err != nil {
+				t.Fatalf("step %d: simulating crash: %v", step, err)
+			}
+			db = open()
+		}
+
+		if err := checkModel(db, model); err != nil {
+			t.Fatalf("step %d (seed %d): %v", step, seed, err)
+		}
+	}
+}
+
+// checkModel compares the items collection with model.
+func checkModel(db *jsondb.Driver, model map[string]int) error {
+	records, err := db.ReadAll("items")
+	if err != nil && len(model) > 0 {
+		return fmt.Errorf("readall: %v", err)
+	}
+
+	var got []int
+	for _, record := range records {
+		var v map[string]int
+		if err := json.Unmarshal([]byte(record), &v); err != nil {
+			return fmt.Errorf("corrupt record %s: %v", record, err)
+		}
+		got = append(got, v["N"])
+	}
+
+	var want []int
+	for _, n := range model {
+		want = append(want, n)
+	}
+
+	sort.Ints(got)
+	sort.Ints(want)
+	if len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+		return fmt.Errorf("collection holds %v, want %v", got, want)
+	}
+	return nil
+}
+
+// sameJSON compares two decoded documents through their JSON encoding, so
+// that codecs may differ in the Go types they decode numbers into.
+func sameJSON(a, b interface{}) bool {
+	var va, vb interface{}
+	for _, p := range []struct {
+		in  interface{}
+		out *interface{}
+	}{{a, &va}, {b, &vb}} {
+		j, err := json.Marshal(p.in)
+		if err != nil || json.Unmarshal(j, p.out) != nil {
+			return false
+		}
+	}
+	return reflect.DeepEqual(va, vb)
+}
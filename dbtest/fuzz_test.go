@@ -0,0 +1,63 @@
+package dbtest_test
+
+import (
+	"testing"
+
+	"database/dbtest"
+)
+
+func FuzzResourceName(f *testing.F) {
+	for _, name := range []string{
+		"John", "John Doe", "a%20b", "x+y", "ünï", "d.json", "_manifest",
+		"", ".", "..", "../etc/passwd", "a/b", `a\b`, "con", "a\x00b", " lead", "trail ",
+	} {
+		f.Add(name)
+	}
+	f.Fuzz(dbtest.FuzzResourceName)
+}
+
+func FuzzCodecRoundTrip(f *testing.F) {
+	for _, doc := range []string{
+		`{"Name":"John","Age":30,"Tags":["a","b"],"Address":{"City":"Oslo"}}`,
+		`{"Items":[1,2]}`,
+		`{"n":12345678901234567890,"f":1e-7,"z":-0}`,
+		`{"":null,"u":"é😀"}`,
+		`[1,2]`, `[]`, `{}`, `1.5`, `"s"`, `true`, `null`,
+	} {
+		f.Add([]byte(doc))
+	}
+	f.Fuzz(dbtest.FuzzCodecRoundTrip)
+}
+
+func FuzzSetValue(f *testing.F) {
+	f.Add([]byte(`{"Name":"John"}`), "Name", "Paul")
+	f.Add([]byte(`{"Address":{"City":"Oslo"}}`), "Address/City", "Bergen")
+	f.Add([]byte(`{"Tags":["a","b"]}`), "Tags/1", "c")
+	f.Add([]byte(`{"Tags":["a"]}`), "Tags/-", "b")
+	f.Add([]byte(`{"Tags":["a"]}`), "Tags/5", "b")
+	f.Add([]byte(`{"Name":"John"}`), "Name/First", "John")
+	f.Add([]byte(`{}`), "a/b/c", "d")
+	f.Add([]byte(`{}`), "", "x")
+	f.Fuzz(dbtest.FuzzSetValue)
+}
+
+func FuzzQuery(f *testing.F) {
+	for _, query := range []string{
+		`SELECT * FROM users`,
+		`SELECT Name, Address.City FROM users WHERE Age > 25 AND _key != 'x' ORDER BY Name DESC LIMIT 10`,
+		`SELECT "Name" FROM "users" WHERE Name = 'O''Brien';`,
+		`SELECT * FROM users WHERE Age > ?`,
+		`SELECT`, `SELECT * FROM`, `SELECT * FROM users WHERE`, `SELECT * FROM users LIMIT -1`,
+		`SELECT * FROM users WHERE Name = 'unterminated`,
+		`Name`, `Address.City`, `Tags[0]`, `..`, ``,
+	} {
+		f.Add(query)
+	}
+	f.Fuzz(dbtest.FuzzQuery)
+}
+
+func TestOperations(t *testing.T) {
+	for seed := int64(1); seed <= 20; seed++ {
+		dbtest.CheckOperations(t, t.TempDir(), seed, 200)
+	}
+}
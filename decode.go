@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"database/jsondb"
+)
+
+// Decode modes of request bodies, set per collection with
+// CollectionConfig.Decode or per request with ?decode=.
+const (
+	// decodeStrict rejects bodies with fields the registered type does not
+	// have or values of the wrong type, listing every offending field.
+	decodeStrict = "strict"
+
+	// decodeLax keeps fields the registered type does not have: records
+	// are checked against the type but stored and returned as sent.
+	decodeLax = "lax"
+)
+
+// decodeMode returns the decode mode for a request on collection.
+func (s *Server) decodeMode(c *fiber.Ctx, collection string) string {
+	if mode := c.Query("decode"); mode != "" {
+		return mode
+	}
+	return s.store(c).CollectionConfig(collection).Decode
+}
+
+// parseGeneric decodes the request body without a target type. JSON numbers
+// are kept as json.Number so no precision is lost.
+func parseGeneric(c *fiber.Ctx) (interface{}, error) {
+	contentType := string(c.Request().Header.ContentType())
+	if contentType == "" {
+		contentType = fiber.MIMEApplicationJSON
+	}
+
+	codec, ok := jsondb.CodecFor(contentType)
+	if !ok {
+		if form, ok, err := parseForm(c); ok {
+			return form, err
+		}
+		return nil, fiber.ErrUnsupportedMediaType
+	}
+	if codec.Name() == "json" {
+		return jsondb.DecodeValue(c.Body())
+	}
+
+	var v interface{}
+	return v, codec.Unmarshal(c.Body(), &v)
+}
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// fieldProblems lists every place where v, a generic decoded document, does
+// not fit t: fields t has no room for and values of the wrong type.
+func fieldProblems(t reflect.Type, v interface{}, path string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if v == nil || reflect.PtrTo(t).Implements(unmarshalerType) || reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return typeProblem(t, v, path)
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return typeProblem(t, v, path)
+		}
+
+		fields := jsonFields(t)
+		var problems []string
+		for key, value := range m {
+			f, ok := fields[strings.ToLower(key)]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s: unknown field", joinPath(path, key)))
+				continue
+			}
+			problems = append(problems, fieldProblems(f.Type, value, joinPath(path, key))...)
+		}
+		sort.Strings(problems)
+		return problems
+
+	case reflect.Slice, reflect.Array:
+		list, ok := v.([]interface{})
+		if !ok || t.Elem().Kind() == reflect.Uint8 {
+			return typeProblem(t, v, path)
+		}
+
+		var problems []string
+		for i, e := range list {
+			problems = append(problems, fieldProblems(t.Elem(), e, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+		return problems
+
+	case reflect.Map:
+		m, ok := v.(map[string]interface{})
+		if !ok || t.Key().Kind() != reflect.String {
+			return typeProblem(t, v, path)
+		}
+
+		var problems []string
+		for key, e := range m {
+			problems = append(problems, fieldProblems(t.Elem(), e, joinPath(path, key))...)
+		}
+		sort.Strings(problems)
+		return problems
+	}
+	return typeProblem(t, v, path)
+}
+
+// typeProblem reports path if v does not decode into a value of type t.
+func typeProblem(t reflect.Type, v interface{}, path string) []string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: %v", path, err)}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(reflect.New(t).Interface()); err != nil {
+		if path == "" {
+			path = "(record)"
+		}
+		return []string{fmt.Sprintf("%s: expected %s, got %s", path, typeKind(t), jsonKind(v))}
+	}
+	return nil
+}
+
+// jsonFields maps the lower-cased JSON names of t's fields, including those
+// of embedded structs, to the fields, matching names case-insensitively as
+// encoding/json does.
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			for k, v := range jsonFields(ft) {
+				if _, ok := fields[k]; !ok {
+					fields[k] = v
+				}
+			}
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = f
+	}
+	return fields
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+var numberType = reflect.TypeOf(json.Number(""))
+
+// typeKind names the JSON type values of t are written as.
+func typeKind(t reflect.Type) string {
+	if t == numberType {
+		return "number"
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	}
+	return t.String()
+}
+
+// jsonKind names the JSON type of a decoded value.
+func jsonKind(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number, float64, int, int64, uint64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+
+	"database/jsondb"
+)
+
+// exportSigned serves POST /admin/exports: {"Dir": "/holds/case-42",
+// "Collections": ["orders"]} writes a signed export of the collections,
+// all by default, into Dir on the server, signed with the ExportKey of the
+// config. It answers the manifest, less the record hashes.
+func (s *Server) exportSigned(c *fiber.Ctx) error {
+	path := s.config().ExportKey
+	if path == "" {
+		return c.Status(404).SendString("No export key is configured")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return c.Status(500).SendString(fmt.Sprintf("Error reading export key: %v", err))
+	}
+	key, err := jsondb.ParseExportKey(b)
+	if err != nil {
+		return c.Status(500).SendString(fmt.Sprintf("Error reading export key: %v", err))
+	}
+
+	var body struct {
+		Dir         string
+		Collections []string
+	}
+	if err := parseBody(c, &body); err != nil {
+		return c.Status(400).SendString(fmt.Sprintf("Error parsing request body: %v", err))
+	}
+	if body.Dir == "" {
+		return c.Status(400).SendString("Missing Dir")
+	}
+
+	m, err := s.store(c).ExportSigned(body.Dir, key, body.Collections...)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	type collection struct {
+		Name    string
+		Records int
+	}
+	collections := make([]collection, len(m.Collections))
+	for i, e := range m.Collections {
+		collections[i] = collection{e.Name, len(e.Records)}
+	}
+	c.Status(201)
+	return respond(c, fiber.Map{"Dir": body.Dir, "Created": m.Created, "Collections": collections, "PublicKey": m.PublicKey})
+}
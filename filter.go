@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"database/jsondb"
+)
+
+// parseFilter reads the filter parameters of a request into a query:
+//
+//	filter[Company]=Google                    Company equals Google
+//	filter[Address][near]=48.85,2.35,50km     Address within 50km of the point
+//	filter[Address][bbox]=48,2,49,3           Address inside minLat,minLng,maxLat,maxLng
+//	filter[Name][matches]=^Al(bert|ice)$      Name matches the RE2 expression
+//	filter[Name][like]=Al*                    Name matches the glob (like or glob)
+//
+// A near radius is in meters unless it ends in m or km. collation=nocase
+// and other jsondb.Collation values set how the conditions compare strings.
+func parseFilter(c *fiber.Ctx) (jsondb.Query, error) {
+	var q jsondb.Query
+	var err error
+
+	c.Context().QueryArgs().VisitAll(func(k, v []byte) {
+		key := string(k)
+		if err != nil || !strings.HasPrefix(key, "filter[") || !strings.HasSuffix(key, "]") {
+			return
+		}
+		field := strings.TrimSuffix(strings.TrimPrefix(key, "filter["), "]")
+
+		op := ""
+		if i := strings.Index(field, "]["); i >= 0 {
+			field, op = field[:i], field[i+2:]
+		}
+
+		switch op {
+		case "":
+			q.Where = append(q.Where, jsondb.Condition{Field: field, Value: string(v)})
+		case jsondb.OpMatches, jsondb.OpLike, jsondb.OpGlob:
+			q.Where = append(q.Where, jsondb.Condition{Field: field, Op: op, Value: string(v)})
+		case "near", "bbox":
+			if q.Geo != nil {
+				err = fmt.Errorf("Only one geo filter is allowed")
+				return
+			}
+			q.Geo, err = parseGeo(field, op, string(v))
+		default:
+			err = fmt.Errorf("Unknown filter operator '%s'", op)
+		}
+	})
+	if err == nil {
+		q.Collation = jsondb.Collation(c.Query("collation"))
+		err = q.Collation.Validate()
+	}
+	for _, cond := range q.Where {
+		if err == nil {
+			err = cond.Validate()
+		}
+	}
+	return q, err
+}
+
+// parseGeo reads a near or bbox filter value.
+func parseGeo(field, op, value string) (*jsondb.GeoFilter, error) {
+	parts := strings.Split(value, ",")
+
+	if op == "near" {
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("Invalid near filter '%s', expected lat,lng,radius", value)
+		}
+		coords, err := parseFloats(parts[:2])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid near filter '%s': %v", value, err)
+		}
+		radius, err := parseRadius(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid near filter '%s': %v", value, err)
+		}
+
+		f := jsondb.Near(coords[0], coords[1], radius)
+		f.Field = field
+		return f, f.Validate()
+	}
+
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("Invalid bbox filter '%s', expected minLat,minLng,maxLat,maxLng", value)
+	}
+	coords, err := parseFloats(parts)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid bbox filter '%s': %v", value, err)
+	}
+
+	f := jsondb.Within(coords[0], coords[1], coords[2], coords[3])
+	f.Field = field
+	return f, f.Validate()
+}
+
+func parseFloats(parts []string) ([]float64, error) {
+	floats := make([]float64, len(parts))
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, err
+		}
+		floats[i] = f
+	}
+	return floats, nil
+}
+
+// parseRadius reads a distance such as 500, 500m or 50km into meters.
+func parseRadius(s string) (float64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	unit := 1.0
+	switch {
+	case strings.HasSuffix(s, "km"):
+		s, unit = strings.TrimSuffix(s, "km"), 1000
+	case strings.HasSuffix(s, "m"):
+		s = strings.TrimSuffix(s, "m")
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return f * unit, nil
+}
+
+// limitedHeader names the limit that cut a listing short when the request
+// asked for partial results.
+const limitedHeader = "X-Query-Limited"
+
+// parseLimits reads the query limits a request asks for: timeout=2s,
+// max_scanned=, max_results= and partial=true. A request may lower the
+// limits of max, the configured ones, but not raise them.
+func parseLimits(c *fiber.Ctx, max jsondb.QueryLimits) (jsondb.QueryLimits, error) {
+	l := max
+	l.Partial = c.QueryBool("partial", max.Partial)
+
+	if v := c.Query("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return l, fmt.Errorf("Invalid timeout '%s'", v)
+		}
+		if max.Timeout <= 0 || d < max.Timeout {
+			l.Timeout = d
+		}
+	}
+
+	for param, limit := range map[string]*int{"max_scanned": &l.MaxScanned, "max_results": &l.MaxResults} {
+		v := c.Query(param)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return l, fmt.Errorf("Invalid %s '%s'", param, v)
+		}
+		if *limit <= 0 || n < *limit {
+			*limit = n
+		}
+	}
+	return l, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"database/jsondb"
+)
+
+// edge reads the two records and the relation of an edge route:
+// /graph/:collection/:id/:relation/:to/:toID. Both collections are resolved
+// like collection does, and must be of the same namespace.
+func (s *Server) edge(c *fiber.Ctx) (*jsondb.Driver, jsondb.Edge, error) {
+	store, from, err := s.collectionParam(c, "collection")
+	if err != nil {
+		return nil, jsondb.Edge{}, err
+	}
+	_, to, err := s.collectionParam(c, "to")
+	if err != nil {
+		return nil, jsondb.Edge{}, err
+	}
+	if strings.HasPrefix(param(c, "collection"), "_") != strings.HasPrefix(param(c, "to"), "_") {
+		return nil, jsondb.Edge{}, fiber.NewError(400, "Edges cannot join system and regular collections")
+	}
+
+	e := jsondb.Edge{
+		From:     jsondb.Node{Collection: from, ID: param(c, "id")},
+		Relation: param(c, "relation"),
+		To:       jsondb.Node{Collection: to, ID: param(c, "toID")},
+	}
+	return store, e, nil
+}
+
+func (s *Server) link(c *fiber.Ctx) error {
+	store, e, err := s.edge(c)
+	if err != nil {
+		return err
+	}
+
+	if err := store.Link(e.From.Collection, e.From.ID, e.Relation, e.To.Collection, e.To.ID); err != nil {
+		return writeError(c, err)
+	}
+	return c.SendStatus(204)
+}
+
+func (s *Server) unlink(c *fiber.Ctx) error {
+	store, e, err := s.edge(c)
+	if err != nil {
+		return err
+	}
+
+	if err := store.Unlink(e.From.Collection, e.From.ID, e.Relation, e.To.Collection, e.To.ID); err != nil {
+		return writeError(c, err)
+	}
+	return c.SendStatus(204)
+}
+
+// traverse returns the records reached from a record through ?relation=
+// edges followed in ?direction= (out, in or both) between ?min= and
+// ?depth= hops, at most ?limit= of them, with their content when
+// ?records=true.
+func (s *Server) traverse(c *fiber.Ctx) error {
+	store, collection, err := s.collection(c)
+	if err != nil {
+		return err
+	}
+
+	opts := jsondb.TraversalOptions{
+		Relation:  c.Query("relation"),
+		Direction: jsondb.Direction(c.Query("direction", string(jsondb.Outbound))),
+		MinDepth:  c.QueryInt("min"),
+		MaxDepth:  c.QueryInt("depth", 1),
+		Limit:     c.QueryInt("limit"),
+		Records:   c.QueryBool("records"),
+	}
+	switch opts.Direction {
+	case jsondb.Outbound, jsondb.Inbound, jsondb.Both:
+	default:
+		return c.Status(400).SendString(fmt.Sprintf("Unknown direction '%s'", opts.Direction))
+	}
+	if opts.MaxDepth > jsondb.MaxTraversalDepth {
+		return c.Status(400).SendString(fmt.Sprintf("Depth must not exceed %d", jsondb.MaxTraversalDepth))
+	}
+
+	hops, err := store.Traverse(jsondb.Node{Collection: collection, ID: param(c, "id")}, opts)
+	if err == jsondb.ErrInvalidName {
+		return c.Status(400).SendString(err.Error())
+	}
+	if err != nil {
+		return c.Status(500).SendString(fmt.Sprintf("Error traversing graph: %v", err))
+	}
+	if hops == nil {
+		hops = []jsondb.Hop{}
+	}
+	return respond(c, hops)
+}
@@ -0,0 +1,161 @@
+package jsondb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Aliases are names standing for a collection, such as "users" for
+// "users_v2", so a new generation of a collection can be loaded aside and
+// put in service at once, by pointing its alias at it. The reads, writes,
+// queries, watches and attachments of records, and CollectionConfig,
+// resolve them; everything else, such as configuring, archiving or
+// deleting a whole collection, takes the name of the collection itself.
+
+// aliasesCollection is the system collection keeping the aliases, by name.
+const aliasesCollection = "aliases"
+
+// alias is the stored form of an alias.
+type alias struct {
+	Target string
+}
+
+// aliasState holds the aliases, shared by the copies of a driver.
+type aliasState struct {
+	mutex   sync.RWMutex
+	targets map[string]string
+}
+
+// loadAliases reads the aliases kept in the system namespace.
+func (d *Driver) loadAliases() error {
+	sys := d.System()
+	if sys == d {
+		return nil
+	}
+
+	docs, err := sys.Query(aliasesCollection, Query{})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	d.aliases.mutex.Lock()
+	defer d.aliases.mutex.Unlock()
+	for _, doc := range docs {
+		var a alias
+		if err := FromGeneric(doc.Data, &a); err != nil {
+			return fmt.Errorf("Error reading alias '%s': %v", doc.Resource, err)
+		}
+		d.aliases.targets[doc.Resource] = a.Target
+	}
+	return nil
+}
+
+// resolve returns the collection collection stands for: the target of the
+// alias of that name, or else collection itself.
+func (d *Driver) resolve(collection string) string {
+	if d.aliases == nil {
+		return collection
+	}
+
+	d.aliases.mutex.RLock()
+	defer d.aliases.mutex.RUnlock()
+	if target, ok := d.aliases.targets[collection]; ok {
+		return target
+	}
+	return collection
+}
+
+// ResolveAlias returns the collection name stands for: the target of the
+// alias name, or else name itself.
+func (d *Driver) ResolveAlias(name string) string {
+	return d.resolve(name)
+}
+
+// SetAlias points alias at the collection target, creating the alias or
+// swapping its target at once: operations started before go on with the
+// former target, those started after use the new one. An alias cannot
+// have the name of a collection, nor point at another alias.
+func (d *Driver) SetAlias(name, target string) error {
+	if err := validName(name, ""); err != nil {
+		return err
+	}
+	if err := validName(target, ""); err != nil {
+		return err
+	}
+	if err := d.checkCollection(name); err != nil {
+		return err
+	}
+	if err := d.checkCollection(target); err != nil {
+		return err
+	}
+	if d.aliases == nil {
+		return fmt.Errorf("Aliases cannot be set in '%s'", d.dir)
+	}
+
+	d.aliases.mutex.Lock()
+	defer d.aliases.mutex.Unlock()
+
+	if name == target {
+		return fmt.Errorf("Alias '%s' cannot point at itself", name)
+	}
+	if _, ok := d.aliases.targets[target]; ok {
+		return fmt.Errorf("Alias '%s' cannot point at alias '%s'", name, target)
+	}
+	for other, t := range d.aliases.targets {
+		if t == name {
+			return fmt.Errorf("'%s' is the target of alias '%s'", name, other)
+		}
+	}
+	if fi, err := d.backend.Stat(filepath.Join(d.dir, name)); err == nil && fi.IsDir() {
+		return fmt.Errorf("Alias '%s' would hide the collection of that name", name)
+	}
+
+	if err := d.System().Write(aliasesCollection, name, alias{Target: target}); err != nil {
+		return err
+	}
+	previous := d.aliases.targets[name]
+	d.aliases.targets[name] = target
+	if previous != "" && previous != target {
+		d.log.Info("Alias '%s' now points at '%s' instead of '%s'\n", name, target, previous)
+	}
+	return nil
+}
+
+// RemoveAlias deletes the alias name; the collection it pointed at stays.
+func (d *Driver) RemoveAlias(name string) error {
+	if d.aliases == nil {
+		return os.ErrNotExist
+	}
+
+	d.aliases.mutex.Lock()
+	defer d.aliases.mutex.Unlock()
+
+	if _, ok := d.aliases.targets[name]; !ok {
+		return os.ErrNotExist
+	}
+	if err := d.System().Delete(aliasesCollection, name); err != nil {
+		return err
+	}
+	delete(d.aliases.targets, name)
+	return nil
+}
+
+// Aliases returns the aliases and their targets.
+func (d *Driver) Aliases() map[string]string {
+	aliases := make(map[string]string)
+	if d.aliases == nil {
+		return aliases
+	}
+
+	d.aliases.mutex.RLock()
+	defer d.aliases.mutex.RUnlock()
+	for name, target := range d.aliases.targets {
+		aliases[name] = target
+	}
+	return aliases
+}
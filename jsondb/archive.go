@@ -0,0 +1,388 @@
+package jsondb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// archivesCollection is the system collection listing archive segments.
+const archivesCollection = "archives"
+
+// OpArchive is reported by Watch when a record is moved to the archive.
+const OpArchive = "archive"
+
+// ArchiveStore keeps compressed archive segments. By default they are
+// stored in the database's system namespace; set Options.Archive to keep
+// them elsewhere, such as an S3 bucket.
+type ArchiveStore interface {
+	Put(name string, data []byte) error
+	Get(name string) ([]byte, error)
+	Delete(name string) error
+}
+
+// ArchivePolicy moves the records of Collection that were not written for
+// MaxAge into the archive, checked on Schedule ("@daily" by default) by the
+// "archive-<Collection>" job.
+type ArchivePolicy struct {
+	Collection string
+	MaxAge     time.Duration
+	Schedule   string
+}
+
+// ArchiveSegment describes one archive segment: the records of a collection
+// archived together.
+type ArchiveSegment struct {
+	Name       string
+	Collection string
+	Created    time.Time
+	Resources  []string
+}
+
+// localArchive stores segments as files below the system namespace.
+type localArchive struct {
+	d *Driver
+}
+
+func (a localArchive) path(name string) string {
+	return filepath.Join(a.d.dir, "segments", filepath.FromSlash(name)+".gz")
+}
+
+func (a localArchive) Put(name string, data []byte) error {
+	return a.d.backend.WriteFile(a.path(name), data)
+}
+
+func (a localArchive) Get(name string) ([]byte, error) {
+	return a.d.backend.ReadFile(a.path(name))
+}
+
+func (a localArchive) Delete(name string) error {
+	return a.d.backend.Remove(a.path(name))
+}
+
+func (d *Driver) archiveStore() ArchiveStore {
+	if d.archive != nil {
+		return d.archive
+	}
+	return localArchive{d.System()}
+}
+
+// ParseAge parses a duration that may also be given in days ("180d").
+func ParseAge(s string) (time.Duration, error) {
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid age '%s'", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// SetArchivePolicy schedules the archival of old records of a collection.
+// A policy without MaxAge removes the collection's policy.
+func (d *Driver) SetArchivePolicy(p ArchivePolicy) error {
+	job := "archive-" + p.Collection
+	if p.MaxAge <= 0 {
+		d.scheduler.Unregister(job)
+		return nil
+	}
+
+	schedule := p.Schedule
+	if schedule == "" {
+		schedule = "@daily"
+	}
+
+	return d.scheduler.Register(job, schedule, func() error {
+		_, err := d.Archive(p.Collection, p.MaxAge)
+		return err
+	})
+}
+
+// Archive moves the records of collection that were last written more than
+// maxAge ago into a new archive segment and returns how many were moved.
+// Archived records are no longer returned by Read, ReadAll or Query; see
+// ReadArchived and Restore. With a replicator the move is replicated, and
+// only made by its leader.
+func (d *Driver) Archive(collection string, maxAge time.Duration) (n int, err error) {
+	d, span := d.trace("Archive", collection, "")
+	defer span.end(&err)
+
+	if err := validName(collection, ""); err != nil {
+		return 0, err
+	}
+	if err := d.checkCollection(collection); err != nil {
+		return 0, err
+	}
+
+	r := d.replicator()
+	if r != nil && !sweeps(r) {
+		return 0, nil
+	}
+
+	unlock, err := d.lockCollection(collection, LockWrite)
+	if err != nil {
+		return 0, err
+	}
+
+	files, err := d.backend.ReadDir(filepath.Join(d.dir, collection))
+	if err != nil {
+		unlock()
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-maxAge)
+	var resources []string
+	for _, file := range files {
+		if isRecord(file) && file.ModTime().Before(cutoff) {
+			resources = append(resources, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+
+	if r != nil && len(resources) > 0 {
+		expect, err := d.expectations(collection, resources)
+		unlock()
+		if err != nil {
+			return 0, err
+		}
+		return d.replicateArchive(r, collection, expect)
+	}
+	defer unlock()
+	return d.archiveRecords(collection, resources)
+}
+
+// archiveRecords moves resources of collection into a new archive segment
+// and returns how many were moved. The caller holds the collection lock.
+func (d *Driver) archiveRecords(collection string, resources []string) (n int, err error) {
+	return d.archiveSegment(newSegment(collection, resources))
+}
+
+// newSegment names a new archive segment of resources of collection.
+func newSegment(collection string, resources []string) ArchiveSegment {
+	now := time.Now().UTC()
+	return ArchiveSegment{
+		Name:       collection + "/" + strconv.FormatInt(now.UnixNano(), 10),
+		Collection: collection,
+		Created:    now,
+		Resources:  resources,
+	}
+}
+
+// archiveSegment moves the resources of segment into it and returns how
+// many were moved. The caller holds the collection lock.
+func (d *Driver) archiveSegment(segment ArchiveSegment) (n int, err error) {
+	collection, resources := segment.Collection, segment.Resources
+	if len(resources) == 0 {
+		return 0, nil
+	}
+
+	dir := filepath.Join(d.dir, collection)
+	records := make(map[string]json.RawMessage, len(resources))
+	for _, resource := range resources {
+		b, err := d.backend.ReadFile(filepath.Join(dir, resource+".json"))
+		if err != nil {
+			return 0, err
+		}
+		records[resource] = b
+	}
+
+	if err := d.putSegment(segment, records); err != nil {
+		return 0, err
+	}
+
+	g, end := d.changes()
+	defer end()
+	for _, resource := range resources {
+		g.record(collection, resource, records[resource], true)
+		if err := d.backend.Remove(filepath.Join(dir, resource+".json")); err != nil {
+			return n, err
+		}
+		d.publish(OpArchive, collection, resource, records[resource])
+		d.updateViews(collection, resource, nil)
+		d.updateGeo(collection, resource, nil)
+		n++
+	}
+
+	d.log.Info("Archived %d records of '%s' into '%s'\n", n, collection, segment.Name)
+	return n, nil
+}
+
+// ReadArchived reads an archived record into v, taking it from the newest
+// segment holding it. It fails with an error satisfying os.IsNotExist if the
+// record was never archived.
+func (d *Driver) ReadArchived(collection, resource string, v interface{}) (err error) {
+	d, span := d.trace("ReadArchived", collection, resource)
+	defer span.end(&err)
+
+	if err := validName(collection, resource); err != nil {
+		return err
+	}
+
+	segments, err := d.ArchiveSegments(collection)
+	if err != nil {
+		return err
+	}
+
+	for i := len(segments) - 1; i >= 0; i-- {
+		if !contains(segments[i].Resources, resource) {
+			continue
+		}
+
+		records, err := d.getSegment(segments[i])
+		if err != nil {
+			return err
+		}
+		if b, ok := records[resource]; ok {
+			d.traceBytes(len(b))
+			return d.DecodeRecord(collection, b, v)
+		}
+	}
+
+	return &os.PathError{Op: "read archived", Path: collection + "/" + resource, Err: os.ErrNotExist}
+}
+
+// Restore moves archived records of collection back into it: the named
+// resource, or every archived record if resource is empty. It returns how
+// many records were restored.
+func (d *Driver) Restore(collection, resource string) (n int, err error) {
+	d, span := d.trace("Restore", collection, resource)
+	defer span.end(&err)
+
+	segments, err := d.ArchiveSegments(collection)
+	if err != nil {
+		return 0, err
+	}
+
+	restored := map[string]bool{}
+	for i := len(segments) - 1; i >= 0; i-- {
+		segment := segments[i]
+		if resource != "" && !contains(segment.Resources, resource) {
+			continue
+		}
+
+		records, err := d.getSegment(segment)
+		if err != nil {
+			return n, err
+		}
+
+		for name, b := range records {
+			if resource != "" && name != resource {
+				continue
+			}
+
+			// Newer segments hold newer versions; older ones are dropped.
+			if !restored[name] {
+				if err := d.Write(collection, name, b); err != nil {
+					return n, err
+				}
+				restored[name] = true
+				n++
+			}
+			delete(records, name)
+		}
+
+		if err := d.replaceSegment(segment, records); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// ArchiveSegments lists the archive segments of collection, oldest first.
+func (d *Driver) ArchiveSegments(collection string) ([]ArchiveSegment, error) {
+	docs, err := d.System().Query(archivesCollection, Query{Where: []Condition{{Field: "Collection", Value: collection}}})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]ArchiveSegment, 0, len(docs))
+	for _, doc := range docs {
+		var segment ArchiveSegment
+		if err := FromGeneric(doc.Data, &segment); err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i].Created.Before(segments[j].Created) })
+	return segments, nil
+}
+
+// segmentRecord is the name of the system record describing a segment.
+func segmentRecord(name string) string {
+	return recordEscaper.Replace(name)
+}
+
+func (d *Driver) putSegment(segment ArchiveSegment, records map[string]json.RawMessage) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(records); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	if err := d.archiveStore().Put(segment.Name, buf.Bytes()); err != nil {
+		return err
+	}
+	return d.System().Write(archivesCollection, segmentRecord(segment.Name), segment)
+}
+
+func (d *Driver) getSegment(segment ArchiveSegment) (map[string]json.RawMessage, error) {
+	b, err := d.archiveStore().Get(segment.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	b, err = ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+
+	var records map[string]json.RawMessage
+	return records, json.Unmarshal(b, &records)
+}
+
+// replaceSegment rewrites segment to hold only records, deleting it when
+// none are left.
+func (d *Driver) replaceSegment(segment ArchiveSegment, records map[string]json.RawMessage) error {
+	if len(records) == 0 {
+		if err := d.System().Delete(archivesCollection, segmentRecord(segment.Name)); err != nil {
+			return err
+		}
+		return d.archiveStore().Delete(segment.Name)
+	}
+
+	segment.Resources = segment.Resources[:0]
+	for name := range records {
+		segment.Resources = append(segment.Resources, name)
+	}
+	sort.Strings(segment.Resources)
+
+	return d.putSegment(segment, records)
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,377 @@
+package jsondb
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Attachments are files kept with a record, such as the photo of a user,
+// in a directory beside it: <collection>/<resource>.attachments holds the
+// content of each as <name>.blob and its Attachment as <name>.json. They
+// live in the database directory, so copies of it, such as the backups of
+// Upgrade, include them, and deleting the record deletes them.
+
+// attachmentsSuffix names the directory of the attachments of a record;
+// listings of collections skip it.
+const attachmentsSuffix = ".attachments"
+
+// ErrNoAttachment is returned for an attachment a record does not have.
+var ErrNoAttachment = fmt.Errorf("Attachment not found")
+
+// Attachment describes a file attached to a record.
+type Attachment struct {
+	Name        string
+	Size        int64
+	ContentType string
+
+	// SHA256 is the hex digest of the content, for clients to check it.
+	SHA256  string
+	Written time.Time
+
+	// Source is the attachment a derivative was made from; see
+	// AttachmentProcessor.
+	Source string `json:",omitempty"`
+
+	// Processing is ProcessingPending while the processors that accept
+	// the attachment have yet to run, then ProcessingDone or
+	// ProcessingFailed with ProcessError. Derivatives names the
+	// attachments they made from it.
+	Processing   string   `json:",omitempty"`
+	ProcessError string   `json:",omitempty"`
+	Derivatives  []string `json:",omitempty"`
+}
+
+// streamBackend is implemented by backends that read and write files as
+// streams, such as the local filesystem; attachments go through others
+// in memory.
+type streamBackend interface {
+	Open(path string) (io.ReadCloser, error)
+	WriteStream(path string, r io.Reader) (int64, error)
+}
+
+func validAttachment(collection, resource, name string) error {
+	if err := validName(collection, resource); err != nil {
+		return err
+	}
+	if resource == "" || name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return ErrInvalidName
+	}
+	return nil
+}
+
+func (d *Driver) attachmentsDir(collection, resource string) string {
+	return filepath.Join(d.dir, collection, resource+attachmentsSuffix)
+}
+
+// PutAttachment stores what r reads as the attachment name of the record
+// collection/resource, replacing any attachment of that name, and returns
+// its description. The content type is guessed from the extension of name,
+// or else from the content. The content is streamed to disk, not held in
+// memory, on the local filesystem. When a registered AttachmentProcessor
+// accepts it, the attachment is queued for processing, and the derivatives
+// of the attachment it replaces are deleted.
+func (d *Driver) PutAttachment(collection, resource, name string, r io.Reader) (_ Attachment, err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("PutAttachment", collection, resource)
+	defer span.end(&err)
+
+	if err := d.allow(PolicyWrite, collection); err != nil {
+		return Attachment{}, err
+	}
+
+	if err := validAttachment(collection, resource, name); err != nil {
+		return Attachment{}, err
+	}
+	if err := d.checkCollection(collection); err != nil {
+		return Attachment{}, err
+	}
+
+	// A read lock keeps the record from being deleted meanwhile without
+	// holding up its readers and writers for the length of an upload.
+	unlock, err := d.lockCollection(collection, LockRead)
+	if err != nil {
+		return Attachment{}, err
+	}
+	defer unlock()
+
+	if _, err := d.backend.Stat(filepath.Join(d.dir, collection, resource+".json")); err != nil {
+		return Attachment{}, err
+	}
+
+	if err := d.removeDerivatives(collection, resource, name); err != nil {
+		return Attachment{}, err
+	}
+
+	a, err := d.storeAttachment(collection, resource, Attachment{Name: name}, r)
+	if err != nil {
+		return Attachment{}, err
+	}
+	if d.processes(a) {
+		a.Processing = ProcessingPending
+		if err := d.writeAttachment(collection, resource, a); err != nil {
+			return Attachment{}, err
+		}
+		if err := d.queueProcessing(collection, resource, name); err != nil {
+			return Attachment{}, err
+		}
+	}
+	return a, nil
+}
+
+// storeAttachment writes what r reads as the attachment a.Name of the
+// record collection/resource, with a, completed, as its description; the
+// caller holds the collection lock.
+func (d *Driver) storeAttachment(collection, resource string, a Attachment, r io.Reader) (_ Attachment, err error) {
+	a.ContentType = mime.TypeByExtension(filepath.Ext(a.Name))
+	br := bufio.NewReader(r)
+	if a.ContentType == "" {
+		head, _ := br.Peek(512)
+		a.ContentType = http.DetectContentType(head)
+	}
+
+	hash := sha256.New()
+	path := filepath.Join(d.attachmentsDir(collection, resource), a.Name+".blob")
+	backend := rawBackend(d.backend)
+	content := io.TeeReader(br, hash)
+
+	if s, ok := backend.(streamBackend); ok {
+		a.Size, err = s.WriteStream(path, content)
+	} else {
+		var b []byte
+		if b, err = io.ReadAll(content); err == nil {
+			a.Size = int64(len(b))
+			err = backend.WriteFile(path, b)
+		}
+	}
+	if err != nil {
+		return Attachment{}, err
+	}
+	d.traceBytes(int(a.Size))
+
+	a.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	a.Written = time.Now().UTC()
+	if err := d.writeAttachment(collection, resource, a); err != nil {
+		return Attachment{}, err
+	}
+	return a, nil
+}
+
+func (d *Driver) writeAttachment(collection, resource string, a Attachment) error {
+	b, err := json.MarshalIndent(a, "", "\t")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(d.attachmentsDir(collection, resource), a.Name+".json")
+	return rawBackend(d.backend).WriteFile(path, append(b, '\n'))
+}
+
+// GetAttachment opens the attachment name of the record collection/resource
+// for reading, with its description; the caller closes it. It fails with
+// ErrNoAttachment when the record has no such attachment.
+func (d *Driver) GetAttachment(collection, resource, name string) (_ io.ReadCloser, _ Attachment, err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("GetAttachment", collection, resource)
+	defer span.end(&err)
+
+	if err := d.allow(PolicyRead, collection); err != nil {
+		return nil, Attachment{}, err
+	}
+
+	if err := validAttachment(collection, resource, name); err != nil {
+		return nil, Attachment{}, err
+	}
+
+	unlock, err := d.lockCollection(collection, LockRead)
+	if err != nil {
+		return nil, Attachment{}, err
+	}
+	defer unlock()
+
+	rc, a, err := d.openAttachment(collection, resource, name)
+	if err != nil {
+		return nil, Attachment{}, err
+	}
+	d.traceBytes(int(a.Size))
+	return rc, a, nil
+}
+
+// openAttachment is GetAttachment without the lock, which the caller
+// holds.
+func (d *Driver) openAttachment(collection, resource, name string) (io.ReadCloser, Attachment, error) {
+	a, err := d.readAttachment(collection, resource, name)
+	if err != nil {
+		return nil, Attachment{}, err
+	}
+
+	path := filepath.Join(d.attachmentsDir(collection, resource), name+".blob")
+	backend := rawBackend(d.backend)
+	var rc io.ReadCloser
+	if s, ok := backend.(streamBackend); ok {
+		rc, err = s.Open(path)
+	} else {
+		var b []byte
+		if b, err = backend.ReadFile(path); err == nil {
+			rc = io.NopCloser(bytes.NewReader(b))
+		}
+	}
+	if os.IsNotExist(err) {
+		return nil, Attachment{}, ErrNoAttachment
+	}
+	if err != nil {
+		return nil, Attachment{}, err
+	}
+	return rc, a, nil
+}
+
+func (d *Driver) readAttachment(collection, resource, name string) (Attachment, error) {
+	var a Attachment
+	b, err := rawBackend(d.backend).ReadFile(filepath.Join(d.attachmentsDir(collection, resource), name+".json"))
+	if os.IsNotExist(err) {
+		return a, ErrNoAttachment
+	}
+	if err != nil {
+		return a, err
+	}
+	return a, json.Unmarshal(b, &a)
+}
+
+// Attachments lists the attachments of the record collection/resource, by
+// name.
+func (d *Driver) Attachments(collection, resource string) (_ []Attachment, err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("Attachments", collection, resource)
+	defer span.end(&err)
+
+	if err := d.allow(PolicyRead, collection); err != nil {
+		return nil, err
+	}
+
+	if err := validName(collection, resource); err != nil {
+		return nil, err
+	}
+
+	unlock, err := d.lockCollection(collection, LockRead)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	files, err := d.backend.ReadDir(d.attachmentsDir(collection, resource))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Attachment
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name(), ".json")
+		if file.IsDir() || !ok {
+			continue
+		}
+		a, err := d.readAttachment(collection, resource, name)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// DeleteAttachment deletes the attachment name of the record
+// collection/resource, with its derivatives. It fails with ErrNoAttachment
+// when there is none.
+func (d *Driver) DeleteAttachment(collection, resource, name string) (err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("DeleteAttachment", collection, resource)
+	defer span.end(&err)
+
+	if err := d.allow(PolicyDelete, collection); err != nil {
+		return err
+	}
+
+	if err := validAttachment(collection, resource, name); err != nil {
+		return err
+	}
+	if err := d.checkCollection(collection); err != nil {
+		return err
+	}
+
+	unlock, err := d.lockCollection(collection, LockWrite)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := d.readAttachment(collection, resource, name); err != nil {
+		return err
+	}
+	if err := d.removeDerivatives(collection, resource, name); err != nil {
+		return err
+	}
+	if err := d.removeAttachment(collection, resource, name); err != nil {
+		return err
+	}
+
+	dir := d.attachmentsDir(collection, resource)
+	if files, err := d.backend.ReadDir(dir); err == nil && len(files) == 0 {
+		rawBackend(d.backend).RemoveAll(dir)
+	}
+	return nil
+}
+
+// removeAttachment deletes the files of the attachment name; the caller
+// holds the collection lock.
+func (d *Driver) removeAttachment(collection, resource, name string) error {
+	dir := d.attachmentsDir(collection, resource)
+	backend := rawBackend(d.backend)
+	if err := backend.Remove(filepath.Join(dir, name+".json")); err != nil {
+		return err
+	}
+	if err := backend.Remove(filepath.Join(dir, name+".blob")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// removeDerivatives deletes the derivatives of the attachment name, if it
+// has any; the caller holds the collection lock.
+func (d *Driver) removeDerivatives(collection, resource, name string) error {
+	a, err := d.readAttachment(collection, resource, name)
+	if err == ErrNoAttachment {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, derivative := range a.Derivatives {
+		if err := d.removeAttachment(collection, resource, derivative); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeAttachments deletes the attachments of a record being deleted;
+// the caller holds the collection lock.
+func (d *Driver) removeAttachments(collection, resource string) error {
+	err := rawBackend(d.backend).RemoveAll(d.attachmentsDir(collection, resource))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
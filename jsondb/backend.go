@@ -0,0 +1,183 @@
+package jsondb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Backend is the storage a Driver keeps its files in. Paths are OS paths
+// built with filepath.Join from the database directory; backends that are
+// not the local filesystem interpret them relative to their own root.
+type Backend interface {
+	ReadFile(path string) ([]byte, error)
+
+	// WriteFile atomically replaces the file at path with data, creating
+	// missing parent directories.
+	WriteFile(path string, data []byte) error
+
+	// ReadDir lists a directory sorted by name.
+	ReadDir(path string) ([]os.FileInfo, error)
+
+	Stat(path string) (os.FileInfo, error)
+	Remove(path string) error
+	RemoveAll(path string) error
+	MkdirAll(path string) error
+}
+
+// ErrReadOnly is returned when modifying a read-only database.
+var ErrReadOnly = fmt.Errorf("Database is read-only")
+
+// dirBackend stores records as files in the local filesystem.
+type dirBackend struct {
+	fault      FaultFunc
+	retry      RetryPolicy
+	durability Durability
+}
+
+func (b dirBackend) ReadFile(path string) (data []byte, err error) {
+	err = b.retry.do(func() error {
+		data, err = ioutil.ReadFile(path)
+		return err
+	})
+	return data, err
+}
+
+// WriteFile writes to a temporary file next to path, flushes it and renames
+// it over path, so readers (and a restart after a crash) see either the old
+// or the new content.
+func (b dirBackend) WriteFile(path string, data []byte) error {
+	if err := b.MkdirAll(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := b.retry.do(func() error { return b.writeTemp(tmpPath, path, data) }); err != nil {
+		return err
+	}
+
+	if b.crash(FaultAfterTempWrite, path) {
+		return ErrInjectedFault
+	}
+
+	if err := replaceFile(b.retry, tmpPath, path); err != nil {
+		return err
+	}
+
+	if b.crash(FaultMidRename, path) {
+		return ErrInjectedFault
+	}
+
+	if b.durability == DurabilityNone {
+		return nil
+	}
+	return b.retry.do(func() error { return syncDir(filepath.Dir(path)) })
+}
+
+// writeTemp writes and flushes the temporary file of a write to path.
+func (b dirBackend) writeTemp(tmpPath, path string, data []byte) error {
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if b.crash(FaultBeforeSync, path) {
+		f.Truncate(int64(len(data) / 2))
+		f.Close()
+		return ErrInjectedFault
+	}
+
+	if b.durability == DurabilityNone {
+		return f.Close()
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Open opens the file at path for reading as a stream.
+func (b dirBackend) Open(path string) (io.ReadCloser, error) {
+	var f *os.File
+	err := b.retry.do(func() (err error) {
+		f, err = os.Open(path)
+		return err
+	})
+	return f, err
+}
+
+// WriteStream is WriteFile for a stream: it copies r into a temporary
+// file, of its own so concurrent writes do not mix, and renames it over
+// path. A stream cannot be read twice, so only the rename is retried.
+func (b dirBackend) WriteStream(path string, r io.Reader) (int64, error) {
+	if err := b.MkdirAll(filepath.Dir(path)); err != nil {
+		return 0, err
+	}
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	tmpPath := path + "." + hex.EncodeToString(suffix) + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil && b.durability != DurabilityNone {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = replaceFile(b.retry, tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return n, err
+	}
+
+	if b.durability == DurabilityNone {
+		return n, nil
+	}
+	return n, b.retry.do(func() error { return syncDir(filepath.Dir(path)) })
+}
+
+func (b dirBackend) ReadDir(path string) (files []os.FileInfo, err error) {
+	err = b.retry.do(func() error {
+		files, err = ioutil.ReadDir(path)
+		return err
+	})
+	return files, err
+}
+
+func (b dirBackend) Stat(path string) (fi os.FileInfo, err error) {
+	err = b.retry.do(func() error {
+		fi, err = os.Stat(path)
+		return err
+	})
+	return fi, err
+}
+
+func (b dirBackend) Remove(path string) error {
+	return removeFile(b.retry, path)
+}
+
+func (b dirBackend) RemoveAll(path string) error {
+	return removeAll(b.retry, path)
+}
+
+func (b dirBackend) MkdirAll(path string) error {
+	return b.retry.do(func() error { return os.MkdirAll(path, 0755) })
+}
@@ -0,0 +1,262 @@
+package jsondb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Circuit breakers stand between the driver and what it reaches over the
+// network: the archive store, the replicator and the loaders of
+// read-through collections. Once a remote fails Failures times in a row,
+// its breaker opens and calls fail at once with ErrBreakerOpen instead of
+// piling up behind timeouts; after Cooldown one call goes through as a
+// probe, closing the breaker when it succeeds and opening it again when it
+// fails.
+
+// Breaker states.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// ErrBreakerOpen is returned for calls a circuit breaker turned away.
+var ErrBreakerOpen = fmt.Errorf("Remote is unavailable (circuit breaker open)")
+
+// BreakerConfig is when circuit breakers trip: after Failures calls failed
+// in a row (5 by default), for Cooldown (30s by default).
+type BreakerConfig struct {
+	Failures int
+	Cooldown time.Duration
+}
+
+func (c BreakerConfig) withDefaults() BreakerConfig {
+	if c.Failures <= 0 {
+		c.Failures = 5
+	}
+	if c.Cooldown <= 0 {
+		c.Cooldown = 30 * time.Second
+	}
+	return c
+}
+
+// BreakerObserver is told when breakers change state. An Instrumentation
+// implementing it, such as a metrics exporter, is told about the breakers
+// of its driver.
+type BreakerObserver interface {
+	OnBreakerChange(name, from, to string)
+}
+
+// BreakerStats describes a circuit breaker: its state, the failures in a
+// row that count toward tripping it, how often it tripped and how many
+// calls it turned away since the database was opened.
+type BreakerStats struct {
+	Name      string
+	State     string
+	Failures  int
+	Trips     int64
+	Rejected  int64
+	OpenedAt  time.Time
+	LastError string `json:",omitempty"`
+}
+
+// breaker is a circuit breaker.
+type breaker struct {
+	cfg      BreakerConfig
+	observer BreakerObserver
+
+	mutex   sync.Mutex
+	stats   BreakerStats
+	probing bool
+}
+
+// call runs fn unless the breaker is open, counting its error as a
+// failure of the remote unless it is that something was not found or the
+// error says the remote is available anyway; see availableError.
+func (b *breaker) call(fn func() error) error {
+	if !b.allow() {
+		return ErrBreakerOpen
+	}
+	err := fn()
+	b.record(err)
+	return err
+}
+
+// allow reports whether a call may go through, letting a single probe
+// through a breaker that cooled down.
+func (b *breaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.stats.State {
+	case BreakerOpen:
+		if time.Since(b.stats.OpenedAt) < b.cfg.Cooldown {
+			b.stats.Rejected++
+			return false
+		}
+		b.change(BreakerHalfOpen)
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			b.stats.Rejected++
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+func (b *breaker) record(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	probe := b.stats.State == BreakerHalfOpen
+	b.probing = false
+	if err == nil || os.IsNotExist(err) || available(err) {
+		b.stats.Failures = 0
+		if probe {
+			b.change(BreakerClosed)
+		}
+		return
+	}
+
+	b.stats.Failures++
+	b.stats.LastError = err.Error()
+	if probe || b.stats.Failures >= b.cfg.Failures {
+		b.stats.Trips++
+		b.stats.OpenedAt = time.Now().UTC()
+		b.change(BreakerOpen)
+	}
+}
+
+// availableError is implemented by errors of remotes that are up but
+// turned a call down, such as a Raft follower leaving writes to its
+// leader; they do not trip breakers.
+type availableError interface {
+	Available() bool
+}
+
+func available(err error) bool {
+	e, ok := err.(availableError)
+	return ok && e.Available()
+}
+
+// change moves the breaker to state; the caller holds the mutex.
+func (b *breaker) change(state string) {
+	from := b.stats.State
+	if from == state {
+		return
+	}
+	b.stats.State = state
+	if b.observer != nil {
+		b.observer.OnBreakerChange(b.stats.Name, from, state)
+	}
+}
+
+// breakerState holds the breakers of a driver, by name, shared by its
+// copies.
+type breakerState struct {
+	cfg      BreakerConfig
+	observer BreakerObserver
+
+	mutex    sync.Mutex
+	breakers map[string]*breaker
+}
+
+func newBreakerState(cfg BreakerConfig, instr Instrumentation) *breakerState {
+	observer, _ := instr.(BreakerObserver)
+	return &breakerState{cfg: cfg.withDefaults(), observer: observer, breakers: make(map[string]*breaker)}
+}
+
+// get returns the breaker name, creating it closed.
+func (st *breakerState) get(name string) *breaker {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	b, ok := st.breakers[name]
+	if !ok {
+		b = &breaker{cfg: st.cfg, observer: st.observer, stats: BreakerStats{Name: name, State: BreakerClosed}}
+		st.breakers[name] = b
+	}
+	return b
+}
+
+// Breakers describes the circuit breakers of the remotes of the database,
+// by name.
+func (d *Driver) Breakers() []BreakerStats {
+	st := d.breakers
+	if st == nil {
+		return []BreakerStats{}
+	}
+
+	st.mutex.Lock()
+	all := make([]*breaker, 0, len(st.breakers))
+	for _, b := range st.breakers {
+		all = append(all, b)
+	}
+	st.mutex.Unlock()
+
+	stats := make([]BreakerStats, len(all))
+	for i, b := range all {
+		b.mutex.Lock()
+		stats[i] = b.stats
+		b.mutex.Unlock()
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+// brokenArchive is an ArchiveStore behind a breaker.
+type brokenArchive struct {
+	store ArchiveStore
+	b     *breaker
+}
+
+func (a brokenArchive) Put(name string, data []byte) error {
+	return a.b.call(func() error { return a.store.Put(name, data) })
+}
+
+func (a brokenArchive) Get(name string) (data []byte, err error) {
+	err = a.b.call(func() error {
+		data, err = a.store.Get(name)
+		return err
+	})
+	return data, err
+}
+
+func (a brokenArchive) Delete(name string) error {
+	return a.b.call(func() error { return a.store.Delete(name) })
+}
+
+// brokenReplicator is a Replicator behind a breaker.
+type brokenReplicator struct {
+	r Replicator
+	b *breaker
+}
+
+func (r brokenReplicator) Replicate(c Change) error {
+	return r.b.call(func() error { return r.r.Replicate(c) })
+}
+
+func (r brokenReplicator) IsLeader() bool {
+	return sweeps(r.r)
+}
+
+// brokenLoader is a Loader behind a breaker.
+type brokenLoader struct {
+	l Loader
+	b *breaker
+}
+
+func (l brokenLoader) Load(ctx context.Context, collection, resource string) (b []byte, err error) {
+	err = l.b.call(func() error {
+		b, err = l.l.Load(ctx, collection, resource)
+		return err
+	})
+	return b, err
+}
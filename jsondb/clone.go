@@ -0,0 +1,116 @@
+package jsondb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CloneTo copies collections, with the collections nested in them and
+// their manifests, or every collection when none are given, into a new
+// database at destDir, such as a test environment made from production
+// data. The records are copied as of one point in time, through a
+// snapshot, while writes go on. Aliases pointing at a copied collection
+// are copied too; attachments, versions and the rest of the system
+// namespace are not. The records are transformed as WithTransform has it.
+// destDir must not exist or be empty.
+func (d *Driver) CloneTo(destDir string, collections ...string) (err error) {
+	d, span := d.trace("CloneTo", "", destDir)
+	defer span.end(&err)
+
+	if files, err := os.ReadDir(destDir); err == nil && len(files) > 0 {
+		return fmt.Errorf("Cannot clone into '%s': the directory is not empty", destDir)
+	}
+
+	selected, err := d.selectCollections(collections)
+	if err != nil {
+		return err
+	}
+
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	clone, err := New(destDir, &Options{Logger: d.log})
+	if err != nil {
+		return err
+	}
+	defer clone.Close()
+
+	var n int
+	for _, collection := range selected {
+		if err := d.allow(PolicyRead, collection); err != nil {
+			return err
+		}
+		records, names, err := tx.snapshotRecords(collection)
+		if os.IsNotExist(err) {
+			continue // deleted meanwhile
+		}
+		if err != nil {
+			return err
+		}
+
+		manifest, err := d.backend.ReadFile(filepath.Join(d.dir, collection, manifestName+".json"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			if err := clone.backend.WriteFile(filepath.Join(clone.dir, collection, manifestName+".json"), manifest); err != nil {
+				return err
+			}
+		}
+
+		for _, resource := range names {
+			b, err := d.transform.applyBytes(collection, records[resource])
+			if err != nil {
+				return fmt.Errorf("Error transforming '%s/%s': %v", collection, resource, err)
+			}
+			if err := clone.backend.WriteFile(filepath.Join(clone.dir, collection, resource+".json"), b); err != nil {
+				return err
+			}
+			n++
+		}
+	}
+
+	for alias, target := range d.Aliases() {
+		if i := sort.SearchStrings(selected, target); i < len(selected) && selected[i] == target {
+			if err := clone.SetAlias(alias, target); err != nil {
+				return err
+			}
+		}
+	}
+
+	d.log.Info("Cloned %d records of %d collections into '%s'\n", n, len(selected), destDir)
+	return nil
+}
+
+// selectCollections returns, in name order, collections with the
+// collections nested in them, or every collection when none are given.
+func (d *Driver) selectCollections(collections []string) ([]string, error) {
+	all, err := d.Collections()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	selected := all
+	if len(collections) > 0 {
+		selected = nil
+		for _, name := range all {
+			for _, c := range collections {
+				c = d.resolve(c)
+				if err := validName(c, ""); err != nil {
+					return nil, err
+				}
+				if name == c || strings.HasPrefix(name, c+"/") {
+					selected = append(selected, name)
+					break
+				}
+			}
+		}
+	}
+	sort.Strings(selected)
+	return selected, nil
+}
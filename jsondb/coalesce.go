@@ -0,0 +1,102 @@
+package jsondb
+
+import (
+	"bytes"
+	"sync"
+)
+
+// CoalesceStats reports how many reads of records shared the storage read
+// of another: concurrent reads of the same record wait for the one read
+// in flight instead of reading it again.
+type CoalesceStats struct {
+	// Reads are the reads of records from storage; Coalesced those that
+	// took the record read for another instead.
+	Reads     int64
+	Coalesced int64
+	InFlight  int
+
+	// Rate is Coalesced over Reads and Coalesced, 0 before the first read.
+	Rate float64
+}
+
+// readFlights holds the storage reads of records in flight, by record,
+// shared by the copies of a driver.
+type readFlights struct {
+	mutex   sync.Mutex
+	flights map[string]*readFlight
+	stats   CoalesceStats
+}
+
+type readFlight struct {
+	done chan struct{}
+	b    []byte
+	err  error
+}
+
+func newReadFlights() *readFlights {
+	return &readFlights{flights: make(map[string]*readFlight)}
+}
+
+// do returns what read returns for collection/resource, running it unless
+// a read of the record is in flight already, whose result it then shares.
+// The caller gets its own copy of the bytes.
+func (f *readFlights) do(collection, resource string, read func() ([]byte, error)) ([]byte, error) {
+	key := collection + "\x00" + resource
+
+	f.mutex.Lock()
+	if flight, ok := f.flights[key]; ok {
+		f.stats.Coalesced++
+		f.mutex.Unlock()
+		<-flight.done
+		return bytes.Clone(flight.b), flight.err
+	}
+	flight := &readFlight{done: make(chan struct{})}
+	f.flights[key] = flight
+	f.stats.Reads++
+	f.mutex.Unlock()
+
+	flight.b, flight.err = read()
+	close(flight.done)
+
+	f.mutex.Lock()
+	if f.flights[key] == flight {
+		delete(f.flights, key)
+	}
+	f.mutex.Unlock()
+	return bytes.Clone(flight.b), flight.err
+}
+
+// forget lets reads of collection/resource, or of every record of
+// collection when resource is empty, starting from now on read it again,
+// as it changed, instead of sharing a read in flight.
+func (f *readFlights) forget(collection, resource string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if resource != "" {
+		delete(f.flights, collection+"\x00"+resource)
+		return
+	}
+	for key := range f.flights {
+		if len(key) > len(collection) && key[:len(collection)+1] == collection+"\x00" {
+			delete(f.flights, key)
+		}
+	}
+}
+
+// CoalesceStats returns the statistics of the coalescing of record reads.
+func (d *Driver) CoalesceStats() CoalesceStats {
+	f := d.flights
+	if f == nil {
+		return CoalesceStats{}
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	stats := f.stats
+	stats.InFlight = len(f.flights)
+	if total := stats.Reads + stats.Coalesced; total > 0 {
+		stats.Rate = float64(stats.Coalesced) / float64(total)
+	}
+	return stats
+}
@@ -0,0 +1,225 @@
+package jsondb
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Codec converts records to and from a wire format.
+type Codec interface {
+	Name() string
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(b []byte, v interface{}) error
+}
+
+var codecs = map[string]Codec{}
+
+// RegisterCodec makes a codec available for content negotiation. Only JSON
+// is built in; importing database/jsondb/codecs adds YAML, MessagePack, BSON
+// and CBOR.
+func RegisterCodec(c Codec) {
+	codecs[c.Name()] = c
+}
+
+// Codecs returns every registered codec, ordered by name.
+func Codecs() []Codec {
+	list := make([]Codec, 0, len(codecs))
+	for _, c := range codecs {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list
+}
+
+// contentTypeAliases maps MIME types in common use that are not
+// registered to the registered ones.
+var contentTypeAliases = map[string]string{
+	"application/x-yaml":    "application/yaml",
+	"text/yaml":             "application/yaml",
+	"text/x-yaml":           "application/yaml",
+	"application/x-msgpack": "application/msgpack",
+}
+
+// CodecFor returns the codec registered under name, or matching a MIME type.
+func CodecFor(name string) (Codec, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if i := strings.Index(name, ";"); i >= 0 {
+		name = strings.TrimSpace(name[:i])
+	}
+	if alias, ok := contentTypeAliases[name]; ok {
+		name = alias
+	}
+
+	if c, ok := codecs[name]; ok {
+		return c, true
+	}
+
+	for _, c := range codecs {
+		if c.ContentType() == name {
+			return c, true
+		}
+	}
+
+	return nil, false
+}
+
+func init() {
+	RegisterCodec(jsonCodec{})
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string        { return "json" }
+func (jsonCodec) ContentType() string { return "application/json" }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(b []byte, v interface{}) error {
+	return json.Unmarshal(b, v)
+}
+
+// ToGeneric turns v into maps, slices and scalars using its JSON encoding.
+func ToGeneric(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	return numbers(generic), nil
+}
+
+// FromGeneric decodes a generic value into v using its JSON encoding.
+func FromGeneric(generic interface{}, v interface{}) error {
+	b, err := json.Marshal(stringKeys(generic))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// numbers replaces json.Number values with int64 or float64 so binary and
+// text formats emit real numbers instead of strings.
+func numbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = numbers(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = numbers(e)
+		}
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		if f, err := t.Float64(); err == nil {
+			return f
+		}
+		return t.String()
+	}
+	return v
+}
+
+// stringKeys converts map[interface{}]interface{} values, as produced by some
+// decoders, into JSON-compatible maps.
+func stringKeys(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[fmt.Sprint(k)] = stringKeys(e)
+		}
+		return m
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = stringKeys(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = stringKeys(e)
+		}
+	}
+	return v
+}
+
+// WriteCSV writes records as CSV, one row per record. Nested objects are
+// flattened into dotted column names (Address.City) and the header is the
+// sorted union of every record's columns.
+func WriteCSV(w io.Writer, records []interface{}) error {
+	rows := make([]map[string]string, 0, len(records))
+	seen := map[string]bool{}
+	var columns []string
+
+	for _, record := range records {
+		generic, err := ToGeneric(record)
+		if err != nil {
+			return err
+		}
+
+		row := map[string]string{}
+		flatten("", generic, row)
+		for col := range row {
+			if !seen[col] {
+				seen[col] = true
+				columns = append(columns, col)
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	sort.Strings(columns)
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		line := make([]string, len(columns))
+		for i, col := range columns {
+			line[i] = row[col]
+		}
+		if err := cw.Write(line); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func flatten(prefix string, v interface{}, out map[string]string) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			key := k
+			if prefix != "" {
+				key = prefix + "." + k
+			}
+			flatten(key, e, out)
+		}
+	case []interface{}:
+		b, _ := json.Marshal(t)
+		out[prefix] = string(b)
+	case nil:
+		out[prefix] = ""
+	default:
+		out[prefix] = fmt.Sprint(t)
+	}
+}
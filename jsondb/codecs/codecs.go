@@ -0,0 +1,140 @@
+// Package codecs registers the YAML, MessagePack, BSON and CBOR codecs
+// with jsondb. It is kept apart so programs embedding the database only
+// depend on their libraries when they import it:
+//
+//	import _ "database/jsondb/codecs"
+package codecs
+
+import (
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"gopkg.in/yaml.v3"
+
+	"database/jsondb"
+)
+
+func init() {
+	jsondb.RegisterCodec(yamlCodec{})
+	jsondb.RegisterCodec(msgpackCodec{})
+	jsondb.RegisterCodec(bsonCodec{})
+	jsondb.RegisterCodec(cborCodec{})
+}
+
+// The codecs go through the JSON representation of a
+// value so field names, tags and json.Number behave the same in every format.
+
+type yamlCodec struct{}
+
+func (yamlCodec) Name() string        { return "yaml" }
+func (yamlCodec) ContentType() string { return "application/yaml" }
+
+func (yamlCodec) Marshal(v interface{}) ([]byte, error) {
+	generic, err := jsondb.ToGeneric(v)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(generic)
+}
+
+func (yamlCodec) Unmarshal(b []byte, v interface{}) error {
+	var generic interface{}
+	if err := yaml.Unmarshal(b, &generic); err != nil {
+		return err
+	}
+	return jsondb.FromGeneric(generic, v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string        { return "msgpack" }
+func (msgpackCodec) ContentType() string { return "application/msgpack" }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	generic, err := jsondb.ToGeneric(v)
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(generic)
+}
+
+func (msgpackCodec) Unmarshal(b []byte, v interface{}) error {
+	var generic interface{}
+	if err := msgpack.Unmarshal(b, &generic); err != nil {
+		return err
+	}
+	return jsondb.FromGeneric(generic, v)
+}
+
+// bsonCodec encodes objects as BSON documents. BSON has no top-level
+// arrays, so other values, such as listings, are sent as the document
+// {"Items": value}, and such a document is unwrapped on decoding; an object
+// of that one key is wrapped as well, so it survives the round trip. Values
+// without a JSON counterpart are decoded to their JSON form: ObjectIDs as
+// hex strings, dates as RFC 3339 strings.
+type bsonCodec struct{}
+
+// bsonWrapper is the key of the document wrapping values that are not
+// objects.
+const bsonWrapper = "Items"
+
+func (bsonCodec) Name() string        { return "bson" }
+func (bsonCodec) ContentType() string { return "application/bson" }
+
+func (bsonCodec) Marshal(v interface{}) ([]byte, error) {
+	generic, err := jsondb.ToGeneric(v)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := generic.(map[string]interface{}); !ok || isBSONWrapper(m) {
+		generic = map[string]interface{}{bsonWrapper: generic}
+	}
+	return bson.Marshal(generic)
+}
+
+func (bsonCodec) Unmarshal(b []byte, v interface{}) error {
+	dec, err := bson.NewDecoder(bsonrw.NewBSONDocumentReader(b))
+	if err != nil {
+		return err
+	}
+	dec.DefaultDocumentM()
+
+	var doc bson.M
+	if err := dec.Decode(&doc); err != nil {
+		return err
+	}
+
+	var generic interface{} = doc
+	if isBSONWrapper(map[string]interface{}(doc)) {
+		generic = doc[bsonWrapper]
+	}
+	return jsondb.FromGeneric(generic, v)
+}
+
+// isBSONWrapper reports whether doc has the shape of a wrapped value.
+func isBSONWrapper(doc map[string]interface{}) bool {
+	_, ok := doc[bsonWrapper]
+	return ok && len(doc) == 1
+}
+
+type cborCodec struct{}
+
+func (cborCodec) Name() string        { return "cbor" }
+func (cborCodec) ContentType() string { return "application/cbor" }
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	generic, err := jsondb.ToGeneric(v)
+	if err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(generic)
+}
+
+func (cborCodec) Unmarshal(b []byte, v interface{}) error {
+	var generic interface{}
+	if err := cbor.Unmarshal(b, &generic); err != nil {
+		return err
+	}
+	return jsondb.FromGeneric(generic, v)
+}
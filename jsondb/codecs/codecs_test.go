@@ -0,0 +1,66 @@
+package codecs
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"database/jsondb"
+)
+
+func TestRoundTrip(t *testing.T) {
+	values := []string{
+		`{"Name":"Ann","Age":30,"Tags":["a","b"]}`,
+		`{"Items":[1,2]}`,
+		`{"Items":1,"Other":2}`,
+		`[1,2]`,
+		`[]`,
+		`1.5`,
+		`"s"`,
+		`true`,
+		`null`,
+	}
+
+	for _, codec := range jsondb.Codecs() {
+		for _, value := range values {
+			want, err := jsondb.DecodeValue([]byte(value))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := codec.Marshal(want)
+			if err != nil {
+				t.Errorf("%s: marshal %s: %v", codec.Name(), value, err)
+				continue
+			}
+			var got interface{}
+			if err := codec.Unmarshal(b, &got); err != nil {
+				t.Errorf("%s: unmarshal %s: %v", codec.Name(), value, err)
+				continue
+			}
+
+			j, _ := json.Marshal(got)
+			var decoded, original interface{}
+			json.Unmarshal(j, &decoded)
+			json.Unmarshal([]byte(value), &original)
+			if !reflect.DeepEqual(decoded, original) {
+				t.Errorf("%s: round trip of %s gave %s", codec.Name(), value, j)
+			}
+		}
+	}
+}
+
+func TestContentTypeAliases(t *testing.T) {
+	for contentType, name := range map[string]string{
+		"application/yaml":         "yaml",
+		"application/x-yaml":       "yaml",
+		"text/yaml; charset=utf-8": "yaml",
+		"application/x-msgpack":    "msgpack",
+		"application/json":         "json",
+	} {
+		codec, ok := jsondb.CodecFor(contentType)
+		if !ok || codec.Name() != name {
+			t.Errorf("CodecFor(%q) = %v, %v; want %s", contentType, codec, ok, name)
+		}
+	}
+}
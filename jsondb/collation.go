@@ -0,0 +1,109 @@
+package jsondb
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Collation says how conditions compare strings. It is a comma-separated
+// list of options: "nocase" ignores case, "noaccent" ignores accents and a
+// BCP 47 language tag, such as "de" or "sv", orders strings the way that
+// language does. "nocase,noaccent" makes "Bengaluru" equal "BENGALÚRU".
+// Strings are Unicode-normalized under any collation; the empty collation
+// compares bytes.
+type Collation string
+
+// Collation options.
+const (
+	CollationNoCase   = "nocase"
+	CollationNoAccent = "noaccent"
+)
+
+// collator compares strings under a parsed Collation.
+type collator struct {
+	fold, strip bool
+	locale      *collate.Collator
+	mutex       sync.Mutex // collate.Collator is not safe for concurrent use
+}
+
+// collators caches parsed collations.
+var collators sync.Map
+
+// Validate checks every option of c is known.
+func (c Collation) Validate() error {
+	_, err := c.collator()
+	return err
+}
+
+func (c Collation) collator() (*collator, error) {
+	if cl, ok := collators.Load(c); ok {
+		return cl.(*collator), nil
+	}
+
+	cl := &collator{}
+	var tag *language.Tag
+	for _, opt := range strings.Split(string(c), ",") {
+		switch opt = strings.TrimSpace(opt); opt {
+		case "":
+		case CollationNoCase:
+			cl.fold = true
+		case CollationNoAccent:
+			cl.strip = true
+		default:
+			t, err := language.Parse(opt)
+			if err != nil || tag != nil {
+				return nil, fmt.Errorf("Invalid collation '%s'", c)
+			}
+			tag = &t
+		}
+	}
+
+	if tag != nil {
+		var opts []collate.Option
+		if cl.fold {
+			opts = append(opts, collate.IgnoreCase)
+		}
+		if cl.strip {
+			opts = append(opts, collate.IgnoreDiacritics)
+		}
+		cl.locale = collate.New(*tag, opts...)
+	}
+
+	collators.Store(c, cl)
+	return cl, nil
+}
+
+// key is the form of s compared without a locale: normalized, then with
+// accents stripped and case folded as c asks.
+func (cl *collator) key(s string) string {
+	if cl.strip {
+		t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+		if out, _, err := transform.String(t, s); err == nil {
+			s = out
+		}
+	} else {
+		s = norm.NFC.String(s)
+	}
+	if cl.fold {
+		s = cases.Fold().String(s)
+	}
+	return s
+}
+
+func (cl *collator) compare(a, b string) int {
+	if cl.locale != nil {
+		cl.mutex.Lock()
+		defer cl.mutex.Unlock()
+		return cl.locale.CompareString(a, b)
+	}
+	return strings.Compare(cl.key(a), cl.key(b))
+}
@@ -0,0 +1,59 @@
+package jsondb
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// ComputedField derives a field of every record written to a collection
+// from the rest of it, so the derived value stays consistent whichever
+// client writes. Template is a text/template executed on the record, such
+// as "{{.First}} {{.Last}}" or "{{lower .Email}}"; the output is stored as
+// a string at the dotted path Field. Besides the builtins it can call
+// lower, upper and trim, get, which returns the value at a dotted path or
+// "" when the record has none, and the other functions of validators: a
+// field the template names directly and the record lacks rejects the
+// write.
+type ComputedField struct {
+	Field    string
+	Template string
+}
+
+// compute sets the computed fields of c in doc, in order, so a template
+// can use the fields computed before it.
+func (c *CollectionConfig) compute(resource string, doc map[string]interface{}) error {
+	for _, f := range c.Computed {
+		t, err := parseScript(f.Template)
+		if err != nil {
+			return err
+		}
+
+		var out bytes.Buffer
+		if err := t.Execute(&out, doc); err != nil {
+			return &ConstraintError{resource, fmt.Sprintf("computed field '%s' failed: %v", f.Field, err)}
+		}
+		if !setPath(doc, f.Field, out.String()) {
+			return &ConstraintError{resource, fmt.Sprintf("computed field '%s' crosses a value that is not an object", f.Field)}
+		}
+	}
+	return nil
+}
+
+// setPath stores v at a dotted path inside doc, creating the objects on
+// the way. It fails if the path crosses a value that is not an object.
+func setPath(doc map[string]interface{}, path string, v interface{}) bool {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := doc[part]
+		if !ok || next == nil {
+			next = map[string]interface{}{}
+			doc[part] = next
+		}
+		if doc, ok = next.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	doc[parts[len(parts)-1]] = v
+	return true
+}
@@ -0,0 +1,157 @@
+package jsondb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// CorruptPolicy says what listings do with records that cannot be read or
+// are not valid JSON.
+type CorruptPolicy string
+
+const (
+	// CorruptFail fails the whole listing, the default.
+	CorruptFail CorruptPolicy = ""
+
+	// CorruptSkip leaves the record out of the listing and reports it in
+	// the log and in Corrupted.
+	CorruptSkip CorruptPolicy = "skip"
+
+	// CorruptQuarantine moves the record into the .corrupt directory of the
+	// database, out of its collection, and reports it like CorruptSkip.
+	CorruptQuarantine CorruptPolicy = "quarantine"
+)
+
+func (p CorruptPolicy) validate() error {
+	switch p {
+	case CorruptFail, CorruptSkip, CorruptQuarantine:
+		return nil
+	}
+	return fmt.Errorf("Unknown corrupt record policy '%s'", p)
+}
+
+// quarantineDir holds quarantined records, by collection, in the database
+// directory.
+const quarantineDir = ".corrupt"
+
+// corruptCollection is the system collection of the incidents of every
+// collection, under "corrupt/<collection>".
+const corruptCollection = "corrupt"
+
+// Corruption is the incident of a record found corrupt by a listing.
+type Corruption struct {
+	Resource string
+	Error    string
+	Time     time.Time
+
+	// Quarantined is the file the record was moved to, empty when it was
+	// skipped and left in place.
+	Quarantined string `json:",omitempty"`
+}
+
+// checkRecord applies the corrupt record policy to the record resource of
+// collection, read from path as b or failing with err. It returns whether
+// the record is sound, and the error failing the listing under CorruptFail.
+func (d *Driver) checkRecord(collection, resource, path string, b []byte, err error) (bool, error) {
+	if err == nil && !json.Valid(b) {
+		err = fmt.Errorf("Record '%s' of '%s' is not valid JSON", resource, collection)
+	}
+	if err == nil || os.IsNotExist(err) {
+		return err == nil, nil
+	}
+	if d.corrupt == CorruptFail {
+		return false, err
+	}
+
+	incident := Corruption{Resource: resource, Error: err.Error(), Time: time.Now().UTC()}
+	action := "skipped"
+	if d.corrupt == CorruptQuarantine {
+		moved, qerr := d.quarantine(collection, resource, path, incident.Time)
+		if qerr != nil {
+			d.log.Error("Unable to quarantine '%s' of '%s': %v\n", resource, collection, qerr)
+		}
+		if moved != "" {
+			incident.Quarantined, action = moved, "quarantined"
+		}
+	}
+
+	d.log.Error("Corrupt record '%s' of '%s' %s: %v\n", resource, collection, action, err)
+	if err := d.System().Write(corruptCollection+"/"+collection, resource, incident); err != nil {
+		d.log.Error("Unable to record the corruption of '%s' of '%s': %v\n", resource, collection, err)
+	}
+	return false, nil
+}
+
+// quarantine moves the record file at path into the quarantine directory,
+// returning its new path relative to the database directory. A record
+// already moved by a concurrent listing is not an error.
+func (d *Driver) quarantine(collection, resource, path string, now time.Time) (string, error) {
+	raw := rawBackend(d.backend)
+	b, err := raw.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	rel := filepath.Join(quarantineDir, collection, resource+"."+now.Format("20060102T150405.000")+".json")
+	if err := raw.WriteFile(filepath.Join(d.dir, rel), b); err != nil {
+		return "", err
+	}
+	if err := d.backend.Remove(path); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	d.publish(OpDelete, collection, resource, nil)
+	d.updateViews(collection, resource, nil)
+	d.updateGeo(collection, resource, nil)
+	return filepath.ToSlash(rel), nil
+}
+
+// Corrupted lists the corrupt records listings of collection reported,
+// oldest first. Skipped records that were rewritten or deleted since are
+// dropped from the list.
+func (d *Driver) Corrupted(collection string) (_ []Corruption, err error) {
+	d, span := d.trace("Corrupted", collection, "")
+	defer span.end(&err)
+
+	if err := validName(collection, ""); err != nil {
+		return nil, err
+	}
+
+	sys := d.System()
+	docs, err := sys.Query(corruptCollection+"/"+collection, Query{})
+	if os.IsNotExist(err) {
+		return []Corruption{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	incidents := []Corruption{}
+	for _, doc := range docs {
+		var incident Corruption
+		if err := FromGeneric(doc.Data, &incident); err != nil {
+			return nil, err
+		}
+
+		if incident.Quarantined == "" {
+			b, err := d.backend.ReadFile(filepath.Join(d.dir, collection, doc.Resource+".json"))
+			if os.IsNotExist(err) || (err == nil && json.Valid(b)) {
+				if err := sys.Delete(corruptCollection+"/"+collection, doc.Resource); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+		incidents = append(incidents, incident)
+	}
+
+	sort.Slice(incidents, func(i, j int) bool { return incidents[i].Time.Before(incidents[j].Time) })
+	return incidents, nil
+}
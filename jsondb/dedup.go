@@ -0,0 +1,263 @@
+package jsondb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Content-addressed deduplication. Records of collections configured with
+// Dedup are stored once per distinct content, as a blob named after its
+// SHA-256 in the system namespace, and each record file becomes a pointer
+// naming the blob. Every blob keeps a count of the pointers to it and is
+// deleted with the last one.
+//
+// Counts are raised before a pointer is written and lowered after it is
+// replaced or removed, so a crash can leave a blob counted too high, and
+// kept, but never a pointer to a missing blob.
+
+// blobsDir holds the blobs, below the system namespace.
+const blobsDir = "blobs"
+
+// ErrBlobPointer is returned for a record, outside deduplicated
+// collections, that reads as a pointer to a blob: it would read, and on
+// deletion release, the blob of another record.
+var ErrBlobPointer = fmt.Errorf("Record has the form of a deduplication pointer")
+
+// blobPointer is the content of a deduplicated record file.
+type blobPointer struct {
+	Blob string `json:"$blob"`
+}
+
+// dedupBackend stores the records of deduplicated collections as pointers
+// to blobs, and resolves pointers on every read whatever the configuration,
+// so Dedup can be turned on and off at any time. It refuses to write a
+// pointer anywhere else, so every pointer it reads is one it wrote.
+type dedupBackend struct {
+	Backend
+
+	dir   string                 // the database directory
+	dedup func(path string) bool // whether the record at path is deduplicated
+	mutex *sync.Mutex            // guards the reference counts
+}
+
+func newDedupBackend(backend Backend, dir string, dedup func(path string) bool) dedupBackend {
+	return dedupBackend{Backend: backend, dir: dir, dedup: dedup, mutex: new(sync.Mutex)}
+}
+
+// rawBackend returns the backend under b's deduplication, which reads
+// pointer records as they are stored.
+func rawBackend(b Backend) Backend {
+	if d, ok := b.(dedupBackend); ok {
+		return d.Backend
+	}
+	return b
+}
+
+func (b dedupBackend) blobPath(hash string) string {
+	return filepath.Join(b.dir, systemDir, blobsDir, hash+".blob")
+}
+
+func (b dedupBackend) refsPath(hash string) string {
+	return filepath.Join(b.dir, systemDir, blobsDir, hash+".refs")
+}
+
+func (b dedupBackend) ReadFile(path string) ([]byte, error) {
+	data, err := b.Backend.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if hash, ok := pointerHash(data); ok {
+		return b.Backend.ReadFile(b.blobPath(hash))
+	}
+	return data, nil
+}
+
+func (b dedupBackend) WriteFile(path string, data []byte) error {
+	old := b.pointed(path)
+
+	if !b.dedup(path) {
+		if _, ok := pointerHash(data); ok && strings.HasSuffix(path, ".json") {
+			return ErrBlobPointer
+		}
+		if err := b.Backend.WriteFile(path, data); err != nil {
+			return err
+		}
+		return b.unref(old)
+	}
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	if hash == old {
+		return nil // same content, same pointer
+	}
+
+	if err := b.ref(hash, data); err != nil {
+		return err
+	}
+
+	pointer, err := json.Marshal(blobPointer{hash})
+	if err != nil {
+		return err
+	}
+	if err := b.Backend.WriteFile(path, append(pointer, '\n')); err != nil {
+		b.unref(hash)
+		return err
+	}
+	return b.unref(old)
+}
+
+func (b dedupBackend) Remove(path string) error {
+	old := b.pointed(path)
+	if err := b.Backend.Remove(path); err != nil {
+		return err
+	}
+	return b.unref(old)
+}
+
+func (b dedupBackend) RemoveAll(path string) error {
+	var hashes []string
+	b.walkPointers(path, func(hash string) { hashes = append(hashes, hash) })
+
+	if err := b.Backend.RemoveAll(path); err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		if err := b.unref(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkPointers calls fn with the blob of every pointer below dir.
+func (b dedupBackend) walkPointers(dir string, fn func(hash string)) {
+	files, err := b.Backend.ReadDir(dir)
+	if err != nil {
+		if hash := b.pointed(dir); hash != "" {
+			fn(hash)
+		}
+		return
+	}
+
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+		if file.IsDir() {
+			b.walkPointers(path, fn)
+		} else if hash := b.pointed(path); hash != "" {
+			fn(hash)
+		}
+	}
+}
+
+// pointed returns the blob the record at path points to, if any.
+func (b dedupBackend) pointed(path string) string {
+	if !strings.HasSuffix(path, ".json") {
+		return ""
+	}
+	fi, err := b.Backend.Stat(path)
+	if err != nil || fi.IsDir() || fi.Size() > maxPointerSize {
+		return ""
+	}
+
+	data, err := b.Backend.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	hash, _ := pointerHash(data)
+	return hash
+}
+
+// maxPointerSize bounds the files worth checking for a pointer.
+const maxPointerSize = 128
+
+// pointerHash returns the blob named by data if it is a pointer.
+func pointerHash(data []byte) (string, bool) {
+	if len(data) > maxPointerSize || !bytes.HasPrefix(data, []byte(`{"$blob":`)) {
+		return "", false
+	}
+
+	var p blobPointer
+	if json.Unmarshal(data, &p) != nil || len(p.Blob) != sha256.Size*2 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(p.Blob); err != nil {
+		return "", false
+	}
+	return p.Blob, true
+}
+
+// ref counts one more pointer to the blob hash, storing data as the blob
+// if it does not exist yet.
+func (b dedupBackend) ref(hash string, data []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	refs := b.refs(hash)
+	if refs == 0 {
+		if err := b.Backend.WriteFile(b.blobPath(hash), data); err != nil {
+			return err
+		}
+	}
+	return b.Backend.WriteFile(b.refsPath(hash), []byte(strconv.Itoa(refs+1)))
+}
+
+// unref counts one pointer less to the blob hash, deleting it with the
+// last one. An empty hash is ignored.
+func (b dedupBackend) unref(hash string) error {
+	if hash == "" {
+		return nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	refs := b.refs(hash) - 1
+	if refs > 0 {
+		return b.Backend.WriteFile(b.refsPath(hash), []byte(strconv.Itoa(refs)))
+	}
+
+	if err := b.Backend.Remove(b.blobPath(hash)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := b.Backend.Remove(b.refsPath(hash)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// refs returns the pointer count of the blob hash; 0 if it does not exist.
+// The caller holds the mutex.
+func (b dedupBackend) refs(hash string) int {
+	data, err := b.Backend.ReadFile(b.refsPath(hash))
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return n
+}
+
+// deduplicated reports whether the record at path belongs to a collection
+// configured with Dedup. Manifests and the system namespace never are.
+func (d *Driver) deduplicated(path string) bool {
+	if !strings.HasSuffix(path, ".json") || filepath.Base(path) == manifestName+".json" {
+		return false
+	}
+
+	rel, err := filepath.Rel(d.dir, filepath.Dir(path))
+	if err != nil || IsReserved(rel) {
+		return false
+	}
+
+	cfg := d.collectionConfig(filepath.ToSlash(rel))
+	return cfg != nil && cfg.Dedup
+}
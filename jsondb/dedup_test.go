@@ -0,0 +1,80 @@
+package jsondb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// forgeDedup stores a record in the deduplicated collection "docs" and
+// returns the hash of its blob.
+func forgeDedup(t *testing.T, db *Driver, dir string) string {
+	t.Helper()
+	if err := db.ConfigureCollection("docs", CollectionConfig{Dedup: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.WriteRaw("docs", "secret", []byte(`{"Secret":"s3cr3t"}`)); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "docs", "secret.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, ok := pointerHash(b)
+	if !ok {
+		t.Fatalf("docs/secret is stored as %s, not as a pointer", b)
+	}
+	return hash
+}
+
+func TestDedupForgedPointerRead(t *testing.T) {
+	db, dir := openTest(t, nil)
+	hash := forgeDedup(t, db, dir)
+
+	forged := []byte(`{"$blob":"` + hash + `"}`)
+	if err := db.WriteRaw("other", "forged", forged); !errors.Is(err, ErrBlobPointer) {
+		t.Errorf("WriteRaw of a pointer = %v, want ErrBlobPointer", err)
+	}
+	if b, err := db.ReadRaw("other", "forged"); err == nil {
+		t.Errorf("forged record reads %s", b)
+	}
+}
+
+func TestDedupForgedPointerDelete(t *testing.T) {
+	db, dir := openTest(t, nil)
+	hash := forgeDedup(t, db, dir)
+
+	forged := []byte(`{"$blob":"` + hash + `"}`)
+	for i := 0; i < 2; i++ {
+		db.WriteRaw("other", "forged", forged)
+		db.Delete("other", "forged")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, systemDir, blobsDir, hash+".blob")); err != nil {
+		t.Errorf("blob of docs/secret: %v", err)
+	}
+	var doc map[string]interface{}
+	if err := db.Read("docs", "secret", &doc); err != nil || doc["Secret"] != "s3cr3t" {
+		t.Errorf("docs/secret = %v, %v", doc, err)
+	}
+}
+
+func TestDedupSharesBlobs(t *testing.T) {
+	db, dir := openTest(t, nil)
+	hash := forgeDedup(t, db, dir)
+	if err := db.WriteRaw("docs", "copy", []byte(`{"Secret":"s3cr3t"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("docs", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc map[string]interface{}
+	if err := db.Read("docs", "copy", &doc); err != nil || doc["Secret"] != "s3cr3t" {
+		t.Errorf("docs/copy = %v, %v", doc, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, systemDir, blobsDir, hash+".blob")); err != nil {
+		t.Errorf("blob shared with docs/copy: %v", err)
+	}
+}
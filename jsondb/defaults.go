@@ -0,0 +1,138 @@
+package jsondb
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultNow, as the default of a field, stands for the time of the write.
+const DefaultNow = "$now"
+
+// Coercions of CollectionConfig.Coerce: the type a field is converted to
+// when a write sends it as another.
+const (
+	// CoerceNumber turns strings holding numbers, such as "32", into
+	// numbers.
+	CoerceNumber = "number"
+
+	// CoerceString turns numbers and booleans into strings.
+	CoerceString = "string"
+
+	// CoerceBool turns strings such as "true" or "0" into booleans.
+	CoerceBool = "bool"
+
+	// CoerceTime turns dates, date-times and Unix seconds into RFC 3339
+	// times in UTC, the way time.Time values are stored.
+	CoerceTime = "time"
+)
+
+// shapes reports whether c changes records on write.
+func (c *CollectionConfig) shapes() bool {
+	return c.Naming != "" || len(c.Defaults) > 0 || len(c.Coerce) > 0 || len(c.Computed) > 0
+}
+
+// shape applies the naming, defaults, coercions and computed fields of c
+// to the encoded record b, in that order, and encodes it again.
+func (c *CollectionConfig) shape(resource string, b []byte) ([]byte, error) {
+	doc, err := decodeDocument(b)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+	if c.Naming != "" {
+		doc = nameFields(c.Naming, doc).(map[string]interface{})
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	for field, value := range c.Defaults {
+		if v, ok := lookup(doc, field); ok && v != nil && v != "" {
+			continue
+		}
+		if value == DefaultNow {
+			value = now
+		}
+		if !setPath(doc, field, value) {
+			return nil, &ConstraintError{resource, fmt.Sprintf("default of '%s' crosses a value that is not an object", field)}
+		}
+	}
+
+	for field, kind := range c.Coerce {
+		v, ok := lookup(doc, field)
+		if !ok || v == nil {
+			continue
+		}
+		coerced, err := coerce(v, kind)
+		if err != nil {
+			return nil, &ConstraintError{resource, fmt.Sprintf("field '%s' %v", field, err)}
+		}
+		setPath(doc, field, coerced)
+	}
+
+	if err := c.compute(resource, doc); err != nil {
+		return nil, err
+	}
+
+	b, err = json.MarshalIndent(doc, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// coerce converts v, a decoded JSON value, to kind.
+func coerce(v interface{}, kind string) (interface{}, error) {
+	switch kind {
+	case CoerceNumber:
+		switch t := v.(type) {
+		case json.Number, float64:
+			return v, nil
+		case string:
+			n := json.Number(strings.TrimSpace(t))
+			if _, err := n.Float64(); err == nil {
+				return n, nil
+			}
+		}
+
+	case CoerceString:
+		switch t := v.(type) {
+		case string:
+			return v, nil
+		case json.Number, float64, bool:
+			return fmt.Sprint(t), nil
+		}
+
+	case CoerceBool:
+		switch t := v.(type) {
+		case bool:
+			return v, nil
+		case string:
+			if b, err := strconv.ParseBool(strings.TrimSpace(t)); err == nil {
+				return b, nil
+			}
+		case json.Number:
+			if b, err := strconv.ParseBool(t.String()); err == nil {
+				return b, nil
+			}
+		}
+
+	case CoerceTime:
+		switch t := v.(type) {
+		case string:
+			for _, layout := range []string{time.RFC3339Nano, time.DateTime, time.DateOnly} {
+				if tm, err := time.Parse(layout, strings.TrimSpace(t)); err == nil {
+					return tm.UTC().Format(time.RFC3339Nano), nil
+				}
+			}
+		case json.Number:
+			if secs, err := t.Int64(); err == nil {
+				return time.Unix(secs, 0).UTC().Format(time.RFC3339Nano), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("cannot be coerced to %s: %v", kind, v)
+}
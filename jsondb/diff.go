@@ -0,0 +1,123 @@
+package jsondb
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PatchOp is an operation of a JSON Patch (RFC 6902). Diff produces add,
+// remove and replace operations.
+type PatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// MarshalJSON leaves out the value of remove operations, which have none.
+func (op PatchOp) MarshalJSON() ([]byte, error) {
+	if op.Op == "remove" {
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{op.Op, op.Path})
+	}
+	type patchOp PatchOp
+	return json.Marshal(patchOp(op))
+}
+
+// JSONPatch is a list of operations turning one JSON document into
+// another, applied in order.
+type JSONPatch []PatchOp
+
+// DiffDocuments returns the JSON Patch turning a into b, which may be any
+// values encoding to JSON. Objects are compared key by key and arrays
+// index by index; an array growing or shrinking gains or loses elements at
+// its end. Equal documents give an empty patch.
+func DiffDocuments(a, b interface{}) (JSONPatch, error) {
+	ga, err := ToGeneric(a)
+	if err != nil {
+		return nil, err
+	}
+	gb, err := ToGeneric(b)
+	if err != nil {
+		return nil, err
+	}
+
+	patch := JSONPatch{}
+	diffValues(&patch, "", ga, gb)
+	return patch, nil
+}
+
+func diffValues(patch *JSONPatch, path string, a, b interface{}) {
+	switch ta := a.(type) {
+	case map[string]interface{}:
+		if tb, ok := b.(map[string]interface{}); ok {
+			diffObjects(patch, path, ta, tb)
+			return
+		}
+	case []interface{}:
+		if tb, ok := b.([]interface{}); ok {
+			diffArrays(patch, path, ta, tb)
+			return
+		}
+	default:
+		switch b.(type) {
+		case map[string]interface{}, []interface{}:
+		default:
+			if a == b {
+				return
+			}
+		}
+	}
+	*patch = append(*patch, PatchOp{Op: "replace", Path: path, Value: b})
+}
+
+func diffObjects(patch *JSONPatch, path string, a, b map[string]interface{}) {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		va, inA := a[k]
+		vb, inB := b[k]
+		p := path + "/" + escapePointer(k)
+		switch {
+		case !inB:
+			*patch = append(*patch, PatchOp{Op: "remove", Path: p})
+		case !inA:
+			*patch = append(*patch, PatchOp{Op: "add", Path: p, Value: vb})
+		default:
+			diffValues(patch, p, va, vb)
+		}
+	}
+}
+
+func diffArrays(patch *JSONPatch, path string, a, b []interface{}) {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		diffValues(patch, path+"/"+strconv.Itoa(i), a[i], b[i])
+	}
+	for i := len(a) - 1; i >= n; i-- {
+		*patch = append(*patch, PatchOp{Op: "remove", Path: path + "/" + strconv.Itoa(i)})
+	}
+	for i := n; i < len(b); i++ {
+		*patch = append(*patch, PatchOp{Op: "add", Path: path + "/" + strconv.Itoa(i), Value: b[i]})
+	}
+}
+
+// escapePointer escapes a key for a JSON Pointer (RFC 6901).
+func escapePointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
@@ -0,0 +1,120 @@
+package jsondb
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DiskWatermark switches the database into a degraded mode when free disk
+// space drops below MinFree bytes or MinFreePercent of the disk: writes
+// fail with ErrDiskFull while reads go on. Writes are accepted again once
+// enough space is free.
+type DiskWatermark struct {
+	MinFree        uint64  `json:",omitempty"`
+	MinFreePercent float64 `json:",omitempty"`
+
+	// CheckInterval is how often writes look at the free space, 5s by
+	// default.
+	CheckInterval time.Duration `json:",omitempty"`
+}
+
+// ErrDiskFull is returned by writes while free disk space is below the
+// watermark.
+var ErrDiskFull = fmt.Errorf("Disk space is below the watermark - writes are rejected")
+
+// DiskStatus reports the free space of the database's disk as last checked.
+type DiskStatus struct {
+	Free     uint64
+	Total    uint64
+	Degraded bool
+
+	// Since is when the database entered or left degraded mode.
+	Since time.Time `json:",omitempty"`
+
+	// Rejected counts the writes refused while degraded.
+	Rejected int64
+}
+
+type diskMonitor struct {
+	mutex   sync.Mutex
+	dir     string
+	log     Logger
+	mark    DiskWatermark
+	status  DiskStatus
+	checked time.Time
+}
+
+func newDiskMonitor(dir string, log Logger, mark DiskWatermark) *diskMonitor {
+	if mark.MinFree == 0 && mark.MinFreePercent <= 0 {
+		return nil
+	}
+	if mark.CheckInterval <= 0 {
+		mark.CheckInterval = 5 * time.Second
+	}
+	return &diskMonitor{dir: dir, log: log, mark: mark}
+}
+
+// refresh looks at the free space if the last look is older than the check
+// interval, and switches modes as needed. The caller holds m.mutex.
+func (m *diskMonitor) refresh() {
+	now := time.Now()
+	if now.Sub(m.checked) < m.mark.CheckInterval {
+		return
+	}
+	m.checked = now
+
+	free, total, err := diskSpace(m.dir)
+	if err != nil {
+		m.log.Warn("Unable to check free space of '%s': %v\n", m.dir, err)
+		return
+	}
+	m.status.Free, m.status.Total = free, total
+
+	low := free < m.mark.MinFree
+	if total > 0 && m.mark.MinFreePercent > 0 {
+		low = low || float64(free)*100/float64(total) < m.mark.MinFreePercent
+	}
+
+	switch {
+	case low && !m.status.Degraded:
+		m.log.Error("Free space of '%s' is %d of %d bytes, below the watermark - rejecting writes\n", m.dir, free, total)
+	case !low && m.status.Degraded:
+		m.log.Info("Free space of '%s' is %d of %d bytes again - accepting writes\n", m.dir, free, total)
+	default:
+		return
+	}
+	m.status.Degraded, m.status.Since = low, now
+}
+
+// admit returns ErrDiskFull if the disk is below the watermark.
+func (m *diskMonitor) admit() error {
+	if m == nil {
+		return nil
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.refresh()
+	if m.status.Degraded {
+		m.status.Rejected++
+		return ErrDiskFull
+	}
+	return nil
+}
+
+// DiskStatus reports the free disk space and whether writes are rejected.
+// It is zero unless Options.DiskWatermark is set.
+func (d *Driver) DiskStatus() DiskStatus {
+	m := d.disk
+	if m == nil {
+		return DiskStatus{}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.refresh()
+	return m.status
+}
@@ -0,0 +1,26 @@
+// Package jsondb is a document database storing each record as a JSON file
+// named after its resource, in a directory per collection.
+//
+// The package is complete on its own and depends on the standard library
+// only: programs embed it by importing database/jsondb and calling Open,
+// with no HTTP server involved.
+//
+//	db, err := jsondb.Open("./data", jsondb.WithDurability(jsondb.DurabilityNone))
+//	if err != nil {
+//		return err
+//	}
+//	defer db.Close()
+//
+//	err = db.Write("users", "ada", User{Name: "Ada"})
+//
+// Optional features that need third-party libraries live in packages of
+// their own:
+//
+//   - database/jsondb/codecs registers the YAML, MessagePack, BSON and CBOR
+//     codecs.
+//   - database/jsondb/oteltrace traces operations with OpenTelemetry.
+//   - database/jsondb/lumberlog logs through lumber.
+//
+// The server in the module's root package is a thin layer over the same
+// Driver, exposing it over HTTP; cmd/dbctl is an embedding of its own.
+package jsondb
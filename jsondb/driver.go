@@ -0,0 +1,718 @@
+package jsondb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+const Version = "1.0.0"
+
+type (
+	Logger interface {
+		Fatal(string, ...interface{})
+		Error(string, ...interface{})
+		Warn(string, ...interface{})
+		Info(string, ...interface{})
+		Debug(string, ...interface{})
+		Trace(string, ...interface{})
+	}
+
+	Driver struct {
+		mutex   *sync.Mutex
+		mutexes map[string]*collectionLock
+		locks   *lockGraph
+		dir     string
+		log     Logger
+		backend Backend
+		ctx     context.Context
+
+		// transform is applied to exports and clones; see WithTransform.
+		transform *Transform
+
+		slowOp      *atomic.Int64
+		perf        *perfStats
+		feed        *changeFeed
+		oplog       *opLog
+		archive     ArchiveStore
+		instr       Instrumentation
+		tracer      Tracer
+		configs     map[string]*CollectionConfig
+		limits      Limits
+		disk        *diskMonitor
+		retry       RetryPolicy
+		recovery    *recoveryState
+		corrupt     CorruptPolicy
+		qcache      *queryCache
+		qlimits     QueryLimits
+		lockTimeout time.Duration
+		memory      *memoryBudget
+		snaps       *snapshotState
+		group       *changeGroup
+
+		replication *replication
+		applying    bool
+		instance    *instance
+		retention   *retentionState
+		quality     *qualityState
+		syncs       *syncState
+		types       *typeRegistry
+		processing  *processorState
+		aliases     *aliasState
+		breakers    *breakerState
+		policy      *policyState
+		stale       *staleCache
+		flights     *readFlights
+		hotKeys     *hotKeys
+
+		readThroughs map[string]ReadThrough
+
+		viewMutex *sync.Mutex
+		views     map[string]*viewState
+		geo       map[string]*geoIndex
+		scheduler *Scheduler
+		system    *Driver
+	}
+)
+
+type Options struct {
+	Logger
+
+	// Fault, when set, injects simulated crashes into file writes. It is
+	// meant for crash-recovery tests only.
+	Fault FaultFunc
+
+	// SlowOp, when positive, logs every operation taking at least as long.
+	SlowOp time.Duration
+
+	// Archive keeps archived records; see ArchivePolicy. By default they
+	// are stored in the database directory.
+	Archive ArchiveStore
+
+	// Instrumentation, when set, is told about every operation.
+	Instrumentation Instrumentation
+
+	// Limits bounds the size and shape of records written.
+	Limits Limits
+
+	// Retry is how file operations failing with transient errors, as
+	// networked filesystems return them, are retried. Zero means
+	// DefaultRetryPolicy.
+	Retry RetryPolicy
+
+	// DiskWatermark, when set, rejects writes while the disk is nearly
+	// full. It has no effect on in-memory databases.
+	DiskWatermark DiskWatermark
+
+	// Durability says whether writes are flushed to disk before they
+	// return. The default is DurabilitySync.
+	Durability Durability
+
+	// Tracer, when set, traces every operation.
+	Tracer Tracer
+
+	// Upgrade says whether a directory of an older layout is migrated on
+	// opening; by default New fails with ErrLayoutOutdated.
+	Upgrade UpgradePolicy
+
+	// Corrupt says what listings do with records that cannot be read or
+	// parsed; by default they fail.
+	Corrupt CorruptPolicy
+
+	// QueryCache, when its Size is set, caches query results.
+	QueryCache QueryCacheConfig
+
+	// QueryLimits bounds the work of every query, unless the query sets
+	// limits of its own.
+	QueryLimits QueryLimits
+
+	// LockTimeout is how long an operation waits for the lock of a
+	// collection before failing with ErrLockTimeout; zero waits as long
+	// as it takes. Deadlocks fail with ErrDeadlock either way.
+	LockTimeout time.Duration
+
+	// MemoryBudget bounds, in bytes, the records ReadAll and Query hold
+	// at once across the driver; past it they fail with ErrMemoryBudget
+	// and Spools move to temporary files in SpillDir, the system's
+	// temporary directory by default. Zero leaves memory unbounded.
+	MemoryBudget int64
+	SpillDir     string
+
+	// ReadThrough makes collections, by name, caches of records loaded
+	// from elsewhere; see ReadThrough.
+	ReadThrough map[string]ReadThrough
+
+	// Policy, when set, allows or denies the operations of callers by
+	// their roles; see Policy and SetPolicy.
+	Policy *Policy
+
+	// StaleCacheSize is how many records are kept, least recently read
+	// first out, to be served by the collections with StaleIfError when
+	// storage fails; 10000 by default.
+	StaleCacheSize int
+
+	// HotKeys, when its SampleRate is set, counts the accesses to records
+	// for HotKeys to report.
+	HotKeys HotKeyConfig
+
+	// Breaker is when the circuit breakers in front of the Archive, the
+	// replicator and the ReadThrough loaders trip; see BreakerConfig.
+	Breaker BreakerConfig
+}
+
+func New(dir string, options *Options) (*Driver, error) {
+	dir = filepath.Clean(dir)
+
+	opts := defaultOptions(options)
+	if err := opts.Corrupt.validate(); err != nil {
+		return nil, err
+	}
+
+	if dir == MemoryDir {
+		opts.Logger.Debug("Creating an in-memory database...\n")
+		driver := open(dir, newMemBackend(), opts)
+		return driver, driver.backend.MkdirAll(dir)
+	}
+
+	driver := open(dir, dirBackend{fault: opts.Fault, retry: opts.Retry, durability: opts.Durability}, opts)
+	driver.disk = newDiskMonitor(dir, opts.Logger, opts.DiskWatermark)
+
+	if _, err := driver.backend.Stat(dir); err == nil {
+		opts.Logger.Debug("Using '%s' (database already exists)\n", dir)
+		if err := driver.checkLayout(opts.Upgrade); err != nil {
+			return driver, err
+		}
+		if _, err := driver.recover(false); err != nil {
+			return driver, err
+		}
+		if err := driver.loadManifests(true); err != nil {
+			return driver, err
+		}
+		return driver, driver.loadAliases()
+	}
+
+	opts.Logger.Debug("Creating the database at '%s'...\n", dir)
+	if err := driver.writeLayout(); err != nil {
+		return driver, err
+	}
+	_, err := driver.recover(false)
+	return driver, err
+}
+
+// openReadOnly opens the database in dir to read it alongside the process
+// that owns it. Unlike New it neither creates, migrates nor recovers the
+// directory, leaves the dirty flag alone and schedules no jobs. MemoryDir
+// opens an empty database, as it does for New.
+func openReadOnly(dir string, options *Options) (*Driver, error) {
+	dir = filepath.Clean(dir)
+	opts := defaultOptions(options)
+
+	if dir == MemoryDir {
+		driver := open(dir, newMemBackend(), opts)
+		return driver, driver.backend.MkdirAll(dir)
+	}
+
+	version, err := LayoutOf(dir)
+	switch {
+	case err != nil:
+		return nil, err
+	case version == 0:
+		return nil, fmt.Errorf("No database at '%s'", dir)
+	case version > LayoutVersion:
+		return nil, ErrLayoutTooNew
+	case version < LayoutVersion:
+		return nil, ErrLayoutOutdated
+	}
+
+	driver := open(dir, dirBackend{retry: opts.Retry, durability: opts.Durability}, opts)
+	if err := driver.loadManifests(false); err != nil {
+		return nil, err
+	}
+	if err := driver.loadAliases(); err != nil {
+		return nil, err
+	}
+	return driver, nil
+}
+
+func defaultOptions(options *Options) Options {
+	opts := Options{}
+
+	if options != nil {
+		opts = *options
+	}
+
+	if opts.Logger == nil {
+		opts.Logger = NewStdLogger(log.New(os.Stdout, "", log.LstdFlags), LogInfo)
+	}
+
+	if opts.Tracer == nil {
+		opts.Tracer = noopTracer{}
+	}
+
+	return opts
+}
+
+// open assembles a driver, its system namespace and scheduler over backend.
+func open(dir string, backend Backend, opts Options) *Driver {
+	driver := newDriver(dir, opts.Logger, backend)
+	driver.backend = newDedupBackend(backend, dir, driver.deduplicated)
+	driver.system = newDriver(filepath.Join(dir, systemDir), opts.Logger, backend)
+	driver.slowOp.Store(int64(opts.SlowOp))
+	driver.system.slowOp = driver.slowOp
+	driver.instr = opts.Instrumentation
+	driver.limits = opts.Limits
+	driver.system.instr = opts.Instrumentation
+	driver.tracer = opts.Tracer
+	driver.system.tracer = opts.Tracer
+	driver.feed = newChangeFeed()
+	driver.oplog = newOpLog()
+	driver.breakers = newBreakerState(opts.Breaker, opts.Instrumentation)
+	if opts.Archive != nil {
+		driver.archive = brokenArchive{opts.Archive, driver.breakers.get("archive")}
+	}
+	driver.scheduler = newScheduler(driver)
+	driver.retry = opts.Retry
+	driver.recovery = new(recoveryState)
+	driver.corrupt = opts.Corrupt
+	driver.qcache = newQueryCache(opts.QueryCache)
+	driver.stale = newStaleCache(opts.StaleCacheSize)
+	driver.flights = newReadFlights()
+	driver.hotKeys = newHotKeys(opts.HotKeys)
+	driver.qlimits = opts.QueryLimits
+	driver.lockTimeout = opts.LockTimeout
+	driver.system.lockTimeout = opts.LockTimeout
+	driver.system.locks = driver.locks
+	driver.memory = newMemoryBudget(opts.MemoryBudget, opts.SpillDir)
+	driver.system.memory = driver.memory
+	driver.snaps = newSnapshotState()
+	driver.replication = new(replication)
+	driver.instance = new(instance)
+	driver.system.instance = driver.instance
+	driver.retention = &retentionState{stats: make(map[string]*RetentionStats)}
+	driver.quality = &qualityState{stats: make(map[string]*QualityStats)}
+	driver.syncs = &syncState{resolvers: make(map[string]ConflictResolver)}
+	driver.types = &typeRegistry{types: make(map[string]reflect.Type)}
+	driver.processing = &processorState{processors: make(map[string]AttachmentProcessor)}
+	driver.aliases = &aliasState{targets: make(map[string]string)}
+	policy := new(atomic.Pointer[Policy])
+	policy.Store(opts.Policy)
+	driver.policy = &policyState{policy: policy}
+	driver.system.policy = &policyState{policy: policy, prefix: "_"}
+	driver.readThroughs = make(map[string]ReadThrough, len(opts.ReadThrough))
+	for collection, rt := range opts.ReadThrough {
+		if rt.Loader != nil {
+			rt.Loader = brokenLoader{rt.Loader, driver.breakers.get("read-through:" + collection)}
+		}
+		driver.readThroughs[collection] = rt
+	}
+	return driver
+}
+
+func newDriver(dir string, log Logger, backend Backend) *Driver {
+	return &Driver{
+		dir:       dir,
+		mutex:     new(sync.Mutex),
+		mutexes:   make(map[string]*collectionLock),
+		locks:     newLockGraph(),
+		log:       log,
+		backend:   backend,
+		perf:      newPerfStats(),
+		slowOp:    new(atomic.Int64),
+		configs:   make(map[string]*CollectionConfig),
+		viewMutex: new(sync.Mutex),
+		views:     make(map[string]*viewState),
+		geo:       make(map[string]*geoIndex),
+	}
+}
+
+func (d *Driver) Write(collection, resource string, v interface{}) (err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("Write", collection, resource)
+	defer span.end(&err)
+
+	if err := d.allow(PolicyWrite, collection); err != nil {
+		return err
+	}
+	if err := d.beforeSave(v); err != nil {
+		return err
+	}
+	return d.put(collection, resource, v)
+}
+
+// put stores v as Write does, once it is allowed and prepared.
+func (d *Driver) put(collection, resource string, v interface{}) error {
+	if collection == "" {
+		return fmt.Errorf("Missing collection - no place to save record!")
+	}
+
+	if resource == "" {
+		return fmt.Errorf("Missing resource - unable to save record (no name)!")
+	}
+
+	if err := validName(collection, resource); err != nil {
+		return err
+	}
+
+	if err := d.checkCollection(collection); err != nil {
+		return err
+	}
+
+	if r := d.replicator(); r != nil {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return d.replicate(r, Change{Op: OpWrite, Collection: collection, Resource: resource, Data: b})
+	}
+
+	unlock, err := d.lockCollection(collection, LockWrite)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return d.write(collection, resource, v)
+}
+
+// write stores v; the caller holds the collection mutex.
+func (d *Driver) write(collection, resource string, v interface{}) error {
+	fnlPath := filepath.Join(d.dir, collection, resource+".json")
+
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	b = append(b, byte('\n'))
+
+	cfg := d.collectionConfig(collection)
+	if cfg != nil && cfg.MergeOnWrite {
+		if b, err = d.mergeOnWrite(fnlPath, v, b); err != nil {
+			return err
+		}
+	}
+
+	return d.writeBytes(collection, resource, cfg, b)
+}
+
+// writeBytes stores the encoded record b, with the defaults, coercions and
+// computed fields of cfg, after checking it against the limits and cfg;
+// the caller holds the collection mutex.
+func (d *Driver) writeBytes(collection, resource string, cfg *CollectionConfig, b []byte) error {
+	b, err := d.prepareBytes(collection, resource, cfg, b)
+	if err != nil {
+		return err
+	}
+	return d.storeBytes(collection, resource, b)
+}
+
+// prepareBytes is the first half of writeBytes: it returns the record b
+// shaped by cfg once it passes the checks.
+func (d *Driver) prepareBytes(collection, resource string, cfg *CollectionConfig, b []byte) ([]byte, error) {
+	if cfg != nil && cfg.shapes() {
+		var err error
+		if b, err = cfg.shape(resource, b); err != nil {
+			return nil, err
+		}
+	}
+	d.traceBytes(len(b))
+
+	if err := d.limits.check(resource, b); err != nil {
+		return nil, err
+	}
+	if err := d.disk.admit(); err != nil {
+		return nil, err
+	}
+
+	if cfg != nil {
+		doc, err := decodeDocument(b)
+		if err != nil {
+			return nil, err
+		}
+		if err := cfg.check(resource, doc); err != nil {
+			return nil, err
+		}
+		if err := d.checkType(collection, resource, cfg, b); err != nil {
+			return nil, err
+		}
+		if err := d.checkUnique(collection, resource, cfg, doc); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// storeBytes is the second half of writeBytes: it writes the prepared
+// record b and tells watchers, views and indexes.
+func (d *Driver) storeBytes(collection, resource string, b []byte) error {
+	fnlPath := filepath.Join(d.dir, collection, resource+".json")
+
+	g, end := d.changes()
+	defer end()
+	if g.needed() {
+		old, err := d.backend.ReadFile(fnlPath)
+		g.record(collection, resource, old, err == nil)
+	}
+
+	op := OpUpdate
+	if _, err := d.backend.Stat(fnlPath); err != nil {
+		op = OpCreate
+	}
+
+	if err := d.backend.WriteFile(fnlPath, b); err != nil {
+		return err
+	}
+	d.publish(op, collection, resource, b)
+	if err := d.keepVersion(collection, resource, b); err != nil {
+		d.log.Error("Unable to keep a version of '%s/%s': %v\n", collection, resource, err)
+	}
+	if err := d.trackWrite(collection, resource); err != nil {
+		d.log.Error("Unable to track the write of '%s/%s': %v\n", collection, resource, err)
+	}
+
+	if doc, err := decodeDocument(b); err == nil {
+		d.updateViews(collection, resource, doc)
+		d.updateGeo(collection, resource, doc)
+	}
+	return nil
+}
+
+func (d *Driver) Read(collection, resource string, v interface{}) (err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("Read", collection, resource)
+	defer span.end(&err)
+
+	if err := d.allow(PolicyRead, collection); err != nil {
+		return err
+	}
+
+	if collection == "" {
+		return fmt.Errorf("Missing collection - unable to read!")
+	}
+
+	if resource == "" {
+		return fmt.Errorf("Missing resource - unable to read record (no name)!")
+	}
+
+	if err := validName(collection, resource); err != nil {
+		return err
+	}
+	d.hotKeys.count(collection, resource, false)
+	b, _, err := d.fetch(collection, resource)
+	if err != nil {
+		return err
+	}
+
+	return d.DecodeRecord(collection, b, v)
+}
+
+func (d *Driver) ReadAll(collection string) (_ []string, err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("ReadAll", collection, "")
+	defer span.end(&err)
+
+	if err := d.allow(PolicyRead, collection); err != nil {
+		return nil, err
+	}
+
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read")
+	}
+
+	if err := validName(collection, ""); err != nil {
+		return nil, err
+	}
+
+	unlock, err := d.lockCollection(collection, LockRead)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	dir := filepath.Join(d.dir, collection)
+
+	if _, err := d.stat(dir); err != nil {
+		return nil, err
+	}
+
+	files, _ := d.backend.ReadDir(dir)
+
+	var records []string
+	var n int
+	res := reservation{budget: d.memory}
+	defer res.release()
+
+	for _, file := range files {
+		// Skip nested collections, the manifest and temporary files of
+		// interrupted writes
+		if !isRecord(file) {
+			continue
+		}
+
+		path := filepath.Join(dir, file.Name())
+		b, err := d.backend.ReadFile(path)
+		if ok, err := d.checkRecord(collection, strings.TrimSuffix(file.Name(), ".json"), path, b, err); !ok {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if err := res.grow(len(b)); err != nil {
+			return nil, err
+		}
+		records = append(records, string(b))
+		n += len(b)
+	}
+	d.traceBytes(n)
+	return records, nil
+}
+
+func (d *Driver) Delete(collection, resource string) (err error) {
+	if resource != "" {
+		collection = d.resolve(collection)
+	}
+	d, span := d.trace("Delete", collection, resource)
+	defer span.end(&err)
+
+	if err := d.allow(PolicyDelete, collection); err != nil {
+		return err
+	}
+
+	if err := validName(collection, resource); err != nil {
+		return err
+	}
+
+	if err := d.checkCollection(collection); err != nil {
+		return err
+	}
+
+	if r := d.replicator(); r != nil {
+		return d.replicate(r, Change{Op: OpDelete, Collection: collection, Resource: resource})
+	}
+
+	path := filepath.Join(collection, resource)
+	unlock, err := d.lockCollection(collection, LockWrite)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	dir := filepath.Join(d.dir, path)
+
+	switch fi, err := d.stat(dir); {
+	case fi == nil, err != nil:
+		return fmt.Errorf("unable to find file or directory named %v\n", path)
+
+	case fi.Mode().IsDir():
+		g, end := d.changes()
+		defer end()
+		d.recordCollection(g, path)
+		if err := d.backend.RemoveAll(dir); err != nil {
+			return err
+		}
+		d.publish(OpDelete, collection, resource, nil)
+		d.forgetConfigs(path)
+		d.forgetGeo(path)
+		if err := d.forgetWrites(path, ""); err != nil {
+			d.log.Error("Unable to forget the writes of '%s': %v\n", path, err)
+		}
+
+	case fi.Mode().IsRegular():
+		return d.remove(collection, resource)
+	}
+
+	d.updateViews(collection, resource, nil)
+	return nil
+}
+
+// remove deletes one record; the caller holds the collection mutex.
+func (d *Driver) remove(collection, resource string) error {
+	return d.removeAs(OpDelete, collection, resource)
+}
+
+// removeAs is remove, publishing the deletion as op.
+func (d *Driver) removeAs(op, collection, resource string) error {
+	path := filepath.Join(d.dir, collection, resource+".json")
+
+	g, end := d.changes()
+	defer end()
+
+	old, err := d.backend.ReadFile(path)
+	g.record(collection, resource, old, err == nil)
+	if err := d.backend.Remove(path); err != nil {
+		return err
+	}
+
+	d.publish(op, collection, resource, old)
+	d.updateViews(collection, resource, nil)
+	d.updateGeo(collection, resource, nil)
+
+	if err := d.unlinkRecord(collection, resource); err != nil {
+		d.log.Error("Unable to remove the edges of '%s/%s': %v\n", collection, resource, err)
+	}
+	if err := d.removeAttachments(collection, resource); err != nil {
+		d.log.Error("Unable to remove the attachments of '%s/%s': %v\n", collection, resource, err)
+	}
+	if err := d.forgetWrites(collection, resource); err != nil {
+		d.log.Error("Unable to forget the writes of '%s/%s': %v\n", collection, resource, err)
+	}
+	return nil
+}
+
+// getOrCreateMutex returns the lock of a collection. Writers hold it
+// exclusively; ReadAll and Query hold it shared so they see the collection
+// at a single point in time.
+func (d *Driver) getOrCreateMutex(collection string) *collectionLock {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	m, ok := d.mutexes[collection]
+
+	if !ok {
+		m = &collectionLock{graph: d.locks}
+		d.mutexes[collection] = m
+	}
+
+	return m
+}
+
+// ErrInvalidName is returned for collection or resource names that would
+// address a file outside their collection.
+var ErrInvalidName = fmt.Errorf("Invalid collection or resource name")
+
+// validName checks that collection (which may be nested, "a/b") and
+// resource (which may be empty) stay inside the database directory and do
+// not address the collection manifest.
+func validName(collection, resource string) error {
+	if collection == "" || !utf8.ValidString(collection+resource) || strings.ContainsAny(collection+resource, "\\\x00") || filepath.IsAbs(collection) {
+		return ErrInvalidName
+	}
+
+	for _, part := range strings.Split(collection, "/") {
+		if part == "" || part == "." || part == ".." {
+			return ErrInvalidName
+		}
+	}
+
+	if strings.Contains(resource, "/") || resource == "." || resource == ".." || resource == manifestName {
+		return ErrInvalidName
+	}
+	return nil
+}
+
+func (d *Driver) stat(path string) (fi os.FileInfo, err error) {
+	if fi, err = d.backend.Stat(path); os.IsNotExist(err) {
+		fi, err = d.backend.Stat(path + ".json")
+	}
+	return
+}
@@ -0,0 +1,139 @@
+package jsondb
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OpExpire is reported by Watch when a record outlived the TTL of its
+// collection and was swept; Data is the record before it was.
+const OpExpire = "expire"
+
+// expirySchedule is how often the records of collections with a TTL are
+// swept.
+const expirySchedule = "@every 1m"
+
+func expiryJob(collection string) string {
+	return "ttl-" + collection
+}
+
+// scheduleExpiry registers the job sweeping the expired records of
+// collection when its configuration has a TTL or a TTLField, and
+// unregisters it otherwise.
+func (d *Driver) scheduleExpiry(collection string, cfg *CollectionConfig) error {
+	job := expiryJob(collection)
+	if cfg == nil || (cfg.TTL == "" && cfg.TTLField == "") {
+		d.scheduler.Unregister(job)
+		return nil
+	}
+
+	return d.scheduler.Register(job, expirySchedule, func() error {
+		_, err := d.Expire(collection)
+		return err
+	})
+}
+
+// Expire deletes, now, the records of collection last written longer ago
+// than its TTL, or past the time their TTLField holds, and returns how
+// many it deleted. Each is reported to
+// watchers as an OpExpire event rather than a delete, so applications can
+// react to it, such as closing the connections of an expired session.
+// With a replicator the deletions are replicated, as OpExpire changes,
+// and only made by its leader.
+func (d *Driver) Expire(collection string) (n int, err error) {
+	d, span := d.trace("Expire", collection, "")
+	defer span.end(&err)
+
+	cfg := d.collectionConfig(collection)
+	if cfg == nil || (cfg.TTL == "" && cfg.TTLField == "") {
+		return 0, nil
+	}
+
+	r := d.replicator()
+	if r != nil && !sweeps(r) {
+		return 0, nil
+	}
+
+	unlock, err := d.lockCollection(collection, LockWrite)
+	if err != nil {
+		return 0, err
+	}
+	expired, err := d.expiredRecords(collection, cfg)
+	if err != nil || len(expired) == 0 {
+		unlock()
+		return 0, err
+	}
+
+	if r != nil {
+		expect, err := d.expectations(collection, expired)
+		unlock()
+		if err != nil {
+			return 0, err
+		}
+		n, err = d.replicateRemovals(r, OpExpire, collection, expect)
+	} else {
+		defer unlock()
+		for _, resource := range expired {
+			if err = d.removeAs(OpExpire, collection, resource); err != nil {
+				break
+			}
+			n++
+		}
+	}
+	if n > 0 {
+		d.log.Info("Expired %d records of '%s'\n", n, collection)
+	}
+	return n, err
+}
+
+// expiredRecords returns the records of collection past the TTL or
+// TTLField of cfg, in name order. The caller holds the collection lock.
+func (d *Driver) expiredRecords(collection string, cfg *CollectionConfig) ([]string, error) {
+	expired := make(map[string]bool)
+	if cfg.TTL != "" {
+		ttl, _ := ParseAge(cfg.TTL) // checked when the config was set
+		files, err := d.backend.ReadDir(filepath.Join(d.dir, collection))
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		cutoff := time.Now().Add(-ttl)
+		for _, file := range files {
+			if isRecord(file) && file.ModTime().Before(cutoff) {
+				expired[strings.TrimSuffix(file.Name(), ".json")] = true
+			}
+		}
+	}
+
+	if cfg.TTLField != "" {
+		now := time.Now()
+		err := d.scan(collection, func(resource string, b []byte) error {
+			doc, err := decodeDocument(b)
+			if err != nil {
+				return nil // left to the corrupt record policy
+			}
+			v, _ := lookup(doc, cfg.TTLField)
+			s, _ := v.(string)
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil && t.Before(now) {
+				expired[resource] = true
+			}
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	resources := make([]string, 0, len(expired))
+	for resource := range expired {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+	return resources, nil
+}
@@ -0,0 +1,285 @@
+package jsondb
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExportManifestName is the file of a signed export holding its
+// ExportManifest.
+const ExportManifestName = "export-manifest.json"
+
+// ErrExportSignature is returned by VerifyExport when the manifest of an
+// export was not signed by the key it is checked against, or was changed
+// since.
+var ErrExportSignature = fmt.Errorf("Export manifest signature is invalid")
+
+// ExportManifest describes a signed export: the SHA-256 of every record
+// file of its collections, by resource, signed with an Ed25519 key.
+// Signature covers the compact JSON encoding of the manifest without it,
+// so changing, adding or dropping a record of the export shows.
+type ExportManifest struct {
+	Created     time.Time
+	Collections []ExportedCollection
+	PublicKey   []byte
+	Signature   []byte `json:",omitempty"`
+}
+
+// ExportedCollection is a collection of a signed export with the SHA-256
+// of its record files, in hex, by resource.
+type ExportedCollection struct {
+	Name    string
+	Records map[string]string
+}
+
+// signedBytes returns what the signature of m covers.
+func (m ExportManifest) signedBytes() ([]byte, error) {
+	m.Signature = nil
+	return json.Marshal(m)
+}
+
+// ExportSigned writes the records of collections, with the collections
+// nested in them, or of every collection when none are given, to destDir
+// as a tamper-evident dump, such as for legal holds: the record files,
+// laid out as in the database, and an ExportManifest of their hashes
+// signed with key, in ExportManifestName. The records are exported as of
+// one point in time, through a snapshot, and transformed as WithTransform
+// has it. destDir must not exist or be empty. VerifyExport checks the dump
+// later.
+func (d *Driver) ExportSigned(destDir string, key ed25519.PrivateKey, collections ...string) (_ *ExportManifest, err error) {
+	d, span := d.trace("ExportSigned", "", destDir)
+	defer span.end(&err)
+
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("Invalid Ed25519 signing key")
+	}
+	if files, err := os.ReadDir(destDir); err == nil && len(files) > 0 {
+		return nil, fmt.Errorf("Cannot export into '%s': the directory is not empty", destDir)
+	}
+
+	selected, err := d.selectCollections(collections)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	m := &ExportManifest{Created: time.Now().UTC(), Collections: []ExportedCollection{}, PublicKey: key.Public().(ed25519.PublicKey)}
+	var n int
+	for _, collection := range selected {
+		if err := d.allow(PolicyRead, collection); err != nil {
+			return nil, err
+		}
+		records, names, err := tx.snapshotRecords(collection)
+		if os.IsNotExist(err) {
+			continue // deleted meanwhile
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		dir := filepath.Join(destDir, filepath.FromSlash(collection))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		exported := ExportedCollection{Name: collection, Records: make(map[string]string, len(names))}
+		for _, resource := range names {
+			b, err := d.transform.applyBytes(collection, records[resource])
+			if err != nil {
+				return nil, fmt.Errorf("Error transforming '%s/%s': %v", collection, resource, err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, resource+".json"), b, 0644); err != nil {
+				return nil, err
+			}
+			sum := sha256.Sum256(b)
+			exported.Records[resource] = hex.EncodeToString(sum[:])
+			n++
+		}
+		m.Collections = append(m.Collections, exported)
+	}
+
+	signed, err := m.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+	m.Signature = ed25519.Sign(key, signed)
+
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(destDir, ExportManifestName), append(b, '\n'), 0644); err != nil {
+		return nil, err
+	}
+
+	d.log.Info("Exported %d records of %d collections into '%s', signed\n", n, len(m.Collections), destDir)
+	return m, nil
+}
+
+// ExportReport is what VerifyExport found in a signed export: the records
+// it checked, and those whose files are missing, differ from the manifest
+// or are not in it, as "collection/resource".
+type ExportReport struct {
+	Created  time.Time
+	Records  int
+	Missing  []string `json:",omitempty"`
+	Modified []string `json:",omitempty"`
+	Extra    []string `json:",omitempty"`
+
+	// KeyFromManifest is set when the export was checked against the
+	// public key its manifest names, which only proves it is intact, not
+	// who signed it.
+	KeyFromManifest bool `json:",omitempty"`
+}
+
+// Intact reports whether every record of the export is as it was signed.
+func (r ExportReport) Intact() bool {
+	return len(r.Missing) == 0 && len(r.Modified) == 0 && len(r.Extra) == 0
+}
+
+// VerifyExport checks the signed export in dir, as ExportSigned wrote it,
+// against pub, the public key of the signer; with a nil pub, the key the
+// manifest names is used. It fails with ErrExportSignature when the
+// manifest is not signed by the key, and reports the records that differ
+// from the manifest otherwise.
+func VerifyExport(dir string, pub ed25519.PublicKey) (ExportReport, error) {
+	var report ExportReport
+
+	b, err := os.ReadFile(filepath.Join(dir, ExportManifestName))
+	if err != nil {
+		return report, err
+	}
+	var m ExportManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return report, fmt.Errorf("Invalid export manifest: %v", err)
+	}
+
+	if pub == nil {
+		pub, report.KeyFromManifest = m.PublicKey, true
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return report, fmt.Errorf("Invalid Ed25519 public key")
+	}
+	signed, err := m.signedBytes()
+	if err != nil {
+		return report, err
+	}
+	if !ed25519.Verify(pub, signed, m.Signature) {
+		return report, ErrExportSignature
+	}
+	report.Created = m.Created
+
+	expected := make(map[string]string)
+	for _, c := range m.Collections {
+		for resource, sum := range c.Records {
+			expected[c.Name+"/"+resource] = sum
+		}
+	}
+
+	err = filepath.WalkDir(dir, func(path string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == ExportManifestName {
+			return nil
+		}
+
+		name := strings.TrimSuffix(rel, ".json")
+		sum, ok := expected[name]
+		if !ok {
+			report.Extra = append(report.Extra, rel)
+			return nil
+		}
+		delete(expected, name)
+		report.Records++
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		actual := sha256.Sum256(b)
+		if hex.EncodeToString(actual[:]) != sum {
+			report.Modified = append(report.Modified, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	for name := range expected {
+		report.Missing = append(report.Missing, name)
+	}
+	sort.Strings(report.Missing)
+	return report, nil
+}
+
+// ParseExportKey reads the Ed25519 private key signing exports from a PEM
+// "PRIVATE KEY" block, as "openssl genpkey -algorithm ed25519" writes it.
+func ParseExportKey(b []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("Export key is not a PEM private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Export key is not an Ed25519 key")
+	}
+	return priv, nil
+}
+
+// ParseExportPublicKey reads the Ed25519 public key checking exports from
+// a PEM "PUBLIC KEY" block, or takes it from a private key as
+// ParseExportKey reads it.
+func ParseExportPublicKey(b []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("Export key is not PEM-encoded")
+	}
+	if block.Type == "PRIVATE KEY" {
+		priv, err := ParseExportKey(b)
+		if err != nil {
+			return nil, err
+		}
+		return priv.Public().(ed25519.PublicKey), nil
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("Export key is not a PEM public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Export key is not an Ed25519 key")
+	}
+	return pub, nil
+}
@@ -0,0 +1,206 @@
+package jsondb
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrPathNotFound is returned when a path expression matches nothing.
+var ErrPathNotFound = fmt.Errorf("Path not found in record")
+
+// Extract returns the part of a record selected by path, without decoding
+// the record into a Go type. path is a JSONPath expression limited to
+// field names, quoted names, indexes (negative ones count from the end),
+// the wildcard and recursive descent: $.Address.City, $['first name'],
+// $.Tags[0], $.Tags[-1], $..City, $.Items[*].Name. The leading $ may be
+// left out (Address.City). Filters, slices and functions are not
+// supported, and neither is JMESPath beyond these dotted paths.
+// Expressions using wildcards or recursive descent return an array of all
+// matches; plain paths return the single value they address.
+func (d *Driver) Extract(collection, resource, path string) (_ json.RawMessage, err error) {
+	d, span := d.trace("Extract", collection, resource)
+	defer span.end(&err)
+
+	steps, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw json.RawMessage
+	if err := d.Read(collection, resource, &raw); err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+	if doc, err = DecodeValue(raw); err != nil {
+		return nil, err
+	}
+
+	values, projected := evalPath(doc, steps)
+	if len(values) == 0 && !projected {
+		return nil, ErrPathNotFound
+	}
+
+	if projected {
+		if values == nil {
+			values = []interface{}{}
+		}
+		return json.Marshal(values)
+	}
+	return json.Marshal(values[0])
+}
+
+type pathStep struct {
+	field    string
+	index    int
+	isIndex  bool
+	wildcard bool
+	descend  bool
+}
+
+// parsePath splits a path expression, as Extract takes it, into steps.
+func parsePath(path string) ([]pathStep, error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return nil, fmt.Errorf("Missing path expression")
+	}
+
+	rest := strings.TrimPrefix(path, "$")
+	var steps []pathStep
+
+	for first := true; rest != ""; first = false {
+		var step pathStep
+
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			step.descend = true
+			rest = rest[2:]
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("Invalid path '%s': missing ]", path)
+			}
+			inner := strings.TrimSpace(rest[1:end])
+			rest = rest[end+1:]
+
+			switch {
+			case inner == "*":
+				step.wildcard = true
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				step.field = inner[1 : len(inner)-1]
+			default:
+				n, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid path '%s': bad index '%s'", path, inner)
+				}
+				step.index, step.isIndex = n, true
+			}
+			steps = append(steps, step)
+			continue
+		case !first || strings.HasPrefix(path, "$"):
+			return nil, fmt.Errorf("Invalid path '%s' near '%s'", path, rest)
+		}
+
+		end := strings.IndexAny(rest, ".[")
+		if end < 0 {
+			end = len(rest)
+		}
+		name := rest[:end]
+		rest = rest[end:]
+
+		switch {
+		case name == "*":
+			step.wildcard = true
+		case name == "":
+			if !step.descend {
+				return nil, fmt.Errorf("Invalid path '%s': empty field name", path)
+			}
+		default:
+			step.field = name
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// evalPath applies steps to doc. projected reports whether the expression
+// can match several values, in which case the result is always a list.
+func evalPath(doc interface{}, steps []pathStep) (values []interface{}, projected bool) {
+	values = []interface{}{doc}
+
+	for _, step := range steps {
+		if step.descend {
+			projected = true
+			var all []interface{}
+			for _, v := range values {
+				all = append(all, descendants(v)...)
+			}
+			values = all
+			if step.field == "" && !step.wildcard && !step.isIndex {
+				continue
+			}
+		}
+
+		var next []interface{}
+		for _, v := range values {
+			switch {
+			case step.wildcard:
+				projected = true
+				next = append(next, children(v)...)
+			case step.isIndex:
+				if a, ok := v.([]interface{}); ok {
+					i := step.index
+					if i < 0 {
+						i += len(a)
+					}
+					if i >= 0 && i < len(a) {
+						next = append(next, a[i])
+					}
+				}
+			default:
+				if m, ok := v.(map[string]interface{}); ok {
+					if e, ok := m[step.field]; ok {
+						next = append(next, e)
+					}
+				}
+			}
+		}
+		values = next
+	}
+	return values, projected
+}
+
+// children returns the members of an object (in key order) or an array.
+func children(v interface{}) []interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		out := make([]interface{}, 0, len(t))
+		for _, k := range keys {
+			out = append(out, t[k])
+		}
+		return out
+	case []interface{}:
+		return t
+	}
+	return nil
+}
+
+// descendants returns v followed by every value nested inside it.
+func descendants(v interface{}) []interface{} {
+	out := []interface{}{v}
+	for _, c := range children(v) {
+		out = append(out, descendants(c)...)
+	}
+	return out
+}
@@ -0,0 +1,92 @@
+package jsondb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FaultPoint is a step of an atomic file write at which a test can inject
+// a crash.
+type FaultPoint int
+
+const (
+	// FaultBeforeSync crashes after the temporary file is written but
+	// before it is flushed; part of its content is lost.
+	FaultBeforeSync FaultPoint = iota
+
+	// FaultAfterTempWrite crashes once the temporary file is durable,
+	// before the target is replaced.
+	FaultAfterTempWrite
+
+	// FaultMidRename crashes after the target is replaced but before the
+	// directory holding it is flushed.
+	FaultMidRename
+)
+
+// FaultPoints lists every point a crash can be injected at.
+var FaultPoints = []FaultPoint{FaultBeforeSync, FaultAfterTempWrite, FaultMidRename}
+
+func (p FaultPoint) String() string {
+	switch p {
+	case FaultBeforeSync:
+		return "before-sync"
+	case FaultAfterTempWrite:
+		return "after-temp-write"
+	case FaultMidRename:
+		return "mid-rename"
+	}
+	return fmt.Sprintf("FaultPoint(%d)", int(p))
+}
+
+// FaultFunc decides whether the write of path crashes at point. It is
+// only meant for tests; see Options.Fault.
+type FaultFunc func(point FaultPoint, path string) bool
+
+// ErrInjectedFault is returned by a write that a FaultFunc crashed. The
+// driver must not be used afterwards; reopen the database instead, as a
+// restarted process would.
+var ErrInjectedFault = fmt.Errorf("Injected fault - simulated crash")
+
+func (b dirBackend) crash(point FaultPoint, path string) bool {
+	return b.fault != nil && b.fault(point, path)
+}
+
+// recoverDir removes the temporary files that writes interrupted by a
+// crash left next to the records of the collections, system namespace
+// included, returning their paths. The records they were replacing are
+// intact. Nothing else below the directory is touched.
+func (d *Driver) recoverDir() ([]string, error) {
+	var removed []string
+	for _, db := range []*Driver{d, d.System()} {
+		err := db.walkCollections("", func(collection string) error {
+			dir := filepath.Join(db.dir, collection)
+			files, err := db.backend.ReadDir(dir)
+			if err != nil {
+				return err
+			}
+
+			for _, file := range files {
+				if file.IsDir() || !strings.HasSuffix(file.Name(), ".json.tmp") {
+					continue
+				}
+
+				path := filepath.Join(dir, file.Name())
+				d.log.Warn("Removing '%s' left by an interrupted write\n", path)
+				if err := removeFile(d.retry, path); err != nil {
+					return err
+				}
+				removed = append(removed, path)
+			}
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		if db == db.System() {
+			break
+		}
+	}
+	return removed, nil
+}
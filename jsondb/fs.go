@@ -0,0 +1,63 @@
+package jsondb
+
+import (
+	"os"
+	"time"
+)
+
+// Platform file operations. Networked and overlay filesystems, and Windows
+// when another process (a virus scanner, an indexer, a concurrent reader)
+// has a file open, fail operations with errors that go away on their own.
+// File operations retry the errors isTransient classifies as temporary,
+// following the database's RetryPolicy; other errors fail at once.
+
+// RetryPolicy says how often a file operation failing with a transient
+// error is attempted, and how long to wait before the first retry; the
+// wait doubles with every further retry.
+type RetryPolicy struct {
+	Attempts int
+	Backoff  time.Duration
+}
+
+// DefaultRetryPolicy is used when Options.Retry is zero.
+var DefaultRetryPolicy = RetryPolicy{Attempts: 10, Backoff: 10 * time.Millisecond}
+
+// do runs op until it succeeds, fails permanently or runs out of attempts.
+func (p RetryPolicy) do(op func() error) error {
+	if p.Attempts <= 0 {
+		p = DefaultRetryPolicy
+	}
+	backoff := p.Backoff
+
+	var err error
+	for attempt := 0; attempt < p.Attempts; attempt++ {
+		if err = op(); err == nil || !isTransient(err) {
+			return err
+		}
+		if attempt < p.Attempts-1 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return err
+}
+
+// replaceFile atomically moves src over dst, replacing dst if it exists.
+func replaceFile(p RetryPolicy, src, dst string) error {
+	return p.do(func() error { return rename(src, dst) })
+}
+
+// removeFile deletes path; a missing file is not an error.
+func removeFile(p RetryPolicy, path string) error {
+	return p.do(func() error {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// removeAll deletes path and everything below it.
+func removeAll(p RetryPolicy, path string) error {
+	return p.do(func() error { return os.RemoveAll(path) })
+}
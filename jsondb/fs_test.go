@@ -0,0 +1,134 @@
+package jsondb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{Attempts: 3, Backoff: time.Millisecond}
+
+	var calls int
+	err := policy.do(func() error {
+		if calls++; calls < 3 {
+			return transientError
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("transient errors: %d calls, %v; want success on the third", calls, err)
+	}
+
+	calls = 0
+	err = policy.do(func() error { calls++; return transientError })
+	if !errors.Is(err, transientError) || calls != 3 {
+		t.Errorf("lasting transient error: %d calls, %v; want it after 3", calls, err)
+	}
+
+	calls = 0
+	permanent := errors.New("permanent")
+	err = policy.do(func() error { calls++; return permanent })
+	if err != permanent || calls != 1 {
+		t.Errorf("permanent error: %d calls, %v; want it at once", calls, err)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	wrapped := &os.PathError{Op: "rename", Path: "x", Err: transientError}
+	if !isTransient(transientError) || !isTransient(wrapped) {
+		t.Errorf("%v is not transient", transientError)
+	}
+	for _, err := range []error{os.ErrNotExist, os.ErrExist, errors.New("other")} {
+		if isTransient(err) {
+			t.Errorf("%v is transient", err)
+		}
+	}
+}
+
+func TestReplaceFile(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "a.json.tmp"), filepath.Join(dir, "a.json")
+
+	for _, content := range []string{"old", "new"} {
+		if err := os.WriteFile(src, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := replaceFile(DefaultRetryPolicy, src, dst); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := os.ReadFile(dst); err != nil || string(b) != content {
+			t.Errorf("dst = %q, %v; want %q", b, err, content)
+		}
+		if _, err := os.Stat(src); !os.IsNotExist(err) {
+			t.Errorf("src left behind: %v", err)
+		}
+	}
+}
+
+// TestReplaceOpenFile replaces a file another handle has open. POSIX
+// systems allow it; Windows refuses until the handle is closed, which the
+// retries wait out.
+func TestReplaceOpenFile(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "a.json.tmp"), filepath.Join(dir, "a.json")
+	if err := os.WriteFile(dst, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(src, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(50*time.Millisecond, func() { f.Close() })
+
+	if err := replaceFile(RetryPolicy{Attempts: 10, Backoff: 10 * time.Millisecond}, src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(dst); err != nil || string(b) != "new" {
+		t.Errorf("dst = %q, %v", b, err)
+	}
+}
+
+func TestRemoveFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.json")
+	if err := os.WriteFile(path, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := removeFile(DefaultRetryPolicy, path); err != nil {
+			t.Errorf("remove %d: %v", i, err)
+		}
+	}
+}
+
+func TestDirBackendWriteFile(t *testing.T) {
+	b := dirBackend{retry: DefaultRetryPolicy}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users", "ann.json")
+
+	for _, content := range []string{`{"Age":30}`, `{"Age":31}`} {
+		if err := b.WriteFile(path, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := b.ReadFile(path); err != nil || string(got) != content {
+			t.Errorf("read %q, %v; want %q", got, err, content)
+		}
+	}
+
+	files, err := os.ReadDir(filepath.Dir(path))
+	if err != nil || len(files) != 1 {
+		t.Errorf("directory holds %v, %v; want the record alone", files, err)
+	}
+}
+
+func TestProcessAlive(t *testing.T) {
+	if !processAlive(os.Getpid()) {
+		t.Error("this process is not alive")
+	}
+}
@@ -0,0 +1,50 @@
+//go:build !windows
+
+package jsondb
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// rename replaces dst with src; rename(2) is atomic on POSIX filesystems.
+func rename(src, dst string) error {
+	return os.Rename(src, dst)
+}
+
+// syncDir flushes the directory entry of a file just renamed into dir.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// isTransient reports errors that networked filesystems such as NFS return
+// while a file is busy or the server is briefly unreachable.
+func isTransient(err error) bool {
+	return errors.Is(err, syscall.EBUSY) ||
+		errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.ESTALE) ||
+		errors.Is(err, syscall.ETIMEDOUT)
+}
+
+// diskSpace returns the bytes available to unprivileged users and the size
+// of the filesystem holding dir.
+func diskSpace(dir string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), uint64(st.Blocks) * uint64(st.Bsize), nil
+}
+
+// processAlive reports whether the process pid is running.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
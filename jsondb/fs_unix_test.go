@@ -0,0 +1,8 @@
+//go:build !windows
+
+package jsondb
+
+import "syscall"
+
+// transientError is an error isTransient classifies as temporary.
+var transientError error = syscall.EBUSY
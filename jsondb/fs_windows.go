@@ -0,0 +1,89 @@
+//go:build windows
+
+package jsondb
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32               = syscall.NewLazyDLL("kernel32.dll")
+	procMoveFileExW        = kernel32.NewProc("MoveFileExW")
+	procGetDiskFreeSpaceEx = kernel32.NewProc("GetDiskFreeSpaceExW")
+)
+
+// Flags of MoveFileEx and the error codes isTransient checks, as defined
+// in the Windows SDK.
+const (
+	moveFileReplaceExisting = 0x1
+	moveFileWriteThrough    = 0x8
+
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+
+	processQueryLimitedInformation = 0x1000
+	stillActive                    = 259
+)
+
+// rename replaces dst with src using MoveFileEx, flushing the move to disk
+// before returning so a crash cannot leave the old file in place.
+func rename(src, dst string) error {
+	from, err := syscall.UTF16PtrFromString(src)
+	if err != nil {
+		return err
+	}
+	to, err := syscall.UTF16PtrFromString(dst)
+	if err != nil {
+		return err
+	}
+
+	flags := uintptr(moveFileReplaceExisting | moveFileWriteThrough)
+	if r, _, err := procMoveFileExW.Call(uintptr(unsafe.Pointer(from)), uintptr(unsafe.Pointer(to)), flags); r == 0 {
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: err}
+	}
+	return nil
+}
+
+// syncDir is a no-op: MOVEFILE_WRITE_THROUGH already flushed the rename.
+func syncDir(dir string) error {
+	return nil
+}
+
+// isTransient reports errors caused by another handle being open on the
+// file, which go away once that handle is closed.
+func isTransient(err error) bool {
+	return errors.Is(err, errorSharingViolation) ||
+		errors.Is(err, errorLockViolation) ||
+		errors.Is(err, syscall.ERROR_ACCESS_DENIED)
+}
+
+// diskSpace returns the bytes available to the caller and the size of the
+// volume holding dir.
+func diskSpace(dir string) (free, total uint64, err error) {
+	path, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	r, _, err := procGetDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(path)),
+		uintptr(unsafe.Pointer(&free)), uintptr(unsafe.Pointer(&total)), 0)
+	if r == 0 {
+		return 0, 0, err
+	}
+	return free, total, nil
+}
+
+// processAlive reports whether the process pid is running.
+func processAlive(pid int) bool {
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return errors.Is(err, syscall.ERROR_ACCESS_DENIED)
+	}
+	defer syscall.CloseHandle(h)
+
+	var code uint32
+	return syscall.GetExitCodeProcess(h, &code) == nil && code == stillActive
+}
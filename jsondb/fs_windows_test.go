@@ -0,0 +1,6 @@
+//go:build windows
+
+package jsondb
+
+// transientError is an error isTransient classifies as temporary.
+var transientError error = errorSharingViolation
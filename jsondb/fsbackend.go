@@ -0,0 +1,65 @@
+package jsondb
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// NewFromFS returns a read-only Driver over fsys, such as an embed.FS or
+// the file system of a zip archive, laid out like a database directory
+// (one directory per collection holding <resource>.json files). Reads and
+// queries work as usual; every write fails with ErrReadOnly.
+func NewFromFS(fsys fs.FS, options *Options) (*Driver, error) {
+	opts := defaultOptions(options)
+	return open(".", fsBackend{fsys}, opts), nil
+}
+
+// fsBackend serves a database from an io/fs file system.
+type fsBackend struct {
+	fsys fs.FS
+}
+
+// fsPath converts a driver path into an io/fs path.
+func fsPath(path string) string {
+	p := filepath.ToSlash(filepath.Clean(path))
+	p = strings.TrimPrefix(p, "./")
+	if p == "" || p == "/" {
+		return "."
+	}
+	return strings.TrimPrefix(p, "/")
+}
+
+func (b fsBackend) ReadFile(path string) ([]byte, error) {
+	return fs.ReadFile(b.fsys, fsPath(path))
+}
+
+func (b fsBackend) ReadDir(path string) ([]os.FileInfo, error) {
+	entries, err := fs.ReadDir(b.fsys, fsPath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (b fsBackend) Stat(path string) (os.FileInfo, error) {
+	return fs.Stat(b.fsys, fsPath(path))
+}
+
+func (fsBackend) WriteFile(string, []byte) error { return ErrReadOnly }
+func (fsBackend) Remove(string) error            { return ErrReadOnly }
+func (fsBackend) RemoveAll(string) error         { return ErrReadOnly }
+func (fsBackend) MkdirAll(string) error          { return ErrReadOnly }
@@ -0,0 +1,439 @@
+package jsondb
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Geospatial queries. A collection declares the field holding the location
+// of its records with CollectionConfig.Geo; a location is an object with
+// Lat and Lng members (Latitude, Lon and Longitude are accepted too, in
+// any case). The driver keeps an in-memory geohash index of that field,
+// built on the first geo query and maintained by every write and delete
+// after it, so Near and Within queries only read the records in the cells
+// covering the area searched.
+
+// earthRadius is the mean radius of the Earth in meters.
+const earthRadius = 6371008.8
+
+// Location is a point on the Earth, in degrees.
+type Location struct {
+	Lat, Lng float64
+}
+
+// Box is an area bounded by two parallels and two meridians. A box whose
+// MinLng is greater than its MaxLng crosses the antimeridian.
+type Box struct {
+	MinLat, MinLng, MaxLat, MaxLng float64
+}
+
+// Contains reports whether l lies inside b, edges included.
+func (b Box) Contains(l Location) bool {
+	if l.Lat < b.MinLat || l.Lat > b.MaxLat {
+		return false
+	}
+	if b.MinLng > b.MaxLng {
+		return l.Lng >= b.MinLng || l.Lng <= b.MaxLng
+	}
+	return l.Lng >= b.MinLng && l.Lng <= b.MaxLng
+}
+
+// split returns b as boxes that do not cross the antimeridian.
+func (b Box) split() []Box {
+	if b.MinLng <= b.MaxLng {
+		return []Box{b}
+	}
+	return []Box{
+		{b.MinLat, b.MinLng, b.MaxLat, 180},
+		{b.MinLat, -180, b.MaxLat, b.MaxLng},
+	}
+}
+
+// GeoFilter restricts a query to the records whose location is within
+// Radius meters of Near, or inside Within. Field is the path of the
+// location; empty means the collection's Geo field.
+type GeoFilter struct {
+	Field  string
+	Near   *Location `json:",omitempty"`
+	Radius float64   `json:",omitempty"`
+	Within *Box      `json:",omitempty"`
+}
+
+// Near returns a filter for the locations within radius meters of lat, lng.
+func Near(lat, lng, radius float64) *GeoFilter {
+	return &GeoFilter{Near: &Location{lat, lng}, Radius: radius}
+}
+
+// Within returns a filter for the locations inside the box.
+func Within(minLat, minLng, maxLat, maxLng float64) *GeoFilter {
+	return &GeoFilter{Within: &Box{minLat, minLng, maxLat, maxLng}}
+}
+
+// Validate checks the coordinates, radius and box of the filter.
+func (f *GeoFilter) Validate() error {
+	if f.Near == nil && f.Within == nil {
+		return fmt.Errorf("Geo filter needs a point or a box")
+	}
+	if f.Near != nil {
+		if !validLocation(*f.Near) {
+			return fmt.Errorf("Invalid location %v, %v", f.Near.Lat, f.Near.Lng)
+		}
+		if !(f.Radius >= 0) {
+			return fmt.Errorf("Invalid radius %v", f.Radius)
+		}
+	}
+	if b := f.Within; b != nil {
+		if !validLocation(Location{b.MinLat, b.MinLng}) || !validLocation(Location{b.MaxLat, b.MaxLng}) || b.MinLat > b.MaxLat {
+			return fmt.Errorf("Invalid box %v, %v, %v, %v", b.MinLat, b.MinLng, b.MaxLat, b.MaxLng)
+		}
+	}
+	return nil
+}
+
+// Match reports whether doc has a location at f.Field passing the filter.
+func (f *GeoFilter) Match(doc map[string]interface{}) bool {
+	v, ok := lookup(doc, f.Field)
+	if !ok {
+		return false
+	}
+	l, ok := ParseLocation(v)
+	if !ok {
+		return false
+	}
+	if f.Near != nil && Distance(*f.Near, l) > f.Radius {
+		return false
+	}
+	if f.Within != nil && !f.Within.Contains(l) {
+		return false
+	}
+	return true
+}
+
+// bounds returns the boxes covering the area of the filter.
+func (f *GeoFilter) bounds() []Box {
+	if f.Within != nil {
+		return f.Within.split()
+	}
+
+	c := *f.Near
+	dLat := f.Radius / earthRadius * 180 / math.Pi
+	minLat, maxLat := c.Lat-dLat, c.Lat+dLat
+	if minLat <= -90 || maxLat >= 90 {
+		// The circle covers a pole, and so every meridian
+		return []Box{{math.Max(minLat, -90), -180, math.Min(maxLat, 90), 180}}
+	}
+
+	dLng := dLat / math.Cos(c.Lat*math.Pi/180)
+	if dLng >= 180 {
+		return []Box{{minLat, -180, maxLat, 180}}
+	}
+	minLng, maxLng := c.Lng-dLng, c.Lng+dLng
+	if minLng < -180 {
+		minLng += 360
+	}
+	if maxLng > 180 {
+		maxLng -= 360
+	}
+	return Box{minLat, minLng, maxLat, maxLng}.split()
+}
+
+// Distance returns the great-circle distance between a and b in meters.
+func Distance(a, b Location) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// ParseLocation reads a location from a decoded object with latitude and
+// longitude members.
+func ParseLocation(v interface{}) (Location, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return Location{}, false
+	}
+
+	var l Location
+	var hasLat, hasLng bool
+	for key, value := range m {
+		f, ok := toFloat(value)
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "lat", "latitude":
+			l.Lat, hasLat = f, true
+		case "lng", "lon", "long", "longitude":
+			l.Lng, hasLng = f, true
+		}
+	}
+	return l, hasLat && hasLng && validLocation(l)
+}
+
+func validLocation(l Location) bool {
+	return l.Lat >= -90 && l.Lat <= 90 && l.Lng >= -180 && l.Lng <= 180
+}
+
+// Geohashes interleave the bits of the longitude and latitude, longitude
+// first, and spell them five at a time in this alphabet.
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohashPrecision is the length of the indexed geohashes, cells of a few
+// centimeters.
+const geohashPrecision = 12
+
+func geohash(l Location, precision int) string {
+	minLat, maxLat := -90.0, 90.0
+	minLng, maxLng := -180.0, 180.0
+
+	hash := make([]byte, precision)
+	var bit int
+	for i := range hash {
+		var ch int
+		for j := 0; j < 5; j, bit = j+1, bit+1 {
+			ch <<= 1
+			if bit%2 == 0 {
+				if mid := (minLng + maxLng) / 2; l.Lng >= mid {
+					ch |= 1
+					minLng = mid
+				} else {
+					maxLng = mid
+				}
+			} else {
+				if mid := (minLat + maxLat) / 2; l.Lat >= mid {
+					ch |= 1
+					minLat = mid
+				} else {
+					maxLat = mid
+				}
+			}
+		}
+		hash[i] = geohashAlphabet[ch]
+	}
+	return string(hash)
+}
+
+// cellSize returns the height and width in degrees of the geohash cells of
+// the given precision.
+func cellSize(precision int) (float64, float64) {
+	bits := precision * 5
+	latBits, lngBits := bits/2, bits-bits/2
+	return 180 / math.Exp2(float64(latBits)), 360 / math.Exp2(float64(lngBits))
+}
+
+// maxCoverCells bounds the number of cells covering a box: the finest
+// precision keeping under it is used.
+const maxCoverCells = 64
+
+// coverBox returns geohash prefixes whose cells together cover b, which
+// does not cross the antimeridian.
+func coverBox(b Box) []string {
+	precision := 1
+	for ; precision < geohashPrecision; precision++ {
+		h, w := cellSize(precision + 1)
+		if (math.Floor((b.MaxLat-b.MinLat)/h)+2)*(math.Floor((b.MaxLng-b.MinLng)/w)+2) > maxCoverCells {
+			break
+		}
+	}
+	h, w := cellSize(precision)
+
+	// Samples no further apart than a cell hit every cell the box overlaps
+	cells := make(map[string]bool)
+	for lat := b.MinLat; ; lat += h {
+		lat = math.Min(lat, b.MaxLat)
+		for lng := b.MinLng; ; lng += w {
+			lng = math.Min(lng, b.MaxLng)
+			cells[geohash(Location{lat, lng}, precision)] = true
+			if lng >= b.MaxLng {
+				break
+			}
+		}
+		if lat >= b.MaxLat {
+			break
+		}
+	}
+
+	prefixes := make([]string, 0, len(cells))
+	for cell := range cells {
+		prefixes = append(prefixes, cell)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// geoEntry is one indexed record.
+type geoEntry struct {
+	hash     string
+	resource string
+}
+
+// geoIndex is the geohash index of the Geo field of one collection: its
+// entries sorted by geohash, so the records of a cell are a contiguous run.
+type geoIndex struct {
+	field   string
+	mutex   sync.Mutex
+	entries []geoEntry
+	hashes  map[string]string // resource -> geohash
+}
+
+func (ix *geoIndex) put(resource string, doc map[string]interface{}) {
+	ix.mutex.Lock()
+	defer ix.mutex.Unlock()
+
+	if hash, ok := ix.hashes[resource]; ok {
+		i := ix.find(hash, resource)
+		ix.entries = append(ix.entries[:i], ix.entries[i+1:]...)
+		delete(ix.hashes, resource)
+	}
+
+	if doc == nil {
+		return
+	}
+	v, ok := lookup(doc, ix.field)
+	if !ok {
+		return
+	}
+	l, ok := ParseLocation(v)
+	if !ok {
+		return
+	}
+
+	hash := geohash(l, geohashPrecision)
+	i := ix.find(hash, resource)
+	ix.entries = append(ix.entries, geoEntry{})
+	copy(ix.entries[i+1:], ix.entries[i:])
+	ix.entries[i] = geoEntry{hash, resource}
+	ix.hashes[resource] = hash
+}
+
+// find returns the position of the entry, or where it belongs.
+func (ix *geoIndex) find(hash, resource string) int {
+	return sort.Search(len(ix.entries), func(i int) bool {
+		e := ix.entries[i]
+		return e.hash > hash || (e.hash == hash && e.resource >= resource)
+	})
+}
+
+// search returns, in name order, the resources in the cells covering the
+// boxes.
+func (ix *geoIndex) search(boxes []Box) []string {
+	ix.mutex.Lock()
+	defer ix.mutex.Unlock()
+
+	found := make(map[string]bool)
+	for _, b := range boxes {
+		for _, prefix := range coverBox(b) {
+			i := sort.Search(len(ix.entries), func(i int) bool { return ix.entries[i].hash >= prefix })
+			for ; i < len(ix.entries) && strings.HasPrefix(ix.entries[i].hash, prefix); i++ {
+				found[ix.entries[i].resource] = true
+			}
+		}
+	}
+
+	resources := make([]string, 0, len(found))
+	for resource := range found {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+	return resources
+}
+
+// geoIndexFor returns the index of collection's Geo field, building it from
+// the records on first use. The caller holds the collection lock.
+func (d *Driver) geoIndexFor(collection, field string) (*geoIndex, error) {
+	d.mutex.Lock()
+	ix, ok := d.geo[collection]
+	d.mutex.Unlock()
+	if ok && ix.field == field {
+		return ix, nil
+	}
+
+	ix = &geoIndex{field: field, hashes: make(map[string]string)}
+	err := d.scan(collection, func(resource string, b []byte) error {
+		doc, err := decodeDocument(b)
+		if err != nil {
+			return fmt.Errorf("Error decoding '%s': %v", resource, err)
+		}
+		ix.put(resource, doc)
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if cur, ok := d.geo[collection]; ok && cur.field == field {
+		return cur, nil // built meanwhile by a concurrent query
+	}
+	d.geo[collection] = ix
+	return ix, nil
+}
+
+// updateGeo keeps the geo index of collection, if built, up to date with a
+// write, or a delete when doc is nil. The caller holds the collection lock
+// exclusively.
+func (d *Driver) updateGeo(collection, resource string, doc map[string]interface{}) {
+	d.mutex.Lock()
+	ix, ok := d.geo[collection]
+	d.mutex.Unlock()
+
+	if ok {
+		ix.put(resource, doc)
+	}
+}
+
+// forgetGeo drops the geo indexes of collection and the collections nested
+// in it; they are rebuilt by the next query.
+func (d *Driver) forgetGeo(collection string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for name := range d.geo {
+		if name == collection || strings.HasPrefix(name, collection+"/") {
+			delete(d.geo, name)
+		}
+	}
+}
+
+// queryGeo is query for queries with a geo filter on the indexed field:
+// only the records in the cells covering the area are read.
+func (d *Driver) queryGeo(collection string, q Query, ix *geoIndex, budget *queryBudget) ([]Document, error) {
+	dir := filepath.Join(d.dir, collection)
+	if _, err := d.stat(dir); err != nil {
+		return nil, err
+	}
+
+	var docs []Document
+	for _, resource := range ix.search(q.Geo.bounds()) {
+		if err := budget.examine(len(docs)); err != nil {
+			return docs, err
+		}
+		b, err := d.backend.ReadFile(filepath.Join(dir, resource+".json"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		doc, err := decodeDocument(b)
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding '%s': %v", resource, err)
+		}
+		if q.Match(doc) {
+			docs = append(docs, Document{Resource: resource, Data: doc})
+		}
+		if q.Limit > 0 && len(docs) >= q.Limit {
+			break
+		}
+	}
+	return docs, nil
+}
@@ -0,0 +1,387 @@
+package jsondb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Graph relations. An edge joins two records with a named relation, as in
+// users/ada FOLLOWS users/grace. Edges live in two system collections, one
+// keyed by their source and one by their target, so the edges leaving or
+// entering a record are listed from directory names alone, in either
+// direction. Deleting a record deletes its edges.
+
+// edgesCollection holds the edges under Key{fromCollection, fromID,
+// relation, toCollection, toID}; inEdgesCollection mirrors them under
+// Key{toCollection, toID, relation, fromCollection, fromID}.
+const (
+	edgesCollection   = "edges"
+	inEdgesCollection = "edges-in"
+)
+
+// Node is a record taking part in a relation.
+type Node struct {
+	Collection string
+	ID         string
+}
+
+// Edge is a relation from one record to another.
+type Edge struct {
+	From     Node
+	Relation string
+	To       Node
+}
+
+func (e Edge) validate() error {
+	if e.Relation == "" {
+		return fmt.Errorf("Missing relation - unable to link records")
+	}
+	if err := validName(e.From.Collection, e.From.ID); err != nil {
+		return err
+	}
+	if e.From.ID == "" || e.To.ID == "" {
+		return fmt.Errorf("Missing resource - unable to link records")
+	}
+	return validName(e.To.Collection, e.To.ID)
+}
+
+func (e Edge) outKey() string {
+	return NewKey(e.From.Collection, e.From.ID, e.Relation, e.To.Collection, e.To.ID).String()
+}
+
+func (e Edge) inKey() string {
+	return NewKey(e.To.Collection, e.To.ID, e.Relation, e.From.Collection, e.From.ID).String()
+}
+
+// edgeRecord is the stored form of an edge.
+type edgeRecord struct {
+	Edge
+	Created time.Time
+}
+
+// Direction selects the edges followed from a record.
+type Direction string
+
+const (
+	Outbound Direction = "out"
+	Inbound  Direction = "in"
+	Both     Direction = "both"
+)
+
+// Link records that fromCollection/fromID is related to toCollection/toID
+// by relation. Linking twice is harmless. The records themselves need not
+// exist yet.
+func (d *Driver) Link(fromCollection, fromID, relation, toCollection, toID string) (err error) {
+	fromCollection, toCollection = d.resolve(fromCollection), d.resolve(toCollection)
+	d, span := d.trace("Link", fromCollection, fromID)
+	defer span.end(&err)
+
+	for _, collection := range []string{fromCollection, toCollection} {
+		if err := d.allow(PolicyWrite, collection); err != nil {
+			return err
+		}
+	}
+
+	e := Edge{Node{fromCollection, fromID}, relation, Node{toCollection, toID}}
+	if err := e.validate(); err != nil {
+		return err
+	}
+
+	sys := d.System()
+	unlock, err := sys.lockEdges(LockWrite)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	record := edgeRecord{e, time.Now().UTC()}
+	if err := sys.write(edgesCollection, e.outKey(), record); err != nil {
+		return err
+	}
+	return sys.write(inEdgesCollection, e.inKey(), record)
+}
+
+// Unlink removes the edge Link made; removing a missing edge is not an
+// error.
+func (d *Driver) Unlink(fromCollection, fromID, relation, toCollection, toID string) (err error) {
+	fromCollection, toCollection = d.resolve(fromCollection), d.resolve(toCollection)
+	d, span := d.trace("Unlink", fromCollection, fromID)
+	defer span.end(&err)
+
+	for _, collection := range []string{fromCollection, toCollection} {
+		if err := d.allow(PolicyDelete, collection); err != nil {
+			return err
+		}
+	}
+
+	e := Edge{Node{fromCollection, fromID}, relation, Node{toCollection, toID}}
+	if err := e.validate(); err != nil {
+		return err
+	}
+
+	sys := d.System()
+	unlock, err := sys.lockEdges(LockWrite)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return sys.removeEdge(e)
+}
+
+// Edges returns the edges leaving or entering a record, or both, ordered
+// by relation and then by the record at their other end. An empty relation
+// matches every relation.
+func (d *Driver) Edges(n Node, dir Direction, relation string) (_ []Edge, err error) {
+	n.Collection = d.resolve(n.Collection)
+	d, span := d.trace("Edges", n.Collection, n.ID)
+	defer span.end(&err)
+
+	if err := d.allow(PolicyRead, n.Collection); err != nil {
+		return nil, err
+	}
+	if err := validName(n.Collection, n.ID); err != nil {
+		return nil, err
+	}
+
+	sys := d.System()
+	unlock, err := sys.lockEdges(LockRead)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return sys.edges(n, dir, relation)
+}
+
+// edges is Edges on the system driver, for callers holding the edge locks.
+func (d *Driver) edges(n Node, dir Direction, relation string) ([]Edge, error) {
+	prefix := NewKey(n.Collection, n.ID)
+	if relation != "" {
+		prefix = prefix.Append(relation)
+	}
+
+	var edges []Edge
+	list := func(collection string, inbound bool) error {
+		names, err := d.edgeNames(collection, prefix.String()+keySeparator)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			k, err := ParseKey(name)
+			if err != nil || len(k) != 5 {
+				continue // not an edge
+			}
+			e := Edge{Node{k[0], k[1]}, k[2], Node{k[3], k[4]}}
+			if inbound {
+				e.From, e.To = e.To, e.From
+			}
+			edges = append(edges, e)
+		}
+		return nil
+	}
+
+	switch dir {
+	case Outbound, "":
+		return edges, list(edgesCollection, false)
+	case Inbound:
+		return edges, list(inEdgesCollection, true)
+	case Both:
+		if err := list(edgesCollection, false); err != nil {
+			return nil, err
+		}
+		return edges, list(inEdgesCollection, true)
+	}
+	return nil, fmt.Errorf("Unknown direction '%s'", dir)
+}
+
+// edgeNames lists the names in an edge collection starting with prefix.
+func (d *Driver) edgeNames(collection, prefix string) ([]string, error) {
+	files, err := d.backend.ReadDir(filepath.Join(d.dir, collection))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if !isRecord(file) {
+			continue
+		}
+		if name := strings.TrimSuffix(file.Name(), ".json"); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// removeEdge deletes both records of e; the caller holds the edge locks.
+func (d *Driver) removeEdge(e Edge) error {
+	for _, path := range []string{
+		filepath.Join(d.dir, edgesCollection, e.outKey()+".json"),
+		filepath.Join(d.dir, inEdgesCollection, e.inKey()+".json"),
+	} {
+		if err := d.backend.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// unlinkRecord deletes the edges of a deleted record.
+func (d *Driver) unlinkRecord(collection, resource string) error {
+	sys := d.System()
+	if sys == d {
+		return nil // system records take no part in relations
+	}
+
+	unlock, err := sys.lockEdges(LockWrite)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	edges, err := sys.edges(Node{collection, resource}, Both, "")
+	if err != nil {
+		return err
+	}
+	for _, e := range edges {
+		if err := sys.removeEdge(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockEdges locks both edge collections in mode, always in the same
+// order, and returns the function unlocking them.
+func (d *Driver) lockEdges(mode string) (func(), error) {
+	unlockOut, err := d.lockCollection(edgesCollection, mode)
+	if err != nil {
+		return nil, err
+	}
+	unlockIn, err := d.lockCollection(inEdgesCollection, mode)
+	if err != nil {
+		unlockOut()
+		return nil, err
+	}
+	return func() {
+		unlockIn()
+		unlockOut()
+	}, nil
+}
+
+// TraversalOptions shape a traversal.
+type TraversalOptions struct {
+	// Relation is the relation followed; empty follows every relation.
+	Relation string
+
+	// Direction is the direction edges are followed in; Outbound by
+	// default.
+	Direction Direction
+
+	// MinDepth and MaxDepth bound the depths of the records returned. A
+	// record is returned at the depth it is first reached, so MinDepth 2
+	// and MaxDepth 2 from a user following others gives the people their
+	// followees follow that the user does not follow. MaxDepth defaults
+	// to 1 and is capped at MaxTraversalDepth.
+	MinDepth int
+	MaxDepth int
+
+	// Limit is the most records returned.
+	Limit int
+
+	// Records includes the content of the records reached.
+	Records bool
+}
+
+// MaxTraversalDepth bounds TraversalOptions.MaxDepth.
+const MaxTraversalDepth = 10
+
+// Hop is a record reached by a traversal: its depth and the edge it was
+// first reached through.
+type Hop struct {
+	Node
+	Depth  int
+	Via    Edge
+	Record map[string]interface{} `json:",omitempty"`
+}
+
+// Traverse walks the graph breadth first from start and returns the
+// records reached, nearest first. The start record is never returned.
+func (d *Driver) Traverse(start Node, opts TraversalOptions) (_ []Hop, err error) {
+	start.Collection = d.resolve(start.Collection)
+	d, span := d.trace("Traverse", start.Collection, start.ID)
+	defer span.end(&err)
+
+	if err := d.allow(PolicyRead, start.Collection); err != nil {
+		return nil, err
+	}
+	if err := validName(start.Collection, start.ID); err != nil {
+		return nil, err
+	}
+	if opts.MaxDepth <= 0 {
+		opts.MaxDepth = 1
+	}
+	if opts.MaxDepth > MaxTraversalDepth {
+		return nil, fmt.Errorf("Traversal depth %d exceeds the maximum of %d", opts.MaxDepth, MaxTraversalDepth)
+	}
+
+	sys := d.System()
+	unlock, err := sys.lockEdges(LockRead)
+	if err != nil {
+		return nil, err
+	}
+	var hops []Hop
+
+	seen := map[Node]bool{start: true}
+	frontier := []Node{start}
+	for depth := 1; depth <= opts.MaxDepth && len(frontier) > 0; depth++ {
+		var next []Node
+		for _, n := range frontier {
+			edges, err := sys.edges(n, opts.Direction, opts.Relation)
+			if err != nil {
+				unlock()
+				return nil, err
+			}
+
+			for _, e := range edges {
+				to := e.To
+				if to == n {
+					to = e.From // inbound edge
+				}
+				if seen[to] {
+					continue
+				}
+				seen[to] = true
+				next = append(next, to)
+
+				if depth >= opts.MinDepth {
+					hops = append(hops, Hop{Node: to, Depth: depth, Via: e})
+				}
+			}
+		}
+		if opts.Limit > 0 && len(hops) >= opts.Limit {
+			hops = hops[:opts.Limit]
+			break
+		}
+		frontier = next
+	}
+	unlock()
+
+	if opts.Records {
+		for i := range hops {
+			var record map[string]interface{}
+			if err := d.Read(hops[i].Collection, hops[i].ID, &record); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			hops[i].Record = record
+		}
+	}
+	return hops, nil
+}
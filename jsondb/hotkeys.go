@@ -0,0 +1,130 @@
+package jsondb
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HotKeyConfig turns on the counting of the accesses to records, for
+// HotKeys to report the most accessed ones.
+type HotKeyConfig struct {
+	// SampleRate is the fraction of accesses counted, such as 0.01 for one
+	// in a hundred, to keep the overhead low; zero disables counting.
+	SampleRate float64
+
+	// MaxKeys bounds the records counted per collection; 10000 by
+	// default. Past it, a newly seen record takes the place of the least
+	// counted one, inheriting its count, so the top of the report stays
+	// right while the tail is approximate.
+	MaxKeys int
+}
+
+// HotKey is how often a record was accessed since counting started.
+// Reads and Writes are estimates, the sampled counts over the sample
+// rate.
+type HotKey struct {
+	Resource string
+	Reads    int64
+	Writes   int64
+	Since    time.Time
+}
+
+// hotKeys counts the sampled accesses to records, by collection, shared by
+// the copies of a driver.
+type hotKeys struct {
+	mutex       sync.Mutex
+	rate        float64
+	max         int
+	since       time.Time
+	collections map[string]map[string]*keyCount
+}
+
+type keyCount struct {
+	reads, writes int64
+}
+
+func newHotKeys(cfg HotKeyConfig) *hotKeys {
+	if cfg.SampleRate <= 0 {
+		return nil
+	}
+	if cfg.SampleRate > 1 {
+		cfg.SampleRate = 1
+	}
+	if cfg.MaxKeys <= 0 {
+		cfg.MaxKeys = 10000
+	}
+	return &hotKeys{rate: cfg.SampleRate, max: cfg.MaxKeys, since: time.Now(), collections: make(map[string]map[string]*keyCount)}
+}
+
+// count counts, if sampled, an access to collection/resource.
+func (h *hotKeys) count(collection, resource string, write bool) {
+	if h == nil || collection == "" || resource == "" || (h.rate < 1 && rand.Float64() >= h.rate) {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	keys, ok := h.collections[collection]
+	if !ok {
+		keys = make(map[string]*keyCount)
+		h.collections[collection] = keys
+	}
+	c, ok := keys[resource]
+	if !ok {
+		c = &keyCount{}
+		if len(keys) >= h.max {
+			var least string
+			for resource, other := range keys {
+				if least == "" || other.reads+other.writes < keys[least].reads+keys[least].writes {
+					least = resource
+				}
+			}
+			*c = *keys[least]
+			delete(keys, least)
+		}
+		keys[resource] = c
+	}
+	if write {
+		c.writes++
+	} else {
+		c.reads++
+	}
+}
+
+// HotKeys returns the topN records of collection accessed most since the
+// database was opened, reads and writes together, most accessed first;
+// every record counted when topN is zero. It returns none unless
+// Options.HotKeys turns counting on.
+func (d *Driver) HotKeys(collection string, topN int) []HotKey {
+	h := d.hotKeys
+	if h == nil {
+		return nil
+	}
+	collection = d.resolve(collection)
+
+	h.mutex.Lock()
+	keys := make([]HotKey, 0, len(h.collections[collection]))
+	for resource, c := range h.collections[collection] {
+		keys = append(keys, HotKey{
+			Resource: resource,
+			Reads:    int64(float64(c.reads) / h.rate),
+			Writes:   int64(float64(c.writes) / h.rate),
+			Since:    h.since,
+		})
+	}
+	h.mutex.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if a, b := keys[i].Reads+keys[i].Writes, keys[j].Reads+keys[j].Writes; a != b {
+			return a > b
+		}
+		return keys[i].Resource < keys[j].Resource
+	})
+	if topN > 0 && len(keys) > topN {
+		keys = keys[:topN]
+	}
+	return keys
+}
@@ -0,0 +1,24 @@
+package jsondb
+
+import "time"
+
+// Instrumentation receives every driver operation, so metrics backends such
+// as StatsD or OpenTelemetry metrics can be plugged in through Options
+// without the package depending on them. Both methods are called on the
+// goroutine running the operation and must be safe for concurrent use.
+type Instrumentation interface {
+	OnOpStart(op OpInfo)
+	OnOpEnd(op OpInfo, elapsed time.Duration, err error)
+}
+
+// OpInfo describes a driver operation such as "Write" or "Query". Resource
+// is empty for operations on a whole collection.
+type OpInfo struct {
+	Op         string
+	Collection string
+	Resource   string
+	Start      time.Time
+
+	// System is set for operations on the reserved system namespace.
+	System bool
+}
@@ -0,0 +1,27 @@
+package jsondb
+
+import (
+	"io"
+	"log"
+	"testing"
+)
+
+// quiet returns options that discard the log.
+func quiet() *Options {
+	return &Options{Logger: NewStdLogger(log.New(io.Discard, "", 0), LogError)}
+}
+
+// openTest opens a database in a temporary directory, closed with the test.
+func openTest(t *testing.T, options *Options) (*Driver, string) {
+	t.Helper()
+	if options == nil {
+		options = quiet()
+	}
+	dir := t.TempDir()
+	db, err := New(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, dir
+}
@@ -0,0 +1,222 @@
+package jsondb
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// keySeparator joins the parts of a Key in its resource name.
+const keySeparator = "#"
+
+// Key is a resource name built from ordered parts, such as a country, a
+// state and a name. Its String form escapes every part, so parts may hold
+// any text, including the separator, and records sharing leading parts
+// can be listed with ReadPrefix.
+type Key []string
+
+// NewKey returns the key made of parts.
+func NewKey(parts ...string) Key {
+	return Key(parts)
+}
+
+// Append returns k extended with parts.
+func (k Key) Append(parts ...string) Key {
+	return append(append(Key{}, k...), parts...)
+}
+
+// HasPrefix reports whether the leading parts of k are those of prefix.
+func (k Key) HasPrefix(prefix Key) bool {
+	if len(prefix) > len(k) {
+		return false
+	}
+	for i, part := range prefix {
+		if k[i] != part {
+			return false
+		}
+	}
+	return true
+}
+
+// keyEscaper escapes the characters that cannot appear in a resource name
+// or would be mistaken for the separator.
+var keyEscaper = strings.NewReplacer("%", "%25", keySeparator, "%23", "/", "%2F", "\\", "%5C", "\x00", "%00")
+
+// String returns the resource name of k: its escaped parts joined by "#",
+// as in "us#ca#San Jose" for Key{"us", "ca", "San Jose"}.
+func (k Key) String() string {
+	parts := make([]string, len(k))
+	for i, part := range k {
+		switch part {
+		case ".", "..":
+			parts[i] = strings.ReplaceAll(part, ".", "%2E")
+		case manifestName:
+			parts[i] = "%5F" + part[1:]
+		default:
+			parts[i] = keyEscaper.Replace(part)
+		}
+	}
+	return strings.Join(parts, keySeparator)
+}
+
+// ParseKey splits a resource name made by Key.String back into its parts.
+func ParseKey(resource string) (Key, error) {
+	var k Key
+	for _, part := range strings.Split(resource, keySeparator) {
+		p, err := url.PathUnescape(part)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key '%s': %v", resource, err)
+		}
+		k = append(k, p)
+	}
+	return k, nil
+}
+
+// ReadPrefix returns the records of collection whose keys start with
+// prefix, ordered by resource name. Only the matching files are read.
+func (d *Driver) ReadPrefix(collection string, prefix Key) (_ []Document, err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("ReadPrefix", collection, prefix.String())
+	defer span.end(&err)
+
+	if err := d.allow(PolicyRead, collection); err != nil {
+		return nil, err
+	}
+
+	if err := validName(collection, ""); err != nil {
+		return nil, err
+	}
+
+	unlock, err := d.lockCollection(collection, LockRead)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	dir := filepath.Join(d.dir, collection)
+
+	if _, err := d.stat(dir); err != nil {
+		return nil, err
+	}
+
+	files, err := d.backend.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	name := prefix.String()
+	var docs []Document
+	var n int
+
+	for _, file := range files {
+		if !isRecord(file) {
+			continue
+		}
+
+		resource := strings.TrimSuffix(file.Name(), ".json")
+		if len(prefix) > 0 && resource != name && !strings.HasPrefix(resource, name+keySeparator) {
+			continue
+		}
+
+		b, err := d.backend.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		n += len(b)
+
+		doc, err := decodeDocument(b)
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding '%s': %v", resource, err)
+		}
+		docs = append(docs, Document{Resource: resource, Data: doc})
+	}
+
+	d.traceBytes(n)
+	return docs, nil
+}
+
+// ListOptions selects the resource names ListKeys returns. Zero fields do
+// not filter.
+type ListOptions struct {
+	// Prefix keeps names starting with it. Use Key.String() with a
+	// trailing "#" to match whole parts of a composite key.
+	Prefix string
+
+	// From and To bound the names lexicographically: From is inclusive,
+	// To exclusive.
+	From string
+	To   string
+
+	// Reverse lists names in descending order; From and To keep their
+	// meaning.
+	Reverse bool
+
+	// Limit is the most names returned.
+	Limit int
+}
+
+// ListKeys returns the resource names of collection selected by opts, in
+// ascending order unless opts.Reverse is set. Only the directory is read,
+// never the records.
+func (d *Driver) ListKeys(collection string, opts ListOptions) (_ []string, err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("ListKeys", collection, "")
+	defer span.end(&err)
+
+	if err := d.allow(PolicyRead, collection); err != nil {
+		return nil, err
+	}
+
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to list")
+	}
+
+	if err := validName(collection, ""); err != nil {
+		return nil, err
+	}
+
+	unlock, err := d.lockCollection(collection, LockRead)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	dir := filepath.Join(d.dir, collection)
+
+	if _, err := d.stat(dir); err != nil {
+		return nil, err
+	}
+
+	files, err := d.backend.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, file := range files {
+		if !isRecord(file) {
+			continue
+		}
+
+		name := strings.TrimSuffix(file.Name(), ".json")
+		if !strings.HasPrefix(name, opts.Prefix) ||
+			(opts.From != "" && name < opts.From) ||
+			(opts.To != "" && name >= opts.To) {
+			continue
+		}
+		keys = append(keys, name)
+	}
+
+	sort.Strings(keys)
+	if opts.Reverse {
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+	if opts.Limit > 0 && len(keys) > opts.Limit {
+		keys = keys[:opts.Limit]
+	}
+	return keys, nil
+}
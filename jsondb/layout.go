@@ -0,0 +1,212 @@
+package jsondb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LayoutVersion is the version of the directory layout this package
+// writes. Directories of an older layout are migrated by New when its
+// UpgradePolicy allows it, and by Upgrade.
+//
+//	1  records in collection directories, metadata in the _system namespace
+const LayoutVersion = 1
+
+// layoutFile stamps the database directory with its layout version.
+const layoutFile = "_layout.json"
+
+// ErrLayoutOutdated is returned by New for a directory of an older layout
+// when its UpgradePolicy does not allow migrating it.
+var ErrLayoutOutdated = fmt.Errorf("Database directory has an older layout; run dbctl upgrade or enable automatic upgrades")
+
+// ErrLayoutTooNew is returned by New for a directory written by a newer
+// version of this package.
+var ErrLayoutTooNew = fmt.Errorf("Database directory has a newer layout than this version supports")
+
+// UpgradePolicy says what New does with a directory of an older layout.
+type UpgradePolicy struct {
+	// Auto migrates the directory to LayoutVersion; otherwise New fails
+	// with ErrLayoutOutdated.
+	Auto bool
+
+	// NoBackup skips the copy of the directory made before migrating.
+	NoBackup bool
+}
+
+// layout is the content of the layout file.
+type layout struct {
+	Version int
+	Written time.Time
+}
+
+// migration turns a directory of layout from into one of layout from+1.
+type migration struct {
+	from        int
+	description string
+	run         func(d *Driver) error
+}
+
+// migrations lists the migrations in order; there are none yet.
+var migrations []migration
+
+// LayoutOf returns the layout version of the database in dir, 0 if there
+// is none. Directories from before layout versions were stamped have the
+// first layout.
+func LayoutOf(dir string) (int, error) {
+	b, err := os.ReadFile(filepath.Join(dir, layoutFile))
+	if err == nil {
+		var l layout
+		if err := json.Unmarshal(b, &l); err != nil || l.Version < 1 {
+			return 0, fmt.Errorf("Invalid layout file in '%s'", dir)
+		}
+		return l.Version, nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+// writeLayout stamps the directory with the current layout version.
+func (d *Driver) writeLayout() error {
+	b, err := json.MarshalIndent(layout{Version: LayoutVersion, Written: time.Now().UTC()}, "", "\t")
+	if err != nil {
+		return err
+	}
+	return d.backend.WriteFile(filepath.Join(d.dir, layoutFile), b)
+}
+
+// checkLayout migrates the directory to the current layout if it is older
+// and upgrade allows it, then stamps it.
+func (d *Driver) checkLayout(upgrade UpgradePolicy) error {
+	version, err := LayoutOf(d.dir)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case version > LayoutVersion:
+		return ErrLayoutTooNew
+	case version < LayoutVersion && !upgrade.Auto:
+		return ErrLayoutOutdated
+	case version < LayoutVersion:
+		if err := d.migrate(version, upgrade); err != nil {
+			return err
+		}
+	}
+
+	if _, err := d.backend.Stat(filepath.Join(d.dir, layoutFile)); err == nil {
+		return nil
+	}
+	return d.writeLayout()
+}
+
+// migrate runs the migrations from version to the current layout, after
+// copying the directory aside unless upgrade says not to.
+func (d *Driver) migrate(version int, upgrade UpgradePolicy) error {
+	d.log.Info("Migrating '%s' from layout %d to %d...\n", d.dir, version, LayoutVersion)
+
+	if !upgrade.NoBackup {
+		backup, err := d.backupDir(version)
+		if err != nil {
+			return fmt.Errorf("Error backing up '%s' before migrating: %v", d.dir, err)
+		}
+		d.log.Info("Backed up '%s' to '%s'\n", d.dir, backup)
+	}
+
+	for _, m := range migrations {
+		if m.from < version {
+			continue
+		}
+		d.log.Info("Layout %d to %d: %s\n", m.from, m.from+1, m.description)
+		if err := m.run(d); err != nil {
+			return fmt.Errorf("Error migrating '%s' from layout %d: %v", d.dir, m.from, err)
+		}
+	}
+
+	if err := d.writeLayout(); err != nil {
+		return err
+	}
+	d.log.Info("Migrated '%s' to layout %d\n", d.dir, LayoutVersion)
+	return nil
+}
+
+// backupDir copies the database directory next to itself, as
+// <dir>.layout<version>-<time>, returning the copy's path.
+func (d *Driver) backupDir(version int) (string, error) {
+	dir, err := filepath.Abs(d.dir)
+	if err != nil {
+		return "", err
+	}
+	backup := fmt.Sprintf("%s.layout%d-%s", dir, version, time.Now().UTC().Format("20060102T150405"))
+
+	var files int
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(backup, rel)
+
+		if entry.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !entry.Type().IsRegular() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		if err := copyFile(path, target); err != nil {
+			return err
+		}
+		if files++; files%1000 == 0 {
+			d.log.Info("Backed up %d files...\n", files)
+		}
+		return nil
+	})
+	return backup, err
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Upgrade migrates the database in dir to the current layout without
+// opening it, backing it up first unless noBackup is set. It returns the
+// layout version the directory had.
+func Upgrade(dir string, logger Logger, noBackup bool) (int, error) {
+	dir = filepath.Clean(dir)
+	version, err := LayoutOf(dir)
+	if err != nil || version == 0 {
+		return version, err
+	}
+
+	opts := defaultOptions(&Options{Logger: logger})
+	d := newDriver(dir, opts.Logger, dirBackend{})
+	return version, d.checkLayout(UpgradePolicy{Auto: true, NoBackup: noBackup})
+}
@@ -0,0 +1,37 @@
+package jsondb
+
+import "context"
+
+// BeforeSaver is implemented by record types that prepare themselves to be
+// stored, such as to normalize fields, compute defaults or encrypt values.
+// Write, Save and Tx.Write call BeforeSave on the value they are given,
+// with the context of the driver, before encoding it; an error stops the
+// write. A pointer must be written for a method with a pointer receiver to
+// be called.
+type BeforeSaver interface {
+	BeforeSave(ctx context.Context) error
+}
+
+// AfterLoader is implemented by record types that finish being read, such
+// as to decrypt values or fill derived fields. Read, Tx.Read and
+// DecodeRecord call AfterLoad on the value they decode into, with the
+// context of the driver; an error fails the read.
+type AfterLoader interface {
+	AfterLoad(ctx context.Context) error
+}
+
+// beforeSave calls the BeforeSave method of v, if any.
+func (d *Driver) beforeSave(v interface{}) error {
+	if s, ok := v.(BeforeSaver); ok {
+		return s.BeforeSave(d.Context())
+	}
+	return nil
+}
+
+// afterLoad calls the AfterLoad method of v, if any.
+func (d *Driver) afterLoad(v interface{}) error {
+	if l, ok := v.(AfterLoader); ok {
+		return l.AfterLoad(d.Context())
+	}
+	return nil
+}
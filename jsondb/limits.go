@@ -0,0 +1,93 @@
+package jsondb
+
+import "fmt"
+
+// Limits protects the database from pathological documents. Zero fields
+// are not limited.
+type Limits struct {
+	// MaxRecordSize is the largest stored record, in bytes.
+	MaxRecordSize int `json:",omitempty"`
+
+	// MaxDepth is the deepest nesting of objects and arrays; a flat record
+	// has depth 1.
+	MaxDepth int `json:",omitempty"`
+
+	// MaxFields is the most object fields a record may have, counted at
+	// every level.
+	MaxFields int `json:",omitempty"`
+}
+
+// Errors reported through LimitError.
+var (
+	ErrRecordTooLarge = fmt.Errorf("Record is too large")
+	ErrTooDeep        = fmt.Errorf("Record is nested too deeply")
+	ErrTooManyFields  = fmt.Errorf("Record has too many fields")
+)
+
+// LimitError is returned when a record breaks one of the Limits. It
+// unwraps to ErrRecordTooLarge, ErrTooDeep or ErrTooManyFields.
+type LimitError struct {
+	Err      error
+	Resource string
+	Max      int
+	Actual   int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%v: '%s' has %d, at most %d allowed", e.Err, e.Resource, e.Actual, e.Max)
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// check reports the first limit the encoded record b breaks, if any.
+func (l Limits) check(resource string, b []byte) error {
+	if l.MaxRecordSize > 0 && len(b) > l.MaxRecordSize {
+		return &LimitError{ErrRecordTooLarge, resource, l.MaxRecordSize, len(b)}
+	}
+	if l.MaxDepth <= 0 && l.MaxFields <= 0 {
+		return nil
+	}
+
+	depth, fields := measureJSON(b)
+	if l.MaxDepth > 0 && depth > l.MaxDepth {
+		return &LimitError{ErrTooDeep, resource, l.MaxDepth, depth}
+	}
+	if l.MaxFields > 0 && fields > l.MaxFields {
+		return &LimitError{ErrTooManyFields, resource, l.MaxFields, fields}
+	}
+	return nil
+}
+
+// measureJSON returns the nesting depth and the number of object fields of
+// a valid JSON document, without decoding it.
+func measureJSON(b []byte) (maxDepth, fields int) {
+	var depth int
+	var inString, escaped bool
+
+	for _, c := range b {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			switch c {
+			case '\\':
+				escaped = true
+			case '"':
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			if depth++; depth > maxDepth {
+				maxDepth = depth
+			}
+		case c == '}' || c == ']':
+			depth--
+		case c == ':':
+			fields++
+		}
+	}
+	return maxDepth, fields
+}
@@ -0,0 +1,120 @@
+package jsondb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// locksCollection is the system collection holding advisory locks.
+const locksCollection = "locks"
+
+// ErrLocked is returned by Lock when another holder has the lock.
+var ErrLocked = fmt.Errorf("Record is locked")
+
+// ErrLockNotHeld is returned by Unlock when the lock expired or was taken
+// over by someone else.
+var ErrLockNotHeld = fmt.Errorf("Lock is not held")
+
+// LockHandle identifies an acquired advisory lock. Token proves ownership
+// and must be presented to Unlock.
+type LockHandle struct {
+	Collection string
+	Resource   string
+	Token      string
+	Expires    time.Time
+}
+
+// recordEscaper makes nested collection names usable as resource names.
+var recordEscaper = strings.NewReplacer("%", "%25", "/", "%2F", "~", "%7E")
+
+// lockRecord names the system record of the lock on collection/resource.
+func lockRecord(collection, resource string) string {
+	return recordEscaper.Replace(collection) + "~" + recordEscaper.Replace(resource)
+}
+
+// Lock takes the advisory lock on a record for ttl. Advisory locks do not
+// stop writes; they let cooperating clients, including HTTP clients of the
+// server, agree on who works on a record. A lock whose ttl has passed is
+// free to be taken again. Locking, and unlocking, take the write
+// permission of the policy on collection.
+func (d *Driver) Lock(collection, resource string, ttl time.Duration) (h LockHandle, err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("Lock", collection, resource)
+	defer span.end(&err)
+
+	if err := validName(collection, resource); err != nil {
+		return h, err
+	}
+	if err := d.allow(PolicyWrite, collection); err != nil {
+		return h, err
+	}
+	if ttl <= 0 {
+		return h, fmt.Errorf("Lock ttl must be positive")
+	}
+
+	sys := d.System()
+	unlock, err := sys.lockCollection(locksCollection, LockWrite)
+	if err != nil {
+		return h, err
+	}
+	defer unlock()
+
+	name := lockRecord(collection, resource)
+
+	var held LockHandle
+	if err := sys.Read(locksCollection, name, &held); err == nil && time.Now().Before(held.Expires) {
+		return h, ErrLocked
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return h, err
+	}
+
+	h = LockHandle{
+		Collection: collection,
+		Resource:   resource,
+		Token:      hex.EncodeToString(token),
+		Expires:    time.Now().Add(ttl).UTC(),
+	}
+	return h, sys.write(locksCollection, name, h)
+}
+
+// Unlock releases a lock taken with Lock.
+func (d *Driver) Unlock(h LockHandle) (err error) {
+	h.Collection = d.resolve(h.Collection)
+	d, span := d.trace("Unlock", h.Collection, h.Resource)
+	defer span.end(&err)
+
+	if err := validName(h.Collection, h.Resource); err != nil {
+		return err
+	}
+	if err := d.allow(PolicyWrite, h.Collection); err != nil {
+		return err
+	}
+
+	sys := d.System()
+	unlock, err := sys.lockCollection(locksCollection, LockWrite)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	name := lockRecord(h.Collection, h.Resource)
+
+	var held LockHandle
+	err = sys.Read(locksCollection, name, &held)
+	if os.IsNotExist(err) || (err == nil && (held.Token != h.Token || time.Now().After(held.Expires))) {
+		return ErrLockNotHeld
+	}
+	if err != nil {
+		return err
+	}
+
+	return sys.backend.Remove(filepath.Join(sys.dir, locksCollection, name+".json"))
+}
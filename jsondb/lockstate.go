@@ -0,0 +1,455 @@
+package jsondb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// collectionLock is the lock of a collection: a readers-writer lock that
+// keeps track of who holds it and who waits for it, for Locks, and that
+// lets waiters give up, on a timeout or a deadlock. A waiting writer holds
+// off new readers, as with sync.RWMutex, except those of an operation
+// already reading.
+type collectionLock struct {
+	graph   *lockGraph
+	holders []*lockHolder
+	waiters []*lockHolder
+	changed chan struct{}
+}
+
+// lockHolder is one holder of, or waiter for, a collection lock.
+type lockHolder struct {
+	mode   string
+	holder string
+	since  time.Time
+	owner  *lockOwner
+	lock   *collectionLock
+}
+
+// lockGraph guards the state of the collection locks of a database, its
+// system namespace included, and maps each operation waiting for one to
+// its waits: together they are the wait-for graph deadlocks are found in.
+type lockGraph struct {
+	mutex sync.Mutex
+	waits map[*lockOwner][]*lockHolder
+}
+
+func newLockGraph() *lockGraph {
+	return &lockGraph{waits: make(map[*lockOwner][]*lockHolder)}
+}
+
+// lockOwner is the operation locks are taken for: a traced operation and
+// those it runs nested, or a single acquisition made outside any.
+type lockOwner struct {
+	op string
+}
+
+// lockOwnerKey is the context key of the owner of the current operation.
+type lockOwnerKey struct{}
+
+// withLockOwner returns ctx with a new owner for the locks of op.
+func withLockOwner(ctx context.Context, op string) context.Context {
+	return context.WithValue(ctx, lockOwnerKey{}, &lockOwner{op: op})
+}
+
+// worker returns a handle on d for a goroutine of its operation taking
+// locks of its own, which must not count as those of the operation.
+func (d *Driver) worker() *Driver {
+	op := ""
+	if o, ok := d.Context().Value(lockOwnerKey{}).(*lockOwner); ok {
+		op = o.op
+	}
+	return d.WithContext(withLockOwner(d.Context(), op))
+}
+
+// Modes of LockInfo.
+const (
+	LockRead     = "read"
+	LockWrite    = "write"
+	LockAdvisory = "advisory"
+)
+
+var (
+	// ErrLockTimeout is returned when an operation waits for the lock of
+	// a collection longer than the LockTimeout of the driver.
+	ErrLockTimeout = fmt.Errorf("Timed out waiting for a lock")
+
+	// ErrDeadlock is returned to the operation whose wait for the lock of
+	// a collection would close a cycle of operations waiting for each
+	// other; it may be retried once the others are through.
+	ErrDeadlock = fmt.Errorf("Deadlock detected")
+)
+
+// LockWaitError tells which collection an operation failed to lock. It
+// matches ErrDeadlock or ErrLockTimeout with errors.Is.
+type LockWaitError struct {
+	Collection string
+	Mode       string
+	Deadlock   bool
+	Waited     time.Duration
+}
+
+func (e *LockWaitError) Error() string {
+	if e.Deadlock {
+		return fmt.Sprintf("Deadlock detected taking the %s lock on '%s'", e.Mode, e.Collection)
+	}
+	return fmt.Sprintf("Timed out after %v waiting for the %s lock on '%s'", e.Waited.Round(time.Millisecond), e.Mode, e.Collection)
+}
+
+func (e *LockWaitError) Is(target error) bool {
+	if e.Deadlock {
+		return target == ErrDeadlock
+	}
+	return target == ErrLockTimeout
+}
+
+// lockCollection takes the lock of collection in mode, LockRead or
+// LockWrite, and returns the function releasing it. It waits at most the
+// LockTimeout of the driver, and not at all when waiting would deadlock.
+func (d *Driver) lockCollection(collection, mode string) (func(), error) {
+	owner, ok := d.Context().Value(lockOwnerKey{}).(*lockOwner)
+	if !ok {
+		owner = &lockOwner{}
+	}
+	h, err := d.getOrCreateMutex(collection).acquire(owner, mode, d.lockTimeout)
+	if err != nil {
+		err.Collection = collection
+		d.log.Warn("%v\n", err)
+		return nil, err
+	}
+	return func() { h.lock.release(h) }, nil
+}
+
+// acquire takes l in mode for owner, waiting at most timeout when it is
+// positive.
+func (l *collectionLock) acquire(owner *lockOwner, mode string, timeout time.Duration) (*lockHolder, *LockWaitError) {
+	h := &lockHolder{mode: mode, holder: owner.op, since: time.Now(), owner: owner, lock: l}
+
+	g := l.graph
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if l.grantable(h) {
+		l.holders = append(l.holders, h)
+		return h, nil
+	}
+
+	if h.holder == "" {
+		h.holder = lockCaller()
+	}
+	l.waiters = append(l.waiters, h)
+	g.waits[owner] = append(g.waits[owner], h)
+	if h.deadlocked() {
+		l.leave(h)
+		return nil, &LockWaitError{Mode: mode, Deadlock: true}
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		if l.changed == nil {
+			l.changed = make(chan struct{})
+		}
+		changed := l.changed
+
+		g.mutex.Unlock()
+		select {
+		case <-changed:
+		case <-expired:
+			g.mutex.Lock()
+			l.leave(h)
+			return nil, &LockWaitError{Mode: mode, Waited: time.Since(h.since)}
+		}
+		g.mutex.Lock()
+
+		if l.grantable(h) {
+			l.leave(h)
+			h.since = time.Now()
+			l.holders = append(l.holders, h)
+			return h, nil
+		}
+	}
+}
+
+// release gives up h; releasing a lock released by ForceRelease does
+// nothing.
+func (l *collectionLock) release(h *lockHolder) {
+	l.graph.mutex.Lock()
+	defer l.graph.mutex.Unlock()
+
+	for i, held := range l.holders {
+		if held == h {
+			l.holders = append(l.holders[:i], l.holders[i+1:]...)
+			l.notify()
+			return
+		}
+	}
+}
+
+// leave forgets the wait h, which may let readers behind it in.
+func (l *collectionLock) leave(h *lockHolder) {
+	for i, w := range l.waiters {
+		if w == h {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			break
+		}
+	}
+	waits := l.graph.waits[h.owner]
+	for i, w := range waits {
+		if w == h {
+			waits = append(waits[:i], waits[i+1:]...)
+			break
+		}
+	}
+	if len(waits) == 0 {
+		delete(l.graph.waits, h.owner)
+	} else {
+		l.graph.waits[h.owner] = waits
+	}
+	l.notify()
+}
+
+// notify wakes the waiters of l up to check whether they may go.
+func (l *collectionLock) notify() {
+	if l.changed != nil {
+		close(l.changed)
+		l.changed = nil
+	}
+}
+
+// grantable reports whether h may take l now.
+func (l *collectionLock) grantable(h *lockHolder) bool {
+	return len(l.blockers(h)) == 0
+}
+
+// blockers returns the operations h has to wait for: every holder for a
+// writer; for a reader the writer holding l and, unless the operation of
+// h reads already, the writers waiting ahead of it.
+func (l *collectionLock) blockers(h *lockHolder) []*lockOwner {
+	var owners []*lockOwner
+	reading := false
+	for _, held := range l.holders {
+		if h.mode == LockWrite || held.mode == LockWrite {
+			owners = append(owners, held.owner)
+		}
+		reading = reading || held.owner == h.owner
+	}
+	if h.mode == LockWrite || reading {
+		return owners
+	}
+	for _, w := range l.waiters {
+		if w == h {
+			break
+		}
+		if w.mode == LockWrite {
+			owners = append(owners, w.owner)
+		}
+	}
+	return owners
+}
+
+// deadlocked reports whether the wait h closes a cycle in the wait-for
+// graph: whether what it waits for waits, in turn, for the operation of h.
+func (h *lockHolder) deadlocked() bool {
+	seen := make(map[*lockOwner]bool)
+	var reaches func(w *lockHolder) bool
+	reaches = func(w *lockHolder) bool {
+		for _, owner := range w.lock.blockers(w) {
+			if owner == h.owner {
+				return true
+			}
+			if seen[owner] {
+				continue
+			}
+			seen[owner] = true
+			for _, next := range h.lock.graph.waits[owner] {
+				if reaches(next) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return reaches(h)
+}
+
+// lockCaller names the driver method waiting for a lock outside any
+// traced operation.
+func lockCaller() string {
+	pc, _, _, ok := runtime.Caller(3)
+	if !ok {
+		return ""
+	}
+	name := runtime.FuncForPC(pc).Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// LockInfo describes a lock held or waited for: the lock of a collection,
+// which operations hold while they run, or an advisory lock on a record.
+type LockInfo struct {
+	Collection string
+	Resource   string `json:",omitempty"`
+
+	// System is set for collections of the system namespace.
+	System bool `json:",omitempty"`
+
+	// Mode is LockRead or LockWrite for collection locks, LockAdvisory
+	// for record locks.
+	Mode string
+
+	// Waiting is set for operations waiting for the lock.
+	Waiting bool `json:",omitempty"`
+
+	// Holder is the operation holding or waiting for a collection lock;
+	// waits outside any operation name the method waiting instead.
+	Holder string `json:",omitempty"`
+
+	// Since is when the lock was taken or the wait started, and Duration
+	// how long ago that was.
+	Since    time.Time
+	Duration time.Duration
+
+	// Expires is when an advisory lock lapses.
+	Expires *time.Time `json:",omitempty"`
+}
+
+// Locks lists the collection locks held and waited for, and the advisory
+// locks in force, longest held first.
+func (d *Driver) Locks() ([]LockInfo, error) {
+	now := time.Now()
+	locks := d.collectionLocks(now, false)
+	if d.system != nil {
+		locks = append(locks, d.system.collectionLocks(now, true)...)
+	}
+
+	sys := d.System()
+	docs, err := sys.Query(locksCollection, Query{})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, doc := range docs {
+		var h LockHandle
+		if err := FromGeneric(doc.Data, &h); err != nil {
+			return nil, err
+		}
+		if now.After(h.Expires) {
+			continue
+		}
+		fi, err := sys.backend.Stat(filepath.Join(sys.dir, locksCollection, doc.Resource+".json"))
+		if err != nil {
+			continue
+		}
+		since, expires := fi.ModTime(), h.Expires
+		locks = append(locks, LockInfo{Collection: h.Collection, Resource: h.Resource, Mode: LockAdvisory, Since: since, Duration: now.Sub(since), Expires: &expires})
+	}
+
+	sort.SliceStable(locks, func(i, j int) bool { return locks[i].Since.Before(locks[j].Since) })
+	return locks, nil
+}
+
+func (d *Driver) collectionLocks(now time.Time, system bool) []LockInfo {
+	d.mutex.Lock()
+	mutexes := make(map[string]*collectionLock, len(d.mutexes))
+	for collection, l := range d.mutexes {
+		mutexes[collection] = l
+	}
+	d.mutex.Unlock()
+
+	var locks []LockInfo
+	for collection, l := range mutexes {
+		l.graph.mutex.Lock()
+		for _, h := range l.holders {
+			locks = append(locks, LockInfo{Collection: collection, System: system, Mode: h.mode, Holder: h.holder, Since: h.since, Duration: now.Sub(h.since)})
+		}
+		for _, h := range l.waiters {
+			locks = append(locks, LockInfo{Collection: collection, System: system, Mode: h.mode, Waiting: true, Holder: h.holder, Since: h.since, Duration: now.Sub(h.since)})
+		}
+		l.graph.mutex.Unlock()
+	}
+	return locks
+}
+
+// ForceRelease frees a lock that is stuck: the advisory lock on resource,
+// or with an empty resource the lock of collection, provided it has been
+// held for at least minAge. The holders of a collection lock lose it and
+// the operations waiting for it go ahead, no longer excluding them;
+// releasing it when they finish, if ever, does nothing.
+func (d *Driver) ForceRelease(collection, resource string, minAge time.Duration) (err error) {
+	d, span := d.trace("ForceRelease", collection, resource)
+	defer span.end(&err)
+
+	if err := validName(collection, resource); err != nil {
+		return err
+	}
+
+	if resource != "" {
+		sys := d.System()
+		unlock, err := sys.lockCollection(locksCollection, LockWrite)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		path := filepath.Join(sys.dir, locksCollection, lockRecord(collection, resource)+".json")
+		fi, err := sys.backend.Stat(path)
+		if os.IsNotExist(err) {
+			return ErrLockNotHeld
+		}
+		if err != nil {
+			return err
+		}
+		if age := time.Since(fi.ModTime()); age < minAge {
+			return fmt.Errorf("Lock on '%s/%s' has been held for %v, less than %v", collection, resource, age.Round(time.Millisecond), minAge)
+		}
+		d.log.Warn("Forcing the release of the lock on '%s/%s'\n", collection, resource)
+		return sys.backend.Remove(path)
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	l, ok := d.mutexes[collection]
+	if !ok {
+		return ErrLockNotHeld
+	}
+
+	l.graph.mutex.Lock()
+	defer l.graph.mutex.Unlock()
+
+	var oldest time.Time
+	for _, h := range l.holders {
+		if oldest.IsZero() || h.since.Before(oldest) {
+			oldest = h.since
+		}
+	}
+
+	if oldest.IsZero() {
+		return ErrLockNotHeld
+	}
+	if age := time.Since(oldest); age < minAge {
+		return fmt.Errorf("Lock on '%s' has been held for %v, less than %v", collection, age.Round(time.Millisecond), minAge)
+	}
+
+	d.log.Warn("Forcing the release of the lock on '%s' held since %s\n", collection, oldest.Format(time.RFC3339))
+	l.holders = nil
+	l.notify()
+	return nil
+}
@@ -0,0 +1,167 @@
+package jsondb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// asOp returns a handle on db whose locks belong to a new operation.
+func asOp(db *Driver, op string) *Driver {
+	return db.WithContext(withLockOwner(context.Background(), op))
+}
+
+// waitForWaiter waits until collection has a waiting operation.
+func waitForWaiter(t *testing.T, db *Driver, collection string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		locks, err := db.Locks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range locks {
+			if l.Collection == collection && l.Waiting {
+				return
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("No operation waits for '%s'", collection)
+}
+
+func TestLockDeadlock(t *testing.T) {
+	db, _ := openTest(t, nil)
+	a, b := asOp(db, "a"), asOp(db, "b")
+
+	unlockA, err := a.lockCollection("x", LockWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlockB, err := b.lockCollection("y", LockWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		unlock, err := a.lockCollection("y", LockWrite)
+		if err == nil {
+			unlock()
+		}
+		done <- err
+	}()
+	waitForWaiter(t, db, "y")
+
+	if _, err := b.lockCollection("x", LockWrite); !errors.Is(err, ErrDeadlock) {
+		t.Errorf("closing the cycle: %v, want ErrDeadlock", err)
+	}
+	unlockB()
+	if err := <-done; err != nil {
+		t.Errorf("wait after the deadlock: %v", err)
+	}
+	unlockA()
+}
+
+func TestLockReentrantRead(t *testing.T) {
+	db, _ := openTest(t, nil)
+	a, b := asOp(db, "a"), asOp(db, "b")
+
+	unlockRead, err := a.lockCollection("x", LockRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		unlock, err := b.lockCollection("x", LockWrite)
+		if err == nil {
+			unlock()
+		}
+		done <- err
+	}()
+	waitForWaiter(t, db, "x")
+
+	// A reader goes ahead of the waiting writer when its operation reads
+	// already, and is held off otherwise.
+	unlock, err := a.lockCollection("x", LockRead)
+	if err != nil {
+		t.Fatalf("reading again: %v", err)
+	}
+	unlock()
+
+	c := asOp(db, "c")
+	c.lockTimeout = 10 * time.Millisecond
+	if _, err := c.lockCollection("x", LockRead); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("reading behind a writer: %v, want ErrLockTimeout", err)
+	}
+
+	unlockRead()
+	if err := <-done; err != nil {
+		t.Errorf("writer: %v", err)
+	}
+}
+
+func TestLockGraphPerDatabase(t *testing.T) {
+	one, _ := openTest(t, nil)
+	two, _ := openTest(t, nil)
+
+	if one.locks == two.locks {
+		t.Error("Two databases share a lock graph")
+	}
+	if one.System().locks != one.locks {
+		t.Error("The system namespace has a lock graph of its own")
+	}
+
+	// An operation spanning the namespaces deadlocks with one that takes
+	// their locks the other way round.
+	a, b := asOp(one, "a"), asOp(one, "b")
+	unlockA, err := a.lockCollection("x", LockWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlockB, err := b.System().lockCollection(edgesCollection, LockWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		unlock, err := a.System().lockCollection(edgesCollection, LockWrite)
+		if err == nil {
+			unlock()
+		}
+		done <- err
+	}()
+	waitForWaiter(t, one, edgesCollection)
+
+	if _, err := b.lockCollection("x", LockWrite); !errors.Is(err, ErrDeadlock) {
+		t.Errorf("closing the cycle across namespaces: %v, want ErrDeadlock", err)
+	}
+	unlockB()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	unlockA()
+}
+
+func TestLockHolderIsOperation(t *testing.T) {
+	db, _ := openTest(t, nil)
+	d, span := db.trace("Update", "x", "r")
+	var err error
+	defer span.end(&err)
+
+	unlock, err := d.lockCollection("x", LockWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	locks, err := db.Locks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locks) != 1 || locks[0].Holder != "Update" {
+		t.Errorf("Locks = %+v, want x held by Update", locks)
+	}
+}
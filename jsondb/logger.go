@@ -0,0 +1,65 @@
+package jsondb
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// LogLevel orders log messages by severity.
+type LogLevel int
+
+const (
+	LogTrace LogLevel = iota
+	LogDebug
+	LogInfo
+	LogWarn
+	LogError
+	LogFatal
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogTrace:
+		return "TRACE"
+	case LogDebug:
+		return "DEBUG"
+	case LogInfo:
+		return "INFO"
+	case LogWarn:
+		return "WARN"
+	case LogError:
+		return "ERROR"
+	case LogFatal:
+		return "FATAL"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// stdLogger is a Logger writing to a standard library logger.
+type stdLogger struct {
+	log   *log.Logger
+	level LogLevel
+}
+
+// NewStdLogger returns a Logger writing messages of at least level to l,
+// prefixed with their level. It is the default logger, writing INFO and
+// above to standard output; database/jsondb/lumberlog adapts lumber.
+func NewStdLogger(l *log.Logger, level LogLevel) Logger {
+	return stdLogger{l, level}
+}
+
+func (l stdLogger) output(level LogLevel, format string, v []interface{}) {
+	if level < l.level {
+		return
+	}
+	msg := strings.TrimSuffix(fmt.Sprintf(format, v...), "\n")
+	l.log.Printf("%-5s %s", level, msg)
+}
+
+func (l stdLogger) Fatal(format string, v ...interface{}) { l.output(LogFatal, format, v) }
+func (l stdLogger) Error(format string, v ...interface{}) { l.output(LogError, format, v) }
+func (l stdLogger) Warn(format string, v ...interface{})  { l.output(LogWarn, format, v) }
+func (l stdLogger) Info(format string, v ...interface{})  { l.output(LogInfo, format, v) }
+func (l stdLogger) Debug(format string, v ...interface{}) { l.output(LogDebug, format, v) }
+func (l stdLogger) Trace(format string, v ...interface{}) { l.output(LogTrace, format, v) }
@@ -0,0 +1,36 @@
+// Package lumberlog logs jsondb databases with lumber, the logger the
+// database used by default before it dropped third-party dependencies.
+package lumberlog
+
+import (
+	"github.com/jcelliott/lumber"
+
+	"database/jsondb"
+)
+
+// levels maps jsondb log levels to lumber's.
+var levels = map[jsondb.LogLevel]int{
+	jsondb.LogTrace: lumber.TRACE,
+	jsondb.LogDebug: lumber.DEBUG,
+	jsondb.LogInfo:  lumber.INFO,
+	jsondb.LogWarn:  lumber.WARN,
+	jsondb.LogError: lumber.ERROR,
+	jsondb.LogFatal: lumber.FATAL,
+}
+
+// Console returns a Logger writing messages of at least level to the
+// console.
+func Console(level jsondb.LogLevel) jsondb.Logger {
+	return lumber.NewConsoleLogger(levels[level])
+}
+
+// File returns a Logger appending messages of at least level to the file
+// at path.
+func File(path string, level jsondb.LogLevel) (jsondb.Logger, error) {
+	l, err := lumber.NewAppendLogger(path)
+	if err != nil {
+		return nil, err
+	}
+	l.Level(levels[level])
+	return l, nil
+}
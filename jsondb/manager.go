@@ -0,0 +1,120 @@
+package jsondb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DatabaseConfig says where a database managed by a Manager lives. Nil
+// Options use the Manager's defaults.
+type DatabaseConfig struct {
+	Dir     string
+	Options *Options `json:"-"`
+}
+
+// Manager opens several named databases side by side in one process, such
+// as dev and staging datasets. The databases share the Manager's default
+// options, and with them its logger, instrumentation, limits and retry
+// policy; each keeps its own locks, change feed and scheduler, since those
+// guard its own directory.
+type Manager struct {
+	mutex    sync.RWMutex
+	defaults Options
+	dbs      map[string]*Driver
+}
+
+// NewManager returns a Manager without databases. Databases opened with nil
+// Options get a copy of defaults.
+func NewManager(defaults *Options) *Manager {
+	return &Manager{
+		defaults: defaultOptions(defaults),
+		dbs:      make(map[string]*Driver),
+	}
+}
+
+// OpenManager returns a Manager holding the databases of dbs, keyed by
+// name. If any fails to open, those already opened are closed.
+func OpenManager(defaults *Options, dbs map[string]DatabaseConfig) (*Manager, error) {
+	m := NewManager(defaults)
+
+	names := make([]string, 0, len(dbs))
+	for name := range dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, err := m.Open(name, dbs[name]); err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Open opens the database cfg describes under name.
+func (m *Manager) Open(name string, cfg DatabaseConfig) (*Driver, error) {
+	if name == "" || strings.ContainsAny(name, "/\\\x00") || name == "." || name == ".." {
+		return nil, fmt.Errorf("Invalid database name '%s'", name)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.dbs[name]; ok {
+		return nil, fmt.Errorf("Database '%s' is already open", name)
+	}
+
+	opts := cfg.Options
+	if opts == nil {
+		defaults := m.defaults
+		opts = &defaults
+	}
+
+	db, err := New(cfg.Dir, opts)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening database '%s': %v", name, err)
+	}
+
+	m.dbs[name] = db
+	return db, nil
+}
+
+// DB returns the database opened under name.
+func (m *Manager) DB(name string) (*Driver, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	db, ok := m.dbs[name]
+	return db, ok
+}
+
+// Names returns the names of the open databases, sorted.
+func (m *Manager) Names() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	names := make([]string, 0, len(m.dbs))
+	for name := range m.dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close closes every database and forgets them, returning the first error.
+func (m *Manager) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var first error
+	for name, db := range m.dbs {
+		if err := db.Close(); err != nil && first == nil {
+			first = fmt.Errorf("Error closing database '%s': %v", name, err)
+		}
+		delete(m.dbs, name)
+	}
+	return first
+}
@@ -0,0 +1,573 @@
+package jsondb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// manifestName is the resource name of a collection's manifest, stored as
+// _collection.json next to its records. It is not a record: ReadAll, Query
+// and friends skip it and it cannot be written as one.
+const manifestName = "_collection"
+
+// CollectionConfig holds the settings of one collection, persisted in its
+// manifest. MergeOnWrite, Dedup, Required, Rules and Validators apply to
+// every write; the other settings are kept for the features that act on
+// them.
+type CollectionConfig struct {
+	// Codec is the preferred wire format of the collection's records.
+	Codec string `json:",omitempty"`
+
+	// Decode is how the server decodes request bodies into the type
+	// registered for the collection: "" drops unknown fields, "strict"
+	// rejects them and "lax" keeps them.
+	Decode string `json:",omitempty"`
+
+	// Typed checks every record written against the Go type registered for
+	// the collection with Driver.RegisterType, rejecting values of the
+	// wrong type.
+	Typed bool `json:",omitempty"`
+
+	// Compression names the compression of stored records: "" or "gzip".
+	Compression string `json:",omitempty"`
+
+	// Naming renames the fields of records written, whatever their struct
+	// tags, to NamingCamel or NamingSnake, keys of nested maps included;
+	// reads into structs map them back. Records stored before it was set
+	// keep their names.
+	Naming string `json:",omitempty"`
+
+	// TTL is the default lifetime of records, such as "30d" or "12h":
+	// records last written longer ago are swept every minute, and Watch
+	// reports them with OpExpire.
+	TTL string `json:",omitempty"`
+
+	// Shards is the number of subdirectories records are spread over; it
+	// cannot change once the collection holds records.
+	Shards int `json:",omitempty"`
+
+	// MergeOnWrite keeps the fields of a stored record that the struct
+	// written over it has no field for, so writers using different types
+	// can share the collection.
+	MergeOnWrite bool `json:",omitempty"`
+
+	// Dedup stores records with the same content once, as a blob shared
+	// by small pointer records, and deletes it with the last of them.
+	Dedup bool `json:",omitempty"`
+
+	// Series makes the collection a time series of bucket records; see
+	// Append.
+	Series *SeriesConfig `json:",omitempty"`
+
+	// Required lists fields every record must have.
+	Required []string `json:",omitempty"`
+
+	// Rules are conditions every record must satisfy.
+	Rules []Condition `json:",omitempty"`
+
+	// Defaults are the values of fields, by dotted path, that records
+	// written without them, or with them null or empty, get; DefaultNow
+	// stands for the time of the write.
+	Defaults map[string]interface{} `json:",omitempty"`
+
+	// Coerce converts fields, by dotted path, written as another type to
+	// one of CoerceNumber, CoerceString, CoerceBool or CoerceTime, and
+	// rejects records where that fails.
+	Coerce map[string]string `json:",omitempty"`
+
+	// Computed lists fields set on every write from the rest of the
+	// record; records stored before are updated when next written.
+	Computed []ComputedField `json:",omitempty"`
+
+	// Validators are checks written as expressions that every record must
+	// pass, after Required and Rules.
+	Validators []Validator `json:",omitempty"`
+
+	// Geo is the path of the field holding the location of records, as an
+	// object with Lat and Lng members, indexed for geo queries.
+	Geo string `json:",omitempty"`
+
+	// Indexes lists the fields to index.
+	Indexes []string `json:",omitempty"`
+
+	// Key is the path of the field holding the resource name of records:
+	// records must have it, equal to their name, and Save writes a value
+	// under the name it holds.
+	Key string `json:",omitempty"`
+
+	// Unique lists fields no two records may have the same value of;
+	// records without the field, or with it null, are not compared. Every
+	// write reads the collection to check them.
+	Unique []string `json:",omitempty"`
+
+	// TTLField is the path of the field holding, as an RFC 3339 time,
+	// when each record expires: records past it are swept as those past
+	// the TTL are.
+	TTLField string `json:",omitempty"`
+
+	// Collations are the collations of fields, by dotted path, for the
+	// query conditions on them that do not pick one, such as "nocase" to
+	// find "Bangalore" when asked for "bangalore".
+	Collations map[string]Collation `json:",omitempty"`
+
+	// Versions is how many versions of each record are kept, the current
+	// one included, for Versions, ReadVersion and audits; 0 keeps none.
+	Versions int `json:",omitempty"`
+
+	// TrackWrites keeps, for every record, its WriteInfo: how many times
+	// it was written, by whom (see WithActor) and when last.
+	TrackWrites bool `json:",omitempty"`
+
+	// Retention purges old records on a schedule.
+	Retention *RetentionPolicy `json:",omitempty"`
+
+	// Quality checks the records against data quality rules on a
+	// schedule; see CheckQuality.
+	Quality *QualityPolicy `json:",omitempty"`
+
+	// StaleIfError, such as "10m", keeps the last copy read of records,
+	// up to Options.StaleCacheSize across collections, for Read and
+	// ReadRaw to serve when reading a record from storage fails, for a
+	// copy no older than that: ReadRawStale tells them apart. Records
+	// written or deleted since are not served; nor are missing ones.
+	StaleIfError string `json:",omitempty"`
+}
+
+// ErrConstraint is returned when a record violates its collection's
+// configuration.
+var ErrConstraint = fmt.Errorf("Record violates the collection configuration")
+
+// ConstraintError describes which part of the configuration a record
+// violates. It matches ErrConstraint with errors.Is.
+type ConstraintError struct {
+	Resource string
+	Reason   string
+}
+
+func (e *ConstraintError) Error() string {
+	return fmt.Sprintf("Record '%s' violates the collection configuration: %s", e.Resource, e.Reason)
+}
+
+func (e *ConstraintError) Is(target error) bool {
+	return target == ErrConstraint
+}
+
+// check reports the first way doc breaks c, if any.
+func (c *CollectionConfig) check(resource string, doc map[string]interface{}) error {
+	if c.Key != "" {
+		key, ok := lookup(doc, c.Key)
+		if !ok || key == nil || fmt.Sprint(key) != resource {
+			return &ConstraintError{resource, fmt.Sprintf("key field '%s' must be the resource name", c.Key)}
+		}
+	}
+	for _, field := range c.Required {
+		if _, ok := lookup(doc, field); !ok {
+			return &ConstraintError{resource, fmt.Sprintf("missing required field '%s'", field)}
+		}
+	}
+	for _, rule := range c.Rules {
+		if !rule.Match(doc) {
+			op := rule.Op
+			if op == "" {
+				op = "="
+			}
+			return &ConstraintError{resource, fmt.Sprintf("rule %s %s %v failed", rule.Field, op, rule.Value)}
+		}
+	}
+	for _, v := range c.Validators {
+		if err := v.passes(resource, doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate checks the settings themselves.
+func (c *CollectionConfig) validate() error {
+	if c.Codec != "" {
+		if _, ok := CodecFor(c.Codec); !ok {
+			return fmt.Errorf("Unknown codec '%s'", c.Codec)
+		}
+	}
+	if c.Decode != "" && c.Decode != "strict" && c.Decode != "lax" {
+		return fmt.Errorf("Unknown decode mode '%s'", c.Decode)
+	}
+	if c.Compression != "" && c.Compression != "gzip" {
+		return fmt.Errorf("Unknown compression '%s'", c.Compression)
+	}
+	if c.Naming != "" && c.Naming != NamingCamel && c.Naming != NamingSnake {
+		return fmt.Errorf("Unknown field naming '%s'", c.Naming)
+	}
+	if c.TTL != "" {
+		if ttl, err := ParseAge(c.TTL); err != nil || ttl <= 0 {
+			return fmt.Errorf("Invalid TTL '%s'", c.TTL)
+		}
+	}
+	if c.StaleIfError != "" {
+		if age, err := ParseAge(c.StaleIfError); err != nil || age <= 0 {
+			return fmt.Errorf("Invalid StaleIfError '%s'", c.StaleIfError)
+		}
+	}
+	if c.Shards < 0 {
+		return fmt.Errorf("Shards must not be negative")
+	}
+	if c.Versions < 0 {
+		return fmt.Errorf("Versions must not be negative")
+	}
+	if c.Series != nil {
+		if err := c.Series.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Quality != nil {
+		if err := c.Quality.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Retention != nil {
+		if err := c.Retention.validate(); err != nil {
+			return err
+		}
+	}
+	for _, field := range append(append(append([]string{}, c.Required...), c.Indexes...), c.Unique...) {
+		if field == "" {
+			return fmt.Errorf("Empty field name in collection configuration")
+		}
+	}
+	for _, field := range []string{c.Key, c.TTLField} {
+		if strings.Contains("."+field+".", "..") && field != "" {
+			return fmt.Errorf("Invalid field '%s' in collection configuration", field)
+		}
+	}
+	for field, collation := range c.Collations {
+		if field == "" {
+			return fmt.Errorf("Empty field name in collection configuration")
+		}
+		if err := collation.Validate(); err != nil {
+			return err
+		}
+	}
+	for field := range c.Defaults {
+		if field == "" || strings.Contains("."+field+".", "..") {
+			return fmt.Errorf("Invalid default field '%s'", field)
+		}
+	}
+	for field, kind := range c.Coerce {
+		if field == "" || strings.Contains("."+field+".", "..") {
+			return fmt.Errorf("Invalid coerced field '%s'", field)
+		}
+		switch kind {
+		case CoerceNumber, CoerceString, CoerceBool, CoerceTime:
+		default:
+			return fmt.Errorf("Unknown coercion '%s' of '%s'", kind, field)
+		}
+	}
+	for _, f := range c.Computed {
+		if f.Field == "" || strings.Contains("."+f.Field+".", "..") {
+			return fmt.Errorf("Invalid computed field '%s'", f.Field)
+		}
+		if _, err := parseScript(f.Template); err != nil {
+			return fmt.Errorf("Invalid template of computed field '%s': %v", f.Field, err)
+		}
+	}
+	for _, rule := range c.Rules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("Invalid rule: %v", err)
+		}
+	}
+	for _, v := range c.Validators {
+		if v.Name == "" || v.Expr == "" {
+			return fmt.Errorf("Validators need a name and an expression")
+		}
+		if _, err := v.template(); err != nil {
+			return fmt.Errorf("Invalid expression of validator '%s': %v", v.Name, err)
+		}
+	}
+	return nil
+}
+
+// isRecord reports whether a directory entry is a stored record.
+func isRecord(file os.FileInfo) bool {
+	return !file.IsDir() && strings.HasSuffix(file.Name(), ".json") && file.Name() != manifestName+".json"
+}
+
+// ConfigureCollection validates cfg against the settings themselves and the
+// records collection already holds, then stores it in the collection's
+// manifest. A zero cfg removes the manifest.
+func (d *Driver) ConfigureCollection(collection string, cfg CollectionConfig) (err error) {
+	d, span := d.trace("ConfigureCollection", collection, "")
+	defer span.end(&err)
+
+	if err := validName(collection, ""); err != nil {
+		return err
+	}
+	if err := d.checkCollection(collection); err != nil {
+		return err
+	}
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	unlock, err := d.lockCollection(collection, LockWrite)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	old := d.CollectionConfig(collection)
+
+	var records int
+	taken := newUniqueValues(cfg.Unique)
+	err = d.scan(collection, func(resource string, b []byte) error {
+		records++
+		doc, err := decodeDocument(b)
+		if err != nil {
+			return fmt.Errorf("Error decoding '%s': %v", resource, err)
+		}
+		if err := cfg.check(resource, doc); err != nil {
+			return err
+		}
+		if err := taken.add(resource, doc); err != nil {
+			return err
+		}
+		return d.checkType(collection, resource, &cfg, b)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if records > 0 && cfg.Shards != old.Shards {
+		return fmt.Errorf("Cannot change the shards of '%s' while it holds records", collection)
+	}
+
+	path := filepath.Join(d.dir, collection, manifestName+".json")
+	if isZeroConfig(cfg) {
+		if err := d.backend.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		b, err := json.MarshalIndent(cfg, "", "\t")
+		if err != nil {
+			return err
+		}
+		if err := d.backend.WriteFile(path, append(b, '\n')); err != nil {
+			return err
+		}
+	}
+
+	if err := d.scheduleJobs(collection, &cfg); err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if isZeroConfig(cfg) {
+		delete(d.configs, collection)
+	} else {
+		d.configs[collection] = &cfg
+	}
+
+	// Collations of fields change what queries match
+	if d.qcache != nil {
+		d.qcache.invalidate(OpDelete, collection, "", nil)
+	}
+	return nil
+}
+
+// CollectionConfig returns the configuration of collection; collections
+// without a manifest have the zero configuration.
+func (d *Driver) CollectionConfig(collection string) CollectionConfig {
+	collection = d.resolve(collection)
+	if c := d.collectionConfig(collection); c != nil {
+		return *c
+	}
+	return CollectionConfig{}
+}
+
+// ConfiguredCollections lists the collections that have a manifest.
+func (d *Driver) ConfiguredCollections() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	names := make([]string, 0, len(d.configs))
+	for name := range d.configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (d *Driver) collectionConfig(collection string) *CollectionConfig {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.configs[collection]
+}
+
+// forgetConfigs drops the cached manifests of a deleted collection and the
+// collections nested in it.
+func (d *Driver) forgetConfigs(collection string) {
+	d.mutex.Lock()
+	var forgotten []string
+	for name := range d.configs {
+		if name == collection || strings.HasPrefix(name, collection+"/") {
+			delete(d.configs, name)
+			forgotten = append(forgotten, name)
+		}
+	}
+	d.mutex.Unlock()
+
+	for _, name := range forgotten {
+		d.scheduleJobs(name, nil)
+	}
+}
+
+// loadManifests reads the manifest of every collection below the database
+// directory, outside the system namespace, registering the jobs they ask
+// for when schedule is set.
+func (d *Driver) loadManifests(schedule bool) error {
+	return d.walkCollections("", func(collection string) error {
+		b, err := d.backend.ReadFile(filepath.Join(d.dir, collection, manifestName+".json"))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var cfg CollectionConfig
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return fmt.Errorf("Error reading manifest of '%s': %v", collection, err)
+		}
+		d.configs[collection] = &cfg
+		if !schedule {
+			return nil
+		}
+		return d.scheduleJobs(collection, &cfg)
+	})
+}
+
+// ReloadManifests reads the manifests of the collections again, taking in
+// changes made to their files, such as new validators, without a restart.
+// A manifest that does not parse or validate leaves its collection on the
+// configuration it has; the first such error is returned.
+func (d *Driver) ReloadManifests() (err error) {
+	d, span := d.trace("ReloadManifests", "", "")
+	defer span.end(&err)
+
+	configs := make(map[string]*CollectionConfig)
+	var failed []string
+	walkErr := d.walkCollections("", func(collection string) error {
+		b, rerr := d.backend.ReadFile(filepath.Join(d.dir, collection, manifestName+".json"))
+		if os.IsNotExist(rerr) {
+			return nil
+		}
+
+		var cfg CollectionConfig
+		if rerr == nil {
+			if rerr = json.Unmarshal(b, &cfg); rerr == nil {
+				rerr = cfg.validate()
+			}
+		}
+		if rerr != nil {
+			failed = append(failed, collection)
+			if err == nil {
+				err = fmt.Errorf("Error reloading manifest of '%s': %v", collection, rerr)
+			}
+			return nil
+		}
+		configs[collection] = &cfg
+		return nil
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+
+	d.mutex.Lock()
+	for _, collection := range failed {
+		if cfg, ok := d.configs[collection]; ok {
+			configs[collection] = cfg
+		}
+	}
+	// The map is shared with the copies of d.
+	var dropped []string
+	for collection := range d.configs {
+		if _, ok := configs[collection]; !ok {
+			dropped = append(dropped, collection)
+		}
+		delete(d.configs, collection)
+	}
+	for collection, cfg := range configs {
+		d.configs[collection] = cfg
+	}
+	d.mutex.Unlock()
+
+	for _, collection := range dropped {
+		d.scheduleJobs(collection, nil)
+	}
+	for collection, cfg := range configs {
+		if serr := d.scheduleJobs(collection, cfg); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// Collections lists the collections of the database outside the system
+// namespace, nested ones as "parent/child".
+func (d *Driver) Collections() ([]string, error) {
+	var names []string
+	err := d.walkCollections("", func(collection string) error {
+		names = append(names, collection)
+		return nil
+	})
+	return names, err
+}
+
+// walkCollections calls fn for every collection nested in collection.
+func (d *Driver) walkCollections(collection string, fn func(collection string) error) error {
+	files, err := d.backend.ReadDir(filepath.Join(d.dir, collection))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if !file.IsDir() || strings.HasSuffix(file.Name(), attachmentsSuffix) || (collection == "" && (file.Name() == systemDir || file.Name() == quarantineDir)) {
+			continue
+		}
+
+		name := file.Name()
+		if collection != "" {
+			name = collection + "/" + name
+		}
+		if err := fn(name); err != nil {
+			return err
+		}
+		if err := d.walkCollections(name, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scheduleJobs registers the jobs the configuration of collection asks
+// for, retention, quality checks and expiry, and unregisters those it no longer does; cfg
+// is nil for a collection without one.
+func (d *Driver) scheduleJobs(collection string, cfg *CollectionConfig) error {
+	if err := d.scheduleRetention(collection, cfg); err != nil {
+		return err
+	}
+	if err := d.scheduleQuality(collection, cfg); err != nil {
+		return err
+	}
+	return d.scheduleExpiry(collection, cfg)
+}
+
+func isZeroConfig(c CollectionConfig) bool {
+	return c.Codec == "" && c.Decode == "" && c.Compression == "" && c.Naming == "" && c.TTL == "" && c.Shards == 0 && !c.Typed && !c.MergeOnWrite && !c.Dedup && c.Series == nil && c.Retention == nil && c.Quality == nil && c.Geo == "" && c.Versions == 0 && !c.TrackWrites &&
+		len(c.Required) == 0 && len(c.Rules) == 0 && len(c.Defaults) == 0 && len(c.Coerce) == 0 && len(c.Computed) == 0 && len(c.Validators) == 0 && len(c.Indexes) == 0 && len(c.Collations) == 0 &&
+		c.Key == "" && len(c.Unique) == 0 && c.TTLField == "" && c.StaleIfError == ""
+}
@@ -0,0 +1,198 @@
+package jsondb
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryDir is the directory name that makes New keep the database in
+// memory instead of on disk. Nothing is persisted; it is meant for tests.
+const MemoryDir = ":memory:"
+
+// memBackend keeps files in a map. Directories exist implicitly as the
+// parents of files, or explicitly once created with MkdirAll.
+type memBackend struct {
+	mutex sync.RWMutex
+	files map[string]memFile
+	dirs  map[string]time.Time
+}
+
+type memFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{
+		files: make(map[string]memFile),
+		dirs:  make(map[string]time.Time),
+	}
+}
+
+func memPath(p string) string {
+	return filepath.ToSlash(filepath.Clean(p))
+}
+
+func memNotExist(op, p string) error {
+	return &fs.PathError{Op: op, Path: p, Err: fs.ErrNotExist}
+}
+
+func (m *memBackend) ReadFile(p string) ([]byte, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	f, ok := m.files[memPath(p)]
+	if !ok {
+		return nil, memNotExist("open", p)
+	}
+	return append([]byte(nil), f.data...), nil
+}
+
+func (m *memBackend) WriteFile(p string, data []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key := memPath(p)
+	if _, ok := m.dirs[key]; ok {
+		return &fs.PathError{Op: "open", Path: p, Err: fs.ErrExist}
+	}
+
+	now := time.Now()
+	m.mkdirAll(path.Dir(key), now)
+	m.files[key] = memFile{data: append([]byte(nil), data...), modTime: now}
+	return nil
+}
+
+func (m *memBackend) ReadDir(p string) ([]os.FileInfo, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	dir := memPath(p)
+	if _, ok := m.dirs[dir]; !ok {
+		return nil, memNotExist("open", p)
+	}
+
+	prefix := dir + "/"
+	seen := map[string]bool{}
+	var infos []os.FileInfo
+
+	for name, f := range m.files {
+		if child, ok := directChild(prefix, name); ok && !seen[child] {
+			seen[child] = true
+			infos = append(infos, memInfo{name: child, size: int64(len(f.data)), modTime: f.modTime})
+		}
+	}
+	for name, modTime := range m.dirs {
+		if child, ok := directChild(prefix, name); ok && !seen[child] {
+			seen[child] = true
+			infos = append(infos, memInfo{name: child, dir: true, modTime: modTime})
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// directChild returns the name of an entry directly below the directory
+// with the given prefix ("dir/").
+func directChild(prefix, name string) (string, bool) {
+	if !strings.HasPrefix(name, prefix) {
+		return "", false
+	}
+	rest := name[len(prefix):]
+	if rest == "" || strings.Contains(rest, "/") {
+		return "", false
+	}
+	return rest, true
+}
+
+func (m *memBackend) Stat(p string) (os.FileInfo, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	key := memPath(p)
+	if f, ok := m.files[key]; ok {
+		return memInfo{name: path.Base(key), size: int64(len(f.data)), modTime: f.modTime}, nil
+	}
+	if modTime, ok := m.dirs[key]; ok {
+		return memInfo{name: path.Base(key), dir: true, modTime: modTime}, nil
+	}
+	return nil, memNotExist("stat", p)
+}
+
+func (m *memBackend) Remove(p string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.files, memPath(p))
+	return nil
+}
+
+func (m *memBackend) RemoveAll(p string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key := memPath(p)
+	prefix := key + "/"
+
+	for name := range m.files {
+		if name == key || strings.HasPrefix(name, prefix) {
+			delete(m.files, name)
+		}
+	}
+	for name := range m.dirs {
+		if name == key || strings.HasPrefix(name, prefix) {
+			delete(m.dirs, name)
+		}
+	}
+	return nil
+}
+
+func (m *memBackend) MkdirAll(p string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.mkdirAll(memPath(p), time.Now())
+	return nil
+}
+
+func (m *memBackend) mkdirAll(dir string, now time.Time) {
+	for {
+		if _, ok := m.dirs[dir]; ok {
+			return
+		}
+		m.dirs[dir] = now
+
+		parent := path.Dir(dir)
+		if parent == dir {
+			return
+		}
+		dir = parent
+	}
+}
+
+type memInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return i.dir }
+func (i memInfo) Sys() interface{}   { return nil }
+
+func (i memInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
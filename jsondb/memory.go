@@ -0,0 +1,284 @@
+package jsondb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// ErrMemoryBudget is returned by ReadAll, Query and the exports built on
+// them when their result would take more memory than the MemoryBudget of
+// the driver has left. ExportJSON into a Spool lists any collection.
+var ErrMemoryBudget = fmt.Errorf("Result exceeds the memory budget")
+
+// MemoryStats reports the use of the memory budget.
+type MemoryStats struct {
+	// Budget is the MemoryBudget of the driver, 0 when unlimited, and
+	// InUse and Peak the bytes of results held now and at most.
+	Budget int64
+	InUse  int64
+	Peak   int64
+
+	// Spills counts the spools moved to a temporary file, SpilledBytes
+	// what was written to them, and Rejected the reads and queries failed
+	// with ErrMemoryBudget.
+	Spills       int64
+	SpilledBytes int64
+	Rejected     int64
+}
+
+// memoryBudget is the memory results may take across the driver, its
+// copies and its system namespace. The size of a result is estimated by
+// that of its records on disk.
+type memoryBudget struct {
+	limit int64
+	dir   string
+
+	used, peak                     atomic.Int64
+	spills, spilledBytes, rejected atomic.Int64
+}
+
+func newMemoryBudget(limit int64, dir string) *memoryBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &memoryBudget{limit: limit, dir: dir}
+}
+
+// reserve takes n bytes of the budget, if they are left.
+func (b *memoryBudget) reserve(n int64) bool {
+	if b == nil {
+		return true
+	}
+	used := b.used.Add(n)
+	if used > b.limit {
+		b.used.Add(-n)
+		return false
+	}
+	for peak := b.peak.Load(); used > peak && !b.peak.CompareAndSwap(peak, used); peak = b.peak.Load() {
+	}
+	return true
+}
+
+func (b *memoryBudget) release(n int64) {
+	if b != nil && n > 0 {
+		b.used.Add(-n)
+	}
+}
+
+// reservation is the share of the budget taken by one result.
+type reservation struct {
+	budget *memoryBudget
+	n      int64
+}
+
+// grow reserves n more bytes for the result, failing with ErrMemoryBudget
+// when the budget is spent.
+func (r *reservation) grow(n int) error {
+	if !r.budget.reserve(int64(n)) {
+		r.budget.rejected.Add(1)
+		return ErrMemoryBudget
+	}
+	r.n += int64(n)
+	return nil
+}
+
+func (r *reservation) release() {
+	r.budget.release(r.n)
+	r.n = 0
+}
+
+// MemoryStats returns the use of the memory budget.
+func (d *Driver) MemoryStats() MemoryStats {
+	b := d.memory
+	if b == nil {
+		return MemoryStats{}
+	}
+	return MemoryStats{
+		Budget:       b.limit,
+		InUse:        b.used.Load(),
+		Peak:         b.peak.Load(),
+		Spills:       b.spills.Load(),
+		SpilledBytes: b.spilledBytes.Load(),
+		Rejected:     b.rejected.Load(),
+	}
+}
+
+// Spool buffers a large result, such as what ExportJSON writes: in memory
+// while the budget of its driver allows, in a temporary file of SpillDir
+// from then on. Close releases both.
+type Spool struct {
+	budget   *memoryBudget
+	mem      bytes.Buffer
+	reserved int64
+	file     *os.File
+	size     int64
+}
+
+// NewSpool returns an empty spool drawing on the memory budget of d.
+func (d *Driver) NewSpool() *Spool {
+	return &Spool{budget: d.memory}
+}
+
+func (s *Spool) Write(p []byte) (int, error) {
+	if s.file == nil {
+		if s.budget.reserve(int64(len(p))) {
+			s.reserved += int64(len(p))
+			s.size += int64(len(p))
+			return s.mem.Write(p)
+		}
+		if err := s.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := s.file.Write(p)
+	s.size += int64(n)
+	s.budget.spilledBytes.Add(int64(n))
+	return n, err
+}
+
+// spill moves what s holds in memory to a temporary file.
+func (s *Spool) spill() error {
+	f, err := os.CreateTemp(s.budget.dir, "jsondb-spill-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(s.mem.Bytes()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	s.file = f
+	s.budget.spills.Add(1)
+	s.budget.spilledBytes.Add(int64(s.mem.Len()))
+	s.mem = bytes.Buffer{}
+	s.budget.release(s.reserved)
+	s.reserved = 0
+	return nil
+}
+
+// Len returns the number of bytes written to s.
+func (s *Spool) Len() int64 {
+	return s.size
+}
+
+// Spilled reports whether s moved to a temporary file.
+func (s *Spool) Spilled() bool {
+	return s.file != nil
+}
+
+// Bytes returns the contents of s while it is in memory, nil once it
+// spilled. They stay valid after Close.
+func (s *Spool) Bytes() []byte {
+	if s.file != nil {
+		return nil
+	}
+	return s.mem.Bytes()
+}
+
+// Reader returns the contents of s from the start; closing it closes s.
+func (s *Spool) Reader() (io.ReadCloser, error) {
+	if s.file == nil {
+		return spoolReader{bytes.NewReader(s.mem.Bytes()), s}, nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return spoolReader{s.file, s}, nil
+}
+
+// Close frees the memory and removes the file of s.
+func (s *Spool) Close() error {
+	s.budget.release(s.reserved)
+	s.reserved = 0
+	s.mem = bytes.Buffer{}
+
+	if s.file == nil {
+		return nil
+	}
+	f := s.file
+	s.file = nil
+	err := f.Close()
+	if rerr := os.Remove(f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+type spoolReader struct {
+	io.Reader
+	spool *Spool
+}
+
+func (r spoolReader) Close() error {
+	return r.spool.Close()
+}
+
+// ExportJSON writes the records of collection matching q to w as a JSON
+// array, as they are stored, without holding them in memory: a Spool takes
+// a listing of any size within the memory budget. The result tells how the
+// query went; it has no Docs. The records are transformed as WithTransform
+// has it.
+func (d *Driver) ExportJSON(collection string, q Query, w io.Writer) (_ QueryResult, err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("ExportJSON", collection, "")
+	defer span.end(&err)
+
+	if err := d.allow(PolicyRead, collection); err != nil {
+		return QueryResult{}, err
+	}
+
+	if collection == "" {
+		return QueryResult{}, fmt.Errorf("Missing collection - unable to read")
+	}
+	if q.Geo != nil {
+		return QueryResult{}, fmt.Errorf("Geo queries cannot be exported")
+	}
+	if err := q.prepare(d.CollectionConfig(collection).Collations); err != nil {
+		return QueryResult{}, err
+	}
+	q.Limits = q.Limits.withDefaults(d.qlimits)
+
+	unlock, err := d.lockCollection(collection, LockRead)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	defer unlock()
+
+	if _, err := io.WriteString(w, "["); err != nil {
+		return QueryResult{}, err
+	}
+
+	var n, size int
+	budget := q.Limits.start(d.ctx)
+	err = d.matching(collection, q, budget, &n, func(resource string, b []byte, doc map[string]interface{}) error {
+		if budget.limits.MaxResults > 0 && n > budget.limits.MaxResults {
+			budget.limited = LimitResults
+			return errLimited
+		}
+		if n > 1 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		size += len(b)
+		b, err := d.transform.applyBytes(collection, b)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(bytes.TrimSpace(b))
+		return err
+	})
+	r, err := budget.result(nil, err)
+	if err != nil {
+		return r, err
+	}
+	d.traceBytes(size)
+
+	_, err = io.WriteString(w, "]")
+	return r, err
+}
@@ -0,0 +1,113 @@
+package jsondb
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// mergeUnknown copies into doc the fields of old that the struct type t
+// has no field for, descending into nested structs. It reports whether
+// anything was copied. Fields t knows are left as written, so clearing one
+// in the struct clears it on disk.
+func mergeUnknown(t reflect.Type, old, doc map[string]interface{}) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+
+	fields := structFields(t)
+	var merged bool
+
+	for key, value := range old {
+		f, known := fields[foldName(key)]
+		if !known {
+			if _, ok := doc[key]; !ok {
+				doc[key] = value
+				merged = true
+			}
+			continue
+		}
+
+		oldSub, ok1 := value.(map[string]interface{})
+		newSub, ok2 := doc[key].(map[string]interface{})
+		if ok1 && ok2 && mergeUnknown(f.t, oldSub, newSub) {
+			merged = true
+		}
+	}
+	return merged
+}
+
+// structField is a field of a struct type, by its JSON name.
+type structField struct {
+	name string
+	t    reflect.Type
+}
+
+// structFields maps the folded JSON names of the fields of t, including
+// those of embedded structs, to the fields; see foldName.
+func structFields(t reflect.Type) map[string]structField {
+	fields := make(map[string]structField)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			for k, v := range structFields(ft) {
+				if _, ok := fields[k]; !ok {
+					fields[k] = v
+				}
+			}
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		fields[foldName(name)] = structField{name, ft}
+	}
+	return fields
+}
+
+// mergeOnWrite returns the encoding of v with the fields of the stored
+// record at path that v's type does not know carried over. Values that are
+// not structs are written as they are.
+func (d *Driver) mergeOnWrite(path string, v interface{}, b []byte) ([]byte, error) {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return b, nil
+	}
+
+	stored, err := d.backend.ReadFile(path)
+	if err != nil {
+		return b, nil // nothing to keep
+	}
+	old, err := decodeDocument(stored)
+	if err != nil {
+		return b, nil
+	}
+
+	doc, err := decodeDocument(b)
+	if err != nil || !mergeUnknown(t, old, doc) {
+		return b, err
+	}
+
+	b, err = json.MarshalIndent(doc, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, byte('\n')), nil
+}
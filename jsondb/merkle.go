@@ -0,0 +1,278 @@
+package jsondb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// merkleLeafSize is the number of records up to which a MerkleNode lists
+// the hashes of its records instead of its children.
+const merkleLeafSize = 16
+
+// MerkleNode is a node of the Merkle tree of a collection, by which two
+// databases holding the same collection, such as a primary and its
+// replica, find the records they disagree on while exchanging little more
+// than the hashes of the nodes that differ; see DiffMerkle.
+//
+// Records are placed by the SHA-256 of their resource name, in hex: the
+// node of Prefix holds the records whose name hashes start with it, the
+// root, of prefix "", all of them, and its 16 children split them by the
+// next hex digit. A record is hashed with its name and its content, as
+// canonical JSON, so records that only differ in formatting are equal.
+type MerkleNode struct {
+	Prefix  string
+	Hash    string
+	Records int
+
+	// Children are the non-empty children of the node, by digit, unless
+	// it holds no more than 16 records; Leaves are then the hashes of
+	// its records, by resource.
+	Children []MerkleChild     `json:",omitempty"`
+	Leaves   map[string]string `json:",omitempty"`
+}
+
+// MerkleChild is a child of a MerkleNode.
+type MerkleChild struct {
+	Prefix  string
+	Hash    string
+	Records int
+}
+
+// merkleLeaf is a record placed in the Merkle tree.
+type merkleLeaf struct {
+	resource string
+	position string // hex SHA-256 of the resource name
+	hash     []byte
+}
+
+// merkleLeaves hashes the records of collection, in the order of their
+// position in the tree. A missing collection has none.
+func (d *Driver) merkleLeaves(collection string) ([]merkleLeaf, error) {
+	unlock, err := d.lockCollection(collection, LockRead)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var leaves []merkleLeaf
+	err = d.scan(collection, func(resource string, b []byte) error {
+		doc, err := decodeDocument(b)
+		if err != nil {
+			return fmt.Errorf("Error decoding '%s/%s': %v", collection, resource, err)
+		}
+		canonical, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+
+		position := sha256.Sum256([]byte(resource))
+		h := sha256.New()
+		h.Write([]byte(resource))
+		h.Write([]byte{0})
+		h.Write(canonical)
+		leaves = append(leaves, merkleLeaf{resource: resource, position: hex.EncodeToString(position[:]), hash: h.Sum(nil)})
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sort.Slice(leaves, func(i, j int) bool { return leaves[i].position < leaves[j].position })
+	return leaves, nil
+}
+
+// merkleHash returns the hash of the node holding leaves, sorted by
+// position, which share their first depth digits: that of the record for a
+// single one, that of the hashes of its children, with their digits,
+// otherwise. An empty node has no hash.
+func merkleHash(leaves []merkleLeaf, depth int) []byte {
+	switch len(leaves) {
+	case 0:
+		return nil
+	case 1:
+		return leaves[0].hash
+	}
+
+	h := sha256.New()
+	for _, child := range merkleSplit(leaves, depth) {
+		h.Write([]byte{child[0].position[depth]})
+		h.Write(merkleHash(child, depth+1))
+	}
+	return h.Sum(nil)
+}
+
+// merkleSplit splits leaves, sorted by position and sharing their first
+// depth digits, by the next digit.
+func merkleSplit(leaves []merkleLeaf, depth int) [][]merkleLeaf {
+	var children [][]merkleLeaf
+	for start := 0; start < len(leaves); {
+		end := start + 1
+		for end < len(leaves) && leaves[end].position[depth] == leaves[start].position[depth] {
+			end++
+		}
+		children = append(children, leaves[start:end])
+		start = end
+	}
+	return children
+}
+
+// Fingerprint returns the hash of the root of the Merkle tree of
+// collection, equal in two databases exactly when they hold the same
+// records; see MerkleNode. It is "" for an empty or missing collection.
+// The records are read and hashed on every call.
+func (d *Driver) Fingerprint(collection string) (_ string, err error) {
+	node, err := d.MerkleNode(collection, "")
+	return node.Hash, err
+}
+
+// MerkleNode returns the node of the Merkle tree of collection at prefix,
+// a string of hex digits, "" for the root. The records are read and hashed
+// on every call.
+func (d *Driver) MerkleNode(collection, prefix string) (_ MerkleNode, err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("MerkleNode", collection, prefix)
+	defer span.end(&err)
+
+	if err := d.allow(PolicyRead, collection); err != nil {
+		return MerkleNode{}, err
+	}
+	if err := validName(collection, ""); err != nil {
+		return MerkleNode{}, err
+	}
+	prefix = strings.ToLower(prefix)
+	if len(prefix) > sha256.Size*2 || strings.Trim(prefix, "0123456789abcdef") != "" {
+		return MerkleNode{}, fmt.Errorf("Invalid Merkle prefix '%s'", prefix)
+	}
+
+	leaves, err := d.merkleLeaves(collection)
+	if err != nil {
+		return MerkleNode{}, err
+	}
+	start := sort.Search(len(leaves), func(i int) bool { return leaves[i].position >= prefix })
+	end := start
+	for end < len(leaves) && strings.HasPrefix(leaves[end].position, prefix) {
+		end++
+	}
+	leaves = leaves[start:end]
+
+	node := MerkleNode{Prefix: prefix, Hash: hex.EncodeToString(merkleHash(leaves, len(prefix))), Records: len(leaves)}
+	if len(leaves) <= merkleLeafSize {
+		node.Leaves = make(map[string]string, len(leaves))
+		for _, leaf := range leaves {
+			node.Leaves[leaf.resource] = hex.EncodeToString(leaf.hash)
+		}
+		return node, nil
+	}
+	for _, child := range merkleSplit(leaves, len(prefix)) {
+		node.Children = append(node.Children, MerkleChild{
+			Prefix:  child[0].position[:len(prefix)+1],
+			Hash:    hex.EncodeToString(merkleHash(child, len(prefix)+1)),
+			Records: len(child),
+		})
+	}
+	return node, nil
+}
+
+// MerkleFunc returns the node of the Merkle tree of a collection at
+// prefix, as Driver.MerkleNode does, wherever the collection is, such as
+// on a server reached by the client package.
+type MerkleFunc func(prefix string) (MerkleNode, error)
+
+// DiffMerkle walks the Merkle trees of a collection in two places down the
+// nodes whose hashes differ, and returns, in order, the resources of the
+// records that are in one only or differ between them.
+func DiffMerkle(a, b MerkleFunc) ([]string, error) {
+	diverged := make(map[string]bool)
+	if err := diffMerkle(a, b, "", diverged); err != nil {
+		return nil, err
+	}
+	resources := make([]string, 0, len(diverged))
+	for resource := range diverged {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+	return resources, nil
+}
+
+func diffMerkle(a, b MerkleFunc, prefix string, diverged map[string]bool) error {
+	na, err := a(prefix)
+	if err != nil {
+		return err
+	}
+	nb, err := b(prefix)
+	if err != nil {
+		return err
+	}
+	if na.Hash == nb.Hash {
+		return nil
+	}
+
+	// Once either side lists its records, the other side's records under
+	// the node are listed too, by walking its subtree.
+	if na.Leaves != nil || nb.Leaves != nil {
+		la, err := merkleRecords(a, na)
+		if err != nil {
+			return err
+		}
+		lb, err := merkleRecords(b, nb)
+		if err != nil {
+			return err
+		}
+		for resource, hash := range la {
+			if lb[resource] != hash {
+				diverged[resource] = true
+			}
+		}
+		for resource := range lb {
+			if _, ok := la[resource]; !ok {
+				diverged[resource] = true
+			}
+		}
+		return nil
+	}
+
+	hashes := make(map[string]string, len(nb.Children))
+	for _, child := range nb.Children {
+		hashes[child.Prefix] = child.Hash
+	}
+	for _, child := range na.Children {
+		if hashes[child.Prefix] != child.Hash {
+			if err := diffMerkle(a, b, child.Prefix, diverged); err != nil {
+				return err
+			}
+		}
+		delete(hashes, child.Prefix)
+	}
+	for prefix := range hashes {
+		if err := diffMerkle(a, b, prefix, diverged); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// merkleRecords returns the hashes of the records under node, by resource.
+func merkleRecords(f MerkleFunc, node MerkleNode) (map[string]string, error) {
+	if node.Leaves != nil {
+		return node.Leaves, nil
+	}
+	records := make(map[string]string, node.Records)
+	for _, child := range node.Children {
+		n, err := f(child.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		sub, err := merkleRecords(f, n)
+		if err != nil {
+			return nil, err
+		}
+		for resource, hash := range sub {
+			records[resource] = hash
+		}
+	}
+	return records, nil
+}
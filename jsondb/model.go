@@ -0,0 +1,235 @@
+package jsondb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// RegisterModel configures collection from the db struct tags of model, a
+// struct or a pointer to one, and registers its type as RegisterType does:
+//
+//	type Session struct {
+//		ID      string    `db:"key"`
+//		User    string    `json:"user" db:"index"`
+//		Token   string    `db:"index,unique"`
+//		Expires time.Time `db:"ttl"`
+//	}
+//
+// "key" makes the field the Key of the collection, "index" adds it to its
+// Indexes, "unique" to Unique and "ttl", on a time, makes it the TTLField.
+// Fields are named as encoding/json names them, the fields of nested
+// structs by dotted path. The rest of the configuration of the collection
+// is kept; as with ConfigureCollection, records already stored must comply.
+func (d *Driver) RegisterModel(collection string, model interface{}) error {
+	collection = d.resolve(collection)
+	t := reflect.TypeOf(model)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return fmt.Errorf("Model of '%s' is not a struct", collection)
+	}
+
+	var m modelTags
+	if err := m.read(t, "", map[reflect.Type]bool{}); err != nil {
+		return fmt.Errorf("Invalid model of '%s': %v", collection, err)
+	}
+
+	cfg := d.CollectionConfig(collection)
+	if m.key != "" {
+		cfg.Key = m.key
+	}
+	if m.ttl != "" {
+		cfg.TTLField = m.ttl
+	}
+	cfg.Indexes = addFields(cfg.Indexes, m.indexes)
+	cfg.Unique = addFields(cfg.Unique, m.unique)
+	if err := d.ConfigureCollection(collection, cfg); err != nil {
+		return err
+	}
+
+	d.RegisterType(collection, model)
+	return nil
+}
+
+// modelTags are the fields a model tags, by path.
+type modelTags struct {
+	key, ttl        string
+	indexes, unique []string
+}
+
+// read reads the db tags of the fields of t, whose paths start with
+// prefix; open holds the structs being read, which t may nest again.
+func (m *modelTags) read(t reflect.Type, prefix string, open map[reflect.Type]bool) error {
+	if open[t] {
+		return nil
+	}
+	open[t] = true
+	defer delete(open, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			if err := m.read(ft, prefix, open); err != nil {
+				return err
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		path := prefix + name
+
+		for _, opt := range strings.Split(f.Tag.Get("db"), ",") {
+			switch strings.TrimSpace(opt) {
+			case "":
+			case "key":
+				if m.key != "" {
+					return fmt.Errorf("both '%s' and '%s' are tagged key", m.key, path)
+				}
+				m.key = path
+			case "index":
+				m.indexes = append(m.indexes, path)
+			case "unique":
+				m.unique = append(m.unique, path)
+			case "ttl":
+				if m.ttl != "" {
+					return fmt.Errorf("both '%s' and '%s' are tagged ttl", m.ttl, path)
+				}
+				if ft != timeType && ft.Kind() != reflect.String {
+					return fmt.Errorf("ttl field '%s' is not a time", path)
+				}
+				m.ttl = path
+			default:
+				return fmt.Errorf("unknown db tag '%s' of '%s'", opt, path)
+			}
+		}
+
+		if ft.Kind() == reflect.Struct && ft != timeType {
+			if err := m.read(ft, path+".", open); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addFields returns fields with those of more it does not have yet.
+func addFields(fields, more []string) []string {
+	for _, field := range more {
+		found := false
+		for _, f := range fields {
+			found = found || f == field
+		}
+		if !found {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// Save writes v as the record of collection named by its Key field, such
+// as a value of a model registered with RegisterModel. The key is read
+// once BeforeSave, if any, has run.
+func (d *Driver) Save(collection string, v interface{}) (err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("Save", collection, "")
+	defer span.end(&err)
+
+	if err := d.allow(PolicyWrite, collection); err != nil {
+		return err
+	}
+	cfg := d.collectionConfig(collection)
+	if cfg == nil || cfg.Key == "" {
+		return fmt.Errorf("Collection '%s' has no key field", collection)
+	}
+	if err := d.beforeSave(v); err != nil {
+		return err
+	}
+
+	generic, err := ToGeneric(v)
+	if err != nil {
+		return err
+	}
+	doc, ok := generic.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Record of '%s' is not an object", collection)
+	}
+	key, ok := lookup(doc, cfg.Key)
+	if !ok || key == nil || fmt.Sprint(key) == "" {
+		return fmt.Errorf("Missing key field '%s' of record of '%s'", cfg.Key, collection)
+	}
+	return d.put(collection, fmt.Sprint(key), v)
+}
+
+// uniqueValues holds, for the Unique fields of a collection, the record
+// holding each value.
+type uniqueValues map[string]map[string]string
+
+func newUniqueValues(fields []string) uniqueValues {
+	u := make(uniqueValues, len(fields))
+	for _, field := range fields {
+		u[field] = make(map[string]string)
+	}
+	return u
+}
+
+// add records the values of doc, failing with a ConstraintError if
+// another record holds one already.
+func (u uniqueValues) add(resource string, doc map[string]interface{}) error {
+	for field, taken := range u {
+		v, ok := lookup(doc, field)
+		if !ok || v == nil {
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if other, ok := taken[string(b)]; ok && other != resource {
+			return &ConstraintError{resource, fmt.Sprintf("field '%s' value %s is taken by '%s'", field, b, other)}
+		}
+		taken[string(b)] = resource
+	}
+	return nil
+}
+
+// checkUnique fails with a ConstraintError if doc, to be written as
+// collection/resource, has the value of a Unique field another record has;
+// the caller holds the collection lock.
+func (d *Driver) checkUnique(collection, resource string, cfg *CollectionConfig, doc map[string]interface{}) error {
+	if len(cfg.Unique) == 0 {
+		return nil
+	}
+
+	taken := newUniqueValues(cfg.Unique)
+	err := d.scan(collection, func(other string, b []byte) error {
+		if other == resource {
+			return nil
+		}
+		stored, err := decodeDocument(b)
+		if err != nil {
+			return nil // left to the corrupt record policy
+		}
+		return taken.add(other, stored)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return taken.add(resource, doc)
+}
@@ -0,0 +1,209 @@
+package jsondb
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// Field namings of CollectionConfig.Naming. Records are stored with their
+// field names, and those of the objects nested in them, in the naming:
+// UserID is stored as userId or user_id.
+const (
+	NamingCamel = "camelCase"
+	NamingSnake = "snake_case"
+)
+
+// splitWords splits a field name into its words, at underscores, dashes
+// and changes of case: "HTTPServer_port" is HTTP, Server and port.
+func splitWords(name string) []string {
+	var words []string
+	runes := []rune(name)
+	start := 0
+	flush := func(end int) {
+		if end > start {
+			words = append(words, string(runes[start:end]))
+		}
+	}
+
+	for i, r := range runes {
+		switch {
+		case r == '_' || r == '-' || r == ' ':
+			flush(i)
+			start = i + 1
+		case i > start && unicode.IsUpper(r):
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				flush(i)
+				start = i
+			}
+		}
+	}
+	flush(len(runes))
+	return words
+}
+
+// nameField returns field in naming.
+func nameField(naming, field string) string {
+	words := splitWords(field)
+	if len(words) == 0 {
+		return field
+	}
+
+	switch naming {
+	case NamingCamel:
+		var b strings.Builder
+		for i, word := range words {
+			word = strings.ToLower(word)
+			if i > 0 {
+				r := []rune(word)
+				word = string(unicode.ToUpper(r[0])) + string(r[1:])
+			}
+			b.WriteString(word)
+		}
+		return b.String()
+
+	case NamingSnake:
+		for i, word := range words {
+			words[i] = strings.ToLower(word)
+		}
+		return strings.Join(words, "_")
+	}
+	return field
+}
+
+// nameFields renames the fields of v, a decoded record, and of the
+// objects nested in it, to naming.
+func nameFields(naming string, v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		named := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			named[nameField(naming, k)] = nameFields(naming, e)
+		}
+		return named
+	case []interface{}:
+		for i, e := range t {
+			t[i] = nameFields(naming, e)
+		}
+	}
+	return v
+}
+
+// foldName is name lower-cased without underscores and dashes, the same
+// in every naming: userId, user_id and UserID all fold to userid.
+func foldName(name string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(name))
+}
+
+// unnameFields renames the fields of v, a record decoded with its fields
+// in a naming, to the JSON names of the fields of t they stand for, so it
+// decodes into t. Fields t does not have are left alone.
+func unnameFields(v interface{}, t reflect.Type) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+		fields := structFields(t)
+		unnamed := make(map[string]interface{}, len(m))
+		for k, e := range m {
+			if f, ok := fields[foldName(k)]; ok {
+				unnamed[f.name] = unnameFields(e, f.t)
+				continue
+			}
+			if _, ok := unnamed[k]; !ok {
+				unnamed[k] = e
+			}
+		}
+		return unnamed
+
+	case reflect.Slice, reflect.Array:
+		list, ok := v.([]interface{})
+		if !ok {
+			return v
+		}
+		for i, e := range list {
+			list[i] = unnameFields(e, t.Elem())
+		}
+
+	case reflect.Map:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+		for k, e := range m {
+			m[k] = unnameFields(e, t.Elem())
+		}
+	}
+	return v
+}
+
+// DecodeRecord decodes b, a record of collection as ReadRaw returns it,
+// into v, matching the fields of a collection with a Naming to those of v,
+// and calls its AfterLoad method, if any.
+func (d *Driver) DecodeRecord(collection string, b []byte, v interface{}) error {
+	collection = d.resolve(collection)
+	t := reflect.TypeOf(v)
+	cfg := d.collectionConfig(collection)
+	if cfg == nil || cfg.Naming == "" || t == nil {
+		if err := json.Unmarshal(b, v); err != nil {
+			return err
+		}
+		return d.afterLoad(v)
+	}
+
+	doc, err := decodeDocument(b)
+	if err != nil {
+		return err
+	}
+	if err := FromGeneric(unnameFields(doc, t), v); err != nil {
+		return err
+	}
+	return d.afterLoad(v)
+}
+
+// DecodeDocument decodes doc, a record of collection as Query returns it,
+// into v as DecodeRecord does.
+func (d *Driver) DecodeDocument(collection string, doc Document, v interface{}) error {
+	b, err := json.Marshal(doc.Data)
+	if err != nil {
+		return err
+	}
+	return d.DecodeRecord(collection, b, v)
+}
+
+// NameFields returns v, a record of collection, with the fields named as
+// the Naming of the collection stores them, for it to be sent as stored.
+// Without a Naming, v is returned as is.
+func (d *Driver) NameFields(collection string, v interface{}) (interface{}, error) {
+	collection = d.resolve(collection)
+	cfg := d.collectionConfig(collection)
+	if cfg == nil || cfg.Naming == "" {
+		return v, nil
+	}
+	generic, err := ToGeneric(v)
+	if err != nil {
+		return nil, err
+	}
+	return nameFields(cfg.Naming, generic), nil
+}
+
+// UnnameFields returns generic, a record of collection with the fields
+// named as the Naming of the collection stores them, with the fields
+// renamed to those of t, so FromGeneric decodes it into a t.
+func (d *Driver) UnnameFields(collection string, generic interface{}, t reflect.Type) interface{} {
+	collection = d.resolve(collection)
+	cfg := d.collectionConfig(collection)
+	if cfg == nil || cfg.Naming == "" {
+		return generic
+	}
+	return unnameFields(generic, t)
+}
@@ -0,0 +1,196 @@
+package jsondb
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The op log shows what an application does to a database as it happens,
+// for debugging: the changes of the change feed and, while someone asks
+// for them, the reads. Reads are not retained, so only changes are
+// available after the fact.
+
+// OpEntry is one operation of the op log: a change event, with its Op
+// ("create", "update", ...), or a read, with the name of the driver
+// operation ("Read", "Query", ...).
+type OpEntry struct {
+	Time       time.Time
+	Op         string
+	Collection string
+	Resource   string `json:",omitempty"`
+
+	// Seq is the sequence number of a change; see Event.
+	Seq uint64 `json:",omitempty"`
+
+	// Elapsed and Error are those of a read.
+	Elapsed time.Duration `json:",omitempty"`
+	Error   string        `json:",omitempty"`
+}
+
+// OpLogFilter selects the entries of an op log: those of Collection, or of
+// every collection outside the system namespace if it is empty, with one
+// of Ops, compared without case, if any are given. Reads are left out
+// unless Reads is set.
+type OpLogFilter struct {
+	Collection string
+	Ops        []string
+	Reads      bool
+}
+
+func (f OpLogFilter) match(e OpEntry) bool {
+	if !watches(f.Collection, e.Collection) {
+		return false
+	}
+	if len(f.Ops) == 0 {
+		return true
+	}
+	for _, op := range f.Ops {
+		if strings.EqualFold(op, e.Op) {
+			return true
+		}
+	}
+	return false
+}
+
+// readOps are the driver operations the op log reports as reads.
+var readOps = map[string]bool{
+	"Read":          true,
+	"ReadRaw":       true,
+	"ReadAll":       true,
+	"ReadMany":      true,
+	"ReadPrefix":    true,
+	"ReadRange":     true,
+	"ReadArchived":  true,
+	"ReadVersion":   true,
+	"Query":         true,
+	"Find":          true,
+	"ListKeys":      true,
+	"ExportJSON":    true,
+	"Versions":      true,
+	"Edges":         true,
+	"Traverse":      true,
+	"Attachments":   true,
+	"GetAttachment": true,
+}
+
+// opLog fans reads out to the op logs asking for them, shared by the
+// copies of a driver. Reads are only reported while one is.
+type opLog struct {
+	active  atomic.Int32
+	mutex   sync.Mutex
+	readers map[chan OpEntry]bool
+}
+
+func newOpLog() *opLog {
+	return &opLog{readers: make(map[chan OpEntry]bool)}
+}
+
+// read reports a read that took elapsed; op logs too slow to take it
+// miss it.
+func (l *opLog) read(info OpInfo, elapsed time.Duration, err error) {
+	if l == nil || l.active.Load() == 0 || info.System || !readOps[info.Op] {
+		return
+	}
+
+	e := OpEntry{Time: info.Start.UTC(), Op: info.Op, Collection: info.Collection, Resource: info.Resource, Elapsed: elapsed}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for ch := range l.readers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func changeEntry(e Event) OpEntry {
+	return OpEntry{Time: e.Time, Op: e.Op, Collection: e.Collection, Resource: e.Resource, Seq: e.Seq}
+}
+
+// RecentOps returns up to n of the latest changes passing f, oldest first,
+// from those kept for resuming watches.
+func (d *Driver) RecentOps(f OpLogFilter, n int) []OpEntry {
+	entries := []OpEntry{}
+	if d.feed == nil || n <= 0 {
+		return entries
+	}
+
+	d.feed.mutex.Lock()
+	defer d.feed.mutex.Unlock()
+
+	for i := len(d.feed.history) - 1; i >= 0 && len(entries) < n; i-- {
+		if e := changeEntry(d.feed.history[i]); f.match(e) {
+			entries = append(entries, e)
+		}
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries
+}
+
+// OpLog streams the operations passing f until ctx is done. Like a watch,
+// the channel is closed early when the log falls too far behind on the
+// changes; reads it is too slow to take are skipped.
+func (d *Driver) OpLog(ctx context.Context, f OpLogFilter) (<-chan OpEntry, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	events, err := d.Watch(ctx, f.Collection, "")
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	var reads chan OpEntry
+	if f.Reads && d.oplog != nil {
+		reads = make(chan OpEntry, watchBuffer)
+		d.oplog.mutex.Lock()
+		d.oplog.readers[reads] = true
+		d.oplog.mutex.Unlock()
+		d.oplog.active.Add(1)
+	}
+
+	out := make(chan OpEntry, watchBuffer)
+	go func() {
+		defer close(out)
+		defer cancel()
+		if reads != nil {
+			defer func() {
+				d.oplog.active.Add(-1)
+				d.oplog.mutex.Lock()
+				delete(d.oplog.readers, reads)
+				d.oplog.mutex.Unlock()
+			}()
+		}
+
+		for {
+			var e OpEntry
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				e = changeEntry(event)
+			case e = <-reads:
+			case <-ctx.Done():
+				return
+			}
+			if !f.match(e) {
+				continue
+			}
+
+			select {
+			case out <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
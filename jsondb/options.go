@@ -0,0 +1,127 @@
+package jsondb
+
+import "time"
+
+// Durability says how far a write has reached when it returns.
+type Durability int
+
+const (
+	// DurabilitySync flushes every record and its directory to disk before
+	// the write returns, so acknowledged writes survive a power loss.
+	DurabilitySync Durability = iota
+
+	// DurabilityNone leaves flushing to the operating system. Writes stay
+	// atomic, and a crashed process loses nothing, but a power loss may
+	// undo recent writes. It suits tests and scratch databases.
+	DurabilityNone
+)
+
+// Option configures a database opened with Open. Options are applied in
+// order, so later ones win; new settings are added as new options without
+// breaking existing callers.
+type Option func(*Options)
+
+// Open opens or creates the database in dir, configured by opts. It is New
+// with functional options:
+//
+//	db, err := jsondb.Open("./data", jsondb.WithLogger(log), jsondb.WithSlowOp(time.Second))
+func Open(dir string, opts ...Option) (*Driver, error) {
+	var options Options
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return New(dir, &options)
+}
+
+// WithOptions applies every field of o, as New would.
+func WithOptions(o Options) Option {
+	return func(opts *Options) { *opts = o }
+}
+
+// WithLogger sets the logger; the default logs INFO and above to the console.
+func WithLogger(l Logger) Option {
+	return func(opts *Options) { opts.Logger = l }
+}
+
+// WithSlowOp logs every operation taking at least d.
+func WithSlowOp(d time.Duration) Option {
+	return func(opts *Options) { opts.SlowOp = d }
+}
+
+// WithArchive keeps archived records in store.
+func WithArchive(store ArchiveStore) Option {
+	return func(opts *Options) { opts.Archive = store }
+}
+
+// WithInstrumentation reports every operation to instr.
+func WithInstrumentation(instr Instrumentation) Option {
+	return func(opts *Options) { opts.Instrumentation = instr }
+}
+
+// WithLimits bounds the size and shape of records written.
+func WithLimits(l Limits) Option {
+	return func(opts *Options) { opts.Limits = l }
+}
+
+// WithRetry sets how file operations failing with transient errors are
+// retried.
+func WithRetry(p RetryPolicy) Option {
+	return func(opts *Options) { opts.Retry = p }
+}
+
+// WithDiskWatermark rejects writes while free disk space is below w.
+func WithDiskWatermark(w DiskWatermark) Option {
+	return func(opts *Options) { opts.DiskWatermark = w }
+}
+
+// WithDurability sets whether writes are flushed to disk before returning.
+func WithDurability(d Durability) Option {
+	return func(opts *Options) { opts.Durability = d }
+}
+
+// WithFault injects simulated crashes into file writes, for crash-recovery
+// tests.
+func WithFault(fn FaultFunc) Option {
+	return func(opts *Options) { opts.Fault = fn }
+}
+
+// WithTracer traces every operation with t.
+func WithTracer(t Tracer) Option {
+	return func(opts *Options) { opts.Tracer = t }
+}
+
+// WithUpgrade sets whether a directory of an older layout is migrated on
+// opening.
+func WithUpgrade(p UpgradePolicy) Option {
+	return func(opts *Options) { opts.Upgrade = p }
+}
+
+// WithCorrupt sets what listings do with records that cannot be read or
+// parsed.
+func WithCorrupt(p CorruptPolicy) Option {
+	return func(opts *Options) { opts.Corrupt = p }
+}
+
+// WithQueryCache caches query results as cfg says.
+func WithQueryCache(cfg QueryCacheConfig) Option {
+	return func(opts *Options) { opts.QueryCache = cfg }
+}
+
+// WithQueryLimits bounds the work of every query.
+func WithQueryLimits(l QueryLimits) Option {
+	return func(opts *Options) { opts.QueryLimits = l }
+}
+
+// WithLockTimeout bounds how long operations wait for collection locks.
+func WithLockTimeout(timeout time.Duration) Option {
+	return func(opts *Options) { opts.LockTimeout = timeout }
+}
+
+// WithMemoryBudget bounds the memory of results to budget bytes, spilling
+// spools to temporary files in spillDir.
+func WithMemoryBudget(budget int64, spillDir string) Option {
+	return func(opts *Options) {
+		opts.MemoryBudget = budget
+		opts.SpillDir = spillDir
+	}
+}
@@ -0,0 +1,82 @@
+// Package oteltrace traces jsondb operations with OpenTelemetry:
+//
+//	db, err := jsondb.Open(dir, jsondb.WithTracer(oteltrace.Tracer{}))
+//
+// Spans go to the global tracer provider, which does nothing until the
+// application installs one. Tracer is a jsondb.TracePropagator using the
+// global propagator, so replicated changes carry their trace.
+package oteltrace
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"database/jsondb"
+)
+
+// tracerName is the instrumentation scope of the spans.
+const tracerName = "database/jsondb"
+
+// Tracer is a jsondb.Tracer starting spans with the global tracer provider.
+type Tracer struct{}
+
+func (Tracer) Start(ctx context.Context, name string, attrs map[string]interface{}) (context.Context, jsondb.Span) {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for key, value := range attrs {
+		kvs = append(kvs, attr(key, value))
+	}
+
+	ctx, s := otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(kvs...))
+	return ctx, span{s}
+}
+
+// Inject returns the trace context of ctx in the fields of the global
+// propagator, such as traceparent.
+func (Tracer) Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+// Extract returns ctx continuing the trace of fields.
+func (Tracer) Extract(ctx context.Context, fields map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(fields))
+}
+
+type span struct {
+	trace.Span
+}
+
+func (s span) SetAttribute(key string, value interface{}) {
+	s.SetAttributes(attr(key, value))
+}
+
+func (s span) End(err error) {
+	if err != nil {
+		s.RecordError(err)
+		s.SetStatus(codes.Error, err.Error())
+	}
+	s.Span.End()
+}
+
+func attr(key string, value interface{}) attribute.KeyValue {
+	switch v := value.(type) {
+	case string:
+		return attribute.String(key, v)
+	case int:
+		return attribute.Int(key, v)
+	case int64:
+		return attribute.Int64(key, v)
+	case float64:
+		return attribute.Float64(key, v)
+	case bool:
+		return attribute.Bool(key, v)
+	}
+	return attribute.String(key, fmt.Sprint(value))
+}
@@ -0,0 +1,655 @@
+package jsondb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Parquet column types.
+const (
+	ParquetString  = "string"
+	ParquetInt64   = "int64"
+	ParquetDouble  = "double"
+	ParquetBoolean = "boolean"
+
+	// ParquetJSON stores arrays (or any value) as JSON text.
+	ParquetJSON = "json"
+)
+
+// ParquetColumn is one column of a Parquet export. Name is a dotted field
+// path (Address.City); Type is one of the Parquet* types.
+type ParquetColumn struct {
+	Name string
+	Type string
+}
+
+// KeyColumn holds the resource name of each record in exports.
+const KeyColumn = "_key"
+
+var parquetMagic = []byte("PAR1")
+
+// Parquet physical and converted types, repetitions and encodings.
+const (
+	pqBoolean   = 0
+	pqInt32     = 1
+	pqInt64     = 2
+	pqFloat     = 4
+	pqDouble    = 5
+	pqByteArray = 6
+
+	pqRequired = 0
+	pqOptional = 1
+
+	pqUTF8 = 0
+	pqJSON = 19
+
+	pqPlain = 0
+	pqRLE   = 3
+
+	pqDataPage = 0
+)
+
+// ExportParquet writes the records of collection to w as a Parquet file
+// with one row per record. Nested objects are flattened into dotted column
+// names and the resource name is stored in the _key column. Without a
+// schema the columns and their types are inferred from the records, as
+// transformed by WithTransform.
+//
+// The file has a single row group with one uncompressed, PLAIN-encoded page
+// per column, which every Parquet reader understands.
+func (d *Driver) ExportParquet(collection string, w io.Writer, schema ...ParquetColumn) error {
+	collection = d.resolve(collection)
+	docs, err := d.Query(collection, Query{})
+	if err != nil {
+		return err
+	}
+
+	rows := make([]map[string]interface{}, len(docs))
+	for i, doc := range docs {
+		rows[i] = map[string]interface{}{}
+		flattenDocument("", d.transform.Apply(collection, doc.Data), rows[i])
+		rows[i][KeyColumn] = doc.Resource
+	}
+
+	if len(schema) == 0 {
+		schema = inferParquetSchema(rows)
+	}
+
+	columns := []ParquetColumn{{KeyColumn, ParquetString}}
+	for _, col := range schema {
+		if col.Name != KeyColumn {
+			columns = append(columns, col)
+		}
+	}
+	schema = columns
+
+	var file bytes.Buffer
+	file.Write(parquetMagic)
+
+	meta := newThriftWriter()
+	meta.i32(1, 1) // version
+	meta.listBegin(2, thriftStruct, len(schema)+1)
+	meta.structBegin(0)
+	meta.binary(4, []byte("schema"))
+	meta.i32(5, int32(len(schema)))
+	meta.structEnd()
+
+	for i, col := range schema {
+		typ, converted := parquetPhysical(col.Type)
+		if typ < 0 {
+			return fmt.Errorf("Unknown Parquet type '%s' for column '%s'", col.Type, col.Name)
+		}
+
+		meta.structBegin(0)
+		meta.i32(1, int32(typ))
+		meta.i32(3, int32(parquetRepetition(i)))
+		meta.binary(4, []byte(col.Name))
+		if converted >= 0 {
+			meta.i32(6, int32(converted))
+		}
+		meta.structEnd()
+	}
+
+	type chunk struct {
+		offset, size int64
+	}
+	chunks := make([]chunk, len(schema))
+
+	for i, col := range schema {
+		page, err := parquetPage(col, parquetRepetition(i) == pqOptional, rows)
+		if err != nil {
+			return err
+		}
+		chunks[i] = chunk{int64(file.Len()), int64(len(page))}
+		file.Write(page)
+	}
+
+	meta.i64(3, int64(len(rows)))
+	meta.listBegin(4, thriftStruct, 1)
+	meta.structBegin(0)
+	meta.listBegin(1, thriftStruct, len(schema))
+
+	var total int64
+	for i, col := range schema {
+		typ, _ := parquetPhysical(col.Type)
+
+		meta.structBegin(0)
+		meta.i64(2, chunks[i].offset)
+		meta.structBegin(3)
+		meta.i32(1, int32(typ))
+		meta.listBegin(2, thriftI32, 2)
+		meta.zigzag(pqPlain)
+		meta.zigzag(pqRLE)
+		meta.listBegin(3, thriftBinary, 1)
+		meta.uvarint(uint64(len(col.Name)))
+		meta.buf.WriteString(col.Name)
+		meta.i32(4, 0) // uncompressed
+		meta.i64(5, int64(len(rows)))
+		meta.i64(6, chunks[i].size)
+		meta.i64(7, chunks[i].size)
+		meta.i64(9, chunks[i].offset)
+		meta.structEnd()
+		meta.structEnd()
+
+		total += chunks[i].size
+	}
+
+	meta.i64(2, total)
+	meta.i64(3, int64(len(rows)))
+	meta.structEnd()
+	meta.binary(6, []byte("jsondb version "+Version))
+	meta.structEnd()
+
+	file.Write(meta.buf.Bytes())
+	binary.Write(&file, binary.LittleEndian, uint32(meta.buf.Len()))
+	file.Write(parquetMagic)
+
+	_, err = w.Write(file.Bytes())
+	return err
+}
+
+// parquetRepetition makes the key column required and every other one
+// optional.
+func parquetRepetition(column int) int {
+	if column == 0 {
+		return pqRequired
+	}
+	return pqOptional
+}
+
+func parquetPhysical(typ string) (physical, converted int) {
+	switch typ {
+	case ParquetString:
+		return pqByteArray, pqUTF8
+	case ParquetJSON:
+		return pqByteArray, pqJSON
+	case ParquetInt64:
+		return pqInt64, -1
+	case ParquetDouble:
+		return pqDouble, -1
+	case ParquetBoolean:
+		return pqBoolean, -1
+	}
+	return -1, -1
+}
+
+// parquetPage encodes the values of col in rows as one data page,
+// including its header.
+func parquetPage(col ParquetColumn, optional bool, rows []map[string]interface{}) ([]byte, error) {
+	var levels []byte
+	var values bytes.Buffer
+	var bits, nbits uint
+
+	for _, row := range rows {
+		v, err := parquetValue(col, row[col.Name])
+		if err != nil {
+			return nil, err
+		}
+
+		if v == nil {
+			if !optional {
+				return nil, fmt.Errorf("Column '%s' is required", col.Name)
+			}
+			levels = append(levels, 0)
+			continue
+		}
+		levels = append(levels, 1)
+
+		switch t := v.(type) {
+		case string:
+			binary.Write(&values, binary.LittleEndian, uint32(len(t)))
+			values.WriteString(t)
+		case int64:
+			binary.Write(&values, binary.LittleEndian, t)
+		case float64:
+			binary.Write(&values, binary.LittleEndian, math.Float64bits(t))
+		case bool:
+			if t {
+				bits |= 1 << nbits
+			}
+			if nbits++; nbits == 8 {
+				values.WriteByte(byte(bits))
+				bits, nbits = 0, 0
+			}
+		}
+	}
+	if nbits > 0 {
+		values.WriteByte(byte(bits))
+	}
+
+	var data bytes.Buffer
+	if optional {
+		rle := encodeLevels(levels)
+		binary.Write(&data, binary.LittleEndian, uint32(len(rle)))
+		data.Write(rle)
+	}
+	data.Write(values.Bytes())
+
+	header := newThriftWriter()
+	header.i32(1, pqDataPage)
+	header.i32(2, int32(data.Len()))
+	header.i32(3, int32(data.Len()))
+	header.structBegin(5)
+	header.i32(1, int32(len(rows)))
+	header.i32(2, pqPlain)
+	header.i32(3, pqRLE)
+	header.i32(4, pqRLE)
+	header.structEnd()
+	header.structEnd()
+
+	return append(header.buf.Bytes(), data.Bytes()...), nil
+}
+
+// encodeLevels encodes definition levels of bit width 1 as RLE runs.
+func encodeLevels(levels []byte) []byte {
+	var out []byte
+	var b [binary.MaxVarintLen64]byte
+
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		out = append(out, b[:binary.PutUvarint(b[:], uint64(j-i)<<1)]...)
+		out = append(out, levels[i])
+		i = j
+	}
+	return out
+}
+
+// parquetValue converts a flattened document value to the Go type stored
+// for col, or nil for a missing value.
+func parquetValue(col ParquetColumn, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	switch col.Type {
+	case ParquetString:
+		switch t := v.(type) {
+		case string:
+			return t, nil
+		case json.Number:
+			return string(t), nil
+		case bool:
+			return strconv.FormatBool(t), nil
+		}
+		b, err := json.Marshal(v)
+		return string(b), err
+
+	case ParquetJSON:
+		b, err := json.Marshal(v)
+		return string(b), err
+
+	case ParquetInt64:
+		if n, err := strconv.ParseInt(fmt.Sprint(v), 10, 64); err == nil {
+			return n, nil
+		}
+
+	case ParquetDouble:
+		if f, ok := toFloat(v); ok {
+			return f, nil
+		}
+
+	case ParquetBoolean:
+		if b, err := strconv.ParseBool(fmt.Sprint(v)); err == nil {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("Column '%s': cannot store %v as %s", col.Name, v, col.Type)
+}
+
+// flattenDocument is flatten keeping the decoded values: nested objects
+// become dotted keys, everything else is stored as is.
+func flattenDocument(prefix string, v interface{}, out map[string]interface{}) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		out[prefix] = v
+		return
+	}
+
+	for k, e := range m {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		flattenDocument(key, e, out)
+	}
+}
+
+// inferParquetSchema picks the narrowest type holding every value of each
+// column, sorted by name.
+func inferParquetSchema(rows []map[string]interface{}) []ParquetColumn {
+	types := map[string]string{}
+
+	for _, row := range rows {
+		for name, v := range row {
+			if v == nil || name == KeyColumn {
+				continue
+			}
+
+			var typ string
+			switch t := v.(type) {
+			case json.Number:
+				typ = ParquetDouble
+				if _, err := t.Int64(); err == nil {
+					typ = ParquetInt64
+				}
+			case bool:
+				typ = ParquetBoolean
+			case string:
+				typ = ParquetString
+			default:
+				typ = ParquetJSON
+			}
+
+			switch prev, ok := types[name]; {
+			case !ok, prev == typ:
+				types[name] = typ
+			case prev == ParquetInt64 && typ == ParquetDouble, prev == ParquetDouble && typ == ParquetInt64:
+				types[name] = ParquetDouble
+			default:
+				types[name] = ParquetString
+			}
+		}
+	}
+
+	var schema []ParquetColumn
+	for name, typ := range types {
+		schema = append(schema, ParquetColumn{name, typ})
+	}
+	sort.Slice(schema, func(i, j int) bool { return schema[i].Name < schema[j].Name })
+	return schema
+}
+
+// ImportParquet writes every row of the Parquet file in r, which is size
+// bytes long, as a record of collection and returns how many were written.
+// Rows are named by their _key column, or numbered if there is none; dotted
+// column names become nested objects and JSON columns are decoded.
+//
+// Only flat schemas with uncompressed, PLAIN-encoded data pages (as written
+// by ExportParquet) are supported.
+func (d *Driver) ImportParquet(collection string, r io.ReaderAt, size int64) (int, error) {
+	rows, err := readParquet(r, size)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, row := range rows {
+		resource, _ := row[KeyColumn].(string)
+		if resource == "" {
+			resource = strconv.Itoa(i)
+		}
+		delete(row, KeyColumn)
+
+		doc := map[string]interface{}{}
+		for name, v := range row {
+			if err := SetValueAt(doc, strings.Split(name, "."), v); err != nil {
+				return i, err
+			}
+		}
+
+		if err := d.Write(collection, resource, doc); err != nil {
+			return i, err
+		}
+	}
+	return len(rows), nil
+}
+
+var errParquet = fmt.Errorf("Unsupported or malformed Parquet file")
+
+// readParquet decodes the rows of a Parquet file, keyed by column name.
+func readParquet(r io.ReaderAt, size int64) ([]map[string]interface{}, error) {
+	if size < 12 || size > math.MaxInt32 {
+		return nil, errParquet
+	}
+
+	file := make([]byte, size)
+	if _, err := r.ReadAt(file, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(file[:4], parquetMagic) || !bytes.Equal(file[size-4:], parquetMagic) {
+		return nil, errParquet
+	}
+
+	metaLen := int64(binary.LittleEndian.Uint32(file[size-8:]))
+	if metaLen > size-12 {
+		return nil, errParquet
+	}
+	meta, err := (&thriftReader{b: file[size-8-metaLen : size-8]}).readStruct()
+	if err != nil {
+		return nil, err
+	}
+
+	type column struct {
+		name      string
+		typ       int64
+		converted int64
+		optional  bool
+	}
+
+	var columns []column
+	schema := meta.list(2)
+	for i, e := range schema {
+		el, _ := e.(thriftFields)
+		if i == 0 {
+			continue // the root
+		}
+		if el == nil || el.int(5) > 0 || el.int(3) > pqOptional {
+			return nil, errParquet // nested or repeated
+		}
+
+		converted := int64(-1)
+		if _, ok := el[6]; ok {
+			converted = el.int(6)
+		}
+		columns = append(columns, column{el.str(4), el.int(1), converted, el.int(3) == pqOptional})
+	}
+
+	var rows []map[string]interface{}
+	for _, g := range meta.list(4) {
+		group, _ := g.(thriftFields)
+		chunks := group.list(1)
+		if group == nil || len(chunks) != len(columns) {
+			return nil, errParquet
+		}
+
+		n := group.int(3)
+		if n < 0 || n > size {
+			return nil, errParquet
+		}
+		first := len(rows)
+		for i := int64(0); i < n; i++ {
+			rows = append(rows, map[string]interface{}{})
+		}
+
+		for i, c := range chunks {
+			cm := c.(thriftFields).strct(3)
+			if cm == nil || cm.int(4) != 0 {
+				return nil, errParquet // compressed
+			}
+
+			col := columns[i]
+			values, err := readColumn(file, cm.int(9), int(n), col.typ, col.optional)
+			if err != nil {
+				return nil, err
+			}
+
+			for j, v := range values {
+				if v == nil {
+					continue
+				}
+				if b, ok := v.([]byte); ok {
+					if col.converted == pqJSON {
+						if v, err = DecodeValue(b); err != nil {
+							return nil, err
+						}
+					} else {
+						v = string(b)
+					}
+				}
+				rows[first+j][col.name] = v
+			}
+		}
+	}
+	return rows, nil
+}
+
+// readColumn decodes n values of a column chunk starting at offset; missing
+// values are nil.
+func readColumn(file []byte, offset int64, n int, typ int64, optional bool) ([]interface{}, error) {
+	var values []interface{}
+
+	for len(values) < n {
+		if offset < 0 || offset >= int64(len(file)) {
+			return nil, errParquet
+		}
+		tr := &thriftReader{b: file[offset:]}
+		header, err := tr.readStruct()
+		if err != nil {
+			return nil, err
+		}
+
+		size := header.int(3)
+		start := offset + int64(tr.pos)
+		if header.int(1) != pqDataPage || size < 0 || start+size > int64(len(file)) {
+			return nil, errParquet
+		}
+		page := file[start : start+size]
+		offset = start + size
+
+		dph := header.strct(5)
+		count := int(dph.int(1))
+		if dph == nil || dph.int(2) != pqPlain || count < 0 || count > n-len(values) {
+			return nil, errParquet
+		}
+
+		defined := make([]bool, count)
+		for i := range defined {
+			defined[i] = true
+		}
+		if optional {
+			if len(page) < 4 {
+				return nil, errParquet
+			}
+			l := int(binary.LittleEndian.Uint32(page))
+			if l > len(page)-4 {
+				return nil, errParquet
+			}
+			if err := decodeLevels(page[4:4+l], defined); err != nil {
+				return nil, err
+			}
+			page = page[4+l:]
+		}
+
+		pos, bit := 0, 0
+		for _, ok := range defined {
+			if !ok {
+				values = append(values, nil)
+				continue
+			}
+
+			var v interface{}
+			width := map[int64]int{pqInt32: 4, pqInt64: 8, pqFloat: 4, pqDouble: 8, pqByteArray: 4}[typ]
+			if typ != pqBoolean && pos+width > len(page) {
+				return nil, errParquet
+			}
+
+			switch typ {
+			case pqBoolean:
+				if pos >= len(page) {
+					return nil, errParquet
+				}
+				v = page[pos]>>bit&1 == 1
+				if bit++; bit == 8 {
+					pos, bit = pos+1, 0
+				}
+			case pqInt32:
+				v = int64(int32(binary.LittleEndian.Uint32(page[pos:])))
+			case pqInt64:
+				v = int64(binary.LittleEndian.Uint64(page[pos:]))
+			case pqFloat:
+				v = float64(math.Float32frombits(binary.LittleEndian.Uint32(page[pos:])))
+			case pqDouble:
+				v = math.Float64frombits(binary.LittleEndian.Uint64(page[pos:]))
+			case pqByteArray:
+				l := int(binary.LittleEndian.Uint32(page[pos:]))
+				if l < 0 || l > len(page)-pos-4 {
+					return nil, errParquet
+				}
+				v = page[pos+4 : pos+4+l]
+				width += l
+			default:
+				return nil, errParquet
+			}
+
+			if typ != pqBoolean {
+				pos += width
+			}
+			values = append(values, v)
+		}
+	}
+	return values, nil
+}
+
+// decodeLevels decodes RLE/bit-packed definition levels of bit width 1.
+func decodeLevels(b []byte, defined []bool) error {
+	i := 0
+	for i < len(defined) {
+		h, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errParquet
+		}
+		b = b[n:]
+
+		if h&1 == 0 { // RLE run
+			if len(b) < 1 {
+				return errParquet
+			}
+			for run := h >> 1; run > 0 && i < len(defined); run-- {
+				defined[i] = b[0] == 1
+				i++
+			}
+			b = b[1:]
+			continue
+		}
+
+		groups := int(h >> 1)
+		if groups > len(b) {
+			return errParquet
+		}
+		for j := 0; j < groups*8 && i < len(defined); j++ {
+			defined[i] = b[j/8]>>(j%8)&1 == 1
+			i++
+		}
+		b = b[groups:]
+	}
+	return nil
+}
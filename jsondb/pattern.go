@@ -0,0 +1,165 @@
+package jsondb
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Pattern operators of conditions, matching strings against Value:
+// OpMatches takes an RE2 regular expression, found anywhere unless
+// anchored, and OpLike a glob matching the whole string, where * stands
+// for any run of characters and ? for one. OpGlob is OpLike.
+const (
+	OpMatches = "matches"
+	OpLike    = "like"
+	OpGlob    = "glob"
+)
+
+// Guardrails on patterns: RE2 runs in linear time, but long patterns and
+// large counted repetitions still make every comparison expensive.
+const (
+	maxPatternLength = 256
+	maxPatternInsts  = 2000
+)
+
+// maxCachedPatterns bounds the cache of compiled patterns.
+const maxCachedPatterns = 1024
+
+var (
+	patterns       sync.Map
+	cachedPatterns atomic.Int64
+)
+
+// compiledPattern is the expression of a pattern condition, with the
+// literal every matching string starts with, if any.
+type compiledPattern struct {
+	re     *regexp.Regexp
+	prefix string
+}
+
+// isPatternOp reports whether op matches strings against a pattern.
+func isPatternOp(op string) bool {
+	return op == OpMatches || op == OpLike || op == OpGlob
+}
+
+// compilePattern compiles the pattern of a condition with op, ignoring case
+// when fold is set.
+func compilePattern(op, value string, fold bool) (*compiledPattern, error) {
+	key := op + "\x00" + value
+	if fold {
+		key = "i" + key
+	}
+	if p, ok := patterns.Load(key); ok {
+		return p.(*compiledPattern), nil
+	}
+
+	if len(value) > maxPatternLength {
+		return nil, fmt.Errorf("Pattern '%.32s...' is longer than %d bytes", value, maxPatternLength)
+	}
+
+	expr := value
+	if op != OpMatches {
+		expr = globExpr(value)
+	}
+	if fold {
+		expr = "(?i)" + expr
+	}
+
+	parsed, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid pattern '%s': %v", value, err)
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil, fmt.Errorf("Invalid pattern '%s': %v", value, err)
+	}
+	if len(prog.Inst) > maxPatternInsts {
+		return nil, fmt.Errorf("Pattern '%s' is too complex", value)
+	}
+
+	p := &compiledPattern{}
+	if p.re, err = regexp.Compile(expr); err != nil {
+		return nil, fmt.Errorf("Invalid pattern '%s': %v", value, err)
+	}
+
+	// LiteralPrefix starts every match, which starts the string only
+	// when the expression is anchored.
+	if !fold && prog.StartCond()&syntax.EmptyBeginText != 0 {
+		p.prefix, _ = p.re.LiteralPrefix()
+	}
+
+	if cachedPatterns.Add(1) <= maxCachedPatterns {
+		patterns.Store(key, p)
+	}
+	return p, nil
+}
+
+// globExpr turns a glob into an anchored regular expression.
+func globExpr(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString("(?s:.*)")
+		case '?':
+			b.WriteString("(?s:.)")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// matchPattern reports whether v, a string, matches the pattern of cond.
+// Patterns that do not compile match nothing; Query rejects them first.
+func (cond Condition) matchPattern(v interface{}) bool {
+	s, ok := v.(string)
+	if !ok {
+		return false
+	}
+
+	var fold bool
+	if cond.Collation != "" {
+		if cl, err := cond.Collation.collator(); err == nil {
+			fold = cl.fold
+			s = cl.key(s)
+		}
+	}
+
+	p, err := compilePattern(cond.Op, fmt.Sprint(cond.Value), fold)
+	if err != nil {
+		return false
+	}
+
+	// Most strings miss an anchored prefix: rule them out before running
+	// the expression.
+	if !strings.HasPrefix(s, p.prefix) {
+		return false
+	}
+	return p.re.MatchString(s)
+}
+
+// scanNeedle returns text every stored record matching cond contains
+// verbatim, so a scan can skip decoding the others, or nil. Only anchored
+// prefixes of plain characters are used, as JSON stores them unescaped.
+func (cond Condition) scanNeedle() []byte {
+	if !isPatternOp(cond.Op) || cond.Collation != "" {
+		return nil
+	}
+	p, err := compilePattern(cond.Op, fmt.Sprint(cond.Value), false)
+	if err != nil || len(p.prefix) < 3 {
+		return nil
+	}
+	for _, r := range p.prefix {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune(" -_.,:@", r)) {
+			return nil
+		}
+	}
+	return []byte(`"` + p.prefix)
+}
@@ -0,0 +1,105 @@
+package jsondb
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// perfSamples is how many recent latencies are kept per collection.
+const perfSamples = 1024
+
+// PerfStats summarizes the recent operation latencies of a collection.
+// Percentiles are taken over the last perfSamples operations; in JSON,
+// durations are nanoseconds.
+type PerfStats struct {
+	Collection string
+	Count      int64
+	Errors     int64
+	P50        time.Duration
+	P90        time.Duration
+	P99        time.Duration
+	Max        time.Duration
+}
+
+type perfStats struct {
+	mutex       sync.Mutex
+	collections map[string]*latencies
+}
+
+// latencies is a ring buffer of recent operation durations.
+type latencies struct {
+	samples []time.Duration
+	next    int
+	count   int64
+	errors  int64
+}
+
+func newPerfStats() *perfStats {
+	return &perfStats{collections: make(map[string]*latencies)}
+}
+
+func (p *perfStats) record(collection string, elapsed time.Duration, failed bool) {
+	if collection == "" {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	l, ok := p.collections[collection]
+	if !ok {
+		l = &latencies{}
+		p.collections[collection] = l
+	}
+
+	if len(l.samples) < perfSamples {
+		l.samples = append(l.samples, elapsed)
+	} else {
+		l.samples[l.next] = elapsed
+		l.next = (l.next + 1) % perfSamples
+	}
+
+	l.count++
+	if failed {
+		l.errors++
+	}
+}
+
+// PerfStats returns latency statistics for every collection operated on
+// since the database was opened, sorted by collection.
+func (d *Driver) PerfStats() []PerfStats {
+	d.perf.mutex.Lock()
+	defer d.perf.mutex.Unlock()
+
+	var stats []PerfStats
+	for collection, l := range d.perf.collections {
+		sorted := append([]time.Duration(nil), l.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		stats = append(stats, PerfStats{
+			Collection: collection,
+			Count:      l.count,
+			Errors:     l.errors,
+			P50:        percentile(sorted, 50),
+			P90:        percentile(sorted, 90),
+			P99:        percentile(sorted, 99),
+			Max:        sorted[len(sorted)-1],
+		})
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Collection < stats[j].Collection })
+	return stats
+}
+
+// percentile returns the p-th percentile of sorted, which is not empty.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+// SetSlowOp changes the threshold above which operations are logged as
+// slow, as Options.SlowOp does when opening the database. Zero disables
+// slow-operation logging.
+func (d *Driver) SetSlowOp(threshold time.Duration) {
+	d.slowOp.Store(int64(threshold))
+}
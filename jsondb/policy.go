@@ -0,0 +1,227 @@
+package jsondb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// Operations of a PolicyRule.
+const (
+	// PolicyRead covers reading, listing, querying, exporting and
+	// watching records and reading their attachments and versions.
+	PolicyRead = "read"
+
+	// PolicyWrite covers writing and updating records and attaching files.
+	PolicyWrite = "write"
+
+	// PolicyDelete covers deleting records, collections and attachments.
+	PolicyDelete = "delete"
+)
+
+// Effects of a PolicyRule.
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// ErrPolicyDenied is matched, with errors.Is, by the PolicyErrors of
+// operations a Policy denies.
+var ErrPolicyDenied = fmt.Errorf("Operation denied by policy")
+
+// PolicyError is returned for an operation a Policy denies.
+type PolicyError struct {
+	Op         string
+	Collection string
+	Roles      []string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("Policy denies %s on '%s' to roles %v", e.Op, e.Collection, e.Roles)
+}
+
+func (e *PolicyError) Is(target error) bool {
+	return target == ErrPolicyDenied
+}
+
+// PolicyRule allows or denies an operation on collections to a role.
+//
+// Role is a role the caller has (see WithRoles), or "*" for any caller,
+// including those bound to no role. Collection is a pattern as path.Match
+// has them, matching the collections it names and those nested in them:
+// "users", "logs/*", "*". System collections are spelled with a leading
+// "_", as the server has them, and only patterns starting with "_" match
+// them: "*" leaves them alone, "_*" does not. Op is PolicyRead,
+// PolicyWrite, PolicyDelete or "*" for all three.
+type PolicyRule struct {
+	Role       string
+	Collection string
+	Op         string
+	Effect     string
+}
+
+// Policy is a firewall for the operations on collections: the first of its
+// Rules matching an operation decides it, and operations no rule matches
+// are as Default has it, PolicyAllow unless set. For instance, letting
+// nothing but the auditor delete from the "_audit" system collection:
+//
+//	{"Rules": [
+//		{"Role": "auditor", "Collection": "_audit", "Op": "delete", "Effect": "allow"},
+//		{"Role": "*", "Collection": "_audit", "Op": "delete", "Effect": "deny"}
+//	]}
+//
+// Policies cover the operations of the API (Read, Write, Delete, Query and
+// the like), not the work the driver does on its own, such as enforcing
+// retention.
+type Policy struct {
+	Rules   []PolicyRule
+	Default string `json:",omitempty"`
+}
+
+// ParsePolicy reads a Policy from its JSON form and checks it.
+func ParsePolicy(b []byte) (*Policy, error) {
+	var p Policy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (p *Policy) validate() error {
+	switch p.Default {
+	case "", PolicyAllow, PolicyDeny:
+	default:
+		return fmt.Errorf("Unknown policy default '%s'", p.Default)
+	}
+
+	for i, rule := range p.Rules {
+		if rule.Role == "" || rule.Collection == "" {
+			return fmt.Errorf("Missing role or collection of policy rule %d", i+1)
+		}
+		if _, err := path.Match(rule.Collection, ""); err != nil {
+			return fmt.Errorf("Invalid collection pattern '%s' of policy rule %d", rule.Collection, i+1)
+		}
+		switch rule.Op {
+		case PolicyRead, PolicyWrite, PolicyDelete, "*":
+		default:
+			return fmt.Errorf("Unknown operation '%s' of policy rule %d", rule.Op, i+1)
+		}
+		switch rule.Effect {
+		case PolicyAllow, PolicyDeny:
+		default:
+			return fmt.Errorf("Unknown effect '%s' of policy rule %d", rule.Effect, i+1)
+		}
+	}
+	return nil
+}
+
+// Allows reports whether p lets a caller with roles perform op on
+// collection, spelled with a leading "_" for system collections. A nil p
+// allows everything.
+func (p *Policy) Allows(roles []string, op, collection string) bool {
+	if p == nil {
+		return true
+	}
+	for _, rule := range p.Rules {
+		if rule.matches(roles, op, collection) {
+			return rule.Effect == PolicyAllow
+		}
+	}
+	return p.Default != PolicyDeny
+}
+
+func (r PolicyRule) matches(roles []string, op, collection string) bool {
+	if r.Op != "*" && r.Op != op {
+		return false
+	}
+	if strings.HasPrefix(collection, "_") != strings.HasPrefix(r.Collection, "_") {
+		return false
+	}
+
+	matched := false
+	for name := collection; name != "." && name != "/"; name = path.Dir(name) {
+		if ok, _ := path.Match(r.Collection, name); ok {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return false
+	}
+
+	if r.Role == "*" {
+		return true
+	}
+	for _, role := range roles {
+		if role == r.Role {
+			return true
+		}
+	}
+	return false
+}
+
+// policyState is the Policy of a driver, shared with its system namespace,
+// which spells its collections with prefix.
+type policyState struct {
+	policy *atomic.Pointer[Policy]
+	prefix string
+}
+
+// SetPolicy makes p decide the operations of the database and its system
+// namespace from now on; nil allows everything again.
+func (d *Driver) SetPolicy(p *Policy) error {
+	if p != nil {
+		if err := p.validate(); err != nil {
+			return err
+		}
+	}
+	if d.policy == nil {
+		return fmt.Errorf("Policies cannot be set on '%s'", d.dir)
+	}
+	d.policy.policy.Store(p)
+	return nil
+}
+
+// Policy returns the Policy set with SetPolicy, nil if none is.
+func (d *Driver) Policy() *Policy {
+	if d.policy == nil {
+		return nil
+	}
+	return d.policy.policy.Load()
+}
+
+// allow fails with a PolicyError if the Policy denies op on collection to
+// the roles of d.
+func (d *Driver) allow(op, collection string) error {
+	if d.policy == nil {
+		return nil
+	}
+	collection = d.policy.prefix + collection
+	roles := Roles(d.Context())
+	if !d.policy.policy.Load().Allows(roles, op, collection) {
+		return &PolicyError{Op: op, Collection: collection, Roles: roles}
+	}
+	return nil
+}
+
+// rolesKey is the context key of the roles of the current operation.
+type rolesKey struct{}
+
+// WithRoles returns ctx carrying roles, those of the caller on whose
+// behalf the operations of a driver bound to it (see WithContext) run, as
+// the rules of a Policy name them.
+func WithRoles(ctx context.Context, roles ...string) context.Context {
+	return context.WithValue(ctx, rolesKey{}, roles)
+}
+
+// Roles returns the roles ctx carries; see WithRoles.
+func Roles(ctx context.Context) []string {
+	roles, _ := ctx.Value(rolesKey{}).([]string)
+	return roles
+}
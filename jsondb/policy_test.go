@@ -0,0 +1,112 @@
+package jsondb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPolicyCoversSeriesAndGraph(t *testing.T) {
+	options := quiet()
+	options.Policy = &Policy{Rules: []PolicyRule{
+		{Role: "viewer", Collection: "users", Op: PolicyWrite, Effect: PolicyDeny},
+		{Role: "viewer", Collection: "users", Op: PolicyDelete, Effect: PolicyDeny},
+		{Role: "guest", Collection: "users", Op: "*", Effect: PolicyDeny},
+	}}
+	db, _ := openTest(t, options)
+	if err := db.Append("users", time.Now(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Link("users", "ann", "FOLLOWS", "teams", "red"); err != nil {
+		t.Fatal(err)
+	}
+
+	viewer := db.WithContext(WithRoles(context.Background(), "viewer"))
+	guest := db.WithContext(WithRoles(context.Background(), "guest"))
+
+	for name, err := range map[string]error{
+		"Append":    viewer.Append("users", time.Now(), 2),
+		"Link":      viewer.Link("teams", "red", "HAS", "users", "ann"),
+		"Unlink":    viewer.Unlink("users", "ann", "FOLLOWS", "teams", "red"),
+		"ReadRange": second(guest.ReadRange("users", time.Time{}, time.Time{})),
+		"Traverse":  second(guest.Traverse(Node{"users", "ann"}, TraversalOptions{})),
+		"Edges":     second(guest.Edges(Node{"users", "ann"}, Outbound, "")),
+	} {
+		if !errors.Is(err, ErrPolicyDenied) {
+			t.Errorf("%s = %v, want a policy error", name, err)
+		}
+	}
+
+	if points, err := viewer.ReadRange("users", time.Time{}, time.Time{}); err != nil || len(points) != 1 {
+		t.Errorf("ReadRange allowed to the viewer = %v, %v", points, err)
+	}
+}
+
+func second[T any](_ T, err error) error { return err }
+
+func TestPolicyCoversRawWrites(t *testing.T) {
+	options := quiet()
+	options.Policy = &Policy{Rules: []PolicyRule{
+		{Role: "viewer", Collection: "users", Op: PolicyWrite, Effect: PolicyDeny},
+	}}
+	db, _ := openTest(t, options)
+	viewer := db.WithContext(WithRoles(context.Background(), "viewer"))
+
+	for name, err := range map[string]error{
+		"WriteRaw":          viewer.WriteRaw("users", "ann", []byte(`{"Name":"Ann"}`)),
+		"WriteRawUnchecked": viewer.WriteRawUnchecked("users", "ann", []byte(`{"Name":"Ann"}`)),
+	} {
+		if !errors.Is(err, ErrPolicyDenied) {
+			t.Errorf("%s = %v, want a policy error", name, err)
+		}
+	}
+}
+
+func TestPolicyCoversQueuesTopicsAndLocks(t *testing.T) {
+	options := quiet()
+	options.Policy = &Policy{Rules: []PolicyRule{
+		{Role: "viewer", Collection: "jobs", Op: PolicyWrite, Effect: PolicyDeny},
+		{Role: "viewer", Collection: "jobs", Op: PolicyDelete, Effect: PolicyDeny},
+		{Role: "guest", Collection: "*", Op: "*", Effect: PolicyDeny},
+	}}
+	db, _ := openTest(t, options)
+	q := db.Queue("jobs")
+	if _, err := q.Enqueue(1); err != nil {
+		t.Fatal(err)
+	}
+	claimed, err := q.Claim(1, time.Minute)
+	if err != nil || len(claimed) != 1 {
+		t.Fatalf("Claim = %v, %v", claimed, err)
+	}
+	h, err := db.Lock("jobs", "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	viewer := db.WithContext(WithRoles(context.Background(), "viewer"))
+	guest := db.WithContext(WithRoles(context.Background(), "guest"))
+	vq := viewer.Queue("jobs")
+
+	for name, err := range map[string]error{
+		"Claim":     second(vq.Claim(1, time.Minute)),
+		"Ack":       vq.Ack(claimed[0]),
+		"Nack":      vq.Nack(claimed[0], "failed"),
+		"Lock":      second(viewer.Lock("jobs", "b", time.Minute)),
+		"Unlock":    viewer.Unlock(h),
+		"Publish":   second(viewer.Publish("jobs", 1)),
+		"Subscribe": second(guest.Subscribe(context.Background(), "news", "ann")),
+		"Commit":    guest.Commit("news", "ann", "1"),
+	} {
+		if !errors.Is(err, ErrPolicyDenied) {
+			t.Errorf("%s = %v, want a policy error", name, err)
+		}
+	}
+
+	if err := q.Ack(claimed[0]); err != nil {
+		t.Errorf("Ack after the denied ones: %v", err)
+	}
+	if err := db.Unlock(h); err != nil {
+		t.Errorf("Unlock after the denied one: %v", err)
+	}
+}
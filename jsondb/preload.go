@@ -0,0 +1,116 @@
+package jsondb
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PreloadTarget names records to preload: those of Collection whose
+// names start with Prefix, every one when it is empty.
+type PreloadTarget struct {
+	Collection string
+	Prefix     string `json:",omitempty"`
+}
+
+// PreloadConfig is what Preload reads.
+type PreloadConfig struct {
+	Targets []PreloadTarget
+
+	// Concurrency is how many records are read at once; 8 by default.
+	Concurrency int
+
+	// MaxBytes bounds the bytes read, so a preload does not push out of
+	// the caches more than it warms; zero leaves it unbounded.
+	MaxBytes int64
+}
+
+// PreloadReport is what Preload read.
+type PreloadReport struct {
+	Records  int64
+	Bytes    int64
+	Errors   int64
+	Duration time.Duration
+
+	// Truncated is set when MaxBytes, or the context, stopped the preload
+	// before every record was read.
+	Truncated bool
+}
+
+// Preload reads the records cfg targets, as reads do, so the first reads
+// after a start do not wait on a cold disk: it warms the page cache of
+// the system and, for collections with StaleIfError, the copies kept of
+// their records, within Options.StaleCacheSize. Records that cannot be
+// read are counted and skipped; a target that cannot be listed fails the
+// preload.
+func (d *Driver) Preload(ctx context.Context, cfg PreloadConfig) (_ PreloadReport, err error) {
+	d, span := d.trace("Preload", "", "")
+	defer span.end(&err)
+
+	start := time.Now()
+	concurrency := cfg.Concurrency
+	if concurrency <= 0 {
+		concurrency = 8
+	}
+
+	type record struct{ collection, resource string }
+	var records []record
+	for _, t := range cfg.Targets {
+		collection := d.resolve(t.Collection)
+		names, err := d.ListKeys(collection, ListOptions{Prefix: t.Prefix})
+		if err != nil && !os.IsNotExist(err) {
+			return PreloadReport{}, err
+		}
+		for _, name := range names {
+			records = append(records, record{collection, name})
+		}
+	}
+
+	var n, bytes, errs atomic.Int64
+	var full atomic.Bool
+	queue := make(chan record)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(d *Driver) {
+			defer wg.Done()
+			for r := range queue {
+				b, _, err := d.fetch(r.collection, r.resource)
+				if os.IsNotExist(err) {
+					continue // deleted meanwhile
+				}
+				if err != nil {
+					errs.Add(1)
+					continue
+				}
+				n.Add(1)
+				if bytes.Add(int64(len(b))) >= cfg.MaxBytes && cfg.MaxBytes > 0 {
+					full.Store(true)
+				}
+			}
+		}(d.worker())
+	}
+
+	truncated := false
+feed:
+	for _, r := range records {
+		if full.Load() {
+			truncated = true
+			break
+		}
+		select {
+		case queue <- r:
+		case <-ctx.Done():
+			truncated = true
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	report := PreloadReport{Records: n.Load(), Bytes: bytes.Load(), Errors: errs.Load(), Duration: time.Since(start), Truncated: truncated}
+	d.log.Info("Preloaded %d records (%d bytes) in %v\n", report.Records, report.Bytes, report.Duration.Round(time.Millisecond))
+	return report, nil
+}
@@ -0,0 +1,229 @@
+package jsondb
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Processing states of an Attachment.
+const (
+	ProcessingPending = "pending"
+	ProcessingDone    = "done"
+	ProcessingFailed  = "failed"
+)
+
+// processingCollection queues, in the system namespace, the attachments
+// waiting for their processors.
+const processingCollection = "processing"
+
+// processingJob is the job that runs the processors; uploads run it at
+// once, its schedule only picks up what a restart left queued.
+const processingJob = "process-attachments"
+
+// derivativeSeparator joins the name of an attachment and that of one of
+// its derivatives: the thumbnail "thumb.png" of "photo.jpg" is the
+// attachment "photo.jpg~thumb.png".
+const derivativeSeparator = "~"
+
+// AttachmentProcessor makes derivatives of attachments, such as resized
+// images or extracted text, after they are uploaded. Processors run in the
+// background, on the "process-attachments" job, so uploads do not wait
+// for them.
+type AttachmentProcessor interface {
+	// Accepts tells whether the processor has something to make of a.
+	Accepts(a Attachment) bool
+
+	// Process reads the content of a from r and stores each derivative it
+	// makes with put, which reads its content from the reader it is given.
+	Process(a Attachment, r io.Reader, put func(name string, r io.Reader) error) error
+}
+
+// processorState holds the registered processors, shared by the copies of
+// a driver.
+type processorState struct {
+	mutex      sync.Mutex
+	processors map[string]AttachmentProcessor
+}
+
+// queuedAttachment is an entry of the processing queue.
+type queuedAttachment struct {
+	Collection string
+	Resource   string
+	Name       string
+	Queued     time.Time
+}
+
+// RegisterProcessor adds p, under name, to the processors of the
+// attachments uploaded from now on, replacing any processor of that name.
+// Processors run in the order of their names.
+func (d *Driver) RegisterProcessor(name string, p AttachmentProcessor) error {
+	if name == "" || strings.Contains(name, derivativeSeparator) {
+		return fmt.Errorf("Invalid processor name '%s'", name)
+	}
+
+	d.processing.mutex.Lock()
+	first := len(d.processing.processors) == 0
+	d.processing.processors[name] = p
+	d.processing.mutex.Unlock()
+
+	if !first {
+		return nil
+	}
+	return d.scheduler.Register(processingJob, "@every 1m", d.ProcessAttachments)
+}
+
+// processorsOf returns the processors that accept a, by name; derivatives
+// are not processed again.
+func (d *Driver) processorsOf(a Attachment) []AttachmentProcessor {
+	if a.Source != "" {
+		return nil
+	}
+
+	d.processing.mutex.Lock()
+	defer d.processing.mutex.Unlock()
+
+	names := make([]string, 0, len(d.processing.processors))
+	for name, p := range d.processing.processors {
+		if p.Accepts(a) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	processors := make([]AttachmentProcessor, len(names))
+	for i, name := range names {
+		processors[i] = d.processing.processors[name]
+	}
+	return processors
+}
+
+func (d *Driver) processes(a Attachment) bool {
+	return len(d.processorsOf(a)) > 0
+}
+
+// queueProcessing queues the attachment name of collection/resource and
+// starts the processing job, unless it is running already, in which case
+// it takes the attachment before it stops.
+func (d *Driver) queueProcessing(collection, resource, name string) error {
+	entry := queuedAttachment{Collection: collection, Resource: resource, Name: name, Queued: time.Now().UTC()}
+	if err := d.System().Write(processingCollection, NewKey(collection, resource, name).String(), entry); err != nil {
+		return err
+	}
+	d.scheduler.RunNow(processingJob)
+	return nil
+}
+
+// ProcessAttachments runs the processors of the attachments waiting for
+// them until none is left, recording the outcome in their Processing. The
+// "process-attachments" job runs it.
+func (d *Driver) ProcessAttachments() (err error) {
+	d, span := d.trace("ProcessAttachments", "", "")
+	defer span.end(&err)
+
+	sys := d.System()
+	for {
+		docs, err := sys.Query(processingCollection, Query{})
+		if os.IsNotExist(err) || len(docs) == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, doc := range docs {
+			var entry queuedAttachment
+			if err := FromGeneric(doc.Data, &entry); err != nil {
+				return err
+			}
+			if err := d.processAttachment(entry.Collection, entry.Resource, entry.Name); err != nil {
+				d.log.Error("Processing attachment '%s' of '%s/%s' failed: %v\n", entry.Name, entry.Collection, entry.Resource, err)
+			}
+			if err := sys.Delete(processingCollection, doc.Resource); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// processAttachment runs the processors that accept the attachment name
+// and records their derivatives, or the first error, in its description.
+// Attachments deleted or replaced meanwhile are left alone: a replacement
+// is queued on its own.
+func (d *Driver) processAttachment(collection, resource, name string) error {
+	unlock, err := d.lockCollection(collection, LockRead)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	a, err := d.readAttachment(collection, resource, name)
+	if err == ErrNoAttachment {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var derivatives []string
+	put := func(derivative string, r io.Reader) error {
+		full := name + derivativeSeparator + derivative
+		if err := validAttachment(collection, resource, full); err != nil {
+			return err
+		}
+		if _, err := d.storeAttachment(collection, resource, Attachment{Name: full, Source: name}, r); err != nil {
+			return err
+		}
+		derivatives = append(derivatives, full)
+		return nil
+	}
+
+	var failure error
+	for _, p := range d.processorsOf(a) {
+		rc, opened, err := d.openAttachment(collection, resource, name)
+		if err == ErrNoAttachment {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if opened.SHA256 != a.SHA256 {
+			rc.Close()
+			return nil
+		}
+		err = p.Process(a, rc, put)
+		rc.Close()
+		if err != nil {
+			failure = err
+			break
+		}
+	}
+
+	current, err := d.readAttachment(collection, resource, name)
+	if err == ErrNoAttachment || (err == nil && current.SHA256 != a.SHA256) {
+		for _, derivative := range derivatives {
+			d.removeAttachment(collection, resource, derivative)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(derivatives)
+	current.Derivatives = derivatives
+	current.Processing = ProcessingDone
+	current.ProcessError = ""
+	if failure != nil {
+		current.Processing = ProcessingFailed
+		current.ProcessError = failure.Error()
+	}
+	if err := d.writeAttachment(collection, resource, current); err != nil {
+		return err
+	}
+	return failure
+}
@@ -0,0 +1,96 @@
+package jsondb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"sync"
+)
+
+// InstanceHeader is the HTTP header calls made on behalf of a database
+// carry its InstanceID in, next to the trace context.
+const InstanceHeader = "X-Database-Instance"
+
+// instanceFile holds, in the system namespace, the ID of the database.
+const instanceFile = "instance.json"
+
+// TracePropagator is implemented by Tracers that carry the trace of an
+// operation to other processes, as oteltrace.Tracer does with the
+// propagator of OpenTelemetry. Replicated changes carry it, so applying
+// them on other nodes continues the trace of the operation that made them.
+type TracePropagator interface {
+	// Inject returns the trace context of ctx as text fields, such as
+	// traceparent.
+	Inject(ctx context.Context) map[string]string
+
+	// Extract returns ctx continuing the trace of fields.
+	Extract(ctx context.Context, fields map[string]string) context.Context
+}
+
+// instance holds the ID of a database, shared by the copies of its
+// driver.
+type instance struct {
+	once sync.Once
+	id   string
+}
+
+// InstanceID identifies the database: a random ID made the first time it
+// is asked for and kept in the system namespace, so it survives restarts.
+// Changes the database replicates and the calls the server makes to other
+// systems carry it, for them to tell where a call comes from.
+func (d *Driver) InstanceID() string {
+	d.instance.once.Do(func() {
+		sys := d.System()
+		path := filepath.Join(sys.dir, instanceFile)
+
+		var saved struct{ ID string }
+		if b, err := sys.backend.ReadFile(path); err == nil && json.Unmarshal(b, &saved) == nil && saved.ID != "" {
+			d.instance.id = saved.ID
+			return
+		}
+
+		id := make([]byte, 8)
+		rand.Read(id)
+		saved.ID = hex.EncodeToString(id)
+		d.instance.id = saved.ID
+
+		// A read-only database keeps the ID for this run only.
+		if b, err := json.Marshal(saved); err == nil {
+			if err := sys.backend.WriteFile(path, b); err != nil {
+				d.log.Debug("Unable to save the instance ID: %v\n", err)
+			}
+		}
+	})
+	return d.instance.id
+}
+
+// InjectTrace returns the trace context of the operation d is bound to,
+// as text fields, or nil when the Tracer of d does not propagate traces.
+func (d *Driver) InjectTrace() map[string]string {
+	p, ok := d.tracer.(TracePropagator)
+	if !ok {
+		return nil
+	}
+	fields := p.Inject(d.Context())
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// replicate hands c to r, with the trace context of the operation and the
+// InstanceID of the database it was made on.
+func (d *Driver) replicate(r Replicator, c Change) error {
+	c.Trace = d.InjectTrace()
+	c.Origin = d.InstanceID()
+	return r.Replicate(c)
+}
+
+// continueTrace binds d to the trace a replicated change carries.
+func (d *Driver) continueTrace(c Change) {
+	if p, ok := d.tracer.(TracePropagator); ok && len(c.Trace) > 0 {
+		d.ctx = p.Extract(d.Context(), c.Trace)
+	}
+}
@@ -0,0 +1,225 @@
+package jsondb
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// QueryCacheConfig turns on the cache of query results. A cached result
+// is dropped as soon as a write, delete or expiry publishes a change that
+// could alter it: to one of its records, or to a record that now matches
+// the query. TTL bounds the age of results anyway, for changes made behind
+// the driver's back, such as by another process.
+type QueryCacheConfig struct {
+	// Size is the number of results kept, least recently used first out;
+	// zero disables the cache.
+	Size int
+
+	// TTL is how long a result is kept at most; one minute by default.
+	TTL time.Duration
+}
+
+// QueryCacheStats reports how well the query cache does.
+type QueryCacheStats struct {
+	Entries       int
+	Hits          int64
+	Misses        int64
+	Invalidations int64
+	Expired       int64
+
+	// HitRate is Hits over Hits and Misses, 0 before the first query.
+	HitRate float64
+}
+
+// queryCache holds query results by collection and query, shared by the
+// copies of a driver.
+type queryCache struct {
+	mutex   sync.Mutex
+	size    int
+	ttl     time.Duration
+	lru     *list.List
+	entries map[string]*list.Element
+	stats   QueryCacheStats
+}
+
+type cachedQuery struct {
+	key        string
+	collection string
+	query      Query
+	docs       []Document
+	resources  map[string]bool
+	expires    time.Time
+}
+
+func newQueryCache(cfg QueryCacheConfig) *queryCache {
+	if cfg.Size <= 0 {
+		return nil
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = time.Minute
+	}
+	return &queryCache{size: cfg.Size, ttl: cfg.TTL, lru: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// queryKey identifies a query on collection; it is empty for queries that
+// cannot be cached.
+func queryKey(collection string, q Query) string {
+	b, err := json.Marshal(q)
+	if err != nil {
+		return ""
+	}
+	return collection + "\x00" + string(b)
+}
+
+// get returns a copy of the cached result of key.
+func (c *queryCache) get(key string) ([]Document, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	entry := el.Value.(*cachedQuery)
+	if time.Now().After(entry.expires) {
+		c.remove(el)
+		c.stats.Expired++
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+	c.stats.Hits++
+	return copyDocuments(entry.docs), true
+}
+
+// put caches a copy of the result of q; the caller holds the collection
+// lock shared, so no change is published between the scan and now.
+func (c *queryCache) put(key, collection string, q Query, docs []Document) {
+	entry := &cachedQuery{
+		key:        key,
+		collection: collection,
+		query:      q,
+		docs:       copyDocuments(docs),
+		resources:  make(map[string]bool, len(docs)),
+		expires:    time.Now().Add(c.ttl),
+	}
+	for _, doc := range docs {
+		entry.resources[doc.Resource] = true
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *queryCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cachedQuery).key)
+}
+
+// invalidate drops the results a change to the record resource of
+// collection may alter; data is the record after a create or update. An
+// empty resource deletes the whole collection.
+func (c *queryCache) invalidate(op, collection, resource string, data []byte) {
+	var doc map[string]interface{}
+	if op != OpDelete && data != nil {
+		doc, _ = decodeDocument(data)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		entry := el.Value.(*cachedQuery)
+
+		var stale bool
+		switch {
+		case resource == "":
+			stale = entry.collection == collection || hasCollectionPrefix(entry.collection, collection)
+		case entry.collection != collection:
+		case entry.resources[resource]:
+			stale = true
+		case op != OpDelete:
+			stale = doc == nil || entry.query.Geo != nil || entry.query.Match(doc)
+		}
+
+		if stale {
+			c.remove(el)
+			c.stats.Invalidations++
+		}
+		el = next
+	}
+}
+
+// hasCollectionPrefix reports whether collection is nested in parent.
+func hasCollectionPrefix(collection, parent string) bool {
+	return len(collection) > len(parent) && collection[:len(parent)] == parent && collection[len(parent)] == '/'
+}
+
+// QueryCacheStats returns the statistics of the query cache, zero when it
+// is disabled.
+func (d *Driver) QueryCacheStats() QueryCacheStats {
+	c := d.qcache
+	if c == nil {
+		return QueryCacheStats{}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
+
+// copyDocuments copies docs deeply, so callers may change what they get.
+func copyDocuments(docs []Document) []Document {
+	if docs == nil {
+		return nil
+	}
+	out := make([]Document, len(docs))
+	for i, doc := range docs {
+		data, _ := copyValue(doc.Data).(map[string]interface{})
+		out[i] = Document{Resource: doc.Resource, Data: data}
+	}
+	return out
+}
+
+func copyValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if t == nil {
+			return t
+		}
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[k] = copyValue(e)
+		}
+		return m
+	case []interface{}:
+		if t == nil {
+			return t
+		}
+		s := make([]interface{}, len(t))
+		for i, e := range t {
+			s[i] = copyValue(e)
+		}
+		return s
+	}
+	return v
+}
@@ -0,0 +1,141 @@
+package jsondb
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// QueryLimits bounds the work of a query, so a filter matching little of a
+// large collection cannot stall the database. Zero fields take the limits
+// of the driver, negative ones lift them.
+type QueryLimits struct {
+	// Timeout is how long the query may run.
+	Timeout time.Duration `json:",omitempty"`
+
+	// MaxScanned is how many records the query may examine.
+	MaxScanned int `json:",omitempty"`
+
+	// MaxResults is how many records the query may return; unlike Limit,
+	// a query finding more is stopped by it.
+	MaxResults int `json:",omitempty"`
+
+	// Partial returns the records found when a limit stops the query,
+	// instead of failing with a QueryLimitError.
+	Partial bool `json:",omitempty"`
+}
+
+// Limits reported by QueryResult and QueryLimitError.
+const (
+	LimitTimeout = "timeout"
+	LimitScanned = "scanned"
+	LimitResults = "results"
+)
+
+// QueryResult is what Find returns.
+type QueryResult struct {
+	Docs []Document
+
+	// Scanned is how many records the query examined; zero for results
+	// served by the query cache.
+	Scanned int
+
+	// Limited names the limit that stopped a query with partial results,
+	// empty when they are complete.
+	Limited string `json:",omitempty"`
+}
+
+// ErrQueryLimit is returned when a query is stopped by its limits.
+var ErrQueryLimit = fmt.Errorf("Query exceeded its limits")
+
+// QueryLimitError tells which limit stopped a query. It matches
+// ErrQueryLimit with errors.Is.
+type QueryLimitError struct {
+	Limit   string
+	Scanned int
+}
+
+func (e *QueryLimitError) Error() string {
+	return fmt.Sprintf("Query stopped by its %s limit after examining %d records", e.Limit, e.Scanned)
+}
+
+func (e *QueryLimitError) Is(target error) bool {
+	return target == ErrQueryLimit
+}
+
+// withDefaults fills the zero fields of l from defaults.
+func (l QueryLimits) withDefaults(defaults QueryLimits) QueryLimits {
+	if l.Timeout == 0 {
+		l.Timeout = defaults.Timeout
+	}
+	if l.MaxScanned == 0 {
+		l.MaxScanned = defaults.MaxScanned
+	}
+	if l.MaxResults == 0 {
+		l.MaxResults = defaults.MaxResults
+	}
+	return l
+}
+
+// queryBudget is what is left of the limits of a running query.
+type queryBudget struct {
+	limits   QueryLimits
+	ctx      context.Context
+	deadline time.Time
+	scanned  int
+	limited  string
+}
+
+// start starts spending l; ctx, when set, cancels the query.
+func (l QueryLimits) start(ctx context.Context) *queryBudget {
+	b := &queryBudget{limits: l, ctx: ctx}
+	if l.Timeout > 0 {
+		b.deadline = time.Now().Add(l.Timeout)
+	}
+	return b
+}
+
+// errLimited stops a scan once a limit is reached.
+var errLimited = fmt.Errorf("query limited")
+
+// examine accounts for one more record examined, results having been found
+// so far, and fails with errLimited once a limit is reached.
+func (b *queryBudget) examine(results int) error {
+	if b.ctx != nil {
+		if err := b.ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case !b.deadline.IsZero() && time.Now().After(b.deadline):
+		b.limited = LimitTimeout
+	case b.limits.MaxScanned > 0 && b.scanned >= b.limits.MaxScanned:
+		b.limited = LimitScanned
+	case b.limits.MaxResults > 0 && results > b.limits.MaxResults:
+		b.limited = LimitResults
+	default:
+		b.scanned++
+		return nil
+	}
+	return errLimited
+}
+
+// result turns the records a query found and the error stopping it into
+// its result.
+func (b *queryBudget) result(docs []Document, err error) (QueryResult, error) {
+	if err == nil && b.limits.MaxResults > 0 && len(docs) > b.limits.MaxResults {
+		b.limited, err = LimitResults, errLimited
+	}
+	if err != errLimited {
+		return QueryResult{Docs: docs, Scanned: b.scanned}, err
+	}
+
+	if !b.limits.Partial {
+		return QueryResult{Scanned: b.scanned}, &QueryLimitError{Limit: b.limited, Scanned: b.scanned}
+	}
+	if b.limits.MaxResults > 0 && len(docs) > b.limits.MaxResults {
+		docs = docs[:b.limits.MaxResults]
+	}
+	return QueryResult{Docs: docs, Scanned: b.scanned, Limited: b.limited}, nil
+}
@@ -0,0 +1,397 @@
+package jsondb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// qualityCollection is the system collection holding the reports of the
+// data quality checks.
+const qualityCollection = "quality"
+
+// qualityHistoryLimit is how many reports are kept per collection.
+const qualityHistoryLimit = 50
+
+// qualityExamples is how many violating records a QualityResult names.
+const qualityExamples = 5
+
+// QualityPolicy is the data quality rules of a collection, checked by the
+// "quality-<collection>" job on Schedule ("@daily" by default) or by
+// CheckQuality.
+type QualityPolicy struct {
+	Rules    []QualityRule
+	Schedule string `json:",omitempty"`
+}
+
+// QualityRule is a check of a field, by dotted path, of the records of a
+// collection; it sets one of MinNonNull, References, or Min and Max.
+// References and ranges skip records where the field is missing or null,
+// which MinNonNull checks.
+type QualityRule struct {
+	// Name names the rule in reports; "<Field> <kind>" by default.
+	Name  string `json:",omitempty"`
+	Field string
+
+	// MinNonNull is the least share, from 0 to 1, of records having the
+	// field, not null.
+	MinNonNull float64 `json:",omitempty"`
+
+	// References is a collection the field, or each element of it, must
+	// name a record of.
+	References string `json:",omitempty"`
+
+	// Min and Max bound the numbers the field holds, inclusively.
+	Min *float64 `json:",omitempty"`
+	Max *float64 `json:",omitempty"`
+
+	// Tolerance is the share of the values checked by References or a
+	// range that may violate it; none by default.
+	Tolerance float64 `json:",omitempty"`
+}
+
+// kind returns what r checks.
+func (r QualityRule) kind() string {
+	switch {
+	case r.MinNonNull > 0:
+		return "non-null"
+	case r.References != "":
+		return "references"
+	}
+	return "range"
+}
+
+// name returns the name of r in reports.
+func (r QualityRule) name() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.Field + " " + r.kind()
+}
+
+func (p *QualityPolicy) validate() error {
+	if len(p.Rules) == 0 {
+		return fmt.Errorf("Quality policy has no rules")
+	}
+	for _, r := range p.Rules {
+		if r.Field == "" {
+			return fmt.Errorf("Quality rule '%s' has no field", r.Name)
+		}
+		kinds := 0
+		if r.MinNonNull != 0 {
+			kinds++
+		}
+		if r.References != "" {
+			kinds++
+		}
+		if r.Min != nil || r.Max != nil {
+			kinds++
+		}
+		if kinds != 1 {
+			return fmt.Errorf("Quality rule '%s' must set one of MinNonNull, References, or Min and Max", r.name())
+		}
+		if r.MinNonNull < 0 || r.MinNonNull > 1 || r.Tolerance < 0 || r.Tolerance > 1 {
+			return fmt.Errorf("Quality rule '%s' has a share outside 0 to 1", r.name())
+		}
+		if r.References != "" {
+			if err := validName(r.References, ""); err != nil {
+				return fmt.Errorf("Quality rule '%s' references an invalid collection", r.name())
+			}
+		}
+		if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+			return fmt.Errorf("Quality rule '%s' has Min above Max", r.name())
+		}
+	}
+	if p.Schedule != "" {
+		if _, err := ParseSchedule(p.Schedule); err != nil {
+			return fmt.Errorf("Invalid quality schedule: %v", err)
+		}
+	}
+	return nil
+}
+
+// QualityReport is the outcome of checking the quality rules of a
+// collection.
+type QualityReport struct {
+	Collection string
+	Checked    time.Time
+	Records    int
+	Passed     bool
+	Results    []QualityResult
+}
+
+// QualityResult is the outcome of a QualityRule: of the values it checked,
+// how many violate it, with a few of the records holding them, or, for
+// MinNonNull, the share of records with the field.
+type QualityResult struct {
+	Rule       string
+	Field      string
+	Passed     bool
+	Checked    int
+	Violations int
+	NonNull    float64  `json:",omitempty"`
+	Examples   []string `json:",omitempty"`
+}
+
+// QualityObserver is told the reports of the data quality checks. An
+// Instrumentation implementing it, such as a metrics exporter, is told
+// those of its driver.
+type QualityObserver interface {
+	OnQualityReport(report QualityReport)
+}
+
+// QualityStats sums up the checks of a collection since the database was
+// opened: how many ran and failed, and whether the last passed, with the
+// rules it failed.
+type QualityStats struct {
+	Runs    int64
+	Failed  int64
+	LastRun time.Time `json:",omitempty"`
+	Passed  bool
+	Failing []string `json:",omitempty"`
+}
+
+// qualityState holds the QualityStats of the collections, shared by the
+// copies of a driver.
+type qualityState struct {
+	mutex sync.Mutex
+	stats map[string]*QualityStats
+}
+
+func qualityJob(collection string) string {
+	return "quality-" + collection
+}
+
+// scheduleQuality registers the quality job of collection when its
+// configuration has a policy, and unregisters it otherwise.
+func (d *Driver) scheduleQuality(collection string, cfg *CollectionConfig) error {
+	job := qualityJob(collection)
+	if cfg == nil || cfg.Quality == nil {
+		d.scheduler.Unregister(job)
+		return nil
+	}
+
+	schedule := cfg.Quality.Schedule
+	if schedule == "" {
+		schedule = "@daily"
+	}
+	return d.scheduler.Register(job, schedule, func() error {
+		report, err := d.CheckQuality(collection)
+		if err == nil && !report.Passed {
+			err = fmt.Errorf("Data quality checks of '%s' failed", collection)
+		}
+		return err
+	})
+}
+
+// CheckQuality checks the records of collection against its quality
+// policy, now, keeps the report in the system namespace, for
+// QualityReports, and returns it. Referenced collections are read without
+// locking them. A collection without a policy has an empty, passing
+// report, which is not kept.
+func (d *Driver) CheckQuality(collection string) (_ QualityReport, err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("CheckQuality", collection, "")
+	defer span.end(&err)
+
+	if err := d.allow(PolicyRead, collection); err != nil {
+		return QualityReport{}, err
+	}
+
+	report := QualityReport{Collection: collection, Checked: time.Now().UTC(), Passed: true}
+	cfg := d.collectionConfig(collection)
+	if cfg == nil || cfg.Quality == nil {
+		return report, nil
+	}
+	rules := cfg.Quality.Rules
+
+	results := make([]QualityResult, len(rules))
+	for i, r := range rules {
+		results[i] = QualityResult{Rule: r.name(), Field: r.Field}
+	}
+
+	unlock, err := d.lockCollection(collection, LockRead)
+	if err != nil {
+		return QualityReport{}, err
+	}
+	err = d.scan(collection, func(resource string, b []byte) error {
+		doc, err := decodeDocument(b)
+		if err != nil {
+			return fmt.Errorf("Error decoding '%s/%s': %v", collection, resource, err)
+		}
+		report.Records++
+		for i, r := range rules {
+			d.checkQualityRule(r, &results[i], resource, doc)
+		}
+		return nil
+	})
+	unlock()
+	if err != nil && !os.IsNotExist(err) {
+		return QualityReport{}, err
+	}
+
+	for i, r := range rules {
+		res := &results[i]
+		if r.MinNonNull > 0 {
+			res.Checked = report.Records
+			if report.Records > 0 {
+				res.NonNull = float64(report.Records-res.Violations) / float64(report.Records)
+			}
+			res.Passed = report.Records == 0 || res.NonNull >= r.MinNonNull
+		} else {
+			res.Passed = float64(res.Violations) <= r.Tolerance*float64(res.Checked)
+		}
+		report.Passed = report.Passed && res.Passed
+	}
+	report.Results = results
+
+	d.recordQuality(report)
+	return report, nil
+}
+
+// checkQualityRule checks the record resource, decoded as doc, against r,
+// counting into res.
+func (d *Driver) checkQualityRule(r QualityRule, res *QualityResult, resource string, doc map[string]interface{}) {
+	v, ok := lookup(doc, r.Field)
+	var values []interface{}
+	switch {
+	case r.MinNonNull > 0:
+		if !ok || v == nil {
+			res.violation(resource)
+		}
+		return
+	case !ok || v == nil:
+		return
+	case r.References != "":
+		if a, isArray := v.([]interface{}); isArray {
+			values = a
+		} else {
+			values = []interface{}{v}
+		}
+	default:
+		values = []interface{}{v}
+	}
+
+	for _, v := range values {
+		res.Checked++
+		var valid bool
+		if r.References != "" {
+			valid = d.recordExists(r.References, fmt.Sprint(v))
+		} else if f, isNumber := toFloat(v); isNumber {
+			valid = (r.Min == nil || f >= *r.Min) && (r.Max == nil || f <= *r.Max)
+		}
+		if !valid {
+			res.violation(resource)
+		}
+	}
+}
+
+// violation counts a violation by the record resource.
+func (res *QualityResult) violation(resource string) {
+	res.Violations++
+	if len(res.Examples) < qualityExamples && (len(res.Examples) == 0 || res.Examples[len(res.Examples)-1] != resource) {
+		res.Examples = append(res.Examples, resource)
+	}
+}
+
+// recordExists reports whether collection/resource is stored.
+func (d *Driver) recordExists(collection, resource string) bool {
+	collection = d.resolve(collection)
+	if resource == "" || validName(collection, resource) != nil {
+		return false
+	}
+	_, err := d.backend.Stat(filepath.Join(d.dir, collection, resource+".json"))
+	return err == nil
+}
+
+// recordQuality counts report, tells the observer, if any, and persists it,
+// trimming the history of its collection to qualityHistoryLimit.
+func (d *Driver) recordQuality(report QualityReport) {
+	var failing []string
+	for _, res := range report.Results {
+		if !res.Passed {
+			failing = append(failing, res.Rule)
+		}
+	}
+
+	q := d.quality
+	q.mutex.Lock()
+	st, ok := q.stats[report.Collection]
+	if !ok {
+		st = &QualityStats{}
+		q.stats[report.Collection] = st
+	}
+	st.Runs++
+	st.LastRun = report.Checked
+	st.Passed = report.Passed
+	st.Failing = failing
+	if !report.Passed {
+		st.Failed++
+	}
+	q.mutex.Unlock()
+
+	if o, ok := d.instr.(QualityObserver); ok {
+		o.OnQualityReport(report)
+	}
+	if !report.Passed {
+		d.log.Warn("Data quality checks of '%s' failed: %s\n", report.Collection, strings.Join(failing, ", "))
+	}
+
+	sys := d.System()
+	resource := fmt.Sprintf("%s-%d", strings.ReplaceAll(report.Collection, "/", "~"), report.Checked.UnixNano())
+	if err := sys.Write(qualityCollection, resource, report); err != nil {
+		d.log.Error("Unable to record the quality report of '%s': %v\n", report.Collection, err)
+		return
+	}
+
+	docs, err := sys.Query(qualityCollection, Query{Where: []Condition{{Field: "Collection", Value: report.Collection}}})
+	if err != nil {
+		return
+	}
+	for i := 0; i < len(docs)-qualityHistoryLimit; i++ {
+		sys.Delete(qualityCollection, docs[i].Resource)
+	}
+}
+
+// QualityReports returns the kept reports of the checks of collection,
+// newest first.
+func (d *Driver) QualityReports(collection string) (_ []QualityReport, err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("QualityReports", collection, "")
+	defer span.end(&err)
+
+	if err := d.allow(PolicyRead, collection); err != nil {
+		return nil, err
+	}
+
+	docs, err := d.System().Query(qualityCollection, Query{Where: []Condition{{Field: "Collection", Value: collection}}})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	reports := make([]QualityReport, 0, len(docs))
+	for i := len(docs) - 1; i >= 0; i-- {
+		var report QualityReport
+		if err := FromGeneric(docs[i].Data, &report); err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// QualityStats returns the outcome of the quality checks, by collection,
+// since the database was opened.
+func (d *Driver) QualityStats() map[string]QualityStats {
+	q := d.quality
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	stats := make(map[string]QualityStats, len(q.stats))
+	for collection, st := range q.stats {
+		stats[collection] = *st
+	}
+	return stats
+}
@@ -0,0 +1,417 @@
+package jsondb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Condition compares the value found at a dotted field path (Address.City)
+// against Value. Op is one of =, !=, >, >=, <, <= or a pattern operator,
+// OpMatches or OpLike; an empty Op means =. Strings are compared under
+// Collation.
+type Condition struct {
+	Field     string
+	Op        string
+	Value     interface{}
+	Collation Collation `json:",omitempty"`
+}
+
+// Query selects the records of a collection matching every condition and
+// the geo filter, if any. Collation applies to the conditions without one
+// of their own; without either, a condition takes the collation the
+// collection configures for its field.
+type Query struct {
+	Where     []Condition
+	Geo       *GeoFilter `json:",omitempty"`
+	Limit     int
+	Collation Collation `json:",omitempty"`
+
+	// Limits bounds the work of the query; zero fields take the limits
+	// of the driver.
+	Limits QueryLimits
+}
+
+// Document is a decoded record together with its resource name.
+type Document struct {
+	Resource string
+	Data     map[string]interface{}
+}
+
+// Match reports whether doc satisfies every condition of q.
+func (q Query) Match(doc map[string]interface{}) bool {
+	for _, cond := range q.Where {
+		if cond.Collation == "" {
+			cond.Collation = q.Collation
+		}
+		if !cond.Match(doc) {
+			return false
+		}
+	}
+	return q.Geo == nil || q.Geo.Match(doc)
+}
+
+// Match reports whether doc satisfies the condition.
+func (cond Condition) Match(doc map[string]interface{}) bool {
+	v, ok := lookup(doc, cond.Field)
+
+	switch cond.Op {
+	case "", "=", "==":
+		return ok && cond.compare(v) == 0
+	case "!=":
+		return !ok || cond.compare(v) != 0
+	case ">":
+		return ok && cond.compare(v) > 0
+	case ">=":
+		return ok && cond.compare(v) >= 0
+	case "<":
+		return ok && cond.compare(v) < 0
+	case "<=":
+		return ok && cond.compare(v) <= 0
+	case OpMatches, OpLike, OpGlob:
+		return ok && cond.matchPattern(v)
+	}
+	return false
+}
+
+// compare orders v against the value of the condition, comparing strings
+// under its collation. An invalid collation compares bytes.
+func (cond Condition) compare(v interface{}) int {
+	if cond.Collation == "" {
+		return compare(v, cond.Value)
+	}
+	if _, ok := toFloat(v); ok {
+		if _, ok := toFloat(cond.Value); ok {
+			return compare(v, cond.Value)
+		}
+	}
+	cl, err := cond.Collation.collator()
+	if err != nil {
+		return compare(v, cond.Value)
+	}
+	return cl.compare(fmt.Sprint(v), fmt.Sprint(cond.Value))
+}
+
+// Query returns the records of collection matching q, ordered by resource
+// name. The collection is locked shared for the duration of the scan, so
+// the result reflects a single point in time. With a query cache, repeated
+// queries are answered from it until a change may alter their result.
+//
+// A query stopped by its limits fails with a QueryLimitError, unless its
+// limits allow partial results; Find tells those apart from complete ones.
+func (d *Driver) Query(collection string, q Query) (_ []Document, err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("Query", collection, "")
+	defer span.end(&err)
+
+	if err := d.allow(PolicyRead, collection); err != nil {
+		return nil, err
+	}
+
+	r, err := d.find(collection, q)
+	return r.Docs, err
+}
+
+// Find is Query returning how the query went along with its records.
+func (d *Driver) Find(collection string, q Query) (_ QueryResult, err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("Find", collection, "")
+	defer span.end(&err)
+
+	if err := d.allow(PolicyRead, collection); err != nil {
+		return QueryResult{}, err
+	}
+
+	return d.find(collection, q)
+}
+
+func (d *Driver) find(collection string, q Query) (QueryResult, error) {
+	if collection == "" {
+		return QueryResult{}, fmt.Errorf("Missing collection - unable to read")
+	}
+	q.Limits = q.Limits.withDefaults(d.qlimits)
+
+	unlock, err := d.lockCollection(collection, LockRead)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	defer unlock()
+
+	c := d.qcache
+	if c == nil {
+		return d.run(collection, q)
+	}
+
+	if err := q.prepare(d.CollectionConfig(collection).Collations); err != nil {
+		return QueryResult{}, err
+	}
+	key := queryKey(collection, q)
+	if docs, ok := c.get(key); ok {
+		return QueryResult{Docs: docs}, nil
+	}
+
+	r, err := d.run(collection, q)
+	if err == nil && r.Limited == "" && key != "" {
+		c.put(key, collection, q, r.Docs)
+	}
+	return r, err
+}
+
+// query runs q without limits, for callers already holding the collection
+// lock.
+func (d *Driver) query(collection string, q Query) ([]Document, error) {
+	r, err := d.run(collection, q)
+	return r.Docs, err
+}
+
+// run is Find for callers already holding the collection lock.
+func (d *Driver) run(collection string, q Query) (QueryResult, error) {
+	if err := q.prepare(d.CollectionConfig(collection).Collations); err != nil {
+		return QueryResult{}, err
+	}
+	budget := q.Limits.start(d.ctx)
+
+	if q.Geo != nil {
+		if err := q.Geo.Validate(); err != nil {
+			return QueryResult{}, err
+		}
+
+		geo := d.CollectionConfig(collection).Geo
+		f := *q.Geo
+		if f.Field == "" {
+			if geo == "" {
+				return QueryResult{}, fmt.Errorf("Collection '%s' has no geo field", collection)
+			}
+			f.Field = geo
+		}
+		q.Geo = &f
+
+		if f.Field == geo {
+			ix, err := d.geoIndexFor(collection, geo)
+			if err != nil {
+				return QueryResult{}, err
+			}
+			docs, err := d.queryGeo(collection, q, ix, budget)
+			return budget.result(docs, err)
+		}
+	}
+
+	var docs []Document
+	var n int
+	res := reservation{budget: d.memory}
+	defer res.release()
+
+	err := d.matching(collection, q, budget, &n, func(resource string, b []byte, doc map[string]interface{}) error {
+		if err := res.grow(len(b)); err != nil {
+			return err
+		}
+		docs = append(docs, Document{Resource: resource, Data: doc})
+		return nil
+	})
+	return budget.result(docs, err)
+}
+
+// matching calls fn with the records of collection matching q, counting
+// them in n, within budget and up to q.Limit.
+func (d *Driver) matching(collection string, q Query, budget *queryBudget, n *int, fn func(resource string, b []byte, doc map[string]interface{}) error) error {
+	var needles [][]byte
+	for _, cond := range q.Where {
+		if needle := cond.scanNeedle(); needle != nil {
+			needles = append(needles, needle)
+		}
+	}
+
+	return d.scan(collection, func(resource string, b []byte) error {
+		if err := budget.examine(*n); err != nil {
+			return err
+		}
+		for _, needle := range needles {
+			if !bytes.Contains(b, needle) {
+				return nil
+			}
+		}
+
+		doc, err := decodeDocument(b)
+		if err != nil {
+			return fmt.Errorf("Error decoding '%s': %v", resource, err)
+		}
+
+		if q.Match(doc) {
+			*n++
+			if err := fn(resource, b, doc); err != nil {
+				return err
+			}
+		}
+
+		if q.Limit > 0 && *n >= q.Limit {
+			return errStopScan
+		}
+		return nil
+	})
+}
+
+// prepare validates the collations and patterns of q, giving the
+// conditions without a collation the one of the query, or else the one
+// configured for their field.
+func (q *Query) prepare(fields map[string]Collation) error {
+	if err := q.Collation.Validate(); err != nil {
+		return err
+	}
+
+	where := make([]Condition, len(q.Where))
+	for i, cond := range q.Where {
+		if cond.Collation == "" {
+			cond.Collation = q.Collation
+		}
+		if cond.Collation == "" {
+			cond.Collation = fields[cond.Field]
+		}
+		if err := cond.Validate(); err != nil {
+			return err
+		}
+		where[i] = cond
+	}
+	q.Where = where
+	return nil
+}
+
+// Validate checks the operator, collation and pattern of cond.
+func (cond Condition) Validate() error {
+	switch cond.Op {
+	case "", "=", "==", "!=", ">", ">=", "<", "<=":
+	case OpMatches, OpLike, OpGlob:
+		s, ok := cond.Value.(string)
+		if !ok {
+			return fmt.Errorf("Pattern of '%s' is not a string", cond.Field)
+		}
+		if _, err := compilePattern(cond.Op, s, false); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unknown operator '%s' on '%s'", cond.Op, cond.Field)
+	}
+	return cond.Collation.Validate()
+}
+
+var errStopScan = fmt.Errorf("stop scan")
+
+// scan calls fn with the name and contents of every record in collection,
+// in name order. fn may return errStopScan to end the scan early.
+func (d *Driver) scan(collection string, fn func(resource string, b []byte) error) error {
+	if err := validName(collection, ""); err != nil {
+		return err
+	}
+	dir := filepath.Join(d.dir, collection)
+
+	if _, err := d.stat(dir); err != nil {
+		return err
+	}
+
+	files, err := d.backend.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if !isRecord(file) {
+			continue
+		}
+
+		resource := strings.TrimSuffix(file.Name(), ".json")
+		path := filepath.Join(dir, file.Name())
+		b, err := d.backend.ReadFile(path)
+		if ok, err := d.checkRecord(collection, resource, path, b, err); !ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := fn(resource, b); err != nil {
+			if err == errStopScan {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// DecodeValue decodes any JSON value, keeping numbers as json.Number.
+func DecodeValue(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func decodeDocument(b []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var doc map[string]interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// lookup returns the value at a dotted path inside doc.
+func lookup(doc map[string]interface{}, path string) (interface{}, bool) {
+	var cur interface{} = doc
+
+	for _, part := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// compare orders two values numerically when both are numbers and as
+// strings otherwise.
+func compare(a, b interface{}) int {
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case json.Number:
+		f, err := t.Float64()
+		return f, err == nil
+	case float64:
+		return t, true
+	case float32:
+		return float64(t), true
+	case int:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case string:
+		f, err := strconv.ParseFloat(t, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,217 @@
+package jsondb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Queue is a work queue kept in a collection, one record per message.
+// Claiming a message hides it for a visibility timeout, like an advisory
+// lock: if it is not acknowledged in time it becomes visible again and is
+// retried. Messages claimed MaxAttempts times without being acknowledged
+// are moved to the dead-letter collection.
+type Queue struct {
+	d          *Driver
+	collection string
+
+	// MaxAttempts is how often a message is delivered before it is
+	// dead-lettered.
+	MaxAttempts int
+
+	// RetryDelay is how long a message stays hidden after the first Nack;
+	// it doubles with every further attempt.
+	RetryDelay time.Duration
+
+	// DeadLetter is the collection failed messages are moved to.
+	DeadLetter string
+}
+
+// Message is one queued message. Receipt identifies a claim and must be
+// passed back to Ack or Nack.
+type Message struct {
+	ID        string
+	Payload   json.RawMessage
+	Attempts  int
+	Enqueued  time.Time
+	VisibleAt time.Time
+	Receipt   string `json:",omitempty"`
+	LastError string `json:",omitempty"`
+}
+
+// Queue returns the work queue stored in collection, with up to 5 attempts
+// per message and a "<collection>.dead" dead-letter collection.
+func (d *Driver) Queue(collection string) *Queue {
+	return &Queue{
+		d:           d,
+		collection:  collection,
+		MaxAttempts: 5,
+		RetryDelay:  time.Second,
+		DeadLetter:  collection + ".dead",
+	}
+}
+
+// Enqueue adds a message carrying payload and returns its ID. Messages are
+// claimed in the order they were enqueued.
+func (q *Queue) Enqueue(payload interface{}) (string, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	m := Message{
+		ID:        fmt.Sprintf("%020d-%s", now.UnixNano(), hex.EncodeToString(suffix)),
+		Payload:   b,
+		Enqueued:  now,
+		VisibleAt: now,
+	}
+	return m.ID, q.d.Write(q.collection, m.ID, m)
+}
+
+// Claim takes up to n visible messages, hiding them from other claims for
+// visibility.
+func (q *Queue) Claim(n int, visibility time.Duration) (claimed []Message, err error) {
+	collection := q.d.resolve(q.collection)
+	d, span := q.d.trace("Claim", collection, "")
+	defer span.end(&err)
+
+	if err := validName(collection, ""); err != nil {
+		return nil, err
+	}
+	for _, op := range []string{PolicyRead, PolicyWrite} {
+		if err := d.allow(op, collection); err != nil {
+			return nil, err
+		}
+	}
+
+	unlock, err := d.lockCollection(collection, LockRead)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := d.query(collection, Query{})
+	unlock()
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	for _, doc := range docs {
+		if len(claimed) == n {
+			break
+		}
+
+		// The message is checked again as it is claimed, in case another
+		// claim or an Ack got to it first.
+		var m Message
+		err := d.modify(collection, doc.Resource, func(raw []byte) (interface{}, error) {
+			m = Message{}
+			if raw == nil {
+				return nil, errUnchanged
+			}
+			if err := json.Unmarshal(raw, &m); err != nil {
+				return nil, err
+			}
+			if m.VisibleAt.After(now) {
+				m.Receipt = ""
+				return nil, errUnchanged
+			}
+
+			if m.Attempts >= q.MaxAttempts {
+				if m.LastError == "" {
+					m.LastError = "Visibility timeout expired"
+				}
+				m.Receipt = ""
+				return nil, q.deadLetter(d, m)
+			}
+
+			receipt := make([]byte, 16)
+			if _, err := rand.Read(receipt); err != nil {
+				return nil, err
+			}
+
+			m.Attempts++
+			m.VisibleAt = now.Add(visibility)
+			m.Receipt = hex.EncodeToString(receipt)
+			return m, nil
+		})
+		if err != nil {
+			return claimed, err
+		}
+		if m.Receipt != "" {
+			claimed = append(claimed, m)
+		}
+	}
+	return claimed, nil
+}
+
+// Ack removes a processed message. It fails with ErrLockNotHeld if the claim
+// expired and the message may have been handed to someone else.
+func (q *Queue) Ack(m Message) error {
+	return q.settle(PolicyDelete, m, func(held Message) (interface{}, error) {
+		return nil, nil
+	})
+}
+
+// Nack returns a message that failed with reason to the queue. It is retried
+// after the retry delay, or dead-lettered once it ran out of attempts.
+func (q *Queue) Nack(m Message, reason string) error {
+	return q.settle(PolicyWrite, m, func(held Message) (interface{}, error) {
+		held.LastError = reason
+		held.Receipt = ""
+		if held.Attempts >= q.MaxAttempts {
+			return nil, q.deadLetter(q.d, held)
+		}
+
+		held.VisibleAt = time.Now().UTC().Add(q.RetryDelay << uint(held.Attempts-1))
+		return held, nil
+	})
+}
+
+// settle replaces the stored message with what fn returns, removing it for
+// nil, if m's claim still holds and the policy allows op.
+func (q *Queue) settle(op string, m Message, fn func(held Message) (interface{}, error)) error {
+	collection := q.d.resolve(q.collection)
+	if err := validName(collection, m.ID); err != nil {
+		return err
+	}
+	if err := q.d.allow(op, collection); err != nil {
+		return err
+	}
+
+	return q.d.modify(collection, m.ID, func(raw []byte) (interface{}, error) {
+		var held Message
+		if raw == nil {
+			return nil, ErrLockNotHeld
+		}
+		if err := json.Unmarshal(raw, &held); err != nil {
+			return nil, err
+		}
+		if held.Receipt != m.Receipt || time.Now().After(held.VisibleAt) {
+			return nil, ErrLockNotHeld
+		}
+		return fn(held)
+	})
+}
+
+// deadLetter copies m, without its receipt, to the dead-letter collection;
+// the caller removes it from the queue.
+func (q *Queue) deadLetter(d *Driver, m Message) error {
+	if q.DeadLetter == q.collection {
+		return fmt.Errorf("Dead-letter collection must differ from the queue")
+	}
+
+	m.Receipt = ""
+	return d.Write(q.DeadLetter, m.ID, m)
+}
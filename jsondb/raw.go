@@ -0,0 +1,190 @@
+package jsondb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// ErrInvalidJSON is returned by WriteRaw for documents that are not a JSON
+// object.
+var ErrInvalidJSON = fmt.Errorf("Record is not a valid JSON object")
+
+// ReadRaw returns the record collection/resource as stored, without
+// decoding it; it converts to a json.RawMessage as is.
+func (d *Driver) ReadRaw(collection, resource string) ([]byte, error) {
+	b, _, err := d.readRaw("ReadRaw", collection, resource)
+	return b, err
+}
+
+// ReadRawStale is ReadRaw telling whether the record was served from the
+// stale-if-error cache of its collection, see CollectionConfig.StaleIfError:
+// stale is nil for a record read from storage.
+func (d *Driver) ReadRawStale(collection, resource string) (_ []byte, stale *Stale, err error) {
+	return d.readRaw("ReadRawStale", collection, resource)
+}
+
+func (d *Driver) readRaw(op, collection, resource string) (_ []byte, _ *Stale, err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace(op, collection, resource)
+	defer span.end(&err)
+
+	if err := d.allow(PolicyRead, collection); err != nil {
+		return nil, nil, err
+	}
+
+	if collection == "" {
+		return nil, nil, fmt.Errorf("Missing collection - unable to read!")
+	}
+
+	if resource == "" {
+		return nil, nil, fmt.Errorf("Missing resource - unable to read record (no name)!")
+	}
+
+	if err := validName(collection, resource); err != nil {
+		return nil, nil, err
+	}
+	d.hotKeys.count(collection, resource, false)
+	return d.fetch(collection, resource)
+}
+
+// ReadMany returns, by resource, the records of collection among resources,
+// as stored, read under one read lock of the collection so no write lands
+// between them. Resources without a record are missing from the map.
+func (d *Driver) ReadMany(collection string, resources []string) (_ map[string]json.RawMessage, err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("ReadMany", collection, "")
+	defer span.end(&err)
+
+	if err := d.allow(PolicyRead, collection); err != nil {
+		return nil, err
+	}
+
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read!")
+	}
+
+	for _, resource := range resources {
+		if resource == "" {
+			return nil, fmt.Errorf("Missing resource - unable to read record (no name)!")
+		}
+		if err := validName(collection, resource); err != nil {
+			return nil, err
+		}
+	}
+
+	// Records read through are loaded first: storing them takes the write
+	// lock.
+	for _, resource := range resources {
+		if err := d.readThrough(collection, resource, false); err != nil {
+			return nil, err
+		}
+	}
+
+	unlock, err := d.lockCollection(collection, LockRead)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	records := make(map[string]json.RawMessage, len(resources))
+	for _, resource := range resources {
+		if _, ok := records[resource]; ok {
+			continue
+		}
+		d.hotKeys.count(collection, resource, false)
+		b, _, err := d.fetchHeld(collection, resource, LockRead)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records[resource] = b
+	}
+	return records, nil
+}
+
+// WriteRaw stores b, the JSON encoding of an object, as the record
+// collection/resource without decoding and re-encoding it, so a large
+// document is not held in memory as a decoded tree and an encoding again.
+// b is only scanned for validity; its formatting, field order and numbers
+// are stored as sent. Limits, the
+// collection configuration, views and watchers apply as for Write, except
+// MergeOnWrite, which needs the type of a Go value.
+func (d *Driver) WriteRaw(collection, resource string, b []byte) (err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("WriteRaw", collection, resource)
+	defer span.end(&err)
+
+	if err := d.allow(PolicyWrite, collection); err != nil {
+		return err
+	}
+
+	return d.writeRaw(collection, resource, b, true)
+}
+
+// WriteRawUnchecked is WriteRaw without the validity scan, for bytes known
+// to hold a JSON object, such as those ReadRaw returns: proxies moving
+// records between databases skip reading every byte once more. Storing
+// anything else leaves a record that reads fail on.
+func (d *Driver) WriteRawUnchecked(collection, resource string, b []byte) (err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("WriteRawUnchecked", collection, resource)
+	defer span.end(&err)
+
+	if err := d.allow(PolicyWrite, collection); err != nil {
+		return err
+	}
+
+	return d.writeRaw(collection, resource, b, false)
+}
+
+func (d *Driver) writeRaw(collection, resource string, b []byte, check bool) error {
+	if collection == "" {
+		return fmt.Errorf("Missing collection - no place to save record!")
+	}
+
+	if resource == "" {
+		return fmt.Errorf("Missing resource - unable to save record (no name)!")
+	}
+
+	if err := validName(collection, resource); err != nil {
+		return err
+	}
+
+	if err := d.checkCollection(collection); err != nil {
+		return err
+	}
+
+	if check && !validObject(b) {
+		return ErrInvalidJSON
+	}
+
+	if r := d.replicator(); r != nil {
+		return d.replicate(r, Change{Op: OpWrite, Collection: collection, Resource: resource, Data: b, Raw: true})
+	}
+
+	// The record outlives the call in the change feed, so it gets its own
+	// copy; callers may reuse b.
+	b = append(append(make([]byte, 0, len(b)+1), b...), '\n')
+	if bytes.HasSuffix(b, []byte("\n\n")) {
+		b = b[:len(b)-1]
+	}
+
+	unlock, err := d.lockCollection(collection, LockWrite)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return d.writeBytes(collection, resource, d.collectionConfig(collection), b)
+}
+
+// validObject reports whether b is a single JSON object. json.Valid scans
+// the document without building it.
+func validObject(b []byte) bool {
+	trimmed := bytes.TrimLeft(b, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '{' && json.Valid(b)
+}
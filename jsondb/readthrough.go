@@ -0,0 +1,83 @@
+package jsondb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Loader fetches records from where a read-through collection takes them,
+// such as the primary server of an edge cache; the client package's Client
+// is one. Load returns the record as JSON, or an error satisfying
+// os.IsNotExist when there is none.
+type Loader interface {
+	Load(ctx context.Context, collection, resource string) ([]byte, error)
+}
+
+// ReadThrough makes a collection a cache of its Loader: reads of a record
+// missing locally load it, store it and serve it. A record stored more
+// than TTL ago is loaded again when read; without a TTL it is kept until
+// it is deleted. When the Loader fails, a stored record is served stale.
+type ReadThrough struct {
+	Loader Loader
+	TTL    time.Duration
+}
+
+// readThrough loads collection/resource into the database if collection
+// reads through and the record is missing or stale; the read that follows
+// serves it. A record the Loader no longer has is deleted. The Loader is
+// called without the collection lock, which is then taken to store the
+// record unless locked says the caller holds it for writing.
+func (d *Driver) readThrough(collection, resource string, locked bool) error {
+	rt, ok := d.readThroughs[collection]
+	if !ok || rt.Loader == nil {
+		return nil
+	}
+
+	path := filepath.Join(d.dir, collection, resource+".json")
+	fi, err := d.backend.Stat(path)
+	if err == nil && (rt.TTL <= 0 || time.Since(fi.ModTime()) < rt.TTL) {
+		return nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	stored := err == nil
+
+	b, err := rt.Loader.Load(d.Context(), collection, resource)
+	switch {
+	case os.IsNotExist(err):
+		if !stored {
+			return nil
+		}
+		if !locked {
+			unlock, err := d.lockCollection(collection, LockWrite)
+			if err != nil {
+				return err
+			}
+			defer unlock()
+		}
+		return d.remove(collection, resource)
+
+	case err != nil && stored:
+		d.log.Warn("Serving stale '%s/%s': %v\n", collection, resource, err)
+		return nil
+
+	case err == ErrBreakerOpen:
+		return err
+
+	case err != nil:
+		return fmt.Errorf("Error loading '%s/%s': %v", collection, resource, err)
+	}
+
+	if !locked {
+		unlock, err := d.lockCollection(collection, LockWrite)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	return d.writeBytes(collection, resource, d.collectionConfig(collection), b)
+}
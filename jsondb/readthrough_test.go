@@ -0,0 +1,55 @@
+package jsondb
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+// mapLoader loads records from a map of collection/resource to JSON.
+type mapLoader map[string]string
+
+func (l mapLoader) Load(ctx context.Context, collection, resource string) ([]byte, error) {
+	b, ok := l[collection+"/"+resource]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return []byte(b), nil
+}
+
+func TestReadThroughUnderLock(t *testing.T) {
+	loader := mapLoader{
+		"users/ann": `{"Name":"Ann","Age":30}`,
+		"users/bob": `{"Name":"Bob","Age":40}`,
+	}
+	options := quiet()
+	options.ReadThrough = map[string]ReadThrough{"users": {Loader: loader}}
+	options.LockTimeout = time.Second
+	db, _ := openTest(t, options)
+
+	err := db.Update("users", "ann", func(doc map[string]interface{}) error {
+		doc["Age"] = 31
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update of a record read through: %v", err)
+	}
+	var ann map[string]interface{}
+	if err := db.Read("users", "ann", &ann); err != nil || ann["Age"] != 31.0 {
+		t.Errorf("ann = %v, %v", ann, err)
+	}
+
+	records, err := db.ReadMany("users", []string{"ann", "bob", "bob", "eve"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("ReadMany = %d records, want 2", len(records))
+	}
+	var bob map[string]interface{}
+	if err := json.Unmarshal(records["bob"], &bob); err != nil || bob["Name"] != "Bob" {
+		t.Errorf("bob = %s, %v", records["bob"], err)
+	}
+}
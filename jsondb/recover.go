@@ -0,0 +1,206 @@
+package jsondb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// dirtyFlag is created in the system namespace when a database directory
+// is opened and removed by Close. Finding it on open means the previous
+// process did not shut down cleanly, so derived state such as view results
+// may disagree with the records.
+const dirtyFlag = "dirty"
+
+// RecoveryReport describes what was checked and repaired when a database
+// directory was opened.
+type RecoveryReport struct {
+	// Unclean is set when the previous process did not Close the database.
+	Unclean bool
+	Started time.Time
+	Elapsed time.Duration
+
+	// TempFiles lists the temporary files of interrupted writes that were
+	// removed.
+	TempFiles []string `json:",omitempty"`
+
+	// StaleViews lists the persisted view results that named records which
+	// no longer exist; those names were dropped. Views are rebuilt in full
+	// when they are defined again.
+	StaleViews []string `json:",omitempty"`
+
+	// OrphanedViews lists the persisted view results of collections that
+	// no longer exist; they were removed.
+	OrphanedViews []string `json:",omitempty"`
+
+	// Transactions lists the transactions a crash interrupted while they
+	// were applied; they were completed from the journal.
+	Transactions []string `json:",omitempty"`
+}
+
+// recoveryState is shared by the copies WithContext makes of a driver.
+type recoveryState struct {
+	report RecoveryReport
+	token  string // content of the dirty flag this process wrote
+}
+
+// Recovery returns the report of the checks run when the database was
+// opened, or by the last call to Recover.
+func (d *Driver) Recovery() RecoveryReport {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.recovery.report
+}
+
+// Recover runs the checks New runs after an unclean shutdown, whatever the
+// dirty flag says, for example after restoring a copied directory. No other
+// operation may be in progress.
+func (d *Driver) Recover() (_ RecoveryReport, err error) {
+	d, span := d.trace("Recover", "", "")
+	defer span.end(&err)
+
+	return d.recover(true)
+}
+
+// recover removes the temporary files of interrupted writes and, when the
+// dirty flag was left behind or force is set, reconciles persisted view
+// results with the records. It then sets the dirty flag, naming this
+// process.
+func (d *Driver) recover(force bool) (RecoveryReport, error) {
+	report := RecoveryReport{Started: time.Now().UTC()}
+
+	d.mutex.Lock()
+	token := d.recovery.token
+	d.mutex.Unlock()
+
+	// A flag this driver wrote itself is not a sign of a crash.
+	flag := filepath.Join(d.dir, systemDir, dirtyFlag)
+	b, err := d.backend.ReadFile(flag)
+	if err == nil && string(b) != token {
+		report.Unclean = true
+	}
+
+	// The temporary files of another live process are writes in flight.
+	if pid := flagOwner(b); pid != 0 && pid != os.Getpid() && processAlive(pid) {
+		d.log.Warn("'%s' is open in process %d; leaving temporary files alone\n", d.dir, pid)
+	} else if report.TempFiles, err = d.recoverDir(); err != nil {
+		return report, err
+	}
+
+	if report.Transactions, err = d.recoverTransactions(); err != nil {
+		return report, err
+	}
+
+	if report.Unclean || force {
+		if err := d.recoverViews(&report); err != nil {
+			return report, err
+		}
+	}
+
+	report.Elapsed = time.Since(report.Started)
+	if report.Unclean || len(report.TempFiles) > 0 || len(report.Transactions) > 0 {
+		d.log.Warn("Recovered '%s' in %v: unclean shutdown %v, %d temporary files removed, %d stale and %d orphaned view results, %d transactions completed\n",
+			d.dir, report.Elapsed, report.Unclean, len(report.TempFiles), len(report.StaleViews), len(report.OrphanedViews), len(report.Transactions))
+	}
+
+	token = fmt.Sprintf("%d %s\n", os.Getpid(), time.Now().UTC().Format(time.RFC3339Nano))
+
+	d.mutex.Lock()
+	d.recovery.report = report
+	d.recovery.token = token
+	d.mutex.Unlock()
+
+	return report, d.backend.WriteFile(flag, []byte(token))
+}
+
+// flagOwner returns the process ID a dirty flag names, 0 if it names none.
+func flagOwner(flag []byte) int {
+	var pid int
+	if _, err := fmt.Sscan(string(flag), &pid); err != nil || pid <= 0 {
+		return 0
+	}
+	return pid
+}
+
+// recoverViews drops the names of missing records from persisted view
+// results and removes the results of views over missing collections.
+func (d *Driver) recoverViews(report *RecoveryReport) error {
+	sys := d.System()
+
+	records, err := sys.ReadAll(viewsCollection)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		var result ViewResult
+		if err := json.Unmarshal([]byte(record), &result); err != nil {
+			return fmt.Errorf("Error decoding view result: %v", err)
+		}
+
+		if _, err := d.backend.Stat(filepath.Join(d.dir, result.Collection)); os.IsNotExist(err) {
+			report.OrphanedViews = append(report.OrphanedViews, result.Name)
+			if err := sys.Delete(viewsCollection, result.Name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		stale := false
+		for group, resources := range result.Groups {
+			var kept []string
+			for _, resource := range resources {
+				path := filepath.Join(d.dir, result.Collection, resource+".json")
+				if _, err := d.backend.Stat(path); err == nil {
+					kept = append(kept, resource)
+				}
+			}
+
+			switch {
+			case len(kept) == len(resources):
+				continue
+			case len(kept) == 0:
+				delete(result.Groups, group)
+			default:
+				result.Groups[group] = kept
+			}
+			stale = true
+		}
+
+		if stale {
+			report.StaleViews = append(report.StaleViews, result.Name)
+			if err := sys.Write(viewsCollection, result.Name, result); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close stops the scheduler, persists the views changed since they last
+// were, and clears the dirty flag, so the next open skips reconciling
+// derived state. The flag is left alone when another process has opened
+// the directory since. The driver must not be used afterwards.
+func (d *Driver) Close() error {
+	d.scheduler.Stop()
+	d.flushViews()
+
+	d.mutex.Lock()
+	token := d.recovery.token
+	d.mutex.Unlock()
+
+	if token == "" {
+		return nil
+	}
+
+	flag := filepath.Join(d.dir, systemDir, dirtyFlag)
+	if b, err := d.backend.ReadFile(flag); err != nil || string(b) != token {
+		return nil
+	}
+	return d.backend.Remove(flag)
+}
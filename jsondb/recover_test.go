@@ -0,0 +1,89 @@
+package jsondb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, paths ...string) {
+	t.Helper()
+	for _, path := range paths {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRecoverRemovesOnlyRecordTempFiles(t *testing.T) {
+	db, dir := openTest(t, nil)
+	if err := db.Write("users", "ann", map[string]string{"Name": "Ann"}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	writeFiles(t, dir,
+		"users/bob.json.tmp",
+		"users/teams/red.json.tmp",
+		"_system/views/byAge.json.tmp",
+		".git/objects/pack/tmp_pack.tmp",
+		"users/notes.tmp",
+		"build.tmp",
+	)
+
+	db, err := New(dir, quiet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	want := map[string]bool{
+		filepath.Join(dir, "users/bob.json.tmp"):           true,
+		filepath.Join(dir, "users/teams/red.json.tmp"):     true,
+		filepath.Join(dir, "_system/views/byAge.json.tmp"): true,
+	}
+	removed := db.Recovery().TempFiles
+	if len(removed) != len(want) {
+		t.Errorf("removed %v, want %d record temporary files", removed, len(want))
+	}
+	for _, path := range removed {
+		if !want[path] {
+			t.Errorf("removed %s", path)
+		}
+	}
+	for _, path := range []string{".git/objects/pack/tmp_pack.tmp", "users/notes.tmp", "build.tmp"} {
+		if _, err := os.Stat(filepath.Join(dir, path)); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+}
+
+func TestRecoverSkipsDirectoryOpenElsewhere(t *testing.T) {
+	db, dir := openTest(t, nil)
+	db.Close()
+
+	// The parent process, the test runner, stands in for a live server.
+	owner := fmt.Sprintf("%d 2026-01-01T00:00:00Z\n", os.Getppid())
+	writeFiles(t, dir, "users/bob.json.tmp")
+	if err := os.WriteFile(filepath.Join(dir, systemDir, dirtyFlag), []byte(owner), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := New(dir, quiet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if removed := db.Recovery().TempFiles; len(removed) != 0 {
+		t.Errorf("removed %v from a directory open elsewhere", removed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "users/bob.json.tmp")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,389 @@
+package jsondb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// OpWrite is the Op of a Change storing a record.
+const OpWrite = "write"
+
+// Change is a record mutation as a Replicator carries it to every node.
+type Change struct {
+	Op         string
+	Collection string
+	Resource   string
+
+	// Data is the record of a write, as JSON.
+	Data json.RawMessage `json:",omitempty"`
+
+	// Raw stores Data as it is, as WriteRaw does.
+	Raw bool `json:",omitempty"`
+
+	// Expect, when set, is the fingerprint of the record the change was
+	// computed from, or of nothing when the record was missing; applying
+	// it fails with ErrConflict if the record changed since. Update, the
+	// writes of series and queues, and the removals of retention and
+	// expiry set it.
+	Expect string `json:",omitempty"`
+
+	// Trace is the trace context of the operation that made the change,
+	// which applying it continues, and Origin the InstanceID of the
+	// database it was made on.
+	Trace  map[string]string `json:",omitempty"`
+	Origin string            `json:",omitempty"`
+}
+
+// ErrConflict is returned when applying a change computed from a record
+// that another change replaced first.
+var ErrConflict = fmt.Errorf("Record changed while the change was replicated")
+
+// Replicator replicates the record changes of a driver, such as through a
+// consensus log. Write, WriteRaw, Update and Delete, the writes of series
+// and queues, and the purges of retention and expiry, hand their change to
+// Replicate instead of applying it, and Replicate returns once the change
+// is committed and applied to this driver through Apply.
+//
+// Changes travel as JSON, so MergeOnWrite, which needs the written type,
+// does not apply to replicated writes. The system namespace is not
+// replicated.
+type Replicator interface {
+	Replicate(c Change) error
+}
+
+// Leader is implemented by replicators through which a single node, the
+// leader, makes every change. Retention and expiry, which pick records by
+// the clock of the node they run on, run on the leader alone and
+// replicate what they remove.
+type Leader interface {
+	IsLeader() bool
+}
+
+// sweeps reports whether retention and expiry run on this node with the
+// replicator r: always, unless r has a leader and it is another node.
+func sweeps(r Replicator) bool {
+	l, ok := r.(Leader)
+	return !ok || l.IsLeader()
+}
+
+// archiveChange is the Data of an OpArchive change: the segment to move
+// records into, and the fingerprints of the records, which are only
+// archived as they were when they were picked.
+type archiveChange struct {
+	Segment ArchiveSegment
+	Expect  map[string]string
+}
+
+// expectations returns the fingerprints of resources of collection, for
+// changes removing them only as they are now. The caller holds the write
+// lock of the collection.
+func (d *Driver) expectations(collection string, resources []string) (map[string]string, error) {
+	expect := make(map[string]string, len(resources))
+	for _, resource := range resources {
+		raw, err := d.readCurrent(collection, resource, LockWrite)
+		if err != nil {
+			return nil, err
+		}
+		if raw != nil {
+			expect[resource] = fingerprint(raw)
+		}
+	}
+	return expect, nil
+}
+
+// replicateRemovals replicates the removal, as op, OpDelete or OpExpire,
+// of the records of collection expect has fingerprints of, and returns how
+// many were removed; those changed meanwhile are kept.
+func (d *Driver) replicateRemovals(r Replicator, op, collection string, expect map[string]string) (n int, err error) {
+	resources := make([]string, 0, len(expect))
+	for resource := range expect {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+
+	for _, resource := range resources {
+		err := d.replicate(r, Change{Op: op, Collection: collection, Resource: resource, Expect: expect[resource]})
+		if errors.Is(err, ErrConflict) {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// replicateArchive replicates the archiving of the records of collection
+// expect has fingerprints of into a new segment, and returns how many
+// were picked.
+func (d *Driver) replicateArchive(r Replicator, collection string, expect map[string]string) (int, error) {
+	resources := make([]string, 0, len(expect))
+	for resource := range expect {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+
+	b, err := json.Marshal(archiveChange{Segment: newSegment(collection, resources), Expect: expect})
+	if err != nil {
+		return 0, err
+	}
+	if err := d.replicate(r, Change{Op: OpArchive, Collection: collection, Data: b}); err != nil {
+		return 0, err
+	}
+	return len(resources), nil
+}
+
+// applyArchive archives the records of an OpArchive change that are still
+// as the change expects.
+func (d *Driver) applyArchive(c Change) error {
+	var a archiveChange
+	if err := json.Unmarshal(c.Data, &a); err != nil {
+		return err
+	}
+	if err := validName(c.Collection, ""); err != nil {
+		return err
+	}
+
+	unlock, err := d.lockCollection(c.Collection, LockWrite)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var resources []string
+	for _, resource := range a.Segment.Resources {
+		raw, err := d.readCurrent(c.Collection, resource, LockWrite)
+		if err != nil {
+			return err
+		}
+		if raw != nil && fingerprint(raw) == a.Expect[resource] {
+			resources = append(resources, resource)
+		}
+	}
+
+	a.Segment.Collection, a.Segment.Resources = c.Collection, resources
+	_, err = d.archiveSegment(a.Segment)
+	return err
+}
+
+// replication holds the replicator of a driver, shared by its copies.
+type replication struct {
+	mutex      sync.RWMutex
+	replicator Replicator
+}
+
+// SetReplicator makes r replicate every record change, behind the
+// "replication" circuit breaker; nil applies changes directly again.
+func (d *Driver) SetReplicator(r Replicator) {
+	if r != nil && d.breakers != nil {
+		r = brokenReplicator{r, d.breakers.get("replication")}
+	}
+	d.replication.mutex.Lock()
+	defer d.replication.mutex.Unlock()
+	d.replication.replicator = r
+}
+
+// replicator returns the replicator a change must go through, nil when it
+// is applied here: on the system driver, while applying a change, and
+// without a replicator.
+func (d *Driver) replicator() Replicator {
+	if d.replication == nil || d.applying {
+		return nil
+	}
+	d.replication.mutex.RLock()
+	defer d.replication.mutex.RUnlock()
+	return d.replication.replicator
+}
+
+// Apply applies a committed change to the records of the driver, without
+// replicating it.
+func (d *Driver) Apply(c Change) error {
+	a := *d
+	a.applying = true
+	a.continueTrace(c)
+
+	if c.Op == OpExpire || (c.Expect != "" && (c.Op == OpWrite || c.Op == OpDelete)) {
+		return a.applyExpected(c)
+	}
+
+	switch c.Op {
+	case OpArchive:
+		return a.applyArchive(c)
+	case OpWrite:
+		if c.Raw {
+			return a.WriteRaw(c.Collection, c.Resource, c.Data)
+		}
+		return a.Write(c.Collection, c.Resource, c.Data)
+	case OpDelete:
+		return a.Delete(c.Collection, c.Resource)
+	}
+	return fmt.Errorf("Unknown change '%s'", c.Op)
+}
+
+// applyExpected writes, deletes or expires the record of c if it still has
+// the fingerprint c expects.
+func (d *Driver) applyExpected(c Change) error {
+	if err := validName(c.Collection, c.Resource); err != nil {
+		return err
+	}
+
+	unlock, err := d.lockCollection(c.Collection, LockWrite)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	raw, err := d.readCurrent(c.Collection, c.Resource, LockWrite)
+	if err != nil {
+		return err
+	}
+	if fingerprint(raw) != c.Expect {
+		return ErrConflict
+	}
+
+	if c.Op != OpWrite {
+		if raw == nil {
+			return nil
+		}
+		return d.removeAs(c.Op, c.Collection, c.Resource)
+	}
+	return d.write(c.Collection, c.Resource, c.Data)
+}
+
+// readRecord returns the record of collection/resource as Read decodes
+// it, for a caller holding the collection lock in mode held, "" for none;
+// see fetchHeld. The policy is left to the caller.
+func (d *Driver) readRecord(collection, resource, held string) (json.RawMessage, error) {
+	d.hotKeys.count(collection, resource, false)
+	b, _, err := d.fetchHeld(collection, resource, held)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw json.RawMessage
+	return raw, d.DecodeRecord(collection, b, &raw)
+}
+
+// readCurrent is readRecord returning nil for a missing record.
+func (d *Driver) readCurrent(collection, resource, held string) (json.RawMessage, error) {
+	raw, err := d.readRecord(collection, resource, held)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return raw, err
+}
+
+// errUnchanged, returned by the function passed to modify, leaves the
+// record as it is.
+var errUnchanged = fmt.Errorf("Record left unchanged")
+
+// modify replaces the record of collection/resource with the value fn
+// computes from it; fn is passed nil for a missing record and returns nil
+// to delete it. Without a replicator fn runs under the write lock of the
+// collection. With one, the result is replicated as a change expecting the
+// record fn saw, and fn runs again if another change got in between, so it
+// must not have effects of its own that cannot be repeated.
+func (d *Driver) modify(collection, resource string, fn func(raw []byte) (interface{}, error)) error {
+	r := d.replicator()
+	if r == nil {
+		unlock, err := d.lockCollection(collection, LockWrite)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		raw, err := d.readCurrent(collection, resource, LockWrite)
+		if err != nil {
+			return err
+		}
+		v, err := fn(raw)
+		switch {
+		case err == errUnchanged:
+			return nil
+		case err != nil:
+			return err
+		case v != nil:
+			return d.write(collection, resource, v)
+		case raw != nil:
+			return d.remove(collection, resource)
+		}
+		return nil
+	}
+
+	for attempt := 0; ; attempt++ {
+		raw, err := d.readCurrent(collection, resource, "")
+		if err != nil {
+			return err
+		}
+		v, err := fn(raw)
+		if err == errUnchanged {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		c := Change{Op: OpDelete, Collection: collection, Resource: resource, Expect: fingerprint(raw)}
+		if v != nil {
+			if c.Data, err = json.Marshal(v); err != nil {
+				return err
+			}
+			c.Op = OpWrite
+		} else if raw == nil {
+			return nil
+		}
+
+		err = d.replicate(r, c)
+		if err != ErrConflict || attempt+1 == maxUpdateAttempts {
+			return err
+		}
+	}
+}
+
+func fingerprint(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// maxUpdateAttempts bounds how often a replicated Update is recomputed
+// after losing a race with another change.
+const maxUpdateAttempts = 5
+
+// replicateUpdate runs Update through r: fn is applied to the current
+// record, and the result is replicated as a write expecting that record,
+// again if another change got in between.
+func (d *Driver) replicateUpdate(r Replicator, collection, resource string, fn func(doc map[string]interface{}) error) error {
+	for attempt := 0; ; attempt++ {
+		raw, err := d.readRecord(collection, resource, "")
+		if err != nil {
+			return err
+		}
+
+		doc, err := decodeDocument(raw)
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			doc = map[string]interface{}{}
+		}
+		if err := fn(doc); err != nil {
+			return err
+		}
+
+		b, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		err = d.replicate(r, Change{Op: OpWrite, Collection: collection, Resource: resource, Data: b, Expect: fingerprint(raw)})
+		if err != ErrConflict || attempt+1 == maxUpdateAttempts {
+			return err
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package jsondb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// applyAll replicates a change by applying it to every driver in turn, as
+// a consensus log commits it to every node; the first driver is the one
+// replicating.
+type applyAll []*Driver
+
+func (a applyAll) Replicate(c Change) error {
+	var err error
+	for i, d := range a {
+		if aerr := d.Apply(c); i == 0 {
+			err = aerr
+		}
+	}
+	return err
+}
+
+func sameCollection(t *testing.T, a, b *Driver, collection string) {
+	t.Helper()
+	want, err := a.ReadAll(collection)
+	if err != nil {
+		t.Fatalf("%s: %v", collection, err)
+	}
+	got, err := b.ReadAll(collection)
+	if err != nil {
+		t.Fatalf("%s on the follower: %v", collection, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s on the follower = %v, want %v", collection, got, want)
+	}
+}
+
+func TestReplicatedSeriesAndQueues(t *testing.T) {
+	leader, _ := openTest(t, nil)
+	follower, _ := openTest(t, nil)
+	leader.SetReplicator(applyAll{leader, follower})
+
+	now := time.Now().UTC()
+	for i := 0; i < 3; i++ {
+		if err := leader.Append("cpu", now.Add(time.Duration(i)*time.Second), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sameCollection(t, leader, follower, "cpu")
+
+	q := leader.Queue("jobs")
+	q.RetryDelay = 0
+	for i := 0; i < 3; i++ {
+		if _, err := q.Enqueue(map[string]int{"N": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	claimed, err := q.Claim(2, time.Minute)
+	if err != nil || len(claimed) != 2 {
+		t.Fatalf("Claim = %d messages, %v", len(claimed), err)
+	}
+	sameCollection(t, leader, follower, "jobs")
+
+	if err := q.Ack(claimed[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Nack(claimed[1], "failed"); err != nil {
+		t.Fatal(err)
+	}
+	sameCollection(t, leader, follower, "jobs")
+
+	q.MaxAttempts = 1
+	if claimed, err := q.Claim(5, time.Minute); err != nil || len(claimed) != 1 {
+		t.Fatalf("Claim = %d messages, %v", len(claimed), err)
+	}
+	if err := q.Nack(claimed[0], "failed"); err != ErrLockNotHeld {
+		t.Errorf("Nack of an acknowledged message = %v, want ErrLockNotHeld", err)
+	}
+	sameCollection(t, leader, follower, "jobs")
+	sameCollection(t, leader, follower, "jobs.dead")
+}
+
+// follower is a replicator of a node that does not lead its cluster.
+type follower struct{ applyAll }
+
+func (follower) IsLeader() bool { return false }
+
+// ageRecords sets the modification times of the records of collection in
+// dir, oldest first.
+func ageRecords(t *testing.T, dir, collection string, resources ...string) {
+	t.Helper()
+	start := time.Now().Add(-time.Hour)
+	for i, resource := range resources {
+		at := start.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(filepath.Join(dir, collection, resource+".json"), at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReplicatedRetention(t *testing.T) {
+	for _, archive := range []bool{false, true} {
+		leader, leaderDir := openTest(t, nil)
+		other, otherDir := openTest(t, nil)
+		leader.SetReplicator(applyAll{leader, other})
+		other.SetReplicator(follower{applyAll{leader, other}})
+
+		cfg := CollectionConfig{Retention: &RetentionPolicy{MaxRecords: 2, Archive: archive}}
+		for _, d := range []*Driver{leader, other} {
+			if err := d.ConfigureCollection("logs", cfg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, name := range []string{"a", "b", "c", "d"} {
+			if err := leader.Write("logs", name, map[string]string{"Name": name}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// The nodes disagree on which records are oldest.
+		ageRecords(t, leaderDir, "logs", "a", "b", "c", "d")
+		ageRecords(t, otherDir, "logs", "d", "c", "b", "a")
+
+		if n, err := other.EnforceRetention("logs"); err != nil || n != 0 {
+			t.Errorf("retention on a follower = %d, %v; want 0", n, err)
+		}
+		if n, err := leader.EnforceRetention("logs"); err != nil || n != 2 {
+			t.Errorf("retention on the leader = %d, %v; want 2", n, err)
+		}
+		sameCollection(t, leader, other, "logs")
+		if keys, _ := other.ListKeys("logs", ListOptions{}); !reflect.DeepEqual(keys, []string{"c", "d"}) {
+			t.Errorf("kept on the follower: %v, want [c d]", keys)
+		}
+		if archive {
+			var a map[string]string
+			if err := other.ReadArchived("logs", "a", &a); err != nil || a["Name"] != "a" {
+				t.Errorf("archived on the follower: %v, %v", a, err)
+			}
+		}
+	}
+}
+
+func TestReplicatedExpiry(t *testing.T) {
+	leader, _ := openTest(t, nil)
+	other, _ := openTest(t, nil)
+	leader.SetReplicator(applyAll{leader, other})
+	other.SetReplicator(follower{applyAll{leader, other}})
+
+	cfg := CollectionConfig{TTLField: "Expires"}
+	for _, d := range []*Driver{leader, other} {
+		if err := d.ConfigureCollection("sessions", cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	past := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano)
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339Nano)
+	for name, expires := range map[string]string{"old": past, "new": future} {
+		if err := leader.Write("sessions", name, map[string]string{"Expires": expires}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := other.Watch(ctx, "sessions", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := other.Expire("sessions"); err != nil || n != 0 {
+		t.Errorf("expiry on a follower = %d, %v; want 0", n, err)
+	}
+	if n, err := leader.Expire("sessions"); err != nil || n != 1 {
+		t.Errorf("expiry on the leader = %d, %v; want 1", n, err)
+	}
+	sameCollection(t, leader, other, "sessions")
+
+	select {
+	case e := <-events:
+		if e.Op != OpExpire || e.Resource != "old" {
+			t.Errorf("event on the follower = %s %s, want expire old", e.Op, e.Resource)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("No event on the follower")
+	}
+}
+
+func TestReplicatedArchive(t *testing.T) {
+	leader, leaderDir := openTest(t, nil)
+	other, _ := openTest(t, nil)
+	leader.SetReplicator(applyAll{leader, other})
+	other.SetReplicator(follower{applyAll{leader, other}})
+
+	for _, name := range []string{"a", "b"} {
+		if err := leader.Write("orders", name, map[string]string{"Name": name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ageRecords(t, leaderDir, "orders", "a")
+
+	if n, err := other.Archive("orders", time.Nanosecond); err != nil || n != 0 {
+		t.Errorf("archiving on a follower = %d, %v; want 0", n, err)
+	}
+	if n, err := leader.Archive("orders", time.Minute); err != nil || n != 1 {
+		t.Errorf("archiving on the leader = %d, %v; want 1", n, err)
+	}
+	sameCollection(t, leader, other, "orders")
+	var a map[string]string
+	if err := other.ReadArchived("orders", "a", &a); err != nil || a["Name"] != "a" {
+		t.Errorf("archived on the follower: %v, %v", a, err)
+	}
+}
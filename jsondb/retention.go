@@ -0,0 +1,220 @@
+package jsondb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetentionPolicy bounds what a log-like collection keeps: records beyond
+// the MaxRecords most recently written, and records last written more than
+// MaxAge ago, are purged by the "retention-<collection>" job, on Schedule
+// ("@hourly" by default). Records written meanwhile are kept until the
+// next run.
+type RetentionPolicy struct {
+	MaxRecords int    `json:",omitempty"`
+	MaxAge     string `json:",omitempty"`
+
+	// Archive moves purged records to the archive instead of deleting
+	// them; see Archive.
+	Archive bool `json:",omitempty"`
+
+	Schedule string `json:",omitempty"`
+}
+
+func (p *RetentionPolicy) validate() error {
+	if p.MaxRecords < 0 {
+		return fmt.Errorf("Retention MaxRecords must not be negative")
+	}
+	if p.MaxAge != "" {
+		if age, err := ParseAge(p.MaxAge); err != nil || age <= 0 {
+			return fmt.Errorf("Invalid retention MaxAge '%s'", p.MaxAge)
+		}
+	}
+	if p.MaxRecords == 0 && p.MaxAge == "" {
+		return fmt.Errorf("Retention needs MaxRecords or MaxAge")
+	}
+	if p.Schedule != "" {
+		if _, err := ParseSchedule(p.Schedule); err != nil {
+			return fmt.Errorf("Invalid retention schedule: %v", err)
+		}
+	}
+	return nil
+}
+
+// RetentionStats counts what the retention policy of a collection purged
+// since the database was opened.
+type RetentionStats struct {
+	Runs     int64
+	Deleted  int64
+	Archived int64
+	LastRun  time.Time `json:",omitempty"`
+	LastErr  string    `json:",omitempty"`
+}
+
+// retentionState holds the RetentionStats of the collections, shared by
+// the copies of a driver.
+type retentionState struct {
+	mutex sync.Mutex
+	stats map[string]*RetentionStats
+}
+
+func retentionJob(collection string) string {
+	return "retention-" + collection
+}
+
+// scheduleRetention registers the retention job of collection when its
+// configuration has a policy, and unregisters it otherwise.
+func (d *Driver) scheduleRetention(collection string, cfg *CollectionConfig) error {
+	job := retentionJob(collection)
+	if cfg == nil || cfg.Retention == nil {
+		d.scheduler.Unregister(job)
+		return nil
+	}
+
+	schedule := cfg.Retention.Schedule
+	if schedule == "" {
+		schedule = "@hourly"
+	}
+	return d.scheduler.Register(job, schedule, func() error {
+		_, err := d.EnforceRetention(collection)
+		return err
+	})
+}
+
+// EnforceRetention purges, now, the records of collection its retention
+// policy does not keep, deleting or archiving them, and returns how many
+// it purged. A collection without a policy is left alone. With a
+// replicator the purges are replicated, and only made by its leader.
+func (d *Driver) EnforceRetention(collection string) (n int, err error) {
+	d, span := d.trace("EnforceRetention", collection, "")
+	defer span.end(&err)
+
+	cfg := d.collectionConfig(collection)
+	if cfg == nil || cfg.Retention == nil {
+		return 0, nil
+	}
+	p := cfg.Retention
+
+	r := d.replicator()
+	if r != nil && !sweeps(r) {
+		return 0, nil
+	}
+
+	defer func() { d.countRetention(collection, p.Archive, n, err) }()
+
+	unlock, err := d.lockCollection(collection, LockWrite)
+	if err != nil {
+		return 0, err
+	}
+	purged, err := d.retentionPurges(collection, p)
+	if err != nil || len(purged) == 0 {
+		unlock()
+		return 0, err
+	}
+
+	if r != nil {
+		expect, err := d.expectations(collection, purged)
+		unlock()
+		if err != nil {
+			return 0, err
+		}
+		if p.Archive {
+			return d.replicateArchive(r, collection, expect)
+		}
+		if n, err = d.replicateRemovals(r, OpDelete, collection, expect); err == nil {
+			d.log.Info("Retention deleted %d records of '%s'\n", n, collection)
+		}
+		return n, err
+	}
+	defer unlock()
+
+	if p.Archive {
+		return d.archiveRecords(collection, purged)
+	}
+	for _, resource := range purged {
+		if err := d.remove(collection, resource); err != nil {
+			return n, err
+		}
+		n++
+	}
+	d.log.Info("Retention deleted %d records of '%s'\n", n, collection)
+	return n, nil
+}
+
+// retentionPurges returns the records of collection p does not keep, in
+// name order. The caller holds the collection lock.
+func (d *Driver) retentionPurges(collection string, p *RetentionPolicy) ([]string, error) {
+	files, err := d.backend.ReadDir(filepath.Join(d.dir, collection))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []os.FileInfo
+	for _, file := range files {
+		if isRecord(file) {
+			records = append(records, file)
+		}
+	}
+	// Newest first, so the records kept come first.
+	sort.SliceStable(records, func(i, j int) bool { return records[i].ModTime().After(records[j].ModTime()) })
+
+	var cutoff time.Time
+	if p.MaxAge != "" {
+		maxAge, _ := ParseAge(p.MaxAge) // checked when the config was set
+		cutoff = time.Now().Add(-maxAge)
+	}
+
+	var purged []string
+	for i, file := range records {
+		if (p.MaxRecords > 0 && i >= p.MaxRecords) || file.ModTime().Before(cutoff) {
+			purged = append(purged, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+	sort.Strings(purged)
+	return purged, nil
+}
+
+func (d *Driver) countRetention(collection string, archive bool, n int, err error) {
+	r := d.retention
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	st, ok := r.stats[collection]
+	if !ok {
+		st = &RetentionStats{}
+		r.stats[collection] = st
+	}
+	st.Runs++
+	if archive {
+		st.Archived += int64(n)
+	} else {
+		st.Deleted += int64(n)
+	}
+	st.LastRun = time.Now().UTC()
+	st.LastErr = ""
+	if err != nil {
+		st.LastErr = err.Error()
+	}
+}
+
+// RetentionStats returns what retention purged, by collection, since the
+// database was opened.
+func (d *Driver) RetentionStats() map[string]RetentionStats {
+	r := d.retention
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stats := make(map[string]RetentionStats, len(r.stats))
+	for collection, st := range r.stats {
+		stats[collection] = *st
+	}
+	return stats
+}
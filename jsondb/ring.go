@@ -0,0 +1,101 @@
+package jsondb
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// RingConfig describes how records are partitioned over several nodes by
+// consistent hashing: each node owns the keys hashing between its points
+// on a ring and the previous ones, so adding or removing a node only moves
+// the keys next to its points.
+type RingConfig struct {
+	// Nodes are the base URLs of the nodes, such as "http://db1:3000".
+	Nodes []string
+
+	// VirtualNodes is the number of points of each node on the ring; more
+	// spread keys more evenly. 64 by default.
+	VirtualNodes int
+
+	// Colocate lists collections kept whole on one node, chosen by the
+	// collection name, so they can be listed and queried on it.
+	Colocate []string
+}
+
+// Ring assigns records to the nodes of a RingConfig.
+type Ring struct {
+	points   []ringPoint
+	nodes    []string
+	colocate map[string]bool
+}
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+// NewRing builds the ring of cfg.
+func NewRing(cfg RingConfig) (*Ring, error) {
+	if len(cfg.Nodes) == 0 {
+		return nil, fmt.Errorf("Ring has no nodes")
+	}
+	vnodes := cfg.VirtualNodes
+	if vnodes <= 0 {
+		vnodes = 64
+	}
+
+	r := &Ring{colocate: make(map[string]bool)}
+	seen := make(map[string]bool)
+	for _, node := range cfg.Nodes {
+		if node == "" || seen[node] {
+			return nil, fmt.Errorf("Ring node '%s' is empty or listed twice", node)
+		}
+		seen[node] = true
+		r.nodes = append(r.nodes, node)
+
+		for i := 0; i < vnodes; i++ {
+			r.points = append(r.points, ringPoint{ringHash(node + "#" + strconv.Itoa(i)), node})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+
+	for _, collection := range cfg.Colocate {
+		r.colocate[collection] = true
+	}
+	return r, nil
+}
+
+// ringHash places s on the ring. Node names differ in a few characters,
+// so it takes a hash whose every bit depends on every input byte.
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Nodes returns the nodes of the ring in configuration order.
+func (r *Ring) Nodes() []string {
+	return append([]string(nil), r.nodes...)
+}
+
+// Owner returns the node owning the record resource of collection.
+func (r *Ring) Owner(collection, resource string) string {
+	key := collection + "/" + resource
+	if r.colocate[collection] {
+		key = collection
+	}
+
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// Colocated reports whether collection is kept whole on one node.
+func (r *Ring) Colocated(collection string) bool {
+	return r.colocate[collection]
+}
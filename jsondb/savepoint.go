@@ -0,0 +1,102 @@
+package jsondb
+
+import "fmt"
+
+// ErrNoSavepoint is returned by RollbackTo and Release for a savepoint the
+// transaction does not have.
+var ErrNoSavepoint = fmt.Errorf("No such savepoint")
+
+// savepoint marks the changes of a transaction at one point: how many it
+// had and how many of them had been replaced since the first savepoint.
+type savepoint struct {
+	name     string
+	ops      int
+	replaced int
+}
+
+// replacedOp is a change a later one to the same record replaced.
+type replacedOp struct {
+	i  int
+	op txOp
+}
+
+// Savepoint marks the changes made so far, so RollbackTo can drop those
+// made after it while keeping the transaction going. A name used again
+// marks a new savepoint; RollbackTo and Release take the latest.
+func (tx *Tx) Savepoint(name string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.savepoints = append(tx.savepoints, savepoint{name: name, ops: len(tx.ops), replaced: len(tx.replaced)})
+	return nil
+}
+
+// RollbackTo drops the changes made since the savepoint name, and the
+// savepoints set after it. The savepoint itself remains.
+func (tx *Tx) RollbackTo(name string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	i := tx.savepointIndex(name)
+	if i < 0 {
+		return ErrNoSavepoint
+	}
+	sp := tx.savepoints[i]
+
+	for j := len(tx.replaced) - 1; j >= sp.replaced; j-- {
+		r := tx.replaced[j]
+		tx.ops[r.i] = r.op
+	}
+	tx.replaced = tx.replaced[:sp.replaced]
+
+	for _, op := range tx.ops[sp.ops:] {
+		delete(tx.at, op.Collection+"\x00"+op.Resource)
+	}
+	tx.ops = tx.ops[:sp.ops]
+	tx.savepoints = tx.savepoints[:i+1]
+	return nil
+}
+
+// Release forgets the savepoint name and those set after it, keeping the
+// changes made since.
+func (tx *Tx) Release(name string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	i := tx.savepointIndex(name)
+	if i < 0 {
+		return ErrNoSavepoint
+	}
+	tx.savepoints = tx.savepoints[:i]
+	if len(tx.savepoints) == 0 {
+		tx.replaced = nil
+	}
+	return nil
+}
+
+// Nested runs fn as a transaction nested in tx: the changes fn makes are
+// kept when it succeeds and dropped when it fails, leaving those made
+// before, and tx, as they were. It returns the error of fn.
+func (tx *Tx) Nested(fn func(tx *Tx) error) error {
+	name := fmt.Sprintf("nested-%d", len(tx.savepoints))
+	if err := tx.Savepoint(name); err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		if rerr := tx.RollbackTo(name); rerr != nil {
+			return rerr
+		}
+		tx.Release(name)
+		return err
+	}
+	return tx.Release(name)
+}
+
+func (tx *Tx) savepointIndex(name string) int {
+	for i := len(tx.savepoints) - 1; i >= 0; i-- {
+		if tx.savepoints[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,140 @@
+package jsondb
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+// committed commits tx and returns those of the users names that exist then.
+func committed(t *testing.T, db *Driver, tx *Tx, names ...string) map[string]person {
+	t.Helper()
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]person)
+	for _, name := range names {
+		var p person
+		err := db.Read("users", name, &p)
+		if err == nil {
+			got[name] = p
+		} else if !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+	}
+	return got
+}
+
+func TestSavepoint(t *testing.T) {
+	db, _ := openTest(t, nil)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx.Write("users", "ann", person{Name: "Ann", Age: 30})
+	if err := tx.Savepoint("a"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Write("users", "ann", person{Name: "Ann", Age: 31})
+	tx.Write("users", "bob", person{Name: "Bob"})
+	if err := tx.Savepoint("b"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Write("users", "cat", person{Name: "Cat"})
+
+	if err := tx.RollbackTo("a"); err != nil {
+		t.Fatal(err)
+	}
+	var p person
+	if err := tx.Read("users", "ann", &p); err != nil || p.Age != 30 {
+		t.Errorf("ann after RollbackTo = %+v, %v, want age 30", p, err)
+	}
+	if err := tx.RollbackTo("b"); err != ErrNoSavepoint {
+		t.Errorf("RollbackTo a savepoint set after the one rolled back to: %v, want ErrNoSavepoint", err)
+	}
+
+	// The savepoint remains, for another try.
+	tx.Write("users", "dan", person{Name: "Dan"})
+	if err := tx.RollbackTo("a"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Write("users", "eve", person{Name: "Eve"})
+
+	got := committed(t, db, tx, "ann", "bob", "cat", "dan", "eve")
+	if len(got) != 2 || got["ann"].Age != 30 || got["eve"].Name != "Eve" {
+		t.Errorf("committed %+v, want ann aged 30 and eve", got)
+	}
+}
+
+func TestSavepointRelease(t *testing.T) {
+	db, _ := openTest(t, nil)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tx.Savepoint("a"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Write("users", "ann", person{Name: "Ann"})
+	if err := tx.Release("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.RollbackTo("a"); err != ErrNoSavepoint {
+		t.Errorf("RollbackTo a released savepoint: %v, want ErrNoSavepoint", err)
+	}
+	if err := tx.Release("a"); err != ErrNoSavepoint {
+		t.Errorf("Release of a released savepoint: %v, want ErrNoSavepoint", err)
+	}
+
+	got := committed(t, db, tx, "ann")
+	if _, ok := got["ann"]; !ok {
+		t.Errorf("committed %+v, want the change made before Release", got)
+	}
+	if err := tx.Savepoint("b"); err != ErrTxDone {
+		t.Errorf("Savepoint after commit: %v, want ErrTxDone", err)
+	}
+}
+
+func TestNested(t *testing.T) {
+	db, _ := openTest(t, nil)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Write("users", "ann", person{Name: "Ann", Age: 30})
+
+	failed := errors.New("failed")
+	err = tx.Nested(func(tx *Tx) error {
+		tx.Write("users", "ann", person{Name: "Ann", Age: 99})
+		tx.Write("users", "bob", person{Name: "Bob"})
+		return failed
+	})
+	if err != failed {
+		t.Errorf("Nested = %v, want the error of fn", err)
+	}
+
+	err = tx.Nested(func(tx *Tx) error {
+		tx.Write("users", "cat", person{Name: "Cat"})
+
+		// A failed transaction nested in it drops only its own changes.
+		tx.Nested(func(tx *Tx) error {
+			tx.Write("users", "cat", person{Name: "Cat", Age: 99})
+			tx.Delete("users", "ann")
+			return failed
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.savepoints) != 0 {
+		t.Errorf("Nested left savepoints %+v", tx.savepoints)
+	}
+
+	got := committed(t, db, tx, "ann", "bob", "cat")
+	if len(got) != 2 || got["ann"].Age != 30 || got["cat"].Age != 0 {
+		t.Errorf("committed %+v, want ann aged 30 and cat", got)
+	}
+}
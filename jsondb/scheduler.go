@@ -0,0 +1,262 @@
+package jsondb
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// jobsCollection is the system collection holding the run history of
+// scheduled jobs.
+const jobsCollection = "jobs"
+
+// jobHistoryLimit is how many past runs are kept per job.
+const jobHistoryLimit = 50
+
+// JobFunc is the work done by a scheduled job.
+type JobFunc func() error
+
+// JobInfo describes a registered job.
+type JobInfo struct {
+	Name     string
+	Schedule string
+	Running  bool
+	NextRun  time.Time
+	LastRun  *JobRun `json:",omitempty"`
+}
+
+// JobRun is one persisted execution of a job.
+type JobRun struct {
+	Job      string
+	Started  time.Time
+	Finished time.Time
+	Duration string
+	Error    string `json:",omitempty"`
+}
+
+type job struct {
+	name     string
+	spec     string
+	schedule Schedule
+	fn       JobFunc
+	next     time.Time
+	running  bool
+	last     *JobRun
+}
+
+// Scheduler runs registered jobs on cron-style schedules and records each
+// run in the "jobs" system collection.
+type Scheduler struct {
+	db *Driver
+
+	mutex     sync.Mutex
+	jobs      map[string]*job
+	overrides map[string]string
+	started   bool
+	stop      chan struct{}
+}
+
+func newScheduler(db *Driver) *Scheduler {
+	return &Scheduler{
+		db:        db,
+		jobs:      make(map[string]*job),
+		overrides: make(map[string]string),
+	}
+}
+
+// Scheduler returns the job scheduler of the driver.
+func (d *Driver) Scheduler() *Scheduler {
+	return d.scheduler
+}
+
+// Register adds or replaces a job running fn on spec (see ParseSchedule).
+// A schedule configured with SetSchedule takes precedence over spec.
+// The scheduler starts with the first registered job.
+func (s *Scheduler) Register(name, spec string, fn JobFunc) error {
+	if name == "" {
+		return fmt.Errorf("Missing job name!")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if override, ok := s.overrides[name]; ok {
+		spec = override
+	}
+
+	schedule, err := ParseSchedule(spec)
+	if err != nil {
+		return err
+	}
+
+	j := &job{name: name, spec: spec, schedule: schedule, fn: fn}
+	j.next = schedule.Next(time.Now())
+
+	if old, ok := s.jobs[name]; ok {
+		j.last = old.last
+	}
+	s.jobs[name] = j
+
+	if !s.started {
+		s.started = true
+		s.stop = make(chan struct{})
+		go s.loop(s.stop)
+	}
+	return nil
+}
+
+// Unregister removes a job. A run in progress is allowed to finish.
+func (s *Scheduler) Unregister(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.jobs, name)
+}
+
+// SetSchedule overrides the schedule of a job, whether or not it is
+// registered yet. This is how schedules from the server config are applied.
+func (s *Scheduler) SetSchedule(name, spec string) error {
+	schedule, err := ParseSchedule(spec)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.overrides[name] = spec
+	if j, ok := s.jobs[name]; ok {
+		j.spec, j.schedule = spec, schedule
+		j.next = schedule.Next(time.Now())
+	}
+	return nil
+}
+
+// Jobs lists the registered jobs by name.
+func (s *Scheduler) Jobs() []JobInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	infos := make([]JobInfo, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		infos = append(infos, JobInfo{
+			Name:     j.name,
+			Schedule: j.spec,
+			Running:  j.running,
+			NextRun:  j.next,
+			LastRun:  j.last,
+		})
+	}
+
+	sort.Slice(infos, func(i, k int) bool { return infos[i].Name < infos[k].Name })
+	return infos
+}
+
+// RunNow starts the named job immediately, outside its schedule.
+func (s *Scheduler) RunNow(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	j, ok := s.jobs[name]
+	if !ok {
+		return fmt.Errorf("Unknown job '%s'", name)
+	}
+	if j.running {
+		return fmt.Errorf("Job '%s' is already running", name)
+	}
+
+	s.start(j)
+	return nil
+}
+
+// History returns the persisted runs of the named job, oldest first.
+func (s *Scheduler) History(name string) ([]JobRun, error) {
+	docs, err := s.db.System().Query(jobsCollection, Query{Where: []Condition{{Field: "Job", Value: name}}})
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make([]JobRun, 0, len(docs))
+	for _, doc := range docs {
+		var run JobRun
+		if err := FromGeneric(doc.Data, &run); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+// Stop halts the scheduler; jobs already running are not interrupted.
+func (s *Scheduler) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.started {
+		close(s.stop)
+		s.started = false
+	}
+}
+
+func (s *Scheduler) loop(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			s.mutex.Lock()
+			for _, j := range s.jobs {
+				if !j.running && !j.next.IsZero() && !now.Before(j.next) {
+					s.start(j)
+				}
+			}
+			s.mutex.Unlock()
+		}
+	}
+}
+
+// start runs j in the background. The caller holds the scheduler mutex.
+func (s *Scheduler) start(j *job) {
+	j.running = true
+	j.next = j.schedule.Next(time.Now())
+
+	go func() {
+		run := JobRun{Job: j.name, Started: time.Now().UTC()}
+
+		if err := j.fn(); err != nil {
+			run.Error = err.Error()
+			s.db.log.Error("Job '%s' failed: %v\n", j.name, err)
+		}
+
+		run.Finished = time.Now().UTC()
+		run.Duration = run.Finished.Sub(run.Started).String()
+
+		s.mutex.Lock()
+		j.running = false
+		j.last = &run
+		s.mutex.Unlock()
+
+		s.record(run)
+	}()
+}
+
+// record persists run and trims the job's history to jobHistoryLimit.
+func (s *Scheduler) record(run JobRun) {
+	resource := fmt.Sprintf("%s-%d", run.Job, run.Started.UnixNano())
+	if err := s.db.System().Write(jobsCollection, resource, run); err != nil {
+		s.db.log.Error("Unable to record run of job '%s': %v\n", run.Job, err)
+		return
+	}
+
+	docs, err := s.db.System().Query(jobsCollection, Query{Where: []Condition{{Field: "Job", Value: run.Job}}})
+	if err != nil {
+		return
+	}
+
+	for i := 0; i < len(docs)-jobHistoryLimit; i++ {
+		s.db.System().Delete(jobsCollection, docs[i].Resource)
+	}
+}
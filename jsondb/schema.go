@@ -0,0 +1,198 @@
+package jsondb
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+)
+
+// schemaExamples is how many distinct example values a FieldSchema keeps.
+const schemaExamples = 3
+
+// SchemaReport describes the fields the records of a collection have, as
+// InferSchema found them.
+type SchemaReport struct {
+	Collection string
+
+	// Records is how many records were read; Sampled is set when they are
+	// a sample of the collection, of Total records.
+	Records int
+	Total   int
+	Sampled bool `json:",omitempty"`
+
+	// Fields are sorted by path.
+	Fields []FieldSchema
+}
+
+// FieldSchema describes a field of the records of a collection, by dotted
+// path; the elements of arrays are at the path of the array with "[]",
+// such as "Tags[]" or "Items[].SKU".
+type FieldSchema struct {
+	Path string
+
+	// Types counts the values of the field by JSON type: string, integer,
+	// number (with a fraction or exponent), boolean, object, array and
+	// null.
+	Types map[string]int
+
+	// Records is how many records have the field, null or not; Coverage
+	// is their share of the records read.
+	Records  int
+	Coverage float64
+
+	// Nullable is set when the field is null, or missing, in some records.
+	Nullable bool
+
+	// Examples are a few distinct scalar values of the field, long
+	// strings cut.
+	Examples []interface{} `json:",omitempty"`
+}
+
+// InferSchema reads every record of collection and reports the fields
+// they have, with their types, coverage and example values, such as to
+// write the Rules of a heterogeneous collection or plan a migration.
+func (d *Driver) InferSchema(collection string) (SchemaReport, error) {
+	return d.InferSchemaSample(collection, 0)
+}
+
+// InferSchemaSample is InferSchema reading a random sample of n records at
+// most, every record when n is zero.
+func (d *Driver) InferSchemaSample(collection string, n int) (_ SchemaReport, err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("InferSchema", collection, "")
+	defer span.end(&err)
+
+	if err := d.allow(PolicyRead, collection); err != nil {
+		return SchemaReport{}, err
+	}
+	if collection == "" {
+		return SchemaReport{}, fmt.Errorf("Missing collection - unable to read")
+	}
+
+	unlock, err := d.lockCollection(collection, LockRead)
+	if err != nil {
+		return SchemaReport{}, err
+	}
+	defer unlock()
+
+	// Reservoir sampling keeps n records picked evenly as the scan goes.
+	report := SchemaReport{Collection: collection}
+	var docs []map[string]interface{}
+	err = d.scan(collection, func(resource string, b []byte) error {
+		doc, err := decodeDocument(b)
+		if err != nil {
+			return fmt.Errorf("Error decoding '%s/%s': %v", collection, resource, err)
+		}
+		report.Total++
+		switch {
+		case n <= 0 || len(docs) < n:
+			docs = append(docs, doc)
+		default:
+			if i := rand.Intn(report.Total); i < n {
+				docs[i] = doc
+			}
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return SchemaReport{}, err
+	}
+
+	fields := make(map[string]*FieldSchema)
+	for _, doc := range docs {
+		seen := make(map[string]bool)
+		inferFields(fields, seen, "", doc)
+		for path := range seen {
+			fields[path].Records++
+		}
+	}
+
+	report.Records = len(docs)
+	report.Sampled = report.Records < report.Total
+	report.Fields = make([]FieldSchema, 0, len(fields))
+	for _, f := range fields {
+		f.Coverage = float64(f.Records) / float64(report.Records)
+		f.Nullable = f.Nullable || f.Records < report.Records
+		report.Fields = append(report.Fields, *f)
+	}
+	sort.Slice(report.Fields, func(i, j int) bool { return report.Fields[i].Path < report.Fields[j].Path })
+	return report, nil
+}
+
+// inferFields counts the fields of doc, whose paths start with prefix,
+// into fields, marking those it has in seen.
+func inferFields(fields map[string]*FieldSchema, seen map[string]bool, prefix string, doc map[string]interface{}) {
+	for name, v := range doc {
+		inferValue(fields, seen, prefix+name, v)
+	}
+}
+
+func inferValue(fields map[string]*FieldSchema, seen map[string]bool, path string, v interface{}) {
+	f, ok := fields[path]
+	if !ok {
+		f = &FieldSchema{Path: path, Types: make(map[string]int)}
+		fields[path] = f
+	}
+	seen[path] = true
+
+	kind := jsonType(v)
+	f.Types[kind]++
+	switch t := v.(type) {
+	case nil:
+		f.Nullable = true
+	case map[string]interface{}:
+		inferFields(fields, seen, path+".", t)
+	case []interface{}:
+		for _, e := range t {
+			inferValue(fields, seen, path+"[]", e)
+		}
+	default:
+		f.addExample(v)
+	}
+}
+
+// addExample keeps v as an example, unless the field has enough or has it.
+func (f *FieldSchema) addExample(v interface{}) {
+	if len(f.Examples) >= schemaExamples {
+		return
+	}
+	if s, ok := v.(string); ok {
+		if r := []rune(s); len(r) > 64 {
+			v = string(r[:61]) + "..."
+		}
+	}
+	b, _ := json.Marshal(v)
+	for _, e := range f.Examples {
+		if other, _ := json.Marshal(e); string(other) == string(b) {
+			return
+		}
+	}
+	f.Examples = append(f.Examples, v)
+}
+
+// jsonType returns the JSON type of a decoded value.
+func jsonType(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if strings.ContainsAny(t.String(), ".eE") {
+			return "number"
+		}
+		return "integer"
+	case float64, float32:
+		return "number"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	return "integer"
+}
@@ -0,0 +1,152 @@
+package jsondb
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Validator is a check, written in the manifest of a collection, that
+// every record written must pass. Expr is a text/template pipeline, without
+// the braces, run on the record; the record is valid when it evaluates to
+// true:
+//
+//	and (has . "Email") (matches .Email "@example\\.com$")
+//	or (eq .Status "draft") (gt (len .Items) 0)
+//
+// Expressions call the functions of computed fields and num, add, sub,
+// mul, div, has and matches, which takes an RE2 expression; eq, ne, lt,
+// le, gt and ge compare numbers of any type, and strings, as query
+// conditions do. A field the expression names directly and the record
+// lacks fails the check; get and has do not.
+// Changing the manifest changes the checks of the next writes, with no
+// restart.
+type Validator struct {
+	Name string
+	Expr string
+
+	// Message is the reason given when the check fails, instead of the
+	// name and expression.
+	Message string `json:",omitempty"`
+}
+
+// scriptFuncs are the functions computed fields and validators can call.
+var scriptFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+	"get": func(doc map[string]interface{}, path string) interface{} {
+		if v, ok := lookup(doc, path); ok && v != nil {
+			return v
+		}
+		return ""
+	},
+	"has": func(doc map[string]interface{}, path string) bool {
+		v, ok := lookup(doc, path)
+		return ok && v != nil
+	},
+	"matches": func(v interface{}, expr string) (bool, error) {
+		p, err := compilePattern(OpMatches, expr, false)
+		if err != nil {
+			return false, err
+		}
+		return p.re.MatchString(fmt.Sprint(v)), nil
+	},
+	"num": func(v interface{}) (float64, error) {
+		if f, ok := toFloat(v); ok {
+			return f, nil
+		}
+		return 0, fmt.Errorf("%v is not a number", v)
+	},
+	"add": arithmetic(func(x, y float64) float64 { return x + y }),
+	"sub": arithmetic(func(x, y float64) float64 { return x - y }),
+	"mul": arithmetic(func(x, y float64) float64 { return x * y }),
+	"div": func(a, b interface{}) (float64, error) {
+		x, y, err := operands(a, b)
+		if err == nil && y == 0 {
+			err = fmt.Errorf("division by zero")
+		}
+		if err != nil {
+			return 0, err
+		}
+		return x / y, nil
+	},
+	"eq": comparison(func(c int) bool { return c == 0 }),
+	"ne": comparison(func(c int) bool { return c != 0 }),
+	"lt": comparison(func(c int) bool { return c < 0 }),
+	"le": comparison(func(c int) bool { return c <= 0 }),
+	"gt": comparison(func(c int) bool { return c > 0 }),
+	"ge": comparison(func(c int) bool { return c >= 0 }),
+}
+
+func arithmetic(op func(x, y float64) float64) func(a, b interface{}) (float64, error) {
+	return func(a, b interface{}) (float64, error) {
+		x, y, err := operands(a, b)
+		if err != nil {
+			return 0, err
+		}
+		return op(x, y), nil
+	}
+}
+
+func operands(a, b interface{}) (float64, float64, error) {
+	x, ok := toFloat(a)
+	if !ok {
+		return 0, 0, fmt.Errorf("%v is not a number", a)
+	}
+	y, ok := toFloat(b)
+	if !ok {
+		return 0, 0, fmt.Errorf("%v is not a number", b)
+	}
+	return x, y, nil
+}
+
+func comparison(holds func(c int) bool) func(a, b interface{}) bool {
+	return func(a, b interface{}) bool {
+		return holds(compare(a, b))
+	}
+}
+
+// scriptTemplates caches parsed templates by their text.
+var scriptTemplates sync.Map
+
+func parseScript(text string) (*template.Template, error) {
+	if t, ok := scriptTemplates.Load(text); ok {
+		return t.(*template.Template), nil
+	}
+	t, err := template.New("script").Funcs(scriptFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	scriptTemplates.Store(text, t)
+	return t, nil
+}
+
+func (v Validator) template() (*template.Template, error) {
+	return parseScript("{{" + v.Expr + "}}")
+}
+
+// passes runs v on doc.
+func (v Validator) passes(resource string, doc map[string]interface{}) error {
+	t, err := v.template()
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	err = t.Execute(&out, doc)
+	if err == nil && strings.TrimSpace(out.String()) == "true" {
+		return nil
+	}
+
+	reason := v.Message
+	if reason == "" {
+		reason = fmt.Sprintf("validator '%s' (%s) failed", v.Name, v.Expr)
+	}
+	if err != nil {
+		reason = fmt.Sprintf("%s: %v", reason, err)
+	}
+	return &ConstraintError{resource, reason}
+}
@@ -0,0 +1,380 @@
+package jsondb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// snapshotState keeps, while snapshots are open, the records that changes
+// replace, so each snapshot reads the database as of when it was taken.
+// Changes are numbered in groups applied together, such as the changes of
+// a transaction: a snapshot sees all of a group or none of it. It is
+// shared by the copies of a driver.
+type snapshotState struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	clock   uint64
+	active  map[*snapshot]bool
+	pending map[uint64]bool
+	before  map[string][]preimage // by record, oldest first
+}
+
+// preimage is a record as it was before the change group seq.
+type preimage struct {
+	seq    uint64
+	data   []byte
+	exists bool
+}
+
+func newSnapshotState() *snapshotState {
+	st := &snapshotState{active: make(map[*snapshot]bool), pending: make(map[uint64]bool), before: make(map[string][]preimage)}
+	st.cond = sync.NewCond(&st.mutex)
+	return st
+}
+
+func recordKey(collection, resource string) string {
+	return collection + "\x00" + resource
+}
+
+// changeGroup is a group of changes being applied.
+type changeGroup struct {
+	st       *snapshotState
+	seq      uint64
+	need     bool // some snapshot needs the records the group replaces
+	recorded map[string]bool
+}
+
+// begin starts a change group; on a nil state it returns a nil group, on
+// which every method does nothing.
+func (st *snapshotState) begin() *changeGroup {
+	if st == nil {
+		return nil
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	st.clock++
+	st.pending[st.clock] = true
+	return &changeGroup{st: st, seq: st.clock, need: len(st.active) > 0, recorded: make(map[string]bool)}
+}
+
+// needed reports whether the group has to record what it replaces.
+func (g *changeGroup) needed() bool {
+	return g != nil && g.need
+}
+
+// record keeps the record collection/resource as it is before the group
+// first changes it: data when it exists. Callers record before writing.
+func (g *changeGroup) record(collection, resource string, data []byte, exists bool) {
+	if !g.needed() {
+		return
+	}
+	key := recordKey(collection, resource)
+
+	g.st.mutex.Lock()
+	defer g.st.mutex.Unlock()
+	if g.recorded[key] {
+		return
+	}
+	g.recorded[key] = true
+	g.st.before[key] = append(g.st.before[key], preimage{seq: g.seq, data: data, exists: exists})
+}
+
+// recordCollection records every record of collection and of the
+// collections nested in it, before they are deleted together.
+func (d *Driver) recordCollection(g *changeGroup, collection string) {
+	if !g.needed() {
+		return
+	}
+	files, err := d.backend.ReadDir(filepath.Join(d.dir, collection))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			d.recordCollection(g, collection+"/"+file.Name())
+			continue
+		}
+		if !isRecord(file) {
+			continue
+		}
+		resource := strings.TrimSuffix(file.Name(), ".json")
+		if b, err := d.backend.ReadFile(filepath.Join(d.dir, collection, file.Name())); err == nil {
+			g.record(collection, resource, b, true)
+		}
+	}
+}
+
+// end marks the group applied.
+func (g *changeGroup) end() {
+	if g == nil {
+		return
+	}
+	g.st.mutex.Lock()
+	defer g.st.mutex.Unlock()
+	delete(g.st.pending, g.seq)
+	g.st.cond.Broadcast()
+}
+
+// changes returns the change group the writes of d belong to, and the
+// function ending it: a group of their own unless d applies a
+// transaction.
+func (d *Driver) changes() (*changeGroup, func()) {
+	if d.group != nil {
+		return d.group, func() {}
+	}
+	g := d.snaps.begin()
+	return g, g.end
+}
+
+// snapshot is the database as of a change group: reads through it see the
+// changes of the groups up to start, and none of the later ones.
+type snapshot struct {
+	st    *snapshotState
+	start uint64
+}
+
+// open takes a snapshot of the database as it is now. Groups still being
+// applied count as done: open waits for them.
+func (st *snapshotState) open() *snapshot {
+	if st == nil {
+		return nil
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	s := &snapshot{st: st, start: st.clock}
+	st.active[s] = true
+	for st.applying(s.start) {
+		st.cond.Wait()
+	}
+	return s
+}
+
+// applying reports whether a group up to seq is being applied.
+func (st *snapshotState) applying(seq uint64) bool {
+	for pending := range st.pending {
+		if pending <= seq {
+			return true
+		}
+	}
+	return false
+}
+
+// close releases s, dropping the records no open snapshot needs.
+func (s *snapshot) close() {
+	if s == nil {
+		return
+	}
+	st := s.st
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	delete(st.active, s)
+	if len(st.active) == 0 {
+		st.before = make(map[string][]preimage)
+		return
+	}
+
+	oldest := st.clock
+	for a := range st.active {
+		if a.start < oldest {
+			oldest = a.start
+		}
+	}
+	for key, images := range st.before {
+		i := sort.Search(len(images), func(i int) bool { return images[i].seq > oldest })
+		if i == len(images) {
+			delete(st.before, key)
+		} else {
+			st.before[key] = images[i:]
+		}
+	}
+}
+
+// replaced returns the record collection/resource as of s when a later
+// change replaced it. Callers read the current record first, then ask:
+// a change landing in between was recorded before it was written.
+func (s *snapshot) replaced(collection, resource string) (preimage, bool) {
+	if s == nil {
+		return preimage{}, false
+	}
+	s.st.mutex.Lock()
+	defer s.st.mutex.Unlock()
+	return s.find(s.st.before[recordKey(collection, resource)])
+}
+
+// replacedIn returns the records of collection later changes replaced, as
+// of s, by resource.
+func (s *snapshot) replacedIn(collection string) map[string]preimage {
+	found := make(map[string]preimage)
+	if s == nil {
+		return found
+	}
+	prefix := collection + "\x00"
+
+	s.st.mutex.Lock()
+	defer s.st.mutex.Unlock()
+	for key, images := range s.st.before {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if image, ok := s.find(images); ok {
+			found[strings.TrimPrefix(key, prefix)] = image
+		}
+	}
+	return found
+}
+
+// find returns the first of images recorded after s was taken.
+func (s *snapshot) find(images []preimage) (preimage, bool) {
+	for _, image := range images {
+		if image.seq > s.start {
+			return image, true
+		}
+	}
+	return preimage{}, false
+}
+
+// readSnapshot returns the record collection/resource as of the snapshot
+// of tx, with the changes of tx.
+func (tx *Tx) readSnapshot(collection, resource string) ([]byte, error) {
+	if err := validName(collection, resource); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(tx.d.dir, collection, resource+".json")
+	notFound := &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+
+	if i, ok := tx.at[recordKey(collection, resource)]; ok {
+		if op := tx.ops[i]; op.Op == OpWrite {
+			return op.Data, nil
+		}
+		return nil, notFound
+	}
+
+	b, err := tx.d.backend.ReadFile(path)
+	if image, ok := tx.snap.replaced(collection, resource); ok {
+		if !image.exists {
+			return nil, notFound
+		}
+		return image.data, nil
+	}
+	return b, err
+}
+
+// snapshotRecords returns the records of collection as of the snapshot of
+// tx, with the changes of tx, and their names in order.
+func (tx *Tx) snapshotRecords(collection string) (map[string][]byte, []string, error) {
+	if err := validName(collection, ""); err != nil {
+		return nil, nil, err
+	}
+	d := tx.d
+
+	records := make(map[string][]byte)
+	unlock, err := d.lockCollection(collection, LockRead)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = d.scan(collection, func(resource string, b []byte) error {
+		records[resource] = b
+		return nil
+	})
+	unlock()
+	missing := os.IsNotExist(err)
+	if err != nil && !missing {
+		return nil, nil, err
+	}
+
+	for resource, image := range tx.snap.replacedIn(collection) {
+		missing = false
+		if image.exists {
+			records[resource] = image.data
+		} else {
+			delete(records, resource)
+		}
+	}
+	for _, op := range tx.ops {
+		if op.Collection != collection {
+			continue
+		}
+		missing = false
+		if op.Op == OpWrite {
+			records[op.Resource] = op.Data
+		} else {
+			delete(records, op.Resource)
+		}
+	}
+	if missing {
+		return nil, nil, err
+	}
+
+	names := make([]string, 0, len(records))
+	for resource := range records {
+		names = append(names, resource)
+	}
+	sort.Strings(names)
+	return records, names, nil
+}
+
+// ReadAll returns the records of collection as of the start of tx, with
+// the changes of tx, in name order.
+func (tx *Tx) ReadAll(collection string) ([]string, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	if err := tx.d.allow(PolicyRead, collection); err != nil {
+		return nil, err
+	}
+	records, names, err := tx.snapshotRecords(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	all := make([]string, len(names))
+	for i, resource := range names {
+		all[i] = string(records[resource])
+	}
+	return all, nil
+}
+
+// Query returns the records of collection matching q as of the start of
+// tx, with the changes of tx. Geo filters are not supported.
+func (tx *Tx) Query(collection string, q Query) ([]Document, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	if q.Geo != nil {
+		return nil, fmt.Errorf("Geo queries cannot run in a transaction")
+	}
+	if err := tx.d.allow(PolicyRead, collection); err != nil {
+		return nil, err
+	}
+	if err := q.prepare(tx.d.CollectionConfig(collection).Collations); err != nil {
+		return nil, err
+	}
+
+	records, names, err := tx.snapshotRecords(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []Document
+	for _, resource := range names {
+		doc, err := decodeDocument(records[resource])
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding '%s': %v", resource, err)
+		}
+		if !q.Match(doc) {
+			continue
+		}
+		docs = append(docs, Document{Resource: resource, Data: doc})
+		if q.Limit > 0 && len(docs) >= q.Limit {
+			break
+		}
+	}
+	return docs, nil
+}
@@ -0,0 +1,481 @@
+package jsondb
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// SQLDriverName is the name the read-only database/sql driver is
+// registered under. The data source name is the database directory:
+//
+//	db, err := sql.Open("jsondb", "./")
+//	rows, err := db.Query(`SELECT Name, Address.City FROM users WHERE Age > ? ORDER BY Name`, 25)
+//
+// Records are exposed as rows with their JSON fields flattened into dotted
+// column names; the resource name is available as the _key column. The
+// database must exist; it is neither migrated nor recovered, so it can be
+// queried while a server has it open.
+const SQLDriverName = "jsondb"
+
+// keyColumn is the column holding the resource name of each record.
+const keyColumn = "_key"
+
+func init() {
+	sql.Register(SQLDriverName, &sqlDriver{dbs: make(map[string]*sqlDB)})
+}
+
+// sqlDriver opens each database once, read-only, and shares it between
+// the connections to it; it is closed with the last of them.
+type sqlDriver struct {
+	mutex sync.Mutex
+	dbs   map[string]*sqlDB
+}
+
+type sqlDB struct {
+	db    *Driver
+	conns int
+}
+
+func (d *sqlDriver) Open(dsn string) (driver.Conn, error) {
+	dir := filepath.Clean(dsn)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	shared, ok := d.dbs[dir]
+	if !ok {
+		db, err := openReadOnly(dir, nil)
+		if err != nil {
+			return nil, err
+		}
+		shared = &sqlDB{db: db}
+		d.dbs[dir] = shared
+	}
+	shared.conns++
+	return &sqlConn{driver: d, dir: dir, db: shared.db}, nil
+}
+
+// release drops a connection to the database in dir, closing it with the
+// last one.
+func (d *sqlDriver) release(dir string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	shared, ok := d.dbs[dir]
+	if !ok {
+		return nil
+	}
+	if shared.conns--; shared.conns > 0 {
+		return nil
+	}
+	delete(d.dbs, dir)
+	return shared.db.Close()
+}
+
+type sqlConn struct {
+	driver *sqlDriver
+	dir    string
+	db     *Driver
+	closed bool
+}
+
+func (c *sqlConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := parseSelect(query)
+	if err != nil {
+		return nil, err
+	}
+	stmt.db = c.db
+	return stmt, nil
+}
+
+func (c *sqlConn) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.driver.release(c.dir)
+}
+
+func (c *sqlConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("jsondb: transactions are not supported (read-only driver)")
+}
+
+// sqlStmt is a parsed SELECT statement.
+type sqlStmt struct {
+	db *Driver
+
+	columns    []string // nil means *
+	collection string
+	where      []sqlCond
+	orderBy    string
+	desc       bool
+	limit      int
+	numInput   int
+}
+
+type sqlCond struct {
+	column string
+	op     string
+	value  interface{}
+	arg    int // index of the ? placeholder, or -1
+}
+
+func (s *sqlStmt) Close() error  { return nil }
+func (s *sqlStmt) NumInput() int { return s.numInput }
+
+func (s *sqlStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, fmt.Errorf("jsondb: only SELECT statements are supported (read-only driver)")
+}
+
+func (s *sqlStmt) Query(args []driver.Value) (driver.Rows, error) {
+	q := Query{}
+	for _, cond := range s.where {
+		value := cond.value
+		if cond.arg >= 0 {
+			value = args[cond.arg]
+		}
+		if cond.column == keyColumn {
+			// Resource names are not part of the document; filter below.
+			continue
+		}
+		q.Where = append(q.Where, Condition{Field: cond.column, Op: cond.op, Value: value})
+	}
+	if s.orderBy == "" {
+		q.Limit = s.limit
+	}
+
+	docs, err := s.db.Query(s.collection, q)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := &sqlRows{}
+	seen := map[string]bool{}
+
+	for _, doc := range docs {
+		row := map[string]driver.Value{}
+		flattenValues("", doc.Data, row)
+		row[keyColumn] = doc.Resource
+
+		if !s.matchKey(row, args) {
+			continue
+		}
+
+		for col := range row {
+			if !seen[col] {
+				seen[col] = true
+				rows.columns = append(rows.columns, col)
+			}
+		}
+		rows.data = append(rows.data, row)
+	}
+
+	if s.orderBy != "" {
+		sort.SliceStable(rows.data, func(i, j int) bool {
+			c := compare(rows.data[i][s.orderBy], rows.data[j][s.orderBy])
+			if s.desc {
+				return c > 0
+			}
+			return c < 0
+		})
+		if s.limit > 0 && len(rows.data) > s.limit {
+			rows.data = rows.data[:s.limit]
+		}
+	}
+
+	if s.columns != nil {
+		rows.columns = s.columns
+	} else {
+		sort.Strings(rows.columns)
+	}
+	return rows, nil
+}
+
+// matchKey applies conditions on the _key column to a row.
+func (s *sqlStmt) matchKey(row map[string]driver.Value, args []driver.Value) bool {
+	for _, cond := range s.where {
+		if cond.column != keyColumn {
+			continue
+		}
+		value := cond.value
+		if cond.arg >= 0 {
+			value = args[cond.arg]
+		}
+		c := Condition{Field: keyColumn, Op: cond.op, Value: value}
+		if !c.Match(map[string]interface{}{keyColumn: row[keyColumn]}) {
+			return false
+		}
+	}
+	return true
+}
+
+type sqlRows struct {
+	columns []string
+	data    []map[string]driver.Value
+	pos     int
+}
+
+func (r *sqlRows) Columns() []string { return r.columns }
+func (r *sqlRows) Close() error      { return nil }
+
+func (r *sqlRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.data) {
+		return io.EOF
+	}
+	row := r.data[r.pos]
+	r.pos++
+
+	for i, col := range r.columns {
+		dest[i] = row[col]
+	}
+	return nil
+}
+
+// flattenValues flattens a document into dotted columns holding
+// database/sql compatible values. Arrays are kept as JSON text.
+func flattenValues(prefix string, v interface{}, out map[string]driver.Value) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			key := k
+			if prefix != "" {
+				key = prefix + "." + k
+			}
+			flattenValues(key, e, out)
+		}
+	case []interface{}:
+		b, _ := json.Marshal(t)
+		out[prefix] = string(b)
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			out[prefix] = i
+		} else if f, err := t.Float64(); err == nil {
+			out[prefix] = f
+		} else {
+			out[prefix] = t.String()
+		}
+	case string, bool, nil:
+		out[prefix] = t
+	default:
+		out[prefix] = fmt.Sprint(t)
+	}
+}
+
+// parseSelect parses
+//
+//	SELECT cols FROM collection [WHERE cond [AND cond]...] [ORDER BY col [ASC|DESC]] [LIMIT n]
+//
+// where a condition is "column op value", op is one of = != <> < <= > >=
+// and value is a quoted string, a number or a ? placeholder.
+func parseSelect(query string) (*sqlStmt, error) {
+	p := &sqlParser{tokens: tokenizeSQL(query)}
+	stmt := &sqlStmt{}
+
+	if !p.keyword("SELECT") {
+		return nil, fmt.Errorf("jsondb: only SELECT statements are supported")
+	}
+
+	if p.peek() == "*" {
+		p.next()
+	} else {
+		for {
+			col := p.next()
+			if !isIdent(col) {
+				return nil, fmt.Errorf("jsondb: expected column name, got %q", col)
+			}
+			stmt.columns = append(stmt.columns, unquoteIdent(col))
+			if p.peek() != "," {
+				break
+			}
+			p.next()
+		}
+	}
+
+	if !p.keyword("FROM") {
+		return nil, fmt.Errorf("jsondb: expected FROM")
+	}
+	stmt.collection = unquoteIdent(p.next())
+	if stmt.collection == "" {
+		return nil, fmt.Errorf("jsondb: missing collection name")
+	}
+
+	if p.keyword("WHERE") {
+		for {
+			cond, err := p.condition(&stmt.numInput)
+			if err != nil {
+				return nil, err
+			}
+			stmt.where = append(stmt.where, cond)
+			if !p.keyword("AND") {
+				break
+			}
+		}
+	}
+
+	if p.keyword("ORDER") {
+		if !p.keyword("BY") {
+			return nil, fmt.Errorf("jsondb: expected BY after ORDER")
+		}
+		stmt.orderBy = unquoteIdent(p.next())
+		if p.keyword("DESC") {
+			stmt.desc = true
+		} else {
+			p.keyword("ASC")
+		}
+	}
+
+	if p.keyword("LIMIT") {
+		n, err := strconv.Atoi(p.next())
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("jsondb: invalid LIMIT")
+		}
+		stmt.limit = n
+	}
+
+	p.keyword(";")
+	if tok := p.peek(); tok != "" {
+		return nil, fmt.Errorf("jsondb: unexpected %q", tok)
+	}
+	return stmt, nil
+}
+
+type sqlParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *sqlParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *sqlParser) next() string {
+	tok := p.peek()
+	if tok != "" {
+		p.pos++
+	}
+	return tok
+}
+
+// keyword consumes the next token if it is kw, ignoring case.
+func (p *sqlParser) keyword(kw string) bool {
+	if strings.EqualFold(p.peek(), kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) condition(numInput *int) (sqlCond, error) {
+	col := p.next()
+	if !isIdent(col) {
+		return sqlCond{}, fmt.Errorf("jsondb: expected column name, got %q", col)
+	}
+
+	op := p.next()
+	switch op {
+	case "=", "!=", "<", "<=", ">", ">=":
+	case "<>":
+		op = "!="
+	default:
+		return sqlCond{}, fmt.Errorf("jsondb: unsupported operator %q", op)
+	}
+
+	cond := sqlCond{column: unquoteIdent(col), op: op, arg: -1}
+
+	tok := p.next()
+	switch {
+	case tok == "?":
+		cond.arg = *numInput
+		*numInput++
+	case strings.HasPrefix(tok, "'"):
+		if len(tok) < 2 || !strings.HasSuffix(tok, "'") {
+			return sqlCond{}, fmt.Errorf("jsondb: unterminated string %s", tok)
+		}
+		cond.value = strings.ReplaceAll(tok[1:len(tok)-1], "''", "'")
+	case tok != "":
+		if _, err := strconv.ParseFloat(tok, 64); err != nil {
+			return sqlCond{}, fmt.Errorf("jsondb: invalid value %q", tok)
+		}
+		cond.value = json.Number(tok)
+	default:
+		return sqlCond{}, fmt.Errorf("jsondb: missing value for %s", cond.column)
+	}
+	return cond, nil
+}
+
+func isIdent(tok string) bool {
+	if tok == "" {
+		return false
+	}
+	r := rune(tok[0])
+	return r == '"' || r == '`' || r == '_' || unicode.IsLetter(r)
+}
+
+func unquoteIdent(tok string) string {
+	if len(tok) >= 2 && (tok[0] == '"' || tok[0] == '`') {
+		return tok[1 : len(tok)-1]
+	}
+	return tok
+}
+
+// tokenizeSQL splits a statement into identifiers (which may contain dots),
+// quoted strings and identifiers, numbers and operators.
+func tokenizeSQL(query string) []string {
+	var tokens []string
+	rs := []rune(query)
+
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '\'' || r == '"' || r == '`':
+			j := i + 1
+			for j < len(rs) {
+				if rs[j] == r {
+					if r == '\'' && j+1 < len(rs) && rs[j+1] == '\'' {
+						j += 2
+						continue
+					}
+					break
+				}
+				j++
+			}
+			if j >= len(rs) {
+				j = len(rs) - 1
+			}
+			tokens = append(tokens, string(rs[i:j+1]))
+			i = j + 1
+		case r == '<' || r == '>' || r == '!' || r == '=':
+			j := i + 1
+			if j < len(rs) && (rs[j] == '=' || (r == '<' && rs[j] == '>')) {
+				j++
+			}
+			tokens = append(tokens, string(rs[i:j]))
+			i = j
+		case strings.ContainsRune(",*?;()", r):
+			tokens = append(tokens, string(r))
+			i++
+		default:
+			j := i
+			for j < len(rs) && !unicode.IsSpace(rs[j]) && !strings.ContainsRune(",*?;()<>!='\"`", rs[j]) {
+				j++
+			}
+			tokens = append(tokens, string(rs[i:j]))
+			i = j
+		}
+	}
+	return tokens
+}
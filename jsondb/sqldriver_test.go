@@ -0,0 +1,89 @@
+package jsondb
+
+import (
+	"database/sql"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLDriverLeavesDirectoryAlone(t *testing.T) {
+	db, dir := openTest(t, nil)
+	if err := db.Write("users", "ann", map[string]interface{}{"Name": "Ann", "Age": 30}); err != nil {
+		t.Fatal(err)
+	}
+
+	flag := filepath.Join(dir, systemDir, dirtyFlag)
+	token, err := os.ReadFile(flag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	temp := filepath.Join(dir, "users", "bob.json.tmp")
+	if err := os.WriteFile(temp, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sqlDB, err := sql.Open(SQLDriverName, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxIdleConns(0)
+
+	var name string
+	if err := sqlDB.QueryRow(`SELECT Name FROM users WHERE Age > ?`, 25).Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	if name != "Ann" {
+		t.Errorf("Name = %q, want Ann", name)
+	}
+	if err := sqlDB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := os.ReadFile(flag); err != nil || string(b) != string(token) {
+		t.Errorf("dirty flag = %q, %v; want the server's %q", b, err, token)
+	}
+	if _, err := os.Stat(temp); err != nil {
+		t.Errorf("in-flight temporary file was removed: %v", err)
+	}
+}
+
+func TestSQLDriverSharesDatabase(t *testing.T) {
+	_, dir := openTest(t, nil)
+
+	d := &sqlDriver{dbs: make(map[string]*sqlDB)}
+	a, err := d.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := d.Open(dir + string(filepath.Separator))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.(*sqlConn).db != b.(*sqlConn).db {
+		t.Error("connections to the same directory opened separate databases")
+	}
+
+	a.Close()
+	if len(d.dbs) != 1 {
+		t.Fatal("database closed while a connection is open")
+	}
+	b.Close()
+	if len(d.dbs) != 0 {
+		t.Error("database not closed with its last connection")
+	}
+}
+
+func TestSQLDriverMemoryDir(t *testing.T) {
+	db, err := sql.Open(SQLDriverName, MemoryDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Query(`SELECT * FROM users`); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("query of a missing collection: %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package jsondb
+
+import (
+	"bytes"
+	"container/list"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// defaultStaleCacheSize is how many records the stale-if-error cache keeps
+// when Options.StaleCacheSize is zero.
+const defaultStaleCacheSize = 10000
+
+// Stale tells that a record was served from the stale-if-error cache of its
+// collection, see CollectionConfig.StaleIfError, because reading it from
+// storage failed with Err. Age is how long ago the copy was read.
+type Stale struct {
+	Age time.Duration
+	Err error
+}
+
+// staleCache holds the last copy read of the records of collections with
+// StaleIfError, shared by the copies of a driver.
+type staleCache struct {
+	mutex   sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type staleCopy struct {
+	key string
+	b   []byte
+	at  time.Time
+}
+
+func newStaleCache(size int) *staleCache {
+	if size <= 0 {
+		size = defaultStaleCacheSize
+	}
+	return &staleCache{size: size, lru: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *staleCache) put(collection, resource string, b []byte) {
+	key := collection + "\x00" + resource
+	entry := &staleCopy{key: key, b: bytes.Clone(b), at: time.Now()}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*staleCopy).key)
+	}
+}
+
+func (c *staleCache) get(collection, resource string) (*staleCopy, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.entries[collection+"\x00"+resource]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*staleCopy), true
+}
+
+// drop forgets the copy of collection/resource, or of every record of
+// collection when resource is empty.
+func (c *staleCache) drop(collection, resource string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if resource != "" {
+		if e, ok := c.entries[collection+"\x00"+resource]; ok {
+			c.lru.Remove(e)
+			delete(c.entries, collection+"\x00"+resource)
+		}
+		return
+	}
+	for key, e := range c.entries {
+		if len(key) > len(collection) && key[:len(collection)+1] == collection+"\x00" {
+			c.lru.Remove(e)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// fetch reads the stored record collection/resource, loading it first if
+// the collection is a ReadThrough, sharing the read with concurrent fetches
+// of the record. For a collection with StaleIfError, it keeps a copy of
+// what it reads and, when reading fails otherwise than for a missing
+// record, serves the copy instead, if it is recent enough.
+func (d *Driver) fetch(collection, resource string) ([]byte, *Stale, error) {
+	return d.fetchHeld(collection, resource, "")
+}
+
+// fetchHeld is fetch for a caller holding the lock of collection in mode
+// held, "" for none. Holding it, the read does not join reads in flight,
+// which may be waiting for the lock. Under a write lock a record read
+// through is stored as it is; under a read lock it cannot be stored, so it
+// is not loaded: the caller reads it through before locking.
+func (d *Driver) fetchHeld(collection, resource, held string) ([]byte, *Stale, error) {
+	var b []byte
+	var err error
+	if d.flights != nil && held == "" {
+		b, err = d.flights.do(collection, resource, func() ([]byte, error) { return d.fetchStored(collection, resource, held) })
+	} else {
+		b, err = d.fetchStored(collection, resource, held)
+	}
+
+	cfg := d.collectionConfig(collection)
+	if d.stale == nil || cfg == nil || cfg.StaleIfError == "" {
+		return b, nil, err
+	}
+	if err == nil {
+		d.stale.put(collection, resource, b)
+		return b, nil, nil
+	}
+	if os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	maxAge, _ := ParseAge(cfg.StaleIfError) // checked when the config was set
+	cached, ok := d.stale.get(collection, resource)
+	if !ok || time.Since(cached.at) > maxAge {
+		return nil, nil, err
+	}
+	age := time.Since(cached.at)
+	d.log.Warn("Serving a copy of '%s/%s' read %v ago: %v\n", collection, resource, age.Round(time.Second), err)
+	return bytes.Clone(cached.b), &Stale{Age: age, Err: err}, nil
+}
+
+func (d *Driver) fetchStored(collection, resource, held string) ([]byte, error) {
+	if held != LockRead {
+		if err := d.readThrough(collection, resource, held == LockWrite); err != nil {
+			return nil, err
+		}
+	}
+
+	record := filepath.Join(d.dir, collection, resource+".json") // Ensure only one .json extension
+
+	if _, err := d.stat(record); err != nil {
+		return nil, err
+	}
+
+	b, err := d.backend.ReadFile(record)
+	if err != nil {
+		return nil, err
+	}
+	d.traceBytes(len(b))
+	return b, nil
+}
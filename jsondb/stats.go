@@ -0,0 +1,153 @@
+package jsondb
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// CollectionStats is the size of one collection; those nested in it are
+// counted apart.
+type CollectionStats struct {
+	Collection string
+	Records    int64
+	Bytes      int64
+
+	// IndexBytes estimates the memory of the geo index of the collection,
+	// once a query built it.
+	IndexBytes int64 `json:",omitempty"`
+}
+
+// DBStats is a capacity report of a database, for planning without going
+// over its directory with du and find.
+type DBStats struct {
+	Collections []CollectionStats
+
+	// Records, Bytes and IndexBytes add up the collections; IndexBytes
+	// also counts the edges of the graph, kept in the system namespace.
+	Records    int64
+	Bytes      int64
+	IndexBytes int64
+
+	// SystemBytes is the size of the system namespace: jobs, versions,
+	// archives, edges and the rest, JournalBytes among them the journal
+	// of transactions being applied.
+	SystemBytes  int64
+	JournalBytes int64
+
+	QueryCache QueryCacheStats
+	Coalesce   CoalesceStats
+	Memory     MemoryStats
+
+	// DiskFree and DiskTotal are the space of the disk of the database,
+	// 0 when it cannot be told.
+	DiskFree  uint64
+	DiskTotal uint64
+}
+
+// DBStats reports the size of every collection and of the indexes, caches
+// and system namespace of the database, with the free disk space. Sizes
+// are read without locks, so writes made meanwhile may or may not count.
+func (d *Driver) DBStats() (_ DBStats, err error) {
+	d, span := d.trace("DBStats", "", "")
+	defer span.end(&err)
+
+	var stats DBStats
+	collections, err := d.Collections()
+	if err != nil && !os.IsNotExist(err) {
+		return stats, err
+	}
+
+	stats.Collections = make([]CollectionStats, 0, len(collections))
+	for _, collection := range collections {
+		cs, err := d.collectionStats(collection)
+		if err != nil {
+			return stats, err
+		}
+		stats.Collections = append(stats.Collections, cs)
+		stats.Records += cs.Records
+		stats.Bytes += cs.Bytes
+		stats.IndexBytes += cs.IndexBytes
+	}
+
+	sys := d.System()
+	if sys != d {
+		if stats.SystemBytes, err = sys.dirSize(sys.dir); err != nil {
+			return stats, err
+		}
+		for _, collection := range []string{edgesCollection, inEdgesCollection} {
+			n, err := sys.dirSize(filepath.Join(sys.dir, collection))
+			if err != nil {
+				return stats, err
+			}
+			stats.IndexBytes += n
+		}
+		if stats.JournalBytes, err = sys.dirSize(filepath.Join(sys.dir, journalCollection)); err != nil {
+			return stats, err
+		}
+	}
+
+	stats.QueryCache = d.QueryCacheStats()
+	stats.Coalesce = d.CoalesceStats()
+	stats.Memory = d.MemoryStats()
+	if free, total, err := diskSpace(d.dir); err == nil {
+		stats.DiskFree, stats.DiskTotal = free, total
+	}
+	return stats, nil
+}
+
+func (d *Driver) collectionStats(collection string) (CollectionStats, error) {
+	cs := CollectionStats{Collection: collection}
+
+	files, err := d.backend.ReadDir(filepath.Join(d.dir, collection))
+	if os.IsNotExist(err) {
+		return cs, nil // deleted meanwhile
+	}
+	if err != nil {
+		return cs, err
+	}
+	for _, file := range files {
+		if isRecord(file) {
+			cs.Records++
+			cs.Bytes += file.Size()
+		}
+	}
+
+	d.mutex.Lock()
+	ix := d.geo[collection]
+	d.mutex.Unlock()
+	if ix != nil {
+		ix.mutex.Lock()
+		for _, e := range ix.entries {
+			// The entry and the hashes map both hold the geohash and ID.
+			cs.IndexBytes += 2 * int64(len(e.hash)+len(e.resource))
+		}
+		ix.mutex.Unlock()
+	}
+	return cs, nil
+}
+
+// dirSize adds up the sizes of the files under dir, 0 when it does not
+// exist.
+func (d *Driver) dirSize(dir string) (int64, error) {
+	files, err := d.backend.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for _, file := range files {
+		if !file.IsDir() {
+			n += file.Size()
+			continue
+		}
+		size, err := d.dirSize(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return 0, err
+		}
+		n += size
+	}
+	return n, nil
+}
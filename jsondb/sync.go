@@ -0,0 +1,401 @@
+package jsondb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sync keeps a collection in step between replicas that change it while
+// apart, such as a server and offline-first clients each holding a copy.
+// Every record carries a version vector counting the changes each replica
+// made to it; a replica sends the changes made since its last sync, and
+// takes those of the other side made since its checkpoint. Changes whose
+// vectors are concurrent conflict and are settled by the collection's
+// ConflictResolver.
+//
+// Records written without Sync, through Write and friends, are noticed by
+// comparing their content with what the last sync saw, so every write
+// counts. The bookkeeping lives in the system namespace: the metadata of
+// every record under "sync/<collection>" and the sequence of changes in
+// "sync-sequences".
+const (
+	syncCollection = "sync"
+	syncSequences  = "sync-sequences"
+)
+
+// VersionVector counts the changes each replica made to a record.
+type VersionVector map[string]uint64
+
+// Ordering is how two version vectors relate.
+type Ordering int
+
+const (
+	Identical Ordering = iota
+	HappenedBefore
+	HappenedAfter
+	Concurrent
+)
+
+// Compare tells whether v happened before, after or concurrently with w.
+func (v VersionVector) Compare(w VersionVector) Ordering {
+	var less, greater bool
+	for replica, n := range v {
+		if n > w[replica] {
+			greater = true
+		} else if n < w[replica] {
+			less = true
+		}
+	}
+	for replica, n := range w {
+		if _, ok := v[replica]; !ok && n > 0 {
+			less = true
+		}
+	}
+
+	switch {
+	case less && greater:
+		return Concurrent
+	case less:
+		return HappenedBefore
+	case greater:
+		return HappenedAfter
+	}
+	return Identical
+}
+
+// Merge returns the vector holding the highest count of every replica of
+// v and w.
+func (v VersionVector) Merge(w VersionVector) VersionVector {
+	m := VersionVector{}
+	for replica, n := range v {
+		m[replica] = n
+	}
+	for replica, n := range w {
+		if n > m[replica] {
+			m[replica] = n
+		}
+	}
+	return m
+}
+
+// SyncChange is the state of a record after a change: its content, or a
+// tombstone when it was deleted.
+type SyncChange struct {
+	Resource string
+	Version  VersionVector
+	Deleted  bool `json:",omitempty"`
+
+	// Time is when the change was made, as the replica making it saw it.
+	Time time.Time
+
+	Data map[string]interface{} `json:",omitempty"`
+}
+
+// ConflictResolver settles concurrent changes of a record: local is the
+// state of this replica, remote the one received. It returns the state to
+// keep; its Data and Deleted are used, the version is the merge of both.
+type ConflictResolver func(local, remote SyncChange) (SyncChange, error)
+
+// LastWriterWins keeps the change made last, and on equal times the one
+// whose vector sorts last, so every replica picks the same side.
+func LastWriterWins(local, remote SyncChange) (SyncChange, error) {
+	if remote.Time.After(local.Time) {
+		return remote, nil
+	}
+	if local.Time.After(remote.Time) {
+		return local, nil
+	}
+	if vectorKey(remote.Version) > vectorKey(local.Version) {
+		return remote, nil
+	}
+	return local, nil
+}
+
+// vectorKey is a deterministic encoding of v, for tie-breaks.
+func vectorKey(v VersionVector) string {
+	replicas := make([]string, 0, len(v))
+	for replica := range v {
+		replicas = append(replicas, replica)
+	}
+	sort.Strings(replicas)
+
+	var b strings.Builder
+	for _, replica := range replicas {
+		fmt.Fprintf(&b, "%q=%020d,", replica, v[replica])
+	}
+	return b.String()
+}
+
+// syncMeta is what the sync of a collection knows about one record.
+type syncMeta struct {
+	Version VersionVector
+	Deleted bool `json:",omitempty"`
+	Time    time.Time
+
+	// Hash is the fingerprint of the content last seen, to notice writes
+	// made without Sync.
+	Hash string `json:",omitempty"`
+
+	// Seq orders the changes of the collection, for checkpoints.
+	Seq uint64
+
+	// Origin is the replica the change came from.
+	Origin string
+}
+
+// syncState serializes the syncs of a driver and holds the resolvers.
+type syncState struct {
+	mutex     sync.Mutex
+	resolvers map[string]ConflictResolver
+}
+
+// SetConflictResolver sets how conflicts of collection are settled;
+// LastWriterWins by default.
+func (d *Driver) SetConflictResolver(collection string, r ConflictResolver) {
+	d.syncs.mutex.Lock()
+	defer d.syncs.mutex.Unlock()
+	d.syncs.resolvers[collection] = r
+}
+
+// SyncRequest is what a replica sends: its changes since its last sync,
+// and the checkpoint of the changes it took from the other side.
+type SyncRequest struct {
+	Replica    string
+	Checkpoint uint64
+	Changes    []SyncChange
+}
+
+// SyncResponse is the answer to a SyncRequest: the changes made here
+// since the request's checkpoint, and the checkpoint to send next time.
+type SyncResponse struct {
+	Checkpoint uint64
+	Changes    []SyncChange
+}
+
+// Sync applies the changes of another replica to collection, settling
+// conflicts, and returns the changes this replica has for it. self names
+// this replica in version vectors. Changes that came from req.Replica are
+// not sent back to it, unless a conflict changed them.
+func (d *Driver) Sync(collection, self string, req SyncRequest) (_ SyncResponse, err error) {
+	d, span := d.trace("Sync", collection, "")
+	defer span.end(&err)
+
+	if err := validName(collection, ""); err != nil {
+		return SyncResponse{}, err
+	}
+	if err := d.checkCollection(collection); err != nil {
+		return SyncResponse{}, err
+	}
+
+	d.syncs.mutex.Lock()
+	defer d.syncs.mutex.Unlock()
+
+	metas, seq, err := d.scanSync(collection, self)
+	if err != nil {
+		return SyncResponse{}, err
+	}
+
+	resolve := d.syncs.resolvers[collection]
+	if resolve == nil {
+		resolve = LastWriterWins
+	}
+
+	for _, remote := range req.Changes {
+		if err := validName(collection, remote.Resource); err != nil {
+			return SyncResponse{}, err
+		}
+
+		meta, known := metas[remote.Resource]
+		order := HappenedAfter
+		if known {
+			order = remote.Version.Compare(meta.Version)
+		}
+
+		var keep SyncChange
+		origin := req.Replica
+		switch order {
+		case Identical, HappenedBefore:
+			continue
+		case HappenedAfter:
+			keep = remote
+		case Concurrent:
+			local := SyncChange{Resource: remote.Resource, Version: meta.Version, Deleted: meta.Deleted, Time: meta.Time}
+			if !meta.Deleted {
+				if local.Data, err = d.syncRecord(collection, remote.Resource); err != nil {
+					return SyncResponse{}, err
+				}
+			}
+			if keep, err = resolve(local, remote); err != nil {
+				return SyncResponse{}, err
+			}
+			keep.Resource = remote.Resource
+			keep.Version = meta.Version.Merge(remote.Version)
+			keep.Version[self]++
+			if keep.Time.IsZero() {
+				keep.Time = time.Now().UTC()
+			}
+			origin = self
+		}
+
+		hash, err := d.applySyncChange(collection, keep)
+		if err != nil {
+			return SyncResponse{}, err
+		}
+		seq++
+		metas[remote.Resource] = &syncMeta{Version: keep.Version, Deleted: keep.Deleted, Time: keep.Time, Hash: hash, Seq: seq, Origin: origin}
+		if err := d.putSyncMeta(collection, remote.Resource, metas[remote.Resource]); err != nil {
+			return SyncResponse{}, err
+		}
+	}
+	if err := d.putSyncSequence(collection, seq); err != nil {
+		return SyncResponse{}, err
+	}
+
+	resp := SyncResponse{Checkpoint: seq, Changes: []SyncChange{}}
+	for resource, meta := range metas {
+		if meta.Seq <= req.Checkpoint || (meta.Origin == req.Replica && req.Replica != "") {
+			continue
+		}
+		change := SyncChange{Resource: resource, Version: meta.Version, Deleted: meta.Deleted, Time: meta.Time}
+		if !meta.Deleted {
+			if change.Data, err = d.syncRecord(collection, resource); err != nil {
+				return SyncResponse{}, err
+			}
+		}
+		resp.Changes = append(resp.Changes, change)
+	}
+	sort.Slice(resp.Changes, func(i, j int) bool {
+		return metas[resp.Changes[i].Resource].Seq < metas[resp.Changes[j].Resource].Seq
+	})
+	return resp, nil
+}
+
+// scanSync loads the sync metadata of collection and records as changes
+// of self the writes and deletes made without Sync since the last scan.
+// It returns the metadata by record and the last sequence number.
+func (d *Driver) scanSync(collection, self string) (map[string]*syncMeta, uint64, error) {
+	sys := d.System()
+	metas := map[string]*syncMeta{}
+
+	stored, err := sys.Query(syncCollection+"/"+collection, Query{})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, err
+	}
+	for _, doc := range stored {
+		var meta syncMeta
+		if err := FromGeneric(doc.Data, &meta); err != nil {
+			return nil, 0, err
+		}
+		metas[doc.Resource] = &meta
+	}
+
+	var sequence struct{ Seq uint64 }
+	if err := sys.Read(syncSequences, NewKey(collection).String(), &sequence); err != nil && !os.IsNotExist(err) {
+		return nil, 0, err
+	}
+	seq := sequence.Seq
+
+	docs, err := d.Query(collection, Query{})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, err
+	}
+
+	now := time.Now().UTC()
+	present := map[string]bool{}
+	touch := func(resource string, meta *syncMeta) error {
+		seq++
+		meta.Version = meta.Version.Merge(nil)
+		meta.Version[self]++
+		meta.Time, meta.Seq, meta.Origin = now, seq, self
+		metas[resource] = meta
+		return d.putSyncMeta(collection, resource, meta)
+	}
+
+	for _, doc := range docs {
+		present[doc.Resource] = true
+		hash, err := contentHash(doc.Data)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		meta, ok := metas[doc.Resource]
+		if ok && !meta.Deleted && meta.Hash == hash {
+			continue
+		}
+		if !ok {
+			meta = &syncMeta{}
+		}
+		meta.Deleted, meta.Hash = false, hash
+		if err := touch(doc.Resource, meta); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	for resource, meta := range metas {
+		if present[resource] || meta.Deleted {
+			continue
+		}
+		meta.Deleted, meta.Hash = true, ""
+		if err := touch(resource, meta); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return metas, seq, d.putSyncSequence(collection, seq)
+}
+
+// applySyncChange writes or deletes the record of c, returning the
+// fingerprint of its new content.
+func (d *Driver) applySyncChange(collection string, c SyncChange) (string, error) {
+	if c.Deleted {
+		if _, err := d.stat(filepath.Join(d.dir, collection, c.Resource+".json")); os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", d.Delete(collection, c.Resource)
+	}
+
+	if c.Data == nil {
+		c.Data = map[string]interface{}{}
+	}
+	if err := d.Write(collection, c.Resource, c.Data); err != nil {
+		return "", err
+	}
+	data, err := d.syncRecord(collection, c.Resource)
+	if err != nil {
+		return "", err
+	}
+	return contentHash(data)
+}
+
+// syncRecord reads a record as a generic document.
+func (d *Driver) syncRecord(collection, resource string) (map[string]interface{}, error) {
+	var raw json.RawMessage
+	if err := d.Read(collection, resource, &raw); err != nil {
+		return nil, err
+	}
+	return decodeDocument(raw)
+}
+
+func (d *Driver) putSyncMeta(collection, resource string, meta *syncMeta) error {
+	return d.System().Write(syncCollection+"/"+collection, resource, meta)
+}
+
+func (d *Driver) putSyncSequence(collection string, seq uint64) error {
+	return d.System().Write(syncSequences, NewKey(collection).String(), struct{ Seq uint64 }{seq})
+}
+
+// contentHash is the fingerprint of a decoded record; encoding/json sorts
+// object keys, so equal records hash alike.
+func contentHash(doc map[string]interface{}) (string, error) {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	return fingerprint(b), nil
+}
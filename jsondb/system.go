@@ -0,0 +1,43 @@
+package jsondb
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// systemDir is the reserved namespace holding the database's own metadata
+// (view results, job history, ...). Its collections are reached through
+// Driver.System and cannot be written through the regular driver.
+const systemDir = "_system"
+
+// ErrReservedCollection is returned when user code tries to modify the
+// reserved system namespace.
+var ErrReservedCollection = fmt.Errorf("Collection is reserved for system use")
+
+// System returns the driver for the reserved system namespace. Calling it
+// on the system driver returns the system driver itself.
+func (d *Driver) System() *Driver {
+	if d.system == nil {
+		return d
+	}
+	if d.ctx != nil {
+		return d.system.WithContext(d.ctx)
+	}
+	return d.system
+}
+
+// IsReserved reports whether collection lies inside the system namespace.
+func IsReserved(collection string) bool {
+	first := strings.Split(filepath.ToSlash(filepath.Clean(collection)), "/")[0]
+	return first == systemDir
+}
+
+// checkCollection rejects writes to the reserved namespace from the regular
+// driver.
+func (d *Driver) checkCollection(collection string) error {
+	if d.system != nil && IsReserved(collection) {
+		return ErrReservedCollection
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package jsondb
+
+import (
+	"image"
+	_ "image/gif" // decoders of the images thumbnailed
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+)
+
+// Thumbnailer is an AttachmentProcessor making of each GIF, JPEG or PNG
+// image a PNG thumbnail, "thumb.png", fitting in a Size by Size square.
+// Images already that small are left alone.
+type Thumbnailer struct {
+	Size int
+}
+
+// Accepts implements AttachmentProcessor.
+func (t Thumbnailer) Accepts(a Attachment) bool {
+	switch strings.ToLower(a.ContentType) {
+	case "image/gif", "image/jpeg", "image/png":
+		return t.Size > 0
+	}
+	return false
+}
+
+// Process implements AttachmentProcessor.
+func (t Thumbnailer) Process(a Attachment, r io.Reader, put func(name string, r io.Reader) error) error {
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return err
+	}
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= t.Size && h <= t.Size {
+		return nil
+	}
+	if w >= h {
+		w, h = t.Size, max(1, h*t.Size/w)
+	} else {
+		w, h = max(1, w*t.Size/h), t.Size
+	}
+
+	// Nearest neighbour: each pixel of the thumbnail takes the colour of
+	// the pixel of the image it falls on.
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dst.Set(x, y, src.At(b.Min.X+x*b.Dx()/w, b.Min.Y+y*b.Dy()/h))
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(png.Encode(pw, dst)) }()
+	err = put("thumb.png", pr)
+	pr.CloseWithError(err)
+	return err
+}
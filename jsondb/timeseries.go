@@ -0,0 +1,312 @@
+package jsondb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Time series. A series is a collection whose records are buckets, each
+// holding the points of one hour or one day in time order, named after the
+// start of their span ("2024-05-01T13" or "2024-05-01", in UTC) so bucket
+// names sort by time. Appending rewrites a single bucket; range queries
+// only read the buckets overlapping the range.
+
+// SeriesConfig configures a time-series collection.
+type SeriesConfig struct {
+	// Bucket is the span of time one record holds: "hour", the default,
+	// or "day".
+	Bucket string `json:",omitempty"`
+
+	// Retention, such as "90d", drops buckets that ended longer ago; empty
+	// keeps everything.
+	Retention string `json:",omitempty"`
+}
+
+func (c *SeriesConfig) validate() error {
+	if c.Bucket != "" && c.Bucket != "hour" && c.Bucket != "day" {
+		return fmt.Errorf("Unknown series bucket '%s'", c.Bucket)
+	}
+	if c.Retention != "" {
+		if r, err := ParseAge(c.Retention); err != nil || r <= 0 {
+			return fmt.Errorf("Invalid series retention '%s'", c.Retention)
+		}
+	}
+	return nil
+}
+
+// span returns the length of a bucket and the layout of its name.
+func (c *SeriesConfig) span() (time.Duration, string) {
+	if c != nil && c.Bucket == "day" {
+		return 24 * time.Hour, "2006-01-02"
+	}
+	return time.Hour, "2006-01-02T15"
+}
+
+// Point is one value of a time series.
+type Point struct {
+	Time  time.Time
+	Value interface{}
+}
+
+// bucket is the stored form of the points of one span.
+type bucket struct {
+	Start  time.Time
+	Points []Point
+}
+
+// Append adds value at time t to series, keeping its bucket in time order.
+// Series without a Series configuration use hourly buckets and keep every
+// point. Opening a new bucket drops those past the retention.
+func (d *Driver) Append(series string, t time.Time, value interface{}) (err error) {
+	series = d.resolve(series)
+	d, span := d.trace("Append", series, "")
+	defer span.end(&err)
+
+	if err := d.allow(PolicyWrite, series); err != nil {
+		return err
+	}
+	if err := validName(series, ""); err != nil {
+		return err
+	}
+	if err := d.checkCollection(series); err != nil {
+		return err
+	}
+
+	cfg := d.CollectionConfig(series).Series
+	length, layout := cfg.span()
+
+	t = t.UTC()
+	start := t.Truncate(length)
+	resource := start.Format(layout)
+
+	var created bool
+	err = d.modify(series, resource, func(raw []byte) (interface{}, error) {
+		var b bucket
+		if created = raw == nil; !created {
+			if err := decodeBucket(series, resource, raw, &b); err != nil {
+				return nil, err
+			}
+		}
+		b.Start = start
+
+		i := sort.Search(len(b.Points), func(i int) bool { return b.Points[i].Time.After(t) })
+		b.Points = append(b.Points, Point{})
+		copy(b.Points[i+1:], b.Points[i:])
+		b.Points[i] = Point{t, value}
+		return b, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if created && cfg != nil && cfg.Retention != "" {
+		if _, err := d.pruneSeries(series, cfg); err != nil {
+			d.log.Error("Unable to apply the retention of series '%s': %v\n", series, err)
+		}
+	}
+	return nil
+}
+
+// ReadRange returns the points of series with from <= Time < to, in time
+// order. A zero from or to leaves that end open.
+func (d *Driver) ReadRange(series string, from, to time.Time) (_ []Point, err error) {
+	series = d.resolve(series)
+	d, span := d.trace("ReadRange", series, "")
+	defer span.end(&err)
+
+	if err := d.allow(PolicyRead, series); err != nil {
+		return nil, err
+	}
+	if err := validName(series, ""); err != nil {
+		return nil, err
+	}
+
+	length, layout := d.CollectionConfig(series).Series.span()
+
+	unlock, err := d.lockCollection(series, LockRead)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	names, err := d.bucketNames(series)
+	if err != nil {
+		return nil, err
+	}
+
+	var points []Point
+	for _, name := range names {
+		start, err := time.Parse(layout, name)
+		if err != nil {
+			continue // not a bucket
+		}
+		if (!to.IsZero() && !start.Before(to)) || (!from.IsZero() && !start.Add(length).After(from)) {
+			continue
+		}
+
+		b, err := d.readBucket(series, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range b.Points {
+			if (from.IsZero() || !p.Time.Before(from)) && (to.IsZero() || p.Time.Before(to)) {
+				points = append(points, p)
+			}
+		}
+	}
+	return points, nil
+}
+
+// PruneSeries drops the buckets of series past its retention and returns
+// how many were dropped.
+func (d *Driver) PruneSeries(series string) (_ int, err error) {
+	d, span := d.trace("PruneSeries", series, "")
+	defer span.end(&err)
+
+	cfg := d.CollectionConfig(series).Series
+	if cfg == nil || cfg.Retention == "" {
+		return 0, nil
+	}
+	return d.pruneSeries(series, cfg)
+}
+
+// pruneSeries is PruneSeries once the retention of series is known. Each
+// bucket is dropped on its own, as a change a replicator carries.
+func (d *Driver) pruneSeries(series string, cfg *SeriesConfig) (int, error) {
+	retention, err := ParseAge(cfg.Retention)
+	if err != nil {
+		return 0, err
+	}
+	length, layout := cfg.span()
+	cutoff := time.Now().UTC().Add(-retention)
+
+	names, err := d.bucketNames(series)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, name := range names {
+		start, err := time.Parse(layout, name)
+		if err != nil {
+			continue
+		}
+		if !start.Add(length).Before(cutoff) {
+			break // names sort by time
+		}
+		err = d.modify(series, name, func(raw []byte) (interface{}, error) { return nil, nil })
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// bucketNames lists the records of series in name, and so time, order.
+func (d *Driver) bucketNames(series string) ([]string, error) {
+	files, err := d.backend.ReadDir(filepath.Join(d.dir, series))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if isRecord(file) {
+			names = append(names, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (d *Driver) readBucket(series, resource string) (bucket, error) {
+	var b bucket
+
+	data, err := d.backend.ReadFile(filepath.Join(d.dir, series, resource+".json"))
+	if err != nil {
+		return b, err
+	}
+	return b, decodeBucket(series, resource, data, &b)
+}
+
+func decodeBucket(series, resource string, data []byte, b *bucket) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(b); err != nil {
+		return fmt.Errorf("Error decoding bucket '%s' of series '%s': %v", resource, series, err)
+	}
+	return nil
+}
+
+// Aggregate reduces the numeric values of a downsampling step to one.
+type Aggregate func(values []float64) float64
+
+// Aggregates for Downsample.
+var (
+	Mean Aggregate = func(v []float64) float64 { return Sum(v) / float64(len(v)) }
+	Sum  Aggregate = func(v []float64) float64 {
+		var s float64
+		for _, x := range v {
+			s += x
+		}
+		return s
+	}
+	Min Aggregate = func(v []float64) float64 {
+		m := v[0]
+		for _, x := range v[1:] {
+			if x < m {
+				m = x
+			}
+		}
+		return m
+	}
+	Max Aggregate = func(v []float64) float64 {
+		m := v[0]
+		for _, x := range v[1:] {
+			if x > m {
+				m = x
+			}
+		}
+		return m
+	}
+	Count Aggregate = func(v []float64) float64 { return float64(len(v)) }
+)
+
+// Downsample groups points, in time order, into steps of the given length
+// and reduces the numeric values of each step with agg. The points returned
+// are stamped with the start of their step; steps without numeric values
+// are left out.
+func Downsample(points []Point, step time.Duration, agg Aggregate) []Point {
+	var out []Point
+	var values []float64
+	var start time.Time
+
+	flush := func() {
+		if len(values) > 0 {
+			out = append(out, Point{start, agg(values)})
+		}
+		values = values[:0]
+	}
+
+	for _, p := range points {
+		if s := p.Time.Truncate(step); !s.Equal(start) {
+			flush()
+			start = s
+		}
+		if f, ok := toFloat(p.Value); ok {
+			values = append(values, f)
+		}
+	}
+	flush()
+	return out
+}
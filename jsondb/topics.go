@@ -0,0 +1,238 @@
+package jsondb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// cursorsCollection is the system collection holding subscriber cursors.
+const cursorsCollection = "cursors"
+
+// OpPublish is the change-feed operation of a message published to a topic.
+const OpPublish = "publish"
+
+// TopicMessage is one message published to a topic. IDs grow with every
+// message, so they order the topic.
+type TopicMessage struct {
+	Topic     string
+	ID        string
+	Payload   json.RawMessage
+	Published time.Time
+}
+
+// Cursor is the position of a subscriber in a topic: the ID of the last
+// message it committed.
+type Cursor struct {
+	Topic      string
+	Subscriber string
+	Last       string
+	Updated    time.Time
+}
+
+// cursorRecord names the system record of subscriber's cursor in topic.
+func cursorRecord(topic, subscriber string) string {
+	return recordEscaper.Replace(topic) + "~" + recordEscaper.Replace(subscriber)
+}
+
+// topicCollection is the system collection holding the messages of topic.
+func topicCollection(topic string) string {
+	return path.Join("topics", topic)
+}
+
+// Publish appends a message carrying payload to topic and hands it to the
+// topic's subscribers. Messages are durable: subscribers that are offline
+// receive them when they subscribe again. The policy of the driver rules
+// topics as collections of their name: publishing writes to one,
+// subscribing and committing read it.
+func (d *Driver) Publish(topic string, payload interface{}) (m TopicMessage, err error) {
+	d, span := d.trace("Publish", topic, "")
+	defer span.end(&err)
+
+	if err := validName(topic, ""); err != nil {
+		return m, err
+	}
+	if err := d.allow(PolicyWrite, topic); err != nil {
+		return m, err
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return m, err
+	}
+
+	sys := d.System()
+	collection := topicCollection(topic)
+
+	// Publishing under the topic's lock keeps IDs and events in order.
+	unlock, err := sys.lockCollection(collection, LockWrite)
+	if err != nil {
+		return m, err
+	}
+	defer unlock()
+
+	now := time.Now().UTC()
+	id := fmt.Sprintf("%020d", now.UnixNano())
+	for {
+		if _, err := sys.backend.Stat(filepath.Join(sys.dir, collection, id+".json")); err != nil {
+			break
+		}
+		now = now.Add(time.Nanosecond)
+		id = fmt.Sprintf("%020d", now.UnixNano())
+	}
+
+	m = TopicMessage{Topic: topic, ID: id, Payload: b, Published: now}
+
+	doc, err := json.Marshal(m)
+	if err != nil {
+		return m, err
+	}
+	if err := sys.write(collection, m.ID, m); err != nil {
+		return m, err
+	}
+
+	d.publish(OpPublish, path.Join(systemDir, collection), m.ID, doc)
+	return m, nil
+}
+
+// Subscribe delivers the messages of topic to subscriber, starting after its
+// committed cursor and continuing with new messages until ctx is done.
+// Delivery is at least once: messages are delivered again after a restart
+// until the subscriber commits them with Commit.
+func (d *Driver) Subscribe(ctx context.Context, topic, subscriber string) (<-chan TopicMessage, error) {
+	if err := validName(topic, ""); err != nil {
+		return nil, err
+	}
+	if subscriber == "" {
+		return nil, fmt.Errorf("Missing subscriber - unable to subscribe")
+	}
+	if err := d.allow(PolicyRead, topic); err != nil {
+		return nil, err
+	}
+
+	cursor, err := d.Cursor(topic, subscriber)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan TopicMessage)
+	go func() {
+		defer close(ch)
+
+		last := cursor.Last
+		for ctx.Err() == nil {
+			var err error
+			if last, err = d.deliver(ctx, topic, last, ch); err != nil {
+				d.log.Error("Subscription of '%s' to '%s' failed: %v\n", subscriber, topic, err)
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// deliver sends the stored messages of topic after last, then the live ones,
+// until ctx is done or the live feed drops the subscription for falling
+// behind. It returns the ID of the last message sent.
+func (d *Driver) deliver(ctx context.Context, topic, last string, ch chan<- TopicMessage) (string, error) {
+	// Watch before reading the backlog, so no message falls between them.
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events, err := d.Watch(watchCtx, path.Join(systemDir, topicCollection(topic)), "")
+	if err != nil {
+		return last, err
+	}
+
+	docs, err := d.System().Query(topicCollection(topic), Query{Where: []Condition{{Field: "ID", Op: ">", Value: last}}})
+	if err != nil && !os.IsNotExist(err) {
+		return last, err
+	}
+
+	send := func(m TopicMessage) bool {
+		select {
+		case ch <- m:
+			last = m.ID
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for _, doc := range docs {
+		var m TopicMessage
+		if err := FromGeneric(doc.Data, &m); err != nil {
+			return last, err
+		}
+		if !send(m) {
+			return last, nil
+		}
+	}
+
+	for e := range events {
+		var m TopicMessage
+		if err := json.Unmarshal(e.Data, &m); err != nil {
+			return last, err
+		}
+		if m.ID <= last {
+			continue // already sent from the backlog
+		}
+		if !send(m) {
+			return last, nil
+		}
+	}
+	return last, nil
+}
+
+// Commit advances the cursor of subscriber in topic to the message id.
+// Committing an ID at or before the cursor has no effect.
+func (d *Driver) Commit(topic, subscriber, id string) (err error) {
+	d, span := d.trace("Commit", topic, subscriber)
+	defer span.end(&err)
+
+	if err := validName(topic, ""); err != nil {
+		return err
+	}
+	if subscriber == "" {
+		return fmt.Errorf("Missing subscriber - unable to commit")
+	}
+	if err := d.allow(PolicyRead, topic); err != nil {
+		return err
+	}
+
+	sys := d.System()
+	unlock, err := sys.lockCollection(cursorsCollection, LockWrite)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	name := cursorRecord(topic, subscriber)
+
+	var cursor Cursor
+	if err := sys.Read(cursorsCollection, name, &cursor); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if id <= cursor.Last {
+		return nil
+	}
+
+	cursor = Cursor{Topic: topic, Subscriber: subscriber, Last: id, Updated: time.Now().UTC()}
+	return sys.write(cursorsCollection, name, cursor)
+}
+
+// Cursor returns the committed position of subscriber in topic. A new
+// subscriber starts at the beginning of the topic.
+func (d *Driver) Cursor(topic, subscriber string) (Cursor, error) {
+	cursor := Cursor{Topic: topic, Subscriber: subscriber}
+
+	err := d.System().Read(cursorsCollection, cursorRecord(topic, subscriber), &cursor)
+	if os.IsNotExist(err) {
+		return cursor, nil
+	}
+	return cursor, err
+}
@@ -0,0 +1,116 @@
+package jsondb
+
+import (
+	"context"
+	"time"
+)
+
+// Tracer starts the spans of driver operations. Without one, set with
+// Options.Tracer, operations are not traced; database/jsondb/oteltrace
+// provides an OpenTelemetry Tracer.
+type Tracer interface {
+	// Start begins the span called name as a child of the span in ctx and
+	// returns a context holding the new span.
+	Start(ctx context.Context, name string, attrs map[string]interface{}) (context.Context, Span)
+}
+
+// Span is a started operation span.
+type Span interface {
+	SetAttribute(key string, value interface{})
+
+	// End records err, if any, and ends the span.
+	End(err error)
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string, attrs map[string]interface{}) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, interface{}) {}
+func (noopSpan) End(error)                        {}
+
+// spanKey is the context key of the span of the current operation.
+type spanKey struct{}
+
+// WithContext returns a handle on the same database whose operations are
+// traced as children of the span in ctx.
+func (d *Driver) WithContext(ctx context.Context) *Driver {
+	c := *d
+	c.ctx = ctx
+	return &c
+}
+
+// Context returns the context d was bound to with WithContext.
+func (d *Driver) Context() context.Context {
+	if d.ctx == nil {
+		return context.Background()
+	}
+	return d.ctx
+}
+
+// span is a traced and timed driver operation.
+type span struct {
+	Span
+
+	d    *Driver
+	info OpInfo
+
+	// nested is set for operations run by another one, which the op log
+	// leaves out.
+	nested bool
+}
+
+// trace starts the span of operation op and returns a handle bound to it,
+// so nested operations become its children.
+func (d *Driver) trace(op, collection, resource string) (*Driver, span) {
+	attrs := make(map[string]interface{}, 2)
+	if collection != "" {
+		attrs["db.collection"] = collection
+	}
+	if resource != "" {
+		attrs["db.resource"] = resource
+	}
+
+	info := OpInfo{Op: op, Collection: collection, Resource: resource, Start: time.Now(), System: d.system == nil}
+	if d.instr != nil {
+		d.instr.OnOpStart(info)
+	}
+
+	_, nested := d.Context().Value(spanKey{}).(Span)
+	ctx, s := d.tracer.Start(d.Context(), "jsondb."+op, attrs)
+	if !nested {
+		ctx = withLockOwner(ctx, op)
+	}
+	return d.WithContext(context.WithValue(ctx, spanKey{}, s)), span{s, d, info, nested}
+}
+
+// traceBytes records the size of the document read or written.
+func (d *Driver) traceBytes(n int) {
+	if s, ok := d.Context().Value(spanKey{}).(Span); ok {
+		s.SetAttribute("db.bytes", n)
+	}
+}
+
+// end records *err, if any, and the latency of the operation, and ends
+// the span.
+func (s span) end(err *error) {
+	s.Span.End(*err)
+
+	elapsed := time.Since(s.info.Start)
+	s.d.perf.record(s.info.Collection, elapsed, *err != nil)
+	if s.d.instr != nil {
+		s.d.instr.OnOpEnd(s.info, elapsed, *err)
+	}
+	if !s.nested {
+		s.d.oplog.read(s.info, elapsed, *err)
+	}
+
+	if slowOp := time.Duration(s.d.slowOp.Load()); slowOp > 0 && elapsed >= slowOp {
+		s.d.log.Warn("Slow %s of '%s' '%s' in '%s' took %v (error: %v)\n",
+			s.info.Op, s.info.Collection, s.info.Resource, s.d.dir, elapsed, *err)
+	}
+}
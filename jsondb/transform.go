@@ -0,0 +1,226 @@
+package jsondb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Actions of a FieldRule.
+const (
+	// TransformHash replaces a value by a keyed hash of it: equal values
+	// stay equal, so records still join on hashed fields.
+	TransformHash = "hash"
+
+	// TransformRedact replaces a string by "[redacted]" and any other
+	// value by null.
+	TransformRedact = "redact"
+
+	// TransformFake replaces a value by a made-up one of the FieldRule's
+	// Fake kind, the same for equal values.
+	TransformFake = "fake"
+
+	// TransformDrop removes the field.
+	TransformDrop = "drop"
+)
+
+// fakeValues are the made-up values of each kind TransformFake knows.
+var fakeValues = map[string][]string{
+	"first_name": {"Alex", "Sam", "Jordan", "Taylor", "Casey", "Robin", "Morgan", "Jamie", "Riley", "Avery", "Quinn", "Drew"},
+	"last_name":  {"Smith", "Garcia", "Chen", "Okafor", "Novak", "Silva", "Khan", "Miller", "Rossi", "Tanaka", "Dubois", "Kowalski"},
+	"city":       {"Springfield", "Riverton", "Fairview", "Lakeside", "Greenville", "Oakdale", "Maplewood", "Hillcrest"},
+	"company":    {"Acme Corp", "Globex", "Initech", "Umbrella Ltd", "Hooli", "Vandelay Industries", "Stark Works", "Wayne Group"},
+	"street":     {"Main Street", "Oak Avenue", "Elm Road", "Park Lane", "Cedar Drive", "Lake View", "Mill Road", "High Street"},
+	"text":       {"Lorem ipsum dolor sit amet.", "Consectetur adipiscing elit.", "Sed do eiusmod tempor.", "Ut enim ad minim veniam."},
+}
+
+// fakeKinds lists the kinds of TransformFake, those of fakeValues and the
+// ones made of several.
+var fakeKinds = map[string]bool{"name": true, "email": true, "phone": true, "number": true}
+
+// FieldRule is how a transform changes one field of the records of a
+// collection, given by its dotted path ("Address.City"); paths crossing an
+// array apply to each of its elements. Fake names the kind of made-up
+// values of TransformFake: name, first_name, last_name, email, phone,
+// city, company, street, number or text.
+type FieldRule struct {
+	Field  string
+	Action string
+	Fake   string `json:",omitempty"`
+}
+
+// Transform is a pipeline of FieldRules by collection, applied to the
+// records of exports and clones of a driver bound to it with
+// WithTransform, such as to scrub personal data from a copy of production
+// data. Salt keys its hashes and fakes: without it, anyone can tell which
+// of a list of values a hash stands for.
+type Transform struct {
+	Collections map[string][]FieldRule
+	Salt        string `json:",omitempty"`
+}
+
+// ParseTransform reads a Transform from its JSON form and checks it.
+func ParseTransform(b []byte) (*Transform, error) {
+	var t Transform
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, err
+	}
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (t *Transform) validate() error {
+	for collection, rules := range t.Collections {
+		for _, rule := range rules {
+			if rule.Field == "" {
+				return fmt.Errorf("Missing field of a rule of '%s'", collection)
+			}
+			switch rule.Action {
+			case TransformHash, TransformRedact, TransformDrop:
+			case TransformFake:
+				if _, ok := fakeValues[rule.Fake]; !ok && !fakeKinds[rule.Fake] {
+					return fmt.Errorf("Unknown fake kind '%s' for '%s.%s'", rule.Fake, collection, rule.Field)
+				}
+			default:
+				return fmt.Errorf("Unknown action '%s' for '%s.%s'", rule.Action, collection, rule.Field)
+			}
+		}
+	}
+	return nil
+}
+
+// WithTransform returns a handle on the same database whose exports
+// (ExportJSON, ExportParquet) and clones (CloneTo) apply t to the records;
+// its other operations are those of d. A nil t applies none.
+func (d *Driver) WithTransform(t *Transform) (*Driver, error) {
+	if t != nil {
+		if err := t.validate(); err != nil {
+			return nil, err
+		}
+	}
+	c := *d
+	c.transform = t
+	return &c, nil
+}
+
+// transforms reports whether t changes the records of collection.
+func (t *Transform) transforms(collection string) bool {
+	return t != nil && len(t.Collections[collection]) > 0
+}
+
+// Apply returns doc, a record of collection, with the rules of the
+// collection applied; doc itself is left as it is.
+func (t *Transform) Apply(collection string, doc map[string]interface{}) map[string]interface{} {
+	if !t.transforms(collection) {
+		return doc
+	}
+	var v interface{} = doc
+	for _, rule := range t.Collections[collection] {
+		v = t.applyRule(v, strings.Split(rule.Field, "."), rule)
+	}
+	return v.(map[string]interface{})
+}
+
+// applyBytes is Apply on an encoded record.
+func (t *Transform) applyBytes(collection string, b []byte) ([]byte, error) {
+	if !t.transforms(collection) {
+		return b, nil
+	}
+	doc, err := decodeDocument(b)
+	if err != nil {
+		return nil, err
+	}
+	out, err := json.MarshalIndent(t.Apply(collection, doc), "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// applyRule returns v with rule applied at path, copying the objects and
+// arrays on the way instead of changing them.
+func (t *Transform) applyRule(v interface{}, path []string, rule FieldRule) interface{} {
+	switch e := v.(type) {
+	case []interface{}:
+		list := make([]interface{}, len(e))
+		for i, item := range e {
+			list[i] = t.applyRule(item, path, rule)
+		}
+		return list
+
+	case map[string]interface{}:
+		field, ok := e[path[0]]
+		if !ok {
+			return v
+		}
+		m := make(map[string]interface{}, len(e))
+		for k, item := range e {
+			m[k] = item
+		}
+		switch {
+		case len(path) > 1:
+			m[path[0]] = t.applyRule(field, path[1:], rule)
+		case rule.Action == TransformDrop:
+			delete(m, path[0])
+		default:
+			m[path[0]] = t.applyValue(field, rule)
+		}
+		return m
+	}
+	return v
+}
+
+// applyValue returns what rule makes of v.
+func (t *Transform) applyValue(v interface{}, rule FieldRule) interface{} {
+	if v == nil {
+		return nil
+	}
+	switch rule.Action {
+	case TransformRedact:
+		if _, ok := v.(string); ok {
+			return "[redacted]"
+		}
+		return nil
+	case TransformHash:
+		return hex.EncodeToString(t.sum(v)[:16])
+	case TransformFake:
+		return t.fake(v, rule.Fake)
+	}
+	return v
+}
+
+// sum is the keyed hash of v.
+func (t *Transform) sum(v interface{}) []byte {
+	b, _ := json.Marshal(v)
+	mac := hmac.New(sha256.New, []byte(t.Salt))
+	mac.Write(b)
+	return mac.Sum(nil)
+}
+
+// fake returns a made-up value of kind for v, the same for equal values.
+func (t *Transform) fake(v interface{}, kind string) interface{} {
+	sum := t.sum(v)
+	pick := func(kind string, i int) string {
+		values := fakeValues[kind]
+		return values[binary.BigEndian.Uint32(sum[i*4:])%uint32(len(values))]
+	}
+	n := binary.BigEndian.Uint64(sum[24:])
+
+	switch kind {
+	case "name":
+		return pick("first_name", 0) + " " + pick("last_name", 1)
+	case "email":
+		return fmt.Sprintf("%s.%s%d@example.com", strings.ToLower(pick("first_name", 0)), strings.ToLower(pick("last_name", 1)), n%1000)
+	case "phone":
+		return fmt.Sprintf("555-%04d", n%10000)
+	case "number":
+		return json.Number(fmt.Sprint(n % 100000))
+	}
+	return pick(kind, 0)
+}
@@ -0,0 +1,396 @@
+package jsondb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrTxDone is returned by the methods of a transaction that was already
+// committed or rolled back.
+var ErrTxDone = fmt.Errorf("Transaction has already been committed or rolled back")
+
+// TxConflictError is returned by Commit when a record the transaction
+// changes was changed by someone else since it started. It matches
+// ErrConflict with errors.Is; the transaction may be run again.
+type TxConflictError struct {
+	Collection string
+	Resource   string
+}
+
+func (e *TxConflictError) Error() string {
+	return fmt.Sprintf("Record '%s/%s' changed since the transaction started", e.Collection, e.Resource)
+}
+
+func (e *TxConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// journalCollection holds, in the system namespace, the transactions
+// being committed. An entry outliving its commit, after a crash, is
+// completed when the database is opened again.
+const journalCollection = "journal"
+
+// Tx is a set of writes and deletes, to records of any collections, that
+// take effect together or not at all. Nothing is stored before Commit;
+// until then only the reads of the transaction see its changes.
+//
+// Reads of a transaction see the database as of its start, across
+// collections, whatever is written meanwhile, and Commit fails with
+// ErrConflict if a record the transaction changes was changed by someone
+// else since: snapshot isolation. Until Commit or Rollback, the records
+// writes replace are kept for it. A Tx is not safe for concurrent use.
+type Tx struct {
+	d    *Driver
+	id   string
+	snap *snapshot
+	ops  []txOp
+	at   map[string]int // index in ops by collection and resource
+	done bool
+
+	savepoints []savepoint
+	replaced   []replacedOp
+}
+
+type txOp struct {
+	Change
+
+	// value is the Go value of a Write, for MergeOnWrite.
+	value interface{}
+}
+
+// txJournal is the journal entry of a transaction: its changes, with the
+// records they replace so a failed commit can be undone.
+type txJournal struct {
+	ID      string
+	Started time.Time
+	Changes []journalChange
+}
+
+type journalChange struct {
+	Change
+
+	// Before is the record the change replaces, empty when it creates one.
+	Before json.RawMessage `json:",omitempty"`
+}
+
+// Begin starts a transaction.
+func (d *Driver) Begin() (*Tx, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	id := fmt.Sprintf("%020d-%s", time.Now().UnixNano(), hex.EncodeToString(suffix))
+	return &Tx{d: d, id: id, snap: d.snaps.open(), at: make(map[string]int)}, nil
+}
+
+// ID identifies tx in logs and in the journal.
+func (tx *Tx) ID() string {
+	return tx.id
+}
+
+// Write stores v as the record collection/resource on commit.
+func (tx *Tx) Write(collection, resource string, v interface{}) error {
+	if err := tx.d.beforeSave(v); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	return tx.add(txOp{Change: Change{Op: OpWrite, Collection: collection, Resource: resource, Data: append(b, '\n')}, value: v})
+}
+
+// WriteRaw stores b, the JSON encoding of an object, as the record
+// collection/resource on commit, as Driver.WriteRaw does.
+func (tx *Tx) WriteRaw(collection, resource string, b []byte) error {
+	if !validObject(b) {
+		return ErrInvalidJSON
+	}
+	b = append(append(make([]byte, 0, len(b)+1), b...), '\n')
+	return tx.add(txOp{Change: Change{Op: OpWrite, Collection: collection, Resource: resource, Data: b, Raw: true}})
+}
+
+// Delete removes the record collection/resource on commit, which fails if
+// the record does not exist then.
+func (tx *Tx) Delete(collection, resource string) error {
+	return tx.add(txOp{Change: Change{Op: OpDelete, Collection: collection, Resource: resource}})
+}
+
+// add records op, replacing an earlier change to the same record.
+func (tx *Tx) add(op txOp) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if op.Collection == "" || op.Resource == "" {
+		return fmt.Errorf("Missing collection or resource - unable to change record")
+	}
+	op.Collection = tx.d.resolve(op.Collection)
+	if err := validName(op.Collection, op.Resource); err != nil {
+		return err
+	}
+	policyOp := PolicyWrite
+	if op.Op == OpDelete {
+		policyOp = PolicyDelete
+	}
+	if err := tx.d.allow(policyOp, op.Collection); err != nil {
+		return err
+	}
+	if err := tx.d.checkCollection(op.Collection); err != nil {
+		return err
+	}
+
+	key := op.Collection + "\x00" + op.Resource
+	if i, ok := tx.at[key]; ok {
+		if len(tx.savepoints) > 0 {
+			tx.replaced = append(tx.replaced, replacedOp{i, tx.ops[i]})
+		}
+		tx.ops[i] = op
+		return nil
+	}
+	tx.at[key] = len(tx.ops)
+	tx.ops = append(tx.ops, op)
+	return nil
+}
+
+// Read reads the record collection/resource into v as of the start of
+// tx, with the changes of tx.
+func (tx *Tx) Read(collection, resource string, v interface{}) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	collection = tx.d.resolve(collection)
+	if err := tx.d.allow(PolicyRead, collection); err != nil {
+		return err
+	}
+	b, err := tx.readSnapshot(collection, resource)
+	if err != nil {
+		return err
+	}
+	return tx.d.DecodeRecord(collection, b, v)
+}
+
+// Rollback drops the changes of tx.
+func (tx *Tx) Rollback() {
+	if !tx.done {
+		tx.snap.close()
+	}
+	tx.done = true
+	tx.ops, tx.at = nil, nil
+	tx.savepoints, tx.replaced = nil, nil
+}
+
+// Commit stores the changes of tx atomically. It locks the collections
+// involved in name order, so transactions cannot deadlock each other, and
+// runs in two phases: every change is checked, as Write and Delete check
+// it, and the whole set is journaled; then the changes are applied. A
+// failure before the journal is written changes nothing; one while
+// applying undoes the changes applied, and a crash is recovered from the
+// journal when the database is opened again.
+func (tx *Tx) Commit() (err error) {
+	d, span := tx.d.trace("Commit", "", tx.id)
+	defer span.end(&err)
+
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	defer tx.snap.close()
+	if len(tx.ops) == 0 {
+		return nil
+	}
+	if d.replicator() != nil {
+		return fmt.Errorf("Transactions cannot run on a replicated database")
+	}
+
+	var collections []string
+	for _, op := range tx.ops {
+		collections = append(collections, op.Collection)
+	}
+	unlock, err := d.lockCollections(collections)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entry, err := d.prepareTx(tx)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	sys := d.System()
+	journal := filepath.Join(sys.dir, journalCollection, tx.id+".json")
+	if err := sys.backend.WriteFile(journal, b); err != nil {
+		return err
+	}
+
+	// Snapshots see the changes of the transaction all at once.
+	a := *d
+	a.group = d.snaps.begin()
+	defer a.group.end()
+	for _, c := range entry.Changes {
+		a.group.record(c.Collection, c.Resource, c.Before, c.Before != nil)
+	}
+
+	for i, c := range entry.Changes {
+		if err := a.applyChange(c.Change); err != nil {
+			d.log.Error("Transaction %s failed on '%s/%s', undoing it: %v\n", tx.id, c.Collection, c.Resource, err)
+			a.undoChanges(entry.Changes[:i])
+			sys.backend.Remove(journal)
+			return err
+		}
+	}
+	return sys.backend.Remove(journal)
+}
+
+// prepareTx is the first phase of Commit: it checks the changes of tx and
+// returns its journal entry.
+func (d *Driver) prepareTx(tx *Tx) (txJournal, error) {
+	entry := txJournal{ID: tx.id, Started: time.Now().UTC()}
+
+	for _, op := range tx.ops {
+		path := filepath.Join(d.dir, op.Collection, op.Resource+".json")
+		before, err := d.backend.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return entry, err
+		}
+		if _, ok := tx.snap.replaced(op.Collection, op.Resource); ok {
+			return entry, &TxConflictError{Collection: op.Collection, Resource: op.Resource}
+		}
+		c := journalChange{Change: op.Change, Before: before}
+
+		switch op.Op {
+		case OpWrite:
+			cfg := d.collectionConfig(op.Collection)
+			b := op.Data
+			if op.value != nil && cfg != nil && cfg.MergeOnWrite {
+				if b, err = d.mergeOnWrite(path, op.value, b); err != nil {
+					return entry, err
+				}
+			}
+			if c.Data, err = d.prepareBytes(op.Collection, op.Resource, cfg, b); err != nil {
+				return entry, err
+			}
+		case OpDelete:
+			if before == nil {
+				return entry, &os.PathError{Op: "delete", Path: filepath.Join(op.Collection, op.Resource), Err: os.ErrNotExist}
+			}
+		}
+		entry.Changes = append(entry.Changes, c)
+	}
+	return entry, nil
+}
+
+// applyChange stores a prepared change; the caller holds the collection
+// lock.
+func (d *Driver) applyChange(c Change) error {
+	if c.Op == OpDelete {
+		return d.remove(c.Collection, c.Resource)
+	}
+	return d.storeBytes(c.Collection, c.Resource, c.Data)
+}
+
+// undoChanges puts back the records changes replaced, last first.
+func (d *Driver) undoChanges(changes []journalChange) {
+	for i := len(changes) - 1; i >= 0; i-- {
+		c := changes[i]
+		var err error
+		if len(c.Before) == 0 {
+			err = d.remove(c.Collection, c.Resource)
+		} else {
+			err = d.storeBytes(c.Collection, c.Resource, c.Before)
+		}
+		if err != nil {
+			d.log.Error("Unable to undo the change to '%s/%s': %v\n", c.Collection, c.Resource, err)
+		}
+	}
+}
+
+// lockCollections takes the write locks of collections in name order and
+// returns the function releasing them.
+func (d *Driver) lockCollections(collections []string) (func(), error) {
+	sorted := append([]string(nil), collections...)
+	sort.Strings(sorted)
+
+	var unlocks []func()
+	release := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+
+	for i, collection := range sorted {
+		if i > 0 && collection == sorted[i-1] {
+			continue
+		}
+		unlock, err := d.lockCollection(collection, LockWrite)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	return release, nil
+}
+
+// recoverTransactions completes the transactions left in the journal by a
+// crash: their entries were written, so they are committed.
+func (d *Driver) recoverTransactions() ([]string, error) {
+	sys := d.System()
+	dir := filepath.Join(sys.dir, journalCollection)
+
+	files, err := sys.backend.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var recovered []string
+	for _, file := range files {
+		if !isRecord(file) {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		b, err := sys.backend.ReadFile(path)
+		if err != nil {
+			return recovered, err
+		}
+
+		var entry txJournal
+		if err := json.Unmarshal(b, &entry); err != nil {
+			return recovered, fmt.Errorf("Invalid journal entry '%s': %v", file.Name(), err)
+		}
+
+		for _, c := range entry.Changes {
+			record := filepath.Join(d.dir, c.Collection, c.Resource+".json")
+			if c.Op == OpDelete {
+				err = d.backend.Remove(record)
+				if os.IsNotExist(err) {
+					err = nil
+				}
+			} else {
+				err = d.backend.WriteFile(record, c.Data)
+			}
+			if err != nil {
+				return recovered, fmt.Errorf("Unable to recover transaction %s: %v", entry.ID, err)
+			}
+		}
+		if err := sys.backend.Remove(path); err != nil {
+			return recovered, err
+		}
+		recovered = append(recovered, strings.TrimSuffix(file.Name(), ".json"))
+	}
+	return recovered, nil
+}
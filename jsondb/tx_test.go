@@ -0,0 +1,225 @@
+package jsondb
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// person is the record of the transaction tests.
+type person struct {
+	Name string
+	Age  int
+}
+
+func TestTxCommit(t *testing.T) {
+	db, _ := openTest(t, nil)
+	if err := db.Write("users", "ann", person{Name: "Ann", Age: 30}); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Write("users", "bob", person{Name: "Bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Write("teams", "red", map[string]interface{}{"Members": []string{"ann", "bob"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Delete("users", "ann"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the transaction sees its changes before Commit.
+	var p person
+	if err := tx.Read("users", "bob", &p); err != nil || p.Name != "Bob" {
+		t.Errorf("tx read of its own write = %+v, %v", p, err)
+	}
+	if err := tx.Read("users", "ann", &p); !os.IsNotExist(err) {
+		t.Errorf("tx read of its own delete: %v, want not found", err)
+	}
+	if err := db.Read("users", "bob", &p); !os.IsNotExist(err) {
+		t.Errorf("read before commit: %v, want not found", err)
+	}
+	if err := db.Read("users", "ann", &p); err != nil {
+		t.Errorf("read before commit: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Read("users", "bob", &p); err != nil || p.Name != "Bob" {
+		t.Errorf("read after commit = %+v, %v", p, err)
+	}
+	if err := db.Read("teams", "red", &map[string]interface{}{}); err != nil {
+		t.Errorf("read after commit: %v", err)
+	}
+	if err := db.Read("users", "ann", &p); !os.IsNotExist(err) {
+		t.Errorf("read of the deleted record after commit: %v, want not found", err)
+	}
+
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Errorf("second commit: %v, want ErrTxDone", err)
+	}
+	if err := tx.Write("users", "cat", person{}); err != ErrTxDone {
+		t.Errorf("write after commit: %v, want ErrTxDone", err)
+	}
+}
+
+func TestTxAllOrNothing(t *testing.T) {
+	db, dir := openTest(t, nil)
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Write("users", "bob", person{Name: "Bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Delete("users", "nobody"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); !os.IsNotExist(err) {
+		t.Fatalf("commit deleting a missing record: %v, want not found", err)
+	}
+
+	if err := db.Read("users", "bob", &person{}); !os.IsNotExist(err) {
+		t.Errorf("read after the failed commit: %v, want not found", err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, systemDir, journalCollection))
+	if len(entries) != 0 {
+		t.Errorf("journal holds %d entries after the failed commit", len(entries))
+	}
+}
+
+func TestTxSnapshotAndConflict(t *testing.T) {
+	db, _ := openTest(t, nil)
+	for _, name := range []string{"ann", "bob"} {
+		if err := db.Write("users", name, person{Name: name, Age: 30}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Write("users", "ann", person{Name: "ann", Age: 31}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The transaction reads the record as of its start.
+	var p person
+	if err := tx.Read("users", "ann", &p); err != nil || p.Age != 30 {
+		t.Errorf("tx read of a record written since = %+v, %v, want age 30", p, err)
+	}
+
+	if err := tx.Write("users", "bob", person{Name: "bob", Age: 40}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Write("users", "ann", person{Name: "ann", Age: 50}); err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	var conflict *TxConflictError
+	if !errors.Is(err, ErrConflict) || !errors.As(err, &conflict) || conflict.Resource != "ann" {
+		t.Fatalf("commit over a changed record: %v, want a conflict on ann", err)
+	}
+
+	if err := db.Read("users", "ann", &p); err != nil || p.Age != 31 {
+		t.Errorf("ann after the conflict = %+v, %v, want age 31", p, err)
+	}
+	if err := db.Read("users", "bob", &p); err != nil || p.Age != 30 {
+		t.Errorf("bob after the conflict = %+v, %v, want age 30", p, err)
+	}
+}
+
+func TestTxRecover(t *testing.T) {
+	db, dir := openTest(t, nil)
+	if err := db.Write("users", "ann", person{Name: "Ann"}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// A crash left a journaled transaction half applied.
+	entry := txJournal{ID: "crashed", Changes: []journalChange{
+		{Change: Change{Op: OpWrite, Collection: "users", Resource: "bob", Data: []byte(`{"Name":"Bob"}`)}},
+		{Change: Change{Op: OpDelete, Collection: "users", Resource: "ann"}},
+		{Change: Change{Op: OpDelete, Collection: "users", Resource: "cat"}},
+	}}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal := filepath.Join(dir, systemDir, journalCollection)
+	if err := os.MkdirAll(journal, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(journal, "crashed.json"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = New(dir, quiet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if got := db.Recovery().Transactions; len(got) != 1 || got[0] != "crashed" {
+		t.Errorf("recovered transactions %v, want [crashed]", got)
+	}
+	var p person
+	if err := db.Read("users", "bob", &p); err != nil || p.Name != "Bob" {
+		t.Errorf("bob after recovery = %+v, %v", p, err)
+	}
+	if err := db.Read("users", "ann", &p); !os.IsNotExist(err) {
+		t.Errorf("ann after recovery: %v, want not found", err)
+	}
+	if _, err := os.Stat(filepath.Join(journal, "crashed.json")); !os.IsNotExist(err) {
+		t.Errorf("journal entry after recovery: %v, want removed", err)
+	}
+}
+
+func TestTxThroughAlias(t *testing.T) {
+	db, dir := openTest(t, nil)
+	if err := db.Write("users_v2", "ann", map[string]interface{}{"Name": "Ann"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetAlias("users", "users_v2"); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ann map[string]interface{}
+	if err := tx.Read("users", "ann", &ann); err != nil || ann["Name"] != "Ann" {
+		t.Errorf("tx read through the alias = %v, %v", ann, err)
+	}
+	if err := tx.Write("users", "bob", map[string]interface{}{"Name": "Bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "users_v2", "bob.json")); err != nil {
+		t.Errorf("commit through the alias: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "users")); !os.IsNotExist(err) {
+		t.Errorf("commit created the collection users: %v", err)
+	}
+
+	// The alias can still be swapped.
+	if err := db.Write("users_v3", "ann", map[string]interface{}{"Name": "Ann"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetAlias("users", "users_v3"); err != nil {
+		t.Errorf("swapping the alias: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package jsondb
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// typeRegistry holds the Go types declared for collections, shared by the
+// copies of a driver.
+type typeRegistry struct {
+	mutex sync.RWMutex
+	types map[string]reflect.Type
+}
+
+// RegisterType declares the Go type of the records of collection, from a
+// value or a pointer to one. Writes to collections configured as Typed are
+// decoded into it before they are stored, so a record that does not fit,
+// such as a string where the type has an int, is rejected with a
+// ConstraintError instead of failing whoever reads it later.
+func (d *Driver) RegisterType(collection string, v interface{}) {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	d.types.mutex.Lock()
+	defer d.types.mutex.Unlock()
+	d.types.types[collection] = t
+}
+
+// recordType returns the type registered for collection.
+func (d *Driver) recordType(collection string) (reflect.Type, bool) {
+	if d.types == nil {
+		return nil, false
+	}
+	d.types.mutex.RLock()
+	defer d.types.mutex.RUnlock()
+
+	t, ok := d.types.types[collection]
+	return t, ok
+}
+
+// checkType decodes the encoded record b into the type registered for its
+// typed collection. Fields the type does not have are left alone, so
+// writers can share a collection as with MergeOnWrite.
+func (d *Driver) checkType(collection, resource string, cfg *CollectionConfig, b []byte) error {
+	if cfg == nil || !cfg.Typed {
+		return nil
+	}
+	t, ok := d.recordType(collection)
+	if !ok {
+		return nil
+	}
+
+	err := json.Unmarshal(b, reflect.New(t).Interface())
+	if e, ok := err.(*json.UnmarshalTypeError); ok {
+		field := e.Field
+		if field == "" {
+			field = "record"
+		}
+		return &ConstraintError{resource, fmt.Sprintf("field '%s' is %s, want %s", field, e.Value, e.Type)}
+	}
+	if err != nil {
+		return &ConstraintError{resource, fmt.Sprintf("does not fit %s: %v", t, err)}
+	}
+	return nil
+}
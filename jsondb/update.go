@@ -0,0 +1,141 @@
+package jsondb
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Update performs a locked read-modify-write of a record: fn receives the
+// decoded document and may modify it in place, and the result is written
+// back while the collection stays locked, so concurrent writers cannot
+// interleave. If fn returns an error nothing is written.
+func (d *Driver) Update(collection, resource string, fn func(doc map[string]interface{}) error) (err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("Update", collection, resource)
+	defer span.end(&err)
+
+	if err := d.allow(PolicyWrite, collection); err != nil {
+		return err
+	}
+
+	if collection == "" {
+		return fmt.Errorf("Missing collection - unable to update!")
+	}
+
+	if resource == "" {
+		return fmt.Errorf("Missing resource - unable to update record (no name)!")
+	}
+
+	if err := validName(collection, resource); err != nil {
+		return err
+	}
+
+	if err := d.checkCollection(collection); err != nil {
+		return err
+	}
+
+	if r := d.replicator(); r != nil {
+		return d.replicateUpdate(r, collection, resource, fn)
+	}
+
+	unlock, err := d.lockCollection(collection, LockWrite)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	raw, err := d.readRecord(collection, resource, LockWrite)
+	if err != nil {
+		return err
+	}
+
+	doc, err := decodeDocument(raw)
+	if err != nil {
+		return err
+	}
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+
+	if err := fn(doc); err != nil {
+		return err
+	}
+
+	return d.write(collection, resource, doc)
+}
+
+// ErrInvalidSubpath is returned when a subpath crosses a value that is
+// neither an object nor an array.
+var ErrInvalidSubpath = fmt.Errorf("Subpath does not address a field of the record")
+
+// ValueAt returns the value reached by following path segments through
+// objects (by key) and arrays (by index).
+func ValueAt(v interface{}, path []string) (interface{}, bool) {
+	for _, seg := range path {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			e, ok := t[seg]
+			if !ok {
+				return nil, false
+			}
+			v = e
+		case []interface{}:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil, false
+			}
+			v = t[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// SetValueAt stores value at path inside doc, creating missing objects on
+// the way. Array elements are addressed by index; "-" appends.
+func SetValueAt(doc map[string]interface{}, path []string, value interface{}) error {
+	if len(path) == 0 {
+		return ErrInvalidSubpath
+	}
+
+	var parent interface{} = doc
+	for _, seg := range path[:len(path)-1] {
+		switch t := parent.(type) {
+		case map[string]interface{}:
+			next, ok := t[seg]
+			if !ok || next == nil {
+				next = map[string]interface{}{}
+				t[seg] = next
+			}
+			parent = next
+		case []interface{}:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(t) {
+				return ErrInvalidSubpath
+			}
+			parent = t[i]
+		default:
+			return ErrInvalidSubpath
+		}
+	}
+
+	last := path[len(path)-1]
+	switch t := parent.(type) {
+	case map[string]interface{}:
+		t[last] = value
+		return nil
+	case []interface{}:
+		if last == "-" {
+			// Appending changes the slice header; store it in its parent.
+			return SetValueAt(doc, path[:len(path)-1], append(t, value))
+		}
+		i, err := strconv.Atoi(last)
+		if err != nil || i < 0 || i >= len(t) {
+			return ErrInvalidSubpath
+		}
+		t[i] = value
+		return nil
+	}
+	return ErrInvalidSubpath
+}
@@ -0,0 +1,168 @@
+package jsondb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// versionsCollection is the system collection keeping the versions of the
+// records of collections configured with Versions, one collection per
+// record: "versions/<collection>/<resource>", by version number.
+const versionsCollection = "versions"
+
+// ErrNoVersion is returned for a version of a record that is not kept.
+var ErrNoVersion = fmt.Errorf("Version not found")
+
+// RecordVersion describes a kept version of a record. Versions are
+// numbered from 1 in the order they were written; the last is the current
+// record, unless it was deleted.
+type RecordVersion struct {
+	Version int
+	Written time.Time
+}
+
+func (d *Driver) versionsDir(collection, resource string) string {
+	sys := d.System()
+	return filepath.Join(sys.dir, versionsCollection, collection, resource)
+}
+
+// keepVersion adds b, just written as collection/resource, to the versions
+// of the record and drops those beyond the Versions of its collection.
+// The caller holds the collection lock.
+func (d *Driver) keepVersion(collection, resource string, b []byte) error {
+	cfg := d.collectionConfig(collection)
+	if cfg == nil || cfg.Versions <= 0 {
+		return nil
+	}
+	sys := d.System()
+	dir := d.versionsDir(collection, resource)
+
+	versions, err := d.listVersions(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	next := 1
+	if len(versions) > 0 {
+		next = versions[len(versions)-1].Version + 1
+	}
+	if err := sys.backend.WriteFile(filepath.Join(dir, versionName(next)), b); err != nil {
+		return err
+	}
+
+	versions = append(versions, RecordVersion{Version: next})
+	for _, v := range versions[:max(len(versions)-cfg.Versions, 0)] {
+		if err := sys.backend.Remove(filepath.Join(dir, versionName(v.Version))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func versionName(version int) string {
+	return fmt.Sprintf("%010d.json", version)
+}
+
+// listVersions lists the versions kept in dir, oldest first.
+func (d *Driver) listVersions(dir string) ([]RecordVersion, error) {
+	files, err := d.System().backend.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []RecordVersion
+	for _, file := range files {
+		if !isRecord(file) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		versions = append(versions, RecordVersion{Version: n, Written: file.ModTime()})
+	}
+	return versions, nil
+}
+
+// Versions lists the kept versions of the record collection/resource,
+// oldest first: the last Versions written, in a collection configured to
+// keep them.
+func (d *Driver) Versions(collection, resource string) (_ []RecordVersion, err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("Versions", collection, resource)
+	defer span.end(&err)
+
+	if err := d.allow(PolicyRead, collection); err != nil {
+		return nil, err
+	}
+
+	if err := validName(collection, resource); err != nil {
+		return nil, err
+	}
+
+	unlock, err := d.lockCollection(collection, LockRead)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	versions, err := d.listVersions(d.versionsDir(collection, resource))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return versions, err
+}
+
+// ReadVersion reads version of the record collection/resource into v. It
+// fails with ErrNoVersion when that version is not kept.
+func (d *Driver) ReadVersion(collection, resource string, version int, v interface{}) (err error) {
+	collection = d.resolve(collection)
+	d, span := d.trace("ReadVersion", collection, resource)
+	defer span.end(&err)
+
+	if err := d.allow(PolicyRead, collection); err != nil {
+		return err
+	}
+
+	if err := validName(collection, resource); err != nil {
+		return err
+	}
+
+	unlock, err := d.lockCollection(collection, LockRead)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	b, err := d.System().backend.ReadFile(filepath.Join(d.versionsDir(collection, resource), versionName(version)))
+	if os.IsNotExist(err) {
+		return ErrNoVersion
+	}
+	if err != nil {
+		return err
+	}
+	d.traceBytes(len(b))
+
+	return d.DecodeRecord(collection, b, v)
+}
+
+// Diff returns the JSON Patch turning the record collection/resource into
+// other, which may be any value encoding to a JSON object, such as another
+// version of the record read with ReadVersion.
+func (d *Driver) Diff(collection, resource string, other interface{}) (_ JSONPatch, err error) {
+	d, span := d.trace("Diff", collection, resource)
+	defer span.end(&err)
+
+	b, err := d.ReadRaw(collection, resource)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := decodeDocument(b)
+	if err != nil {
+		return nil, err
+	}
+	return DiffDocuments(doc, other)
+}
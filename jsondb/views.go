@@ -0,0 +1,242 @@
+package jsondb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// viewsCollection is the system collection holding the persisted results
+// of materialized views.
+const viewsCollection = "views"
+
+// viewPersistDelay is how long a view changed by writes waits before it
+// is persisted, so that a burst of writes persists it once.
+const viewPersistDelay = time.Second
+
+// View is a materialized view: the records of Collection matching Where,
+// grouped by the value of the GroupBy field path. Results are kept up to
+// date as records are written and deleted, and are rebuilt from scratch
+// every Refresh interval when it is set, by the "refresh-view-<Name>" job.
+// Views are not kept across restarts: define them again on opening.
+type View struct {
+	Name       string
+	Collection string
+	Where      []Condition
+	GroupBy    string
+	Refresh    time.Duration
+}
+
+// ViewResult is the persisted content of a view: the resource names of the
+// matching records for each group.
+type ViewResult struct {
+	Name        string
+	Collection  string
+	RefreshedAt time.Time
+	Groups      map[string][]string
+}
+
+type viewState struct {
+	View
+	members   map[string]string // resource -> group
+	refreshed time.Time
+	pending   *time.Timer // persists changes not persisted yet
+}
+
+// DefineView registers v, builds its initial result and persists it.
+// Redefining a view replaces the previous definition.
+func (d *Driver) DefineView(v View) error {
+	if v.Name == "" {
+		return fmt.Errorf("Missing view name!")
+	}
+
+	if v.Collection == "" || IsReserved(v.Collection) {
+		return fmt.Errorf("Invalid collection '%s' for view '%s'", v.Collection, v.Name)
+	}
+
+	state := &viewState{View: v}
+
+	// Lock order is collection, then views, as in Write.
+	unlock, err := d.lockCollection(v.Collection, LockRead)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	d.viewMutex.Lock()
+	defer d.viewMutex.Unlock()
+
+	if err := d.rebuildView(state); err != nil {
+		return err
+	}
+	d.views[v.Name] = state
+
+	job := "refresh-view-" + v.Name
+	if v.Refresh <= 0 {
+		d.scheduler.Unregister(job)
+		return nil
+	}
+
+	return d.scheduler.Register(job, "@every "+v.Refresh.String(), func() error {
+		return d.RefreshView(v.Name)
+	})
+}
+
+// ReadView returns the result of the named view: the current one for a
+// view defined on d, the last persisted one otherwise.
+func (d *Driver) ReadView(name string) (ViewResult, error) {
+	d.viewMutex.Lock()
+	state, ok := d.views[name]
+	if ok {
+		defer d.viewMutex.Unlock()
+		return state.result(), nil
+	}
+	d.viewMutex.Unlock()
+
+	var result ViewResult
+	err := d.System().Read(viewsCollection, name, &result)
+	return result, err
+}
+
+// RefreshView rebuilds the named view from its source collection.
+func (d *Driver) RefreshView(name string) (err error) {
+	d, span := d.trace("RefreshView", "", name)
+	defer span.end(&err)
+
+	d.viewMutex.Lock()
+	state, ok := d.views[name]
+	d.viewMutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("Unknown view '%s'", name)
+	}
+
+	// Lock order is collection, then views, as in Write.
+	unlock, err := d.lockCollection(state.Collection, LockRead)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	d.viewMutex.Lock()
+	defer d.viewMutex.Unlock()
+
+	return d.rebuildView(state)
+}
+
+// rebuildView recomputes state from every record of its collection.
+// The caller holds the collection lock and viewMutex.
+func (d *Driver) rebuildView(state *viewState) error {
+	docs, err := d.query(state.Collection, Query{Where: state.Where})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	state.members = make(map[string]string, len(docs))
+	for _, doc := range docs {
+		state.members[doc.Resource] = state.group(doc.Data)
+	}
+	state.refreshed = time.Now().UTC()
+
+	return d.persistView(state)
+}
+
+func (state *viewState) group(doc map[string]interface{}) string {
+	if state.GroupBy == "" {
+		return ""
+	}
+	v, _ := lookup(doc, state.GroupBy)
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// result returns the content of state. The caller holds viewMutex.
+func (state *viewState) result() ViewResult {
+	result := ViewResult{
+		Name:        state.Name,
+		Collection:  state.Collection,
+		RefreshedAt: state.refreshed,
+		Groups:      map[string][]string{},
+	}
+
+	for resource, group := range state.members {
+		result.Groups[group] = append(result.Groups[group], resource)
+	}
+	for _, resources := range result.Groups {
+		sort.Strings(resources)
+	}
+	return result
+}
+
+// persistView writes the result of state, and cancels the pending persist
+// it makes unnecessary. The caller holds viewMutex.
+func (d *Driver) persistView(state *viewState) error {
+	if state.pending != nil {
+		state.pending.Stop()
+		state.pending = nil
+	}
+	return d.System().Write(viewsCollection, state.Name, state.result())
+}
+
+// schedulePersist persists state viewPersistDelay from now, unless that
+// is pending already. The caller holds viewMutex.
+func (d *Driver) schedulePersist(state *viewState) {
+	if state.pending != nil {
+		return
+	}
+	db := d.WithContext(context.Background())
+	state.pending = time.AfterFunc(viewPersistDelay, func() {
+		db.viewMutex.Lock()
+		defer db.viewMutex.Unlock()
+		if state.pending == nil {
+			return
+		}
+		if err := db.persistView(state); err != nil {
+			db.log.Error("Unable to persist view '%s': %v\n", state.Name, err)
+		}
+	})
+}
+
+// flushViews persists the views with changes not persisted yet.
+func (d *Driver) flushViews() {
+	d.viewMutex.Lock()
+	defer d.viewMutex.Unlock()
+
+	for _, state := range d.views {
+		if state.pending == nil {
+			continue
+		}
+		if err := d.persistView(state); err != nil {
+			d.log.Error("Unable to persist view '%s': %v\n", state.Name, err)
+		}
+	}
+}
+
+// updateViews applies a change to one record of collection to every view
+// defined over it, and schedules their persisting. A nil doc means the
+// record was deleted; an empty resource means the whole collection was.
+func (d *Driver) updateViews(collection, resource string, doc map[string]interface{}) {
+	d.viewMutex.Lock()
+	defer d.viewMutex.Unlock()
+
+	for _, state := range d.views {
+		if state.Collection != collection {
+			continue
+		}
+
+		switch {
+		case resource == "":
+			state.members = map[string]string{}
+		case doc != nil && Query{Where: state.Where}.Match(doc):
+			state.members[resource] = state.group(doc)
+		default:
+			delete(state.members, resource)
+		}
+		state.refreshed = time.Now().UTC()
+		d.schedulePersist(state)
+	}
+}
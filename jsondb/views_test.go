@@ -0,0 +1,53 @@
+package jsondb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestViewPersistedAfterWrites(t *testing.T) {
+	db, dir := openTest(t, nil)
+	if err := db.DefineView(View{Name: "byAge", Collection: "users", GroupBy: "Age"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, u := range []struct {
+		name string
+		age  int
+	}{{"ann", 30}, {"bob", 40}, {"eve", 30}} {
+		if err := db.Write("users", u.name, map[string]interface{}{"Age": u.age}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("users", "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{"30": {"ann", "eve"}}
+	result, err := db.ReadView("byAge")
+	if err != nil || !reflect.DeepEqual(result.Groups, want) {
+		t.Errorf("ReadView = %v, %v; want %v", result.Groups, err, want)
+	}
+
+	// The writes persist the view later, in one go.
+	var persisted ViewResult
+	if err := db.System().Read(viewsCollection, "byAge", &persisted); err != nil {
+		t.Fatal(err)
+	}
+	if len(persisted.Groups) != 0 {
+		t.Errorf("persisted right away: %v", persisted.Groups)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := New(dir, quiet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	result, err = reopened.ReadView("byAge")
+	if err != nil || !reflect.DeepEqual(result.Groups, want) {
+		t.Errorf("persisted view = %v, %v; want %v", result.Groups, err, want)
+	}
+}
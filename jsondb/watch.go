@@ -0,0 +1,201 @@
+package jsondb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Operations reported by change events.
+const (
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// Event describes one change to a record. Deleting a whole collection is a
+// single delete event with an empty Resource.
+type Event struct {
+	Seq        uint64
+	Op         string
+	Collection string
+	Resource   string `json:",omitempty"`
+	Time       time.Time
+
+	// Data is the record after a create or update, and before a delete.
+	Data json.RawMessage `json:",omitempty"`
+}
+
+// Token returns the resume token that continues a watch after e.
+func (e Event) Token() string {
+	return strconv.FormatUint(e.Seq, 10)
+}
+
+// ErrResumeExpired is returned by Watch when events after the resume token
+// are no longer retained, so a watcher would miss changes. The watcher has
+// to re-read the collection and watch from now on.
+var ErrResumeExpired = fmt.Errorf("Resume token has expired - changes were missed")
+
+const (
+	// feedHistory is how many recent events are kept for resuming.
+	feedHistory = 4096
+
+	// watchBuffer is how many events a watcher may fall behind before it
+	// is dropped.
+	watchBuffer = 256
+)
+
+// changeFeed fans change events out to watchers.
+type changeFeed struct {
+	mutex    sync.Mutex
+	seq      uint64
+	history  []Event
+	watchers map[*watcher]bool
+}
+
+type watcher struct {
+	collection string
+	ch         chan Event
+}
+
+// watches reports whether a watch of watched sees the events of collection.
+// Watching every collection leaves out the system namespace, such as the
+// messages of topics.
+func watches(watched, collection string) bool {
+	if watched == "" {
+		return !IsReserved(collection)
+	}
+	return watched == collection
+}
+
+func newChangeFeed() *changeFeed {
+	// Sequence numbers start at the current time, so tokens handed out
+	// before a restart are recognized as expired instead of being reused.
+	return &changeFeed{
+		seq:      uint64(time.Now().UnixNano()),
+		watchers: make(map[*watcher]bool),
+	}
+}
+
+// publish records a change; the caller holds the collection lock, so events
+// of one collection are published in the order they happened.
+func (d *Driver) publish(op, collection, resource string, data []byte) {
+	if d.qcache != nil {
+		d.qcache.invalidate(op, collection, resource, data)
+	}
+	if d.stale != nil {
+		d.stale.drop(collection, resource)
+	}
+	if d.flights != nil {
+		d.flights.forget(collection, resource)
+	}
+	d.hotKeys.count(collection, resource, true)
+
+	f := d.feed
+	if f == nil {
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.seq++
+	e := Event{
+		Seq:        f.seq,
+		Op:         op,
+		Collection: collection,
+		Resource:   resource,
+		Time:       time.Now().UTC(),
+		Data:       json.RawMessage(data),
+	}
+
+	if len(f.history) == feedHistory {
+		copy(f.history, f.history[1:])
+		f.history = f.history[:feedHistory-1]
+	}
+	f.history = append(f.history, e)
+
+	for w := range f.watchers {
+		if !watches(w.collection, collection) {
+			continue
+		}
+		select {
+		case w.ch <- e:
+		default:
+			// Too slow: drop the watcher. It resumes from its last event.
+			delete(f.watchers, w)
+			close(w.ch)
+		}
+	}
+}
+
+// ChangeToken returns the resume token of the latest change, for Watch
+// to see the changes made from now on; it is "" for drivers whose changes
+// cannot be watched.
+func (d *Driver) ChangeToken() string {
+	f := d.feed
+	if f == nil {
+		return ""
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return strconv.FormatUint(f.seq, 10)
+}
+
+// Watch streams the changes to collection, or to every collection if it is
+// empty, until ctx is done. With a resume token (see Event.Token) the
+// events after it are replayed first. The channel is closed when ctx is done
+// or when the watcher falls too far behind; reconnect with the token of the
+// last event received.
+func (d *Driver) Watch(ctx context.Context, collection, resume string) (<-chan Event, error) {
+	collection = d.resolve(collection)
+	if err := d.allow(PolicyRead, collection); err != nil {
+		return nil, err
+	}
+	f := d.feed
+	if f == nil {
+		return nil, fmt.Errorf("Changes to '%s' cannot be watched", d.dir)
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var replay []Event
+	if resume != "" {
+		after, err := strconv.ParseUint(resume, 10, 64)
+		if err != nil || after > f.seq {
+			return nil, ErrResumeExpired
+		}
+		if after < f.seq && (len(f.history) == 0 || f.history[0].Seq > after+1) {
+			return nil, ErrResumeExpired
+		}
+
+		for _, e := range f.history {
+			if e.Seq > after && watches(collection, e.Collection) {
+				replay = append(replay, e)
+			}
+		}
+	}
+
+	w := &watcher{collection: collection, ch: make(chan Event, watchBuffer+len(replay))}
+	for _, e := range replay {
+		w.ch <- e
+	}
+	f.watchers[w] = true
+
+	go func() {
+		<-ctx.Done()
+
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		if f.watchers[w] {
+			delete(f.watchers, w)
+			close(w.ch)
+		}
+	}()
+
+	return w.ch, nil
+}
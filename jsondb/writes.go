@@ -0,0 +1,120 @@
+package jsondb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// writesCollection is the system collection keeping the WriteInfo of the
+// records of collections configured with TrackWrites:
+// "writes/<collection>", by resource.
+const writesCollection = "writes"
+
+// actorKey is the context key of the actor of the current operation.
+type actorKey struct{}
+
+// WithActor returns ctx carrying actor, the user or service on whose
+// behalf the operations of a driver bound to it (see WithContext) run.
+// Collections with TrackWrites record it as the writer of their records.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// Actor returns the actor ctx carries, if any; see WithActor.
+func Actor(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// claimedActorKey is the context key of the actor an operation claims.
+type claimedActorKey struct{}
+
+// WithClaimedActor returns ctx carrying actor as the one the caller says
+// it acts for, unverified, as a service behind a shared account names its
+// user. Collections with TrackWrites record it apart from the writer.
+func WithClaimedActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, claimedActorKey{}, actor)
+}
+
+// ClaimedActor returns the claimed actor ctx carries, if any; see
+// WithClaimedActor.
+func ClaimedActor(ctx context.Context) string {
+	actor, _ := ctx.Value(claimedActorKey{}).(string)
+	return actor
+}
+
+// WriteInfo is who last wrote a record of a collection with TrackWrites,
+// and when, for telling who overwrote a change.
+type WriteInfo struct {
+	// Version counts the writes of the record, from 1 when it was
+	// created; deleting it starts over.
+	Version int64
+
+	// Writer is the actor of the last write, and ClaimedWriter the actor
+	// it claimed to act for, which nothing checks.
+	Writer        string `json:",omitempty"`
+	ClaimedWriter string `json:",omitempty"`
+	Modified      time.Time
+}
+
+// trackWrite counts a write of collection/resource by the actor of d; the
+// caller holds the collection lock.
+func (d *Driver) trackWrite(collection, resource string) error {
+	cfg := d.collectionConfig(collection)
+	if cfg == nil || !cfg.TrackWrites {
+		return nil
+	}
+
+	sys := d.System()
+	var info WriteInfo
+	if err := sys.Read(writesCollection+"/"+collection, resource, &info); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	info.Version++
+	info.Writer = Actor(d.Context())
+	info.ClaimedWriter = ClaimedActor(d.Context())
+	info.Modified = time.Now().UTC()
+	return sys.Write(writesCollection+"/"+collection, resource, info)
+}
+
+// forgetWrites drops the WriteInfo of a deleted record, or of a whole
+// collection when resource is empty.
+func (d *Driver) forgetWrites(collection, resource string) error {
+	sys := d.System()
+	if sys == d {
+		return nil
+	}
+
+	path := filepath.Join(sys.dir, writesCollection, collection)
+	if resource != "" {
+		path = filepath.Join(path, resource+".json")
+	}
+	err := sys.backend.RemoveAll(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// WriteInfo returns who last wrote the record collection/resource, and
+// when. It returns a zero WriteInfo for records of collections without
+// TrackWrites, and for those not written since it was set.
+func (d *Driver) WriteInfo(collection, resource string) (WriteInfo, error) {
+	collection = d.resolve(collection)
+	var info WriteInfo
+	if err := validName(collection, resource); err != nil {
+		return info, err
+	}
+
+	cfg := d.collectionConfig(collection)
+	if cfg == nil || !cfg.TrackWrites {
+		return info, nil
+	}
+	err := d.System().Read(writesCollection+"/"+collection, resource, &info)
+	if os.IsNotExist(err) {
+		return WriteInfo{}, nil
+	}
+	return info, err
+}
@@ -0,0 +1,36 @@
+package jsondb
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWriteInfoKeepsClaimApart(t *testing.T) {
+	db, _ := openTest(t, nil)
+	if err := db.ConfigureCollection("docs", CollectionConfig{TrackWrites: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := WithClaimedActor(WithActor(context.Background(), "alice"), "mallory")
+	if err := db.WithContext(ctx).Write("docs", "a", map[string]int{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := db.WriteInfo("docs", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Writer != "alice" || info.ClaimedWriter != "mallory" {
+		t.Errorf("WriteInfo = %+v, want writer alice, claimed mallory", info)
+	}
+
+	// A write claiming nobody clears the claim of the one before.
+	if err := db.WithContext(WithActor(context.Background(), "bob")).Write("docs", "a", map[string]int{"n": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = db.WriteInfo("docs", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if info.Writer != "bob" || info.ClaimedWriter != "" || info.Version != 2 {
+		t.Errorf("WriteInfo = %+v, want version 2 by bob, claiming nobody", info)
+	}
+}
@@ -1,207 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io/ioutil"
-	"net/url"
 	"os"
 	"path/filepath"
-	"sync"
+	"time"
 	"archive/zip"
 	"io"
+	"os/signal"
+	"syscall"
 
-	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/jcelliott/lumber"
+	"database/jsondb"
+	_ "database/jsondb/codecs"
+	"database/jsondb/oteltrace"
 )
 
-const Version = "1.0.0"
-
-type (
-	Logger interface {
-		Fatal(string, ...interface{})
-		Error(string, ...interface{})
-		Warn(string, ...interface{})
-		Info(string, ...interface{})
-		Debug(string, ...interface{})
-		Trace(string, ...interface{})
-	}
-
-	Driver struct {
-		mutex   sync.Mutex
-		mutexes map[string]*sync.Mutex
-		dir     string
-		log     Logger
-	}
-)
-
-type Options struct {
-	Logger
-}
-
-func New(dir string, options *Options) (*Driver, error) {
-	dir = filepath.Clean(dir)
-
-	opts := Options{}
-
-	if options != nil {
-		opts = *options
-	}
-
-	if opts.Logger == nil {
-		opts.Logger = lumber.NewConsoleLogger((lumber.INFO))
-	}
-
-	driver := Driver{
-		dir:     dir,
-		mutexes: make(map[string]*sync.Mutex),
-		log:     opts.Logger,
-	}
-
-	if _, err := os.Stat(dir); err == nil {
-		opts.Logger.Debug("Using '%s' (database already exists)\n", dir)
-		return &driver, nil
-	}
-
-	opts.Logger.Debug("Creating the database at '%s'...\n", dir)
-	return &driver, os.MkdirAll(dir, 0755)
-}
-
-func (d *Driver) Write(collection, resource string, v interface{}) error {
-	if collection == "" {
-		return fmt.Errorf("Missing collection - no place to save record!")
-	}
-
-	if resource == "" {
-		return fmt.Errorf("Missing resource - unable to save record (no name)!")
-	}
-
-	mutex := d.getOrCreateMutex(collection)
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	dir := filepath.Join(d.dir, collection)
-	fnlPath := filepath.Join(dir, resource+".json")
-	tmpPath := fnlPath + ".tmp"
-
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return err
-	}
-
-	b, err := json.MarshalIndent(v, "", "\t")
-	if err != nil {
-		return err
-	}
-
-	b = append(b, byte('\n'))
-
-	if err := ioutil.WriteFile(tmpPath, b, 0644); err != nil {
-		return err
-	}
-
-	return os.Rename(tmpPath, fnlPath)
-}
-
-func (d *Driver) Read(collection, resource string, v interface{}) error {
-	if collection == "" {
-		return fmt.Errorf("Missing collection - unable to read!")
-	}
-
-	if resource == "" {
-		return fmt.Errorf("Missing resource - unable to read record (no name)!")
-	}
-
-	// Decode the resource name if needed
-	decodedResource, err := url.QueryUnescape(resource)
-	if err != nil {
-		return fmt.Errorf("Error decoding resource name: %v", err)
-	}
-
-	record := filepath.Join(d.dir, collection, decodedResource + ".json") // Ensure only one .json extension
-
-	if _, err := stat(record); err != nil {
-		return err
-	}
-
-	b, err := ioutil.ReadFile(record)
-	if err != nil {
-		return err
-	}
-
-	return json.Unmarshal(b, &v)
-}
-
-
-func (d *Driver) ReadAll(collection string) ([]string, error) {
-
-	if collection == "" {
-		return nil, fmt.Errorf("Missing collection - unable to read")
-	}
-	dir := filepath.Join(d.dir, collection)
-
-	if _, err := stat(dir); err != nil {
-		return nil, err
-	}
-
-	files, _ := ioutil.ReadDir(dir)
-
-	var records []string
-
-	for _, file := range files {
-		b, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
-		if err != nil {
-			return nil, err
-		}
-
-		records = append(records, string(b))
-	}
-	return records, nil
-}
-
-func (d *Driver) Delete(collection, resource string) error {
-
-	path := filepath.Join(collection, resource)
-	mutex := d.getOrCreateMutex(collection)
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	dir := filepath.Join(d.dir, path)
-
-	switch fi, err := stat(dir); {
-	case fi == nil, err != nil:
-		return fmt.Errorf("unable to find file or directory named %v\n", path)
-
-	case fi.Mode().IsDir():
-		return os.RemoveAll(dir)
-
-	case fi.Mode().IsRegular():
-		return os.RemoveAll(dir + ".json")
-	}
-	return nil
-}
-
-func (d *Driver) getOrCreateMutex(collection string) *sync.Mutex {
-
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
-	m, ok := d.mutexes[collection]
-
-	if !ok {
-		m = &sync.Mutex{}
-		d.mutexes[collection] = m
-	}
-
-	return m
-}
-
-func stat(path string) (fi os.FileInfo, err error) {
-	if fi, err = os.Stat(path); os.IsNotExist(err) {
-		fi, err = os.Stat(path + ".json")
-	}
-	return
-}
-
 type Address struct {
 	City    string
 	State   string
@@ -276,16 +92,50 @@ func zipFolder(source, target string) error {
 
 
 func main() {
-	app := fiber.New()
-    
-	// Default CORS config allows all origins
-    app.Use(cors.New())
+	configPath := flag.String("config", "config.json", "path to the server config file")
+	flag.Parse()
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		fmt.Println("Error", err)
+	}
+
+	shutdownTracing, err := setupTracing(cfg.Tracing)
+	if err != nil {
+		fmt.Println("Error", err)
+	} else {
+		defer shutdownTracing(context.Background())
+	}
+
+	log := newLevelLogger()
+
+	opts := &jsondb.Options{Logger: log, Limits: cfg.Limits, Retry: cfg.Retry, DiskWatermark: cfg.DiskWatermark, Tracer: oteltrace.Tracer{}, Upgrade: cfg.Upgrade, Corrupt: cfg.Corrupt, QueryCache: cfg.QueryCache, QueryLimits: cfg.QueryLimits, LockTimeout: cfg.LockTimeout, MemoryBudget: cfg.MemoryBudget, SpillDir: cfg.SpillDir, Breaker: cfg.Breaker, HotKeys: cfg.HotKeys}
+
+	// Only the main database reads through; those of the manager are
+	// not on the upstream server.
+	mainOpts := *opts
+	if mainOpts.ReadThrough, err = readThroughOptions(cfg.ReadThrough); err != nil {
+		fmt.Println("Error", err)
+	}
 
-	dir := "./"
+	db, err := jsondb.New(cfg.Dir, &mainOpts)
+	if err != nil {
+		fmt.Println("Error", err)
+	}
 
-	db, err := New(dir, nil)
+	dbs := make(map[string]jsondb.DatabaseConfig)
+	for name, dir := range cfg.Databases {
+		dbs[name] = jsondb.DatabaseConfig{Dir: dir}
+	}
+
+	manager, err := jsondb.OpenManager(opts, dbs)
 	if err != nil {
 		fmt.Println("Error", err)
+		manager = jsondb.NewManager(opts)
+	}
+
+	if err := applySettings(db, log, Config{}, cfg); err != nil {
+		fmt.Println("Error", err)
 	}
 
 	// employees := []User{
@@ -307,106 +157,49 @@ func main() {
 	// 	})
 	// }
 
-	app.Get("/", func(c *fiber.Ctx) error {
-		return c.SendString("Welcome to the database server")
-	})
-
-	app.Post("/addUser", func(c *fiber.Ctx) error {
-		var user User
-
-		if err := c.BodyParser(&user); err != nil {
-			return c.Status(400).SendString("Error parsing request body")
-		}
-
-		if err := db.Write("users", user.Name, user); err != nil {
-			return c.Status(500).SendString("Error saving user data")
-		}
-
-		return c.Status(201).JSON(user)
-	})
-
-	app.Delete("/deleteUser/:name", func(c *fiber.Ctx) error {
-		name := c.Params("name")
-	
-		if name == "" {
-			return c.Status(400).SendString("Name parameter is required")
-		}
-	
-		if err := db.Delete("users", name); err != nil {
-			return c.Status(500).SendString("Error deleting user data")
-		}
-	
-		return c.SendString("User deleted successfully")
-	})
-
-
-	app.Delete("/deleteAllUsers", func(c *fiber.Ctx) error {
-		if err := db.Delete("users", ""); err != nil {
-			return c.Status(500).SendString("Error deleting all user data")
-		}
-	
-		return c.SendString("All users deleted successfully")
-	})
-
+	if err := db.DefineView(jsondb.View{Name: "users_by_city", Collection: "users", GroupBy: "Address.City", Refresh: time.Hour}); err != nil {
+		fmt.Println("Error", err)
+	}
 
-	app.Get("/getUser/:name", func(c *fiber.Ctx) error {
-		name := c.Params("name")
-		
-	
-		if name == "" {
-			return c.Status(400).SendString("Name parameter is required")
-		}
-	
-		var user User
-		if err := db.Read("users", name, &user); err != nil {
-			// Log the error and return a detailed message
-			return c.Status(500).SendString(fmt.Sprintf("Error retrieving user data: %v", err))
+	if cfg.Thumbnails > 0 {
+		if err := db.RegisterProcessor("thumbnails", jsondb.Thumbnailer{Size: cfg.Thumbnails}); err != nil {
+			fmt.Println("Error", err)
 		}
-	
-		return c.JSON(user)
-	})
+	}
 
-	app.Get("/getAllUsers", func(c *fiber.Ctx) error {
-		records, err := db.ReadAll("users")
-		if err != nil {
-			return c.Status(500).SendString("Error retrieving all users")
-		}
-	
-		var allUsers []User
-		for _, record := range records {
-			var user User
-			if err := json.Unmarshal([]byte(record), &user); err != nil {
-				return c.Status(500).SendString("Error parsing user data")
+	if len(cfg.Preload.Targets) > 0 {
+		go func() {
+			if _, err := db.Preload(context.Background(), cfg.Preload); err != nil {
+				fmt.Println("Error preloading", err)
 			}
-			allUsers = append(allUsers, user)
-		}
-	
-		return c.JSON(allUsers)
-	})
+		}()
+	}
 
-	// app.Get("/downloadDB", func(c *fiber.Ctx) error {
-	// 	return c.Download("C:\\Users\\Rajkumar\\Desktop\\go_tutorials\\database\\users\\Rajkumar Pawar.json")
-	// })
+	server := NewServer(db, cfg)
+	server.RegisterType("users", User{})
+	server.SetManager(manager)
+	server.reloadFrom(*configPath, log)
 
-	// Route to download the entire database
-app.Get("/downloadDB", func(c *fiber.Ctx) error {
-	// Define source folder and target zip file
-	sourceFolder := "./users"
-	zipFile := "./users_database.zip"
+	// Stop serving on SIGINT or SIGTERM so the database is closed cleanly
+	// and the next start skips recovery
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		server.Shutdown()
+	}()
 
-	// Create the zip file
-	err := zipFolder(sourceFolder, zipFile)
-	if err != nil {
-		return c.Status(500).SendString("Failed to zip the database")
+	if err := server.Listen(cfg.Addr); err != nil {
+		fmt.Println("Error", err)
 	}
 
-	// Serve the zip file
-	return c.Download(zipFile)
-})
-	
-
+	if err := manager.Close(); err != nil {
+		fmt.Println("Error", err)
+	}
 
-	app.Listen(":3000")
+	if err := db.Close(); err != nil {
+		fmt.Println("Error", err)
+	}
 
 	// records, err := db.ReadAll("users")
 	// if err != nil {
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"database/jsondb"
+)
+
+const (
+	csvContentType     = "text/csv"
+	parquetContentType = "application/vnd.apache.parquet"
+
+	// spilledHeader marks responses served from a temporary file.
+	spilledHeader = "X-Spilled"
+)
+
+// parseBody decodes the request body using the codec named by Content-Type.
+// JSON is assumed when no Content-Type is sent. Forms are decoded with
+// parseForm, and XML, for which there is no codec either, with fiber's
+// BodyParser.
+func parseBody(c *fiber.Ctx, v interface{}) error {
+	contentType := string(c.Request().Header.ContentType())
+	if contentType == "" {
+		contentType = fiber.MIMEApplicationJSON
+	}
+
+	codec, ok := jsondb.CodecFor(contentType)
+	if ok {
+		return codec.Unmarshal(c.Body(), v)
+	}
+
+	form, ok, err := parseForm(c)
+	if ok {
+		if err != nil {
+			return err
+		}
+		return jsondb.FromGeneric(form, v)
+	}
+
+	if err := c.BodyParser(v); err != nil {
+		if errors.Is(err, fiber.ErrUnprocessableEntity) {
+			return fiber.ErrUnsupportedMediaType
+		}
+		return err
+	}
+	return nil
+}
+
+// parseForm decodes a URL-encoded or multipart form body into a generic
+// record: dotted keys ("Address.City") make nested objects and repeated
+// keys lists. It reports whether the body is a form at all.
+func parseForm(c *fiber.Ctx) (map[string]interface{}, bool, error) {
+	contentType := strings.ToLower(string(c.Request().Header.ContentType()))
+
+	values := map[string][]string{}
+	switch {
+	case strings.HasPrefix(contentType, fiber.MIMEApplicationForm):
+		c.Request().PostArgs().VisitAll(func(key, value []byte) {
+			values[string(key)] = append(values[string(key)], string(value))
+		})
+	case strings.HasPrefix(contentType, fiber.MIMEMultipartForm):
+		form, err := c.MultipartForm()
+		if err != nil {
+			return nil, true, fiber.NewError(400, fmt.Sprintf("Invalid form: %v", err))
+		}
+		values = form.Value
+	default:
+		return nil, false, nil
+	}
+
+	record := map[string]interface{}{}
+	for key, vs := range values {
+		parent := record
+		parts := strings.Split(key, ".")
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := parent[part].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				parent[part] = child
+			}
+			parent = child
+		}
+
+		name := parts[len(parts)-1]
+		if len(vs) == 1 {
+			parent[name] = vs[0]
+			continue
+		}
+		list := make([]interface{}, len(vs))
+		for i, v := range vs {
+			list[i] = v
+		}
+		parent[name] = list
+	}
+	return record, true, nil
+}
+
+// responseCodec picks the codec for the response from the "format" query
+// parameter or the Accept header, falling back to JSON.
+func responseCodec(c *fiber.Ctx, offers ...string) string {
+	if format := c.Query("format"); format != "" {
+		if format == "csv" {
+			return csvContentType
+		}
+		if codec, ok := jsondb.CodecFor(format); ok {
+			return codec.ContentType()
+		}
+	}
+
+	offers = append([]string{fiber.MIMEApplicationJSON}, offers...)
+	for _, codec := range jsondb.Codecs() {
+		if codec.ContentType() != fiber.MIMEApplicationJSON {
+			offers = append(offers, codec.ContentType())
+		}
+	}
+
+	if accepted := c.Accepts(offers...); accepted != "" {
+		return accepted
+	}
+	return fiber.MIMEApplicationJSON
+}
+
+// respond encodes v in the format negotiated with the client.
+func respond(c *fiber.Ctx, v interface{}) error {
+	codec, ok := jsondb.CodecFor(responseCodec(c))
+	if !ok {
+		codec, _ = jsondb.CodecFor("json")
+	}
+
+	b, err := codec.Marshal(v)
+	if err != nil {
+		return c.Status(500).SendString(fmt.Sprintf("Error encoding response: %v", err))
+	}
+
+	c.Set(fiber.HeaderContentType, codec.ContentType())
+	return c.Send(b)
+}
+
+// respondList is respond for list endpoints, which may also be served as CSV.
+func respondList(c *fiber.Ctx, records []interface{}) error {
+	if responseCodec(c, csvContentType) != csvContentType {
+		if records == nil {
+			records = []interface{}{}
+		}
+		return respond(c, records)
+	}
+
+	var buf bytes.Buffer
+	if err := jsondb.WriteCSV(&buf, records); err != nil {
+		return c.Status(500).SendString(fmt.Sprintf("Error encoding response: %v", err))
+	}
+
+	c.Set(fiber.HeaderContentType, csvContentType)
+	return c.Send(buf.Bytes())
+}
+
+// acceptsParquet reports whether the client asked for a Parquet export.
+func acceptsParquet(c *fiber.Ctx) bool {
+	return strings.EqualFold(c.Query("format"), "parquet") ||
+		strings.Contains(c.Get(fiber.HeaderAccept), parquetContentType)
+}
+
+// respondParquet sends collection as a Parquet file.
+func respondParquet(c *fiber.Ctx, store *jsondb.Driver, collection string) error {
+	spool := store.NewSpool()
+	if err := store.ExportParquet(collection, spool); err != nil {
+		spool.Close()
+		if errors.Is(err, jsondb.ErrMemoryBudget) {
+			return writeError(c, err)
+		}
+		return c.Status(500).SendString(fmt.Sprintf("Error exporting records: %v", err))
+	}
+
+	c.Set(fiber.HeaderContentType, parquetContentType)
+	return sendSpool(c, spool)
+}
+
+// respondSpooled sends the records of collection matching q as a JSON
+// array spooled by the driver, as they are stored: for listings of
+// collections without a registered type, and those too large for the
+// memory budget, which go out from a temporary file once spilled.
+func respondSpooled(c *fiber.Ctx, store *jsondb.Driver, collection string, q jsondb.Query) error {
+	spool := store.NewSpool()
+	r, err := store.ExportJSON(collection, q, spool)
+	if err != nil {
+		spool.Close()
+		switch {
+		case errors.Is(err, jsondb.ErrQueryLimit):
+			return c.Status(422).SendString(err.Error())
+		case errors.Is(err, jsondb.ErrDeadlock), errors.Is(err, jsondb.ErrLockTimeout):
+			return writeError(c, err)
+		}
+		return c.Status(500).SendString(fmt.Sprintf("Error retrieving records: %v", err))
+	}
+
+	if r.Limited != "" {
+		c.Set(limitedHeader, r.Limited)
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return sendSpool(c, spool)
+}
+
+// sendSpool sends the contents of spool, streamed from its file once it
+// spilled, and closes it.
+func sendSpool(c *fiber.Ctx, spool *jsondb.Spool) error {
+	if !spool.Spilled() {
+		b := spool.Bytes()
+		spool.Close()
+		return c.Send(b)
+	}
+
+	r, err := spool.Reader()
+	if err != nil {
+		spool.Close()
+		return c.Status(500).SendString(fmt.Sprintf("Error encoding response: %v", err))
+	}
+	c.Set(spilledHeader, "true")
+	return c.SendStream(r, int(spool.Len()))
+}
+
+// acceptsCSV reports whether the client asked for CSV explicitly.
+func acceptsCSV(c *fiber.Ctx) bool {
+	return strings.EqualFold(c.Query("format"), "csv") ||
+		strings.Contains(c.Get(fiber.HeaderAccept), csvContentType)
+}
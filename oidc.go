@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/oauth2"
+)
+
+// OIDCConfig configures single sign-on through an OpenID Connect provider.
+// Browsers log in with the authorization code flow at /auth/oidc/login and
+// get a session like /auth/login gives; API clients send the provider's
+// JWTs as bearer tokens.
+type OIDCConfig struct {
+	// Issuer is the URL of the provider; empty disables OIDC.
+	Issuer string
+
+	// ClientID and ClientSecret identify the server to the provider.
+	ClientID     string
+	ClientSecret string
+
+	// RedirectURL is the /auth/oidc/callback URL of this server, as
+	// registered with the provider.
+	RedirectURL string
+
+	// Scopes are requested along with openid; profile and email by
+	// default.
+	Scopes []string
+
+	// Audience is the audience bearer tokens must be issued for; ClientID
+	// by default.
+	Audience string
+
+	// UserClaim is the claim used as user name; email by default, and the
+	// subject when the token has no such claim.
+	UserClaim string
+
+	// RolesClaim is the claim listing the groups or roles of the user;
+	// groups by default.
+	RolesClaim string
+
+	// Roles maps values of RolesClaim to server roles. The admin role
+	// grants admin scope.
+	Roles map[string]string
+}
+
+// identity returns the user name and server roles of a verified token.
+func (c OIDCConfig) identity(subject string, claims map[string]interface{}) (string, []string) {
+	userClaim := c.UserClaim
+	if userClaim == "" {
+		userClaim = "email"
+	}
+	user, _ := claims[userClaim].(string)
+	if user == "" {
+		user = subject
+	}
+
+	rolesClaim := c.RolesClaim
+	if rolesClaim == "" {
+		rolesClaim = "groups"
+	}
+
+	var values []string
+	switch v := claims[rolesClaim].(type) {
+	case string:
+		values = strings.Fields(v)
+	case []interface{}:
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	var roles []string
+	for _, v := range values {
+		if role, ok := c.Roles[v]; ok {
+			roles = append(roles, role)
+		}
+	}
+	return user, roles
+}
+
+// oidcState is the discovered provider of the configured issuer, kept
+// across requests so its keys are fetched once.
+type oidcState struct {
+	mutex    sync.Mutex
+	issuer   string
+	provider *oidc.Provider
+}
+
+// oidcTimeout bounds provider discovery and code exchange.
+const oidcTimeout = 10 * time.Second
+
+// oidcProvider returns the provider of cfg, discovering it on first use or
+// after the issuer changed. Failed discoveries are retried by the next
+// request.
+func (s *Server) oidcProvider(cfg OIDCConfig) (*oidc.Provider, error) {
+	s.oidc.mutex.Lock()
+	defer s.oidc.mutex.Unlock()
+
+	if s.oidc.provider != nil && s.oidc.issuer == cfg.Issuer {
+		return s.oidc.provider, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), oidcTimeout)
+	defer cancel()
+
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	s.oidc.issuer, s.oidc.provider = cfg.Issuer, provider
+	return provider, nil
+}
+
+// verifyBearer checks a bearer token that is not a session token as a JWT
+// of the OIDC provider, returning its user name and roles.
+func (s *Server) verifyBearer(c *fiber.Ctx, token string) (string, []string, bool) {
+	cfg := s.config().OIDC
+	if cfg.Issuer == "" || strings.Count(token, ".") != 2 {
+		return "", nil, false
+	}
+
+	provider, err := s.oidcProvider(cfg)
+	if err != nil {
+		return "", nil, false
+	}
+
+	audience := cfg.Audience
+	if audience == "" {
+		audience = cfg.ClientID
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: audience}).Verify(c.UserContext(), token)
+	if err != nil {
+		return "", nil, false
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return "", nil, false
+	}
+	user, roles := cfg.identity(idToken.Subject, claims)
+	return user, roles, true
+}
+
+// oauthConfig returns the OAuth2 client of cfg.
+func oauthConfig(cfg OIDCConfig, provider *oidc.Provider) *oauth2.Config {
+	scopes := cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"profile", "email"}
+	}
+	return &oauth2.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  cfg.RedirectURL,
+		Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+	}
+}
+
+// oidcCookie carries the state, PKCE verifier, nonce and destination of a
+// login in progress from oidcLogin to oidcCallback.
+const oidcCookie = "oidc_login"
+
+// oidcLogin sends the browser to the provider, to come back to ?redirect=,
+// a path on this server, once logged in.
+func (s *Server) oidcLogin(c *fiber.Ctx) error {
+	cfg := s.config().OIDC
+	if cfg.Issuer == "" {
+		return fiber.NewError(404, "OIDC is not configured")
+	}
+
+	provider, err := s.oidcProvider(cfg)
+	if err != nil {
+		return c.Status(502).SendString(fmt.Sprintf("Error contacting the OIDC provider: %v", err))
+	}
+
+	redirect := c.Query("redirect", "/")
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+		return c.Status(400).SendString("Redirect must be a path on this server")
+	}
+
+	state, nonce, verifier := randomHex(16), randomHex(16), oauth2.GenerateVerifier()
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcCookie,
+		Value:    url.Values{"state": {state}, "nonce": {nonce}, "verifier": {verifier}, "redirect": {redirect}}.Encode(),
+		Path:     "/auth/oidc",
+		Expires:  time.Now().Add(10 * time.Minute),
+		HTTPOnly: true,
+		Secure:   c.Protocol() == "https",
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+
+	u := oauthConfig(cfg, provider).AuthCodeURL(state, oauth2.S256ChallengeOption(verifier), oidc.Nonce(nonce))
+	return c.Redirect(u, 302)
+}
+
+// oidcCallback completes a login: it exchanges the code for tokens,
+// verifies the ID token and starts a session for its user.
+func (s *Server) oidcCallback(c *fiber.Ctx) error {
+	cfg := s.config().OIDC
+	if cfg.Issuer == "" {
+		return fiber.NewError(404, "OIDC is not configured")
+	}
+
+	login, err := url.ParseQuery(c.Cookies(oidcCookie))
+	if err != nil || login.Get("state") == "" || login.Get("state") != c.Query("state") {
+		return c.Status(400).SendString("Invalid or expired login state")
+	}
+	c.ClearCookie(oidcCookie)
+
+	if e := c.Query("error"); e != "" {
+		return c.Status(401).SendString(fmt.Sprintf("Login failed: %s %s", e, c.Query("error_description")))
+	}
+
+	provider, err := s.oidcProvider(cfg)
+	if err != nil {
+		return c.Status(502).SendString(fmt.Sprintf("Error contacting the OIDC provider: %v", err))
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), oidcTimeout)
+	defer cancel()
+
+	token, err := oauthConfig(cfg, provider).Exchange(ctx, c.Query("code"), oauth2.VerifierOption(login.Get("verifier")))
+	if err != nil {
+		return c.Status(401).SendString(fmt.Sprintf("Error exchanging the code: %v", err))
+	}
+
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		return c.Status(502).SendString("The OIDC provider returned no ID token")
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}).Verify(ctx, raw)
+	if err != nil || idToken.Nonce != login.Get("nonce") {
+		return c.Status(401).SendString("Invalid ID token")
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return c.Status(401).SendString(fmt.Sprintf("Invalid ID token: %v", err))
+	}
+
+	user, roles := cfg.identity(idToken.Subject, claims)
+	if _, _, err := s.startSession(c, user, roles); err != nil {
+		return writeError(c, err)
+	}
+	return c.Redirect(login.Get("redirect"), 302)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+func TestOIDCIdentity(t *testing.T) {
+	roles := map[string]string{"db-admins": adminRole, "staff": "reader"}
+	tests := []struct {
+		name      string
+		cfg       OIDCConfig
+		claims    map[string]interface{}
+		wantUser  string
+		wantRoles []string
+	}{
+		{
+			name:      "email and groups",
+			cfg:       OIDCConfig{Roles: roles},
+			claims:    map[string]interface{}{"email": "alice@example.com", "groups": []interface{}{"staff", "db-admins"}},
+			wantUser:  "alice@example.com",
+			wantRoles: []string{"reader", adminRole},
+		},
+		{
+			name:     "subject without email",
+			cfg:      OIDCConfig{Roles: roles},
+			claims:   map[string]interface{}{"groups": []interface{}{"others"}},
+			wantUser: "subject",
+		},
+		{
+			name:      "configured claims",
+			cfg:       OIDCConfig{UserClaim: "preferred_username", RolesClaim: "roles", Roles: roles},
+			claims:    map[string]interface{}{"email": "alice@example.com", "preferred_username": "alice", "roles": "staff others", "groups": []interface{}{"db-admins"}},
+			wantUser:  "alice",
+			wantRoles: []string{"reader"},
+		},
+		{
+			name:     "claims of other types",
+			cfg:      OIDCConfig{Roles: roles},
+			claims:   map[string]interface{}{"email": 42, "groups": []interface{}{1, true}},
+			wantUser: "subject",
+		},
+	}
+	for _, tt := range tests {
+		user, got := tt.cfg.identity("subject", tt.claims)
+		if user != tt.wantUser || !reflect.DeepEqual(got, tt.wantRoles) {
+			t.Errorf("%s: identity = %q, %v, want %q, %v", tt.name, user, got, tt.wantUser, tt.wantRoles)
+		}
+	}
+}
+
+// testProvider is an OIDC provider signing tokens with a key of its own.
+type testProvider struct {
+	*httptest.Server
+	signer jose.Signer
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &testProvider{signer: signer}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                p.URL,
+			"authorization_endpoint":                p.URL + "/authorize",
+			"token_endpoint":                        p.URL + "/token",
+			"jwks_uri":                              p.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "test", Algorithm: string(jose.RS256), Use: "sig"},
+		}})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// token returns a JWT of p for audience, expiring at expires, with claims.
+func (p *testProvider) token(t *testing.T, audience string, expires time.Time, claims map[string]interface{}) string {
+	t.Helper()
+	payload := map[string]interface{}{
+		"iss": p.URL,
+		"sub": "subject",
+		"aud": audience,
+		"iat": time.Now().Add(-time.Minute).Unix(),
+		"exp": expires.Unix(),
+	}
+	for k, v := range claims {
+		payload[k] = v
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jws, err := p.signer.Sign(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestOIDCBearer(t *testing.T) {
+	p := newTestProvider(t)
+	s := newTestServer(t, Config{OIDC: OIDCConfig{
+		Issuer:   p.URL,
+		ClientID: "database",
+		Roles:    map[string]string{"db-admins": adminRole},
+	}})
+	hour := time.Now().Add(time.Hour)
+
+	token := p.token(t, "database", hour, map[string]interface{}{"email": "alice@example.com", "groups": []string{"db-admins"}})
+	r := do(t, s, "GET", "/auth/me", nil, bearer(token)...)
+	if r.Status != 200 {
+		t.Fatalf("/auth/me with a token: %d %s", r.Status, r.Body)
+	}
+	var me struct {
+		Username string
+		Roles    []string
+	}
+	r.decode(t, &me)
+	if me.Username != "alice@example.com" || !reflect.DeepEqual(me.Roles, []string{adminRole}) {
+		t.Errorf("/auth/me = %s, want alice@example.com with the admin role", r.Body)
+	}
+	if r := do(t, s, "GET", "/admin/jobs", nil, bearer(token)...); r.Status != 200 {
+		t.Errorf("Admin request with an admin token: %d %s", r.Status, r.Body)
+	}
+
+	plain := p.token(t, "database", hour, map[string]interface{}{"email": "bob@example.com", "groups": []string{"staff"}})
+	if r := do(t, s, "GET", "/admin/jobs", nil, bearer(plain)...); r.Status != 403 {
+		t.Errorf("Admin request with a token without the admin role: %d, want 403", r.Status)
+	}
+
+	for name, bad := range map[string]string{
+		"another audience": p.token(t, "other", hour, nil),
+		"expired":          p.token(t, "database", time.Now().Add(-time.Minute), nil),
+		"tampered":         token[:len(token)-4] + "AAAA",
+	} {
+		if r := do(t, s, "GET", "/auth/me", nil, bearer(bad)...); r.Status != 401 {
+			t.Errorf("/auth/me with a token of %s: %d, want 401", name, r.Status)
+		}
+	}
+}
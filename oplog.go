@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"database/jsondb"
+)
+
+// defaultRecentOps is how many recent changes /admin/oplog returns without
+// ?n=.
+const defaultRecentOps = 100
+
+// opLogFilter reads ?collection=, ?ops=create,Read and ?reads=true.
+func opLogFilter(c *fiber.Ctx) jsondb.OpLogFilter {
+	f := jsondb.OpLogFilter{Collection: c.Query("collection"), Reads: c.QueryBool("reads")}
+	if ops := c.Query("ops"); ops != "" {
+		for _, op := range strings.Split(ops, ",") {
+			f.Ops = append(f.Ops, strings.TrimSpace(op))
+		}
+	}
+	return f
+}
+
+// oplog returns the latest changes of the database, ?n= of them, or with
+// ?follow=true streams its operations as server-sent events, starting with
+// the ?n= latest changes. Reads are only streamed, as they happen.
+func (s *Server) oplog(c *fiber.Ctx) error {
+	store := s.store(c)
+	filter := opLogFilter(c)
+
+	n := defaultRecentOps
+	if c.QueryBool("follow") {
+		n = 0
+	}
+	if v := c.Query("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 0 {
+			return c.Status(400).SendString(fmt.Sprintf("Invalid n '%s'", v))
+		}
+	}
+
+	if !c.QueryBool("follow") {
+		return respond(c, store.RecentOps(filter, n))
+	}
+
+	// The log is opened before the recent changes are read, so none is
+	// missed in between.
+	ctx, cancel := context.WithCancel(context.Background())
+	entries, err := store.OpLog(ctx, filter)
+	if err != nil {
+		cancel()
+		return c.Status(500).SendString(fmt.Sprintf("Error following operations: %v", err))
+	}
+	recent := store.RecentOps(filter, n)
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer cancel()
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+
+		fmt.Fprint(w, ": connected\n\n")
+
+		// Changes made once the log was open come twice; the log skips
+		// those already sent.
+		var last uint64
+		for _, e := range recent {
+			if !writeOp(w, e) {
+				return
+			}
+			last = e.Seq
+		}
+
+		for {
+			if err := w.Flush(); err != nil {
+				return
+			}
+
+			select {
+			case e, ok := <-entries:
+				if !ok {
+					return // fell behind on the changes; the client reconnects
+				}
+				if e.Seq != 0 && e.Seq <= last {
+					continue
+				}
+				if !writeOp(w, e) {
+					return
+				}
+
+			case t := <-heartbeat.C:
+				fmt.Fprintf(w, "event: heartbeat\ndata: %d\n\n", t.Unix())
+			}
+		}
+	})
+	return nil
+}
+
+func writeOp(w *bufio.Writer, e jsondb.OpEntry) bool {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return false
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Op, b)
+	return true
+}
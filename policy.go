@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"database/jsondb"
+)
+
+// loadPolicy reads the policy file at path; an empty path sets no policy.
+func loadPolicy(path string) (*jsondb.Policy, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading policy: %v", err)
+	}
+	p, err := jsondb.ParsePolicy(b)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid policy %s: %v", path, err)
+	}
+	return p, nil
+}
+
+// requestRoles returns the roles of the session or token of the request,
+// with the admin role for requests with admin scope.
+func (s *Server) requestRoles(c *fiber.Ctx) []string {
+	roles, _ := c.Locals(rolesLocal).([]string)
+	if s.isAdmin(c) && !hasRole(c, adminRole) {
+		roles = append(roles[:len(roles):len(roles)], adminRole)
+	}
+	return roles
+}
+
+// bindRoles binds the request context to the roles of the request, for the
+// policy of the database to decide its operations.
+func (s *Server) bindRoles(c *fiber.Ctx) error {
+	c.SetUserContext(jsondb.WithRoles(c.UserContext(), s.requestRoles(c)...))
+	return c.Next()
+}
+
+// policyOp is the policy operation of a request on a collection: reads
+// for GET and lookups of several records, deletes for DELETE and writes
+// otherwise.
+func policyOp(c *fiber.Ctx) string {
+	switch {
+	case c.Method() == fiber.MethodGet, c.Method() == fiber.MethodHead, strings.HasSuffix(c.Route().Path, "/_mget"):
+		return jsondb.PolicyRead
+	case c.Method() == fiber.MethodDelete:
+		return jsondb.PolicyDelete
+	}
+	return jsondb.PolicyWrite
+}
+
+// checkPolicy turns away with 403 a request the policy of store denies on
+// collection, spelled as in the request.
+func (s *Server) checkPolicy(c *fiber.Ctx, store *jsondb.Driver, collection string) error {
+	roles, op := s.requestRoles(c), policyOp(c)
+	if !store.Policy().Allows(roles, op, collection) {
+		return fiber.NewError(403, fmt.Sprintf("Policy denies %s on '%s'", op, collection))
+	}
+	return nil
+}
+
+// drivers returns the main database and those of the manager.
+func (s *Server) drivers() []*jsondb.Driver {
+	dbs := []*jsondb.Driver{s.db}
+	s.mutex.RLock()
+	m := s.manager
+	s.mutex.RUnlock()
+	if m != nil {
+		for _, name := range m.Names() {
+			if db, ok := m.DB(name); ok {
+				dbs = append(dbs, db)
+			}
+		}
+	}
+	return dbs
+}
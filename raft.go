@@ -0,0 +1,487 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+
+	"database/jsondb"
+)
+
+// RaftConfig turns on replication of the main database through a Raft
+// log: writes are committed by a majority of the nodes before they are
+// acknowledged, and applied to every node in the same order. Followers
+// redirect writes to the leader.
+type RaftConfig struct {
+	// NodeID names this node in the cluster; empty disables Raft.
+	NodeID string
+
+	// Bind is the address Raft listens on for the other nodes, such as
+	// "10.0.0.1:7000". It must be reachable by them.
+	Bind string
+
+	// HTTP is the URL clients reach this node's API at, where followers
+	// redirect writes to while it leads.
+	HTTP string
+
+	// Dir holds the Raft log and snapshots; the database directory with a
+	// ".raft" suffix by default.
+	Dir string
+
+	// Bootstrap starts a new cluster with this node as its only member.
+	// Further nodes are added through /admin/raft/join.
+	Bootstrap bool
+
+	// ApplyTimeout bounds how long a write waits to be committed, such as
+	// "10s", the default.
+	ApplyTimeout string
+}
+
+func (c RaftConfig) applyTimeout() time.Duration {
+	if d, err := time.ParseDuration(c.ApplyTimeout); err == nil && d > 0 {
+		return d
+	}
+	return 10 * time.Second
+}
+
+// raftCommand is an entry of the Raft log: a record change, or the HTTP
+// URL of a member, so every node knows where to redirect to.
+type raftCommand struct {
+	Change *jsondb.Change `json:",omitempty"`
+	Member *raftMember    `json:",omitempty"`
+}
+
+type raftMember struct {
+	ID   string
+	HTTP string
+}
+
+// raftNode replicates the changes of db through a Raft log. It is the
+// Replicator of db and the finite state machine applying the log to it.
+type raftNode struct {
+	db      *jsondb.Driver
+	raft    *raft.Raft
+	timeout time.Duration
+
+	mutex   sync.RWMutex
+	members map[string]string // node ID to HTTP URL
+}
+
+// ErrNotLeader is returned for writes to a follower; the HTTP layer
+// redirects them to the leader.
+var ErrNotLeader error = notLeaderError{}
+
+type notLeaderError struct{}
+
+func (notLeaderError) Error() string { return "This node is not the Raft leader" }
+
+// Available tells the replication circuit breaker that the cluster is up:
+// the write only belongs to another node.
+func (notLeaderError) Available() bool { return true }
+
+// startRaft starts the Raft node of db and makes it replicate db's writes.
+func startRaft(db *jsondb.Driver, dir string, cfg RaftConfig) (*raftNode, error) {
+	if cfg.Bind == "" || cfg.HTTP == "" {
+		return nil, fmt.Errorf("Raft needs Bind and HTTP addresses")
+	}
+	if cfg.Dir == "" {
+		cfg.Dir = filepath.Clean(dir) + ".raft"
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	n := &raftNode{db: db, timeout: cfg.applyTimeout(), members: map[string]string{cfg.NodeID: cfg.HTTP}}
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(cfg.NodeID)
+
+	addr, err := net.ResolveTCPAddr("tcp", cfg.Bind)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Raft address '%s': %v", cfg.Bind, err)
+	}
+	transport, err := raft.NewTCPTransport(cfg.Bind, addr, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(cfg.Dir, 2, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	store, err := raftboltdb.NewBoltStore(filepath.Join(cfg.Dir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	if n.raft, err = raft.NewRaft(conf, n, store, store, snapshots, transport); err != nil {
+		return nil, err
+	}
+
+	var seed bool
+	if cfg.Bootstrap {
+		existing, err := raft.HasExistingState(store, store, snapshots)
+		if err != nil {
+			return nil, err
+		}
+		if !existing {
+			n.raft.BootstrapCluster(raft.Configuration{Servers: []raft.Server{{ID: conf.LocalID, Address: transport.LocalAddr()}}})
+			seed = true
+		}
+	}
+
+	// Once this node leads, record its HTTP URL in the log for the others.
+	// A new cluster first logs the records the database already held, so
+	// the nodes joining it get them.
+	go func() {
+		for isLeader := range n.raft.LeaderCh() {
+			if !isLeader {
+				continue
+			}
+			if err := n.apply(raftCommand{Member: &raftMember{cfg.NodeID, cfg.HTTP}}); err != nil {
+				fmt.Println("Error announcing the Raft leader:", err)
+			}
+			if seed {
+				if err := n.seed(); err != nil {
+					fmt.Println("Error logging the existing records:", err)
+				}
+				seed = false
+			}
+		}
+	}()
+
+	db.SetReplicator(n)
+	return n, nil
+}
+
+// seed writes every record of the database through the log.
+func (n *raftNode) seed() error {
+	return eachRecord(n.db, func(collection string, doc jsondb.Document) error {
+		return n.db.Write(collection, doc.Resource, doc.Data)
+	})
+}
+
+// eachRecord calls fn for every record of every collection of db.
+func eachRecord(db *jsondb.Driver, fn func(collection string, doc jsondb.Document) error) error {
+	collections, err := db.Collections()
+	if err != nil {
+		return err
+	}
+	for _, collection := range collections {
+		docs, err := db.Query(collection, jsondb.Query{})
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, doc := range docs {
+			if err := fn(collection, doc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Replicate commits c to the log; it returns once c is applied here.
+func (n *raftNode) Replicate(c jsondb.Change) error {
+	return n.apply(raftCommand{Change: &c})
+}
+
+// IsLeader reports whether this node leads the cluster, and so runs the
+// retention and expiry sweeps.
+func (n *raftNode) IsLeader() bool {
+	return n.raft.State() == raft.Leader
+}
+
+func (n *raftNode) apply(cmd raftCommand) error {
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	f := n.raft.Apply(b, n.timeout)
+	if err := f.Error(); err == raft.ErrNotLeader {
+		return ErrNotLeader
+	} else if err != nil {
+		return err
+	}
+	if err, ok := f.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// Apply applies a committed log entry; its error is the response of the
+// entry.
+func (n *raftNode) Apply(l *raft.Log) interface{} {
+	var cmd raftCommand
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		return fmt.Errorf("Invalid Raft log entry %d: %v", l.Index, err)
+	}
+
+	switch {
+	case cmd.Change != nil:
+		return n.db.Apply(*cmd.Change)
+	case cmd.Member != nil:
+		n.mutex.Lock()
+		n.members[cmd.Member.ID] = cmd.Member.HTTP
+		n.mutex.Unlock()
+	}
+	return nil
+}
+
+// raftSnapshot is the state of the database at a log index, as JSON: the
+// members, the collection configurations, then one record per line.
+type raftSnapshot struct {
+	Members map[string]string
+	Configs map[string]jsondb.CollectionConfig
+	records []jsondb.Change
+}
+
+// Snapshot captures every record of the database; it runs between Apply
+// calls, so the records are those of one log index.
+func (n *raftNode) Snapshot() (raft.FSMSnapshot, error) {
+	snap := &raftSnapshot{Members: map[string]string{}, Configs: map[string]jsondb.CollectionConfig{}}
+
+	n.mutex.RLock()
+	for id, url := range n.members {
+		snap.Members[id] = url
+	}
+	n.mutex.RUnlock()
+
+	for _, collection := range n.db.ConfiguredCollections() {
+		snap.Configs[collection] = n.db.CollectionConfig(collection)
+	}
+
+	err := eachRecord(n.db, func(collection string, doc jsondb.Document) error {
+		b, err := json.Marshal(doc.Data)
+		if err != nil {
+			return err
+		}
+		snap.records = append(snap.records, jsondb.Change{Op: jsondb.OpWrite, Collection: collection, Resource: doc.Resource, Data: b})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+func (s *raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	enc := json.NewEncoder(sink)
+	err := enc.Encode(s)
+	for i := 0; err == nil && i < len(s.records); i++ {
+		err = enc.Encode(s.records[i])
+	}
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *raftSnapshot) Release() {}
+
+// Restore replaces the database with a snapshot, as sent to a node that
+// joins or fell too far behind.
+func (n *raftNode) Restore(r io.ReadCloser) error {
+	defer r.Close()
+
+	dec := json.NewDecoder(r)
+	var snap raftSnapshot
+	if err := dec.Decode(&snap); err != nil {
+		return fmt.Errorf("Invalid Raft snapshot: %v", err)
+	}
+
+	collections, err := n.db.Collections()
+	if err != nil {
+		return err
+	}
+	for _, collection := range collections {
+		if strings.Contains(collection, "/") {
+			continue // deleted with its parent
+		}
+		if err := n.db.Apply(jsondb.Change{Op: jsondb.OpDelete, Collection: collection}); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	for collection, cfg := range snap.Configs {
+		if err := n.db.ConfigureCollection(collection, cfg); err != nil {
+			return err
+		}
+	}
+
+	var records int
+	for dec.More() {
+		var c jsondb.Change
+		if err := dec.Decode(&c); err != nil {
+			return fmt.Errorf("Invalid Raft snapshot: %v", err)
+		}
+		if err := n.db.Apply(c); err != nil {
+			return err
+		}
+		records++
+	}
+
+	n.mutex.Lock()
+	for id, url := range snap.Members {
+		n.members[id] = url
+	}
+	n.mutex.Unlock()
+
+	fmt.Printf("Restored %d records from a Raft snapshot\n", records)
+	return nil
+}
+
+// leaderURL returns the HTTP URL of the current leader, "" if unknown.
+func (n *raftNode) leaderURL() string {
+	_, id := n.raft.LeaderWithID()
+
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.members[string(id)]
+}
+
+func (n *raftNode) close() error {
+	return n.raft.Shutdown().Error()
+}
+
+// toLeader redirects writes to the main database, and reads asking for ?consistent=true, to the
+// Raft leader when this node is not it. Consistent reads on the leader
+// wait until it has applied every committed write.
+func (s *Server) toLeader(c *fiber.Ctx) error {
+	if s.raft == nil || c.Locals(dbLocal) != nil {
+		return c.Next()
+	}
+
+	read := c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead
+	if read && !c.QueryBool("consistent") {
+		return c.Next()
+	}
+
+	if s.raft.raft.State() == raft.Leader {
+		if read {
+			if err := s.raft.raft.Barrier(s.raft.timeout).Error(); err != nil {
+				return c.Status(503).SendString(fmt.Sprintf("Error reaching the Raft cluster: %v", err))
+			}
+		}
+		return c.Next()
+	}
+	return s.redirectToLeader(c)
+}
+
+func (s *Server) redirectToLeader(c *fiber.Ctx) error {
+	leader := s.raft.leaderURL()
+	if leader == "" {
+		return c.Status(503).SendString("No Raft leader")
+	}
+	return c.Redirect(strings.TrimSuffix(leader, "/")+c.OriginalURL(), fiber.StatusTemporaryRedirect)
+}
+
+// raftStatus returns the state of this node and the members of the
+// cluster.
+func (s *Server) raftStatus(c *fiber.Ctx) error {
+	if s.raft == nil {
+		return c.Status(404).SendString("Raft is not enabled")
+	}
+
+	f := s.raft.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return c.Status(500).SendString(fmt.Sprintf("Error reading the Raft configuration: %v", err))
+	}
+
+	type member struct {
+		ID       string
+		Address  string
+		HTTP     string
+		Suffrage string
+	}
+	members := []member{}
+	s.raft.mutex.RLock()
+	for _, srv := range f.Configuration().Servers {
+		members = append(members, member{string(srv.ID), string(srv.Address), s.raft.members[string(srv.ID)], srv.Suffrage.String()})
+	}
+	s.raft.mutex.RUnlock()
+
+	return respond(c, fiber.Map{
+		"State":   s.raft.raft.State().String(),
+		"Leader":  s.raft.leaderURL(),
+		"Members": members,
+		"Stats":   s.raft.raft.Stats(),
+	})
+}
+
+// raftJoin is the body of /admin/raft/join: the node to add, its Raft
+// address and its HTTP URL.
+type raftJoin struct {
+	ID       string
+	Address  string
+	HTTP     string
+	NonVoter bool
+}
+
+// joinRaft adds a node to the cluster; the leader sends it a snapshot and
+// the log from there.
+func (s *Server) joinRaft(c *fiber.Ctx) error {
+	if s.raft == nil {
+		return c.Status(404).SendString("Raft is not enabled")
+	}
+	if s.raft.raft.State() != raft.Leader {
+		return s.redirectToLeader(c)
+	}
+
+	var req raftJoin
+	if err := parseBody(c, &req); err != nil {
+		return c.Status(400).SendString(fmt.Sprintf("Error parsing request body: %v", err))
+	}
+	if req.ID == "" || req.Address == "" || req.HTTP == "" {
+		return c.Status(400).SendString("ID, Address and HTTP are required")
+	}
+
+	add := s.raft.raft.AddVoter
+	if req.NonVoter {
+		add = s.raft.raft.AddNonvoter
+	}
+	if err := add(raft.ServerID(req.ID), raft.ServerAddress(req.Address), 0, s.raft.timeout).Error(); err != nil {
+		return c.Status(500).SendString(fmt.Sprintf("Error adding '%s': %v", req.ID, err))
+	}
+	if err := s.raft.apply(raftCommand{Member: &raftMember{req.ID, req.HTTP}}); err != nil {
+		return c.Status(500).SendString(fmt.Sprintf("Error recording '%s': %v", req.ID, err))
+	}
+	return c.SendStatus(204)
+}
+
+// leaveRaft removes a node from the cluster.
+func (s *Server) leaveRaft(c *fiber.Ctx) error {
+	if s.raft == nil {
+		return c.Status(404).SendString("Raft is not enabled")
+	}
+	if s.raft.raft.State() != raft.Leader {
+		return s.redirectToLeader(c)
+	}
+
+	if err := s.raft.raft.RemoveServer(raft.ServerID(param(c, "id")), 0, s.raft.timeout).Error(); err != nil {
+		return c.Status(500).SendString(fmt.Sprintf("Error removing '%s': %v", param(c, "id"), err))
+	}
+	return c.SendStatus(204)
+}
+
+// snapshotRaft compacts the log into a snapshot now.
+func (s *Server) snapshotRaft(c *fiber.Ctx) error {
+	if s.raft == nil {
+		return c.Status(404).SendString("Raft is not enabled")
+	}
+	if err := s.raft.raft.Snapshot().Error(); err != nil {
+		return c.Status(500).SendString(fmt.Sprintf("Error taking a snapshot: %v", err))
+	}
+	return c.SendStatus(204)
+}
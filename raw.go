@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+
+	"database/jsondb"
+)
+
+// rawBody reports whether the body of a write to collection can be stored
+// as sent: JSON for a collection without a registered type, which decoding
+// would only turn into a generic map and encode again.
+func (s *Server) rawBody(c *fiber.Ctx, collection string) bool {
+	if _, typed := s.recordType(collection); typed {
+		return false
+	}
+
+	switch s.decodeMode(c, collection) {
+	case "", decodeStrict, decodeLax:
+	default:
+		return false // let decode report the mode
+	}
+
+	contentType := string(c.Request().Header.ContentType())
+	if contentType == "" {
+		return true
+	}
+	codec, ok := jsondb.CodecFor(contentType)
+	return ok && codec.Name() == "json"
+}
+
+// rawResponse reports whether records of collection can be sent as they
+// are stored: JSON is negotiated, among offers, and no registered type
+// would shape them.
+func (s *Server) rawResponse(c *fiber.Ctx, collection string, offers ...string) bool {
+	if _, typed := s.recordType(collection); typed {
+		return false
+	}
+	return responseCodec(c, offers...) == fiber.MIMEApplicationJSON
+}
+
+// unlimited lifts every query limit, for listings that read everything.
+var unlimited = jsondb.QueryLimits{Timeout: -1, MaxScanned: -1, MaxResults: -1}
+
+// writeRaw stores the request body as the record :resource of collection
+// and echoes it back.
+func (s *Server) writeRaw(c *fiber.Ctx, store *jsondb.Driver, collection string) error {
+	body := c.Body()
+
+	err := store.WriteRaw(collection, param(c, "resource"), body)
+	switch {
+	case err == jsondb.ErrInvalidJSON:
+		return c.Status(400).SendString(fmt.Sprintf("Error parsing request body: %v", err))
+	case err != nil:
+		return writeError(c, err)
+	}
+
+	if codec, ok := jsondb.CodecFor(responseCodec(c)); !ok || codec.Name() == "json" {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		return c.Send(body)
+	}
+
+	record, err := jsondb.DecodeValue(body)
+	if err != nil {
+		return c.Status(500).SendString(fmt.Sprintf("Error encoding response: %v", err))
+	}
+	return respond(c, record)
+}
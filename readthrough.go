@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+
+	"database/client"
+	"database/jsondb"
+)
+
+// ReadThroughConfig makes this server an edge cache of another one: reads
+// of records of the listed collections missing here are served from
+// Upstream, and kept.
+type ReadThroughConfig struct {
+	// Upstream is the URL of the primary server, such as
+	// "http://primary:3000"; empty disables read-through.
+	Upstream string
+
+	// Token is sent to Upstream as a bearer token.
+	Token string
+
+	// Collections maps the collections read through to how long their
+	// records are kept before they are loaded again, such as "10m" or
+	// "1d"; "" keeps them until they are deleted.
+	Collections map[string]string
+}
+
+// readThroughOptions returns the jsondb.Options.ReadThrough of cfg.
+func readThroughOptions(cfg ReadThroughConfig) (map[string]jsondb.ReadThrough, error) {
+	if cfg.Upstream == "" || len(cfg.Collections) == 0 {
+		return nil, nil
+	}
+
+	upstream := client.New(cfg.Upstream)
+	upstream.Token = cfg.Token
+
+	collections := make(map[string]jsondb.ReadThrough, len(cfg.Collections))
+	for collection, ttl := range cfg.Collections {
+		rt := jsondb.ReadThrough{Loader: upstream}
+		if ttl != "" {
+			age, err := jsondb.ParseAge(ttl)
+			if err != nil || age <= 0 {
+				return nil, fmt.Errorf("Invalid read-through TTL '%s' of '%s'", ttl, collection)
+			}
+			rt.TTL = age
+		}
+		collections[collection] = rt
+	}
+	return collections, nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jcelliott/lumber"
+
+	"database/jsondb"
+)
+
+// logLevels are the accepted values of Config.LogLevel.
+var logLevels = map[string]int32{
+	"trace": lumber.TRACE,
+	"debug": lumber.DEBUG,
+	"info":  lumber.INFO,
+	"warn":  lumber.WARN,
+	"error": lumber.ERROR,
+	"fatal": lumber.FATAL,
+}
+
+// levelLogger logs to the console at a level that can change while the
+// server runs.
+type levelLogger struct {
+	log   *lumber.ConsoleLogger
+	level atomic.Int32
+}
+
+func newLevelLogger() *levelLogger {
+	l := &levelLogger{log: lumber.NewConsoleLogger(lumber.TRACE)}
+	l.level.Store(lumber.INFO)
+	return l
+}
+
+func (l *levelLogger) logs(level int32) bool { return level >= l.level.Load() }
+
+func (l *levelLogger) Fatal(f string, v ...interface{}) {
+	if l.logs(lumber.FATAL) {
+		l.log.Fatal(f, v...)
+	}
+}
+
+func (l *levelLogger) Error(f string, v ...interface{}) {
+	if l.logs(lumber.ERROR) {
+		l.log.Error(f, v...)
+	}
+}
+
+func (l *levelLogger) Warn(f string, v ...interface{}) {
+	if l.logs(lumber.WARN) {
+		l.log.Warn(f, v...)
+	}
+}
+
+func (l *levelLogger) Info(f string, v ...interface{}) {
+	if l.logs(lumber.INFO) {
+		l.log.Info(f, v...)
+	}
+}
+
+func (l *levelLogger) Debug(f string, v ...interface{}) {
+	if l.logs(lumber.DEBUG) {
+		l.log.Debug(f, v...)
+	}
+}
+
+func (l *levelLogger) Trace(f string, v ...interface{}) {
+	if l.logs(lumber.TRACE) {
+		l.log.Trace(f, v...)
+	}
+}
+
+// ReloadReport tells what a config reload changed. Settings listed in
+// RequiresRestart differ from the running server but were left as they are.
+// Collection manifests are read again too; ManifestErrors lists those that
+// failed, which keep their previous configuration.
+type ReloadReport struct {
+	Applied         []string
+	RequiresRestart []string
+	ManifestErrors  []string `json:",omitempty"`
+}
+
+// settings are the parsed forms of the settings that can change at runtime.
+type settings struct {
+	logLevel int32
+	slowOp   time.Duration
+	schedule map[string]string
+	archive  map[string]time.Duration
+	policy   *jsondb.Policy
+}
+
+// parseSettings checks every runtime setting of cfg, so a reload with an
+// invalid value changes nothing.
+func parseSettings(cfg Config) (settings, error) {
+	st := settings{logLevel: lumber.INFO, schedule: cfg.Jobs, archive: map[string]time.Duration{}}
+
+	if cfg.LogLevel != "" {
+		level, ok := logLevels[strings.ToLower(cfg.LogLevel)]
+		if !ok {
+			return st, fmt.Errorf("Unknown log level '%s'", cfg.LogLevel)
+		}
+		st.logLevel = level
+	}
+
+	if cfg.SlowOp != "" {
+		var err error
+		if st.slowOp, err = time.ParseDuration(cfg.SlowOp); err != nil {
+			return st, fmt.Errorf("Invalid SlowOp: %v", err)
+		}
+	}
+
+	if cfg.Sunset != "" {
+		if _, err := time.Parse(time.DateOnly, cfg.Sunset); err != nil {
+			return st, fmt.Errorf("Invalid Sunset '%s', want a date such as 2027-06-30", cfg.Sunset)
+		}
+	}
+
+	for name, spec := range cfg.Jobs {
+		if _, err := jsondb.ParseSchedule(spec); err != nil {
+			return st, fmt.Errorf("Invalid schedule of job '%s': %v", name, err)
+		}
+	}
+
+	for collection, p := range cfg.Cache {
+		if _, err := p.header(); err != nil {
+			return st, fmt.Errorf("Invalid cache policy of '%s': %v", collection, err)
+		}
+	}
+
+	for collection, age := range cfg.Archive {
+		maxAge, err := jsondb.ParseAge(age)
+		if err != nil {
+			return st, err
+		}
+		st.archive[collection] = maxAge
+	}
+
+	var err error
+	if st.policy, err = loadPolicy(cfg.Policy); err != nil {
+		return st, err
+	}
+	return st, nil
+}
+
+// applySettings puts the runtime settings of cfg into effect. Archive
+// policies of collections that old had and cfg has not are removed.
+func applySettings(db *jsondb.Driver, log *levelLogger, old, cfg Config) error {
+	st, err := parseSettings(cfg)
+	if err != nil {
+		return err
+	}
+
+	log.level.Store(st.logLevel)
+	db.SetSlowOp(st.slowOp)
+	if err := db.SetPolicy(st.policy); err != nil {
+		return err
+	}
+
+	for name, spec := range st.schedule {
+		if err := db.Scheduler().SetSchedule(name, spec); err != nil {
+			return err
+		}
+	}
+
+	for collection := range old.Archive {
+		if _, ok := st.archive[collection]; !ok {
+			db.SetArchivePolicy(jsondb.ArchivePolicy{Collection: collection})
+		}
+	}
+	for collection, maxAge := range st.archive {
+		if err := db.SetArchivePolicy(jsondb.ArchivePolicy{Collection: collection, MaxAge: maxAge}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// config returns the configuration the server currently runs with.
+func (s *Server) config() Config {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.cfg
+}
+
+// Reload re-reads the config file and the collection manifests, and
+// applies the settings that can change at runtime: LogLevel, SlowOp,
+// AdminToken, SignedURLs, Sunset, Jobs, Archive, Cache and Policy,
+// so bumping the key version revokes signed URLs at once. The policy file
+// is read again even when its path is unchanged. If any of them
+// is invalid nothing changes. A job dropped from Jobs keeps its current
+// schedule. Changes to other settings are reported as requiring a restart.
+func (s *Server) Reload() (ReloadReport, error) {
+	var report ReloadReport
+	if s.configPath == "" {
+		return report, fmt.Errorf("Server was not started from a config file")
+	}
+
+	cfg, err := LoadConfig(s.configPath)
+	if err != nil {
+		return report, err
+	}
+
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	old := s.config()
+	if err := applySettings(s.db, s.log, old, cfg); err != nil {
+		return report, err
+	}
+	for _, db := range s.drivers()[1:] {
+		db.SetPolicy(s.db.Policy())
+	}
+
+	runtime := map[string]bool{"LogLevel": true, "SlowOp": true, "AdminToken": true, "SignedURLs": true, "Sunset": true, "Jobs": true, "Archive": true, "Cache": true, "Policy": true}
+
+	ov, nv := reflect.ValueOf(old), reflect.ValueOf(&cfg).Elem()
+	for i := 0; i < ov.NumField(); i++ {
+		name := ov.Type().Field(i).Name
+		if reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+
+		if runtime[name] {
+			report.Applied = append(report.Applied, name)
+		} else {
+			report.RequiresRestart = append(report.RequiresRestart, name)
+			nv.Field(i).Set(ov.Field(i)) // keep running with the old value
+		}
+	}
+	sort.Strings(report.Applied)
+	sort.Strings(report.RequiresRestart)
+	report.ManifestErrors = s.reloadManifests()
+
+	s.mutex.Lock()
+	s.cfg = cfg
+	s.mutex.Unlock()
+
+	s.log.Info("Reloaded %s: applied %v, requires restart %v\n", s.configPath, report.Applied, report.RequiresRestart)
+	return report, nil
+}
+
+// reloadManifests reads the collection manifests of every database again,
+// so validators and computed fields edited in their files take effect.
+func (s *Server) reloadManifests() []string {
+	var errs []string
+	for _, db := range s.drivers() {
+		if err := db.ReloadManifests(); err != nil {
+			s.log.Error("%v\n", err)
+			errs = append(errs, err.Error())
+		}
+	}
+	return errs
+}
+
+// reloadFrom lets the server reload its config from path on SIGHUP and
+// /admin/reload, changing the level of log.
+func (s *Server) reloadFrom(path string, log *levelLogger) {
+	s.configPath, s.log = path, log
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			if _, err := s.Reload(); err != nil {
+				s.log.Error("Reloading %s failed: %v\n", s.configPath, err)
+			}
+		}
+	}()
+}
+
+// reload serves /admin/reload.
+func (s *Server) reload(c *fiber.Ctx) error {
+	report, err := s.Reload()
+	if err != nil {
+		return c.Status(400).SendString(fmt.Sprintf("Error reloading config: %v", err))
+	}
+
+	return respond(c, report)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"database/jsondb"
+)
+
+// aggregates are the ?agg= values of series queries.
+var aggregates = map[string]jsondb.Aggregate{
+	"mean":  jsondb.Mean,
+	"sum":   jsondb.Sum,
+	"min":   jsondb.Min,
+	"max":   jsondb.Max,
+	"count": jsondb.Count,
+}
+
+// appendPoint adds the request body, a JSON value, to a series at ?t=
+// (RFC 3339), or now.
+func (s *Server) appendPoint(c *fiber.Ctx) error {
+	store, series, err := s.series(c)
+	if err != nil {
+		return err
+	}
+
+	t := time.Now()
+	if v := c.Query("t"); v != "" {
+		if t, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return c.Status(400).SendString(fmt.Sprintf("Invalid time '%s'", v))
+		}
+	}
+
+	value, err := parseGeneric(c)
+	if err != nil {
+		return c.Status(400).SendString(fmt.Sprintf("Error parsing request body: %v", err))
+	}
+
+	if err := store.Append(series, t, value); err != nil {
+		return writeError(c, err)
+	}
+	return c.SendStatus(204)
+}
+
+// readRange returns the points of a series between ?from= and ?to=,
+// downsampled to ?step= with ?agg= (mean by default) when step is set.
+func (s *Server) readRange(c *fiber.Ctx) error {
+	store, series, err := s.series(c)
+	if err != nil {
+		return err
+	}
+
+	var from, to time.Time
+	for key, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := c.Query(key); v != "" {
+			if *t, err = time.Parse(time.RFC3339Nano, v); err != nil {
+				return c.Status(400).SendString(fmt.Sprintf("Invalid time '%s'", v))
+			}
+		}
+	}
+
+	points, err := store.ReadRange(series, from, to)
+	if err != nil {
+		return c.Status(500).SendString(fmt.Sprintf("Error reading series: %v", err))
+	}
+
+	if v := c.Query("step"); v != "" {
+		step, err := jsondb.ParseAge(v)
+		if err != nil || step <= 0 {
+			return c.Status(400).SendString(fmt.Sprintf("Invalid step '%s'", v))
+		}
+
+		agg, ok := aggregates[c.Query("agg", "mean")]
+		if !ok {
+			return c.Status(400).SendString(fmt.Sprintf("Unknown aggregate '%s'", c.Query("agg")))
+		}
+		points = jsondb.Downsample(points, step, agg)
+	}
+
+	if points == nil {
+		points = []jsondb.Point{}
+	}
+	return respond(c, points)
+}
+
+// series resolves the :series route parameter like collection does.
+func (s *Server) series(c *fiber.Ctx) (*jsondb.Driver, string, error) {
+	return s.collectionParam(c, "series")
+}
@@ -0,0 +1,1352 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/websocket/v2"
+
+	"database/jsondb"
+)
+
+// Validator is implemented by registered types that check their own fields
+// before they are written.
+type Validator interface {
+	Validate() error
+}
+
+// Server exposes a Driver over HTTP.
+type Server struct {
+	app *fiber.App
+	db  *jsondb.Driver
+	cfg Config
+
+	mutex sync.RWMutex
+	types map[string]reflect.Type
+
+	configPath  string
+	log         *levelLogger
+	reloadMutex sync.Mutex
+	authMutex   sync.Mutex
+	oidc        oidcState
+	accessLog   *accessLog
+	ring        *jsondb.Ring
+	raft        *raftNode
+
+	manager *jsondb.Manager
+}
+
+// NewServer creates a server for db with all routes installed.
+func NewServer(db *jsondb.Driver, cfg Config) *Server {
+	s := &Server{
+		app:   fiber.New(),
+		db:    db,
+		cfg:   cfg,
+		types: make(map[string]reflect.Type),
+	}
+
+	// Default CORS config allows all origins; browsers may read the write
+	// headers of records
+	s.app.Use(cors.New(cors.Config{ExposeHeaders: "X-Record-Version, X-Last-Writer, X-Last-Writer-Claimed"}))
+	s.app.Use(traceRequests)
+
+	if cfg.AccessLog.Enabled {
+		l, err := startAccessLog(db, cfg.AccessLog)
+		if err != nil {
+			fmt.Println("Error", err)
+		} else {
+			s.accessLog = l
+			s.app.Use(s.auditRequests)
+		}
+	}
+	s.app.Use(s.authenticate)
+	s.app.Use(identifyActor)
+	s.app.Use(s.bindRoles)
+
+	if cfg.Raft.NodeID != "" {
+		n, err := startRaft(db, cfg.Dir, cfg.Raft)
+		if err != nil {
+			fmt.Println("Error", err)
+		} else {
+			s.raft = n
+		}
+	}
+
+	if cfg.Cluster.Self != "" {
+		ring, err := newRing(cfg.Cluster)
+		if err != nil {
+			fmt.Println("Error", err)
+		} else {
+			s.ring = ring
+		}
+	}
+
+	// Cannot fail: the spec is valid and SetSchedule validated overrides
+	db.Scheduler().Register("expire-sessions", "@every 1h", s.expireSessions)
+
+	s.routes()
+	return s
+}
+
+// RegisterType sets the Go type records of collection are decoded into.
+// Collections without a registered type are handled as generic JSON objects.
+// The type is declared to every database too, for collections configured as
+// Typed.
+func (s *Server) RegisterType(collection string, v interface{}) {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.types[collection] = t
+
+	s.db.RegisterType(collection, v)
+	if s.manager != nil {
+		for _, name := range s.manager.Names() {
+			if db, ok := s.manager.DB(name); ok {
+				db.RegisterType(collection, v)
+			}
+		}
+	}
+}
+
+// Listen serves HTTP requests on addr.
+func (s *Server) Listen(addr string) error {
+	return s.app.Listen(addr)
+}
+
+// Shutdown stops Listen once the requests in flight are served and their
+// access log entries written.
+func (s *Server) Shutdown() error {
+	err := s.app.Shutdown()
+	if s.accessLog != nil {
+		s.accessLog.close()
+	}
+	if s.raft != nil {
+		if rerr := s.raft.close(); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// SetManager serves the databases of m under /db/<name>/, with the same
+// routes as the main database.
+func (s *Server) SetManager(m *jsondb.Manager) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.manager = m
+
+	for _, name := range m.Names() {
+		db, _ := m.DB(name)
+		for collection, t := range s.types {
+			db.RegisterType(collection, reflect.New(t).Interface())
+		}
+		db.SetPolicy(s.db.Policy())
+	}
+}
+
+// recordType returns the type registered for collection.
+func (s *Server) recordType(collection string) (reflect.Type, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	t, ok := s.types[collection]
+	return t, ok
+}
+
+// newRecord returns a pointer to a fresh value of the type registered for
+// collection. Records of lax collections of store are read as generic JSON
+// objects, so fields the type does not have are kept.
+func (s *Server) newRecord(store *jsondb.Driver, collection string) interface{} {
+	t, ok := s.recordType(collection)
+	if !ok || store.CollectionConfig(collection).Decode == decodeLax {
+		return &map[string]interface{}{}
+	}
+	return reflect.New(t).Interface()
+}
+
+// present returns record, read into a newRecord, as it is sent: with the
+// fields named as collection stores them when it has a Naming.
+func (s *Server) present(store *jsondb.Driver, collection string, record interface{}) interface{} {
+	v := reflect.ValueOf(record).Elem().Interface()
+	if named, err := store.NameFields(collection, v); err == nil {
+		return named
+	}
+	return v
+}
+
+// decode parses the request body into the registered type for collection
+// and runs its validation. In strict mode every field that does not fit
+// the type is reported; in lax mode the body is checked against the type
+// but returned as sent.
+func (s *Server) decode(c *fiber.Ctx, collection string) (interface{}, error) {
+	var record interface{} = &map[string]interface{}{}
+	t, typed := s.recordType(collection)
+	if typed {
+		record = reflect.New(t).Interface()
+	}
+
+	var generic interface{}
+	var err error
+
+	// Bodies of collections with a field naming name fields as stored.
+	store := s.store(c)
+	named := typed && store.CollectionConfig(collection).Naming != ""
+
+	mode := s.decodeMode(c, collection)
+	switch mode {
+	case "":
+		if !named {
+			err = parseBody(c, record)
+			break
+		}
+		if generic, err = parseGeneric(c); err == nil {
+			err = jsondb.FromGeneric(store.UnnameFields(collection, generic, t), record)
+		}
+
+	case decodeStrict, decodeLax:
+		if generic, err = parseGeneric(c); err != nil {
+			break
+		}
+		if named {
+			generic = store.UnnameFields(collection, generic, t)
+		}
+		if mode == decodeStrict && typed {
+			if problems := fieldProblems(t, generic, ""); len(problems) > 0 {
+				return nil, fiber.NewError(400, "Invalid fields in request body:\n  "+strings.Join(problems, "\n  "))
+			}
+		}
+		err = jsondb.FromGeneric(generic, record)
+
+	default:
+		return nil, fiber.NewError(400, fmt.Sprintf("Unknown decode mode '%s'", mode))
+	}
+
+	if err != nil {
+		if err == fiber.ErrUnsupportedMediaType {
+			return nil, fiber.NewError(415, "Unsupported content type")
+		}
+		return nil, fiber.NewError(400, fmt.Sprintf("Error parsing request body: %v", err))
+	}
+
+	if v, ok := record.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return nil, fiber.NewError(422, fmt.Sprintf("Invalid record: %v", err))
+		}
+	}
+
+	// Generic bodies keep their json.Numbers and, in lax mode, the fields
+	// the type does not have.
+	if m, ok := generic.(map[string]interface{}); ok && (mode == decodeLax || !typed) {
+		return &m, nil
+	}
+	return record, nil
+}
+
+// readAll returns every record of collection decoded into its registered type.
+func (s *Server) readAll(store *jsondb.Driver, collection string) ([]interface{}, error) {
+	records, err := store.ReadAll(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	var all []interface{}
+	for _, r := range records {
+		record := s.newRecord(store, collection)
+		if err := store.DecodeRecord(collection, []byte(r), record); err != nil {
+			return nil, err
+		}
+		all = append(all, s.present(store, collection, record))
+	}
+	return all, nil
+}
+
+// query returns the records of collection matching q as values of the
+// type registered for it, and the limit that cut them short, if any.
+func (s *Server) query(store *jsondb.Driver, collection string, q jsondb.Query) ([]interface{}, string, error) {
+	r, err := store.Find(collection, q)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var all []interface{}
+	for _, doc := range r.Docs {
+		record := s.newRecord(store, collection)
+		if err := jsondb.FromGeneric(store.UnnameFields(collection, doc.Data, reflect.TypeOf(record)), record); err != nil {
+			return nil, "", err
+		}
+		all = append(all, s.present(store, collection, record))
+	}
+	return all, r.Limited, nil
+}
+
+// checkType verifies that doc still decodes into the type registered for
+// collection and passes its validation.
+func (s *Server) checkType(collection string, doc map[string]interface{}) error {
+	t, ok := s.recordType(collection)
+	if !ok {
+		return nil
+	}
+
+	record := reflect.New(t).Interface()
+	if err := jsondb.FromGeneric(doc, record); err != nil {
+		return fiber.NewError(422, fmt.Sprintf("Invalid record: %v", err))
+	}
+
+	if v, ok := record.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return fiber.NewError(422, fmt.Sprintf("Invalid record: %v", err))
+		}
+	}
+	return nil
+}
+
+// param returns the URL-decoded route parameter key. Fiber reuses the
+// memory behind c.Params once the handler returns, so the value is copied
+// before the driver keeps it as a lock or span attribute.
+func param(c *fiber.Ctx, key string) string {
+	v := strings.Clone(c.Params(key))
+	if unescaped, err := url.PathUnescape(v); err == nil {
+		return unescaped
+	}
+	return v
+}
+
+// subpath returns the decoded path segments after /api/:collection/:resource/.
+func subpath(c *fiber.Ctx) []string {
+	var segs []string
+	for _, seg := range strings.Split(c.Params("*"), "/") {
+		if seg == "" {
+			continue
+		}
+		if unescaped, err := url.PathUnescape(seg); err == nil {
+			seg = unescaped
+		}
+		segs = append(segs, seg)
+	}
+	return segs
+}
+
+// recordRoutePrefix starts the segment after a record naming a route on
+// it, such as ~path or ~versions, rather than a field: subdocument routes
+// cannot address top-level fields starting with it.
+const recordRoutePrefix = "~"
+
+// checkSubpath rejects subdocument paths whose first field would be
+// taken for a route on the record.
+func checkSubpath(c *fiber.Ctx) error {
+	if segs := subpath(c); len(segs) > 0 && strings.HasPrefix(segs[0], recordRoutePrefix) {
+		return fiber.NewError(404, fmt.Sprintf("Unknown record route '%s'", segs[0]))
+	}
+	return nil
+}
+
+// collection resolves the :collection route parameter to the driver and
+// collection it names. System collections are spelled with a leading "_"
+// and are only available to admins. Requests the policy of the database
+// denies are turned away.
+func (s *Server) collection(c *fiber.Ctx) (*jsondb.Driver, string, error) {
+	return s.collectionParam(c, "collection")
+}
+
+// collectionParam is collection for the route parameter key.
+func (s *Server) collectionParam(c *fiber.Ctx, key string) (*jsondb.Driver, string, error) {
+	collection := param(c, key)
+
+	if jsondb.IsReserved(collection) {
+		return nil, "", fiber.NewError(403, jsondb.ErrReservedCollection.Error())
+	}
+
+	store := s.store(c)
+	if err := s.checkPolicy(c, store, collection); err != nil {
+		return nil, "", err
+	}
+
+	if !strings.HasPrefix(collection, "_") {
+		return store, collection, nil
+	}
+
+	if !s.isAdmin(c) {
+		return nil, "", fiber.NewError(403, "Admin scope required for system collections")
+	}
+	return store.System(), strings.TrimPrefix(collection, "_"), nil
+}
+
+// dbLocal is the key under which selectDB stores the database of a request.
+const dbLocal = "db"
+
+// store returns the driver bound to the request context, so storage spans
+// are children of the request span. Requests under /db/<name>/ use the
+// named database.
+func (s *Server) store(c *fiber.Ctx) *jsondb.Driver {
+	db := s.db
+	if named, ok := c.Locals(dbLocal).(*jsondb.Driver); ok {
+		db = named
+	}
+	return db.WithContext(c.UserContext())
+}
+
+// selectDB resolves the :db route parameter to a database of the manager.
+func (s *Server) selectDB(c *fiber.Ctx) error {
+	s.mutex.RLock()
+	m := s.manager
+	s.mutex.RUnlock()
+
+	name := param(c, "db")
+	if m == nil {
+		return fiber.NewError(404, fmt.Sprintf("Unknown database '%s'", name))
+	}
+
+	db, ok := m.DB(name)
+	if !ok {
+		return fiber.NewError(404, fmt.Sprintf("Unknown database '%s'", name))
+	}
+
+	c.Locals(dbLocal, db)
+	return c.Next()
+}
+
+// isAdmin reports whether the request has admin scope: it carries the
+// configured admin token or a session or token with the admin role or,
+// when no admin token is configured, comes from loopback.
+func (s *Server) isAdmin(c *fiber.Ctx) bool {
+	if hasRole(c, adminRole) {
+		return true
+	}
+
+	cfg := s.config()
+	if cfg.AdminToken == "" {
+		ip := net.ParseIP(c.IP())
+		return ip != nil && ip.IsLoopback()
+	}
+
+	token := strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1
+}
+
+// healthz reports whether the remotes of the database are reachable:
+// "degraded", still with 200 since local records are served, while a
+// circuit breaker is open or probing, "ok" otherwise.
+func (s *Server) healthz(c *fiber.Ctx) error {
+	breakers := s.store(c).Breakers()
+	status := "ok"
+	for _, b := range breakers {
+		if b.State != jsondb.BreakerClosed {
+			status = "degraded"
+		}
+	}
+	return respond(c, fiber.Map{"Status": status, "Breakers": breakers})
+}
+
+// requireAdmin rejects requests without admin scope.
+func (s *Server) requireAdmin(c *fiber.Ctx) error {
+	if !s.isAdmin(c) {
+		return fiber.NewError(403, "Admin scope required")
+	}
+	return c.Next()
+}
+
+// writeError answers a failed write: 400 for bad names, 403 for writes the
+// policy denies, 413 for records
+// over the size limit, 409 for conflicts and deadlocks, 422 for records the
+// collection does not accept, 503 while the disk is nearly full, a lock
+// cannot be had in time, memory runs short or the replication circuit
+// breaker is open and 500 otherwise.
+func writeError(c *fiber.Ctx, err error) error {
+	switch {
+	case err == jsondb.ErrInvalidName, errors.Is(err, jsondb.ErrBlobPointer):
+		return c.Status(400).SendString(err.Error())
+	case errors.Is(err, jsondb.ErrPolicyDenied):
+		return c.Status(403).SendString(err.Error())
+	case errors.Is(err, jsondb.ErrRecordTooLarge):
+		return c.Status(413).SendString(err.Error())
+	case errors.Is(err, jsondb.ErrTooDeep), errors.Is(err, jsondb.ErrTooManyFields), errors.Is(err, jsondb.ErrConstraint):
+		return c.Status(422).SendString(err.Error())
+	case err == jsondb.ErrDiskFull, err == ErrNotLeader, err == jsondb.ErrBreakerOpen:
+		return c.Status(503).SendString(err.Error())
+	case errors.Is(err, jsondb.ErrConflict), errors.Is(err, jsondb.ErrDeadlock):
+		return c.Status(409).SendString(err.Error())
+	case errors.Is(err, jsondb.ErrLockTimeout), errors.Is(err, jsondb.ErrMemoryBudget):
+		return c.Status(503).SendString(err.Error())
+	}
+	return c.Status(500).SendString(fmt.Sprintf("Error saving record: %v", err))
+}
+
+// fieldString returns the named top-level field of a decoded record as a
+// string, or "" when it is missing.
+func fieldString(record interface{}, field string) string {
+	v := reflect.Indirect(reflect.ValueOf(record))
+
+	switch v.Kind() {
+	case reflect.Map:
+		if e := v.MapIndex(reflect.ValueOf(field)); e.IsValid() && !e.IsNil() {
+			return fmt.Sprint(e.Interface())
+		}
+	case reflect.Struct:
+		if f := v.FieldByName(field); f.IsValid() {
+			return fmt.Sprint(f.Interface())
+		}
+	}
+	return ""
+}
+
+func (s *Server) routes() {
+	// The unversioned routes are those of version 1, deprecated
+	s.app.Use(s.deprecateLegacy)
+	s.install(s.app, 1)
+
+	// Accounts and sessions of the main database, shared by every database
+	// and version
+	s.app.Post("/auth/register", s.register)
+	s.app.Post("/auth/login", s.login)
+	s.app.Post("/auth/logout", s.logout)
+	s.app.Get("/auth/me", s.whoami)
+	s.app.Get("/auth/oidc/login", s.oidcLogin)
+	s.app.Get("/auth/oidc/callback", s.oidcCallback)
+
+	s.app.Get("/db", s.databases)
+	s.installRaft(s.app)
+
+	// Every route again for the databases of the manager: /db/staging/api/users
+	s.install(s.app.Group("/db/:db", s.selectDB), 1)
+
+	// Versioned routes: /v1/api/users, /v2/collections/users and
+	// /v2/db/staging/collections/users
+	for version := 1; version <= 2; version++ {
+		v := s.app.Group(fmt.Sprintf("/v%d", version))
+		s.install(v, version)
+		v.Get("/db", s.databases)
+		s.installRaft(v)
+		s.install(v.Group("/db/:db", s.selectDB), version)
+	}
+}
+
+// installRaft adds the endpoints managing the Raft cluster of the main
+// database.
+func (s *Server) installRaft(app fiber.Router) {
+	app.Get("/admin/raft", s.requireAdmin, s.raftStatus)
+	app.Post("/admin/raft/join", s.requireAdmin, s.joinRaft)
+	app.Delete("/admin/raft/members/:id", s.requireAdmin, s.leaveRaft)
+	app.Post("/admin/raft/snapshot", s.requireAdmin, s.snapshotRaft)
+}
+
+// databases lists the names of the databases of the manager.
+func (s *Server) databases(c *fiber.Ctx) error {
+	s.mutex.RLock()
+	m := s.manager
+	s.mutex.RUnlock()
+
+	names := []string{}
+	if m != nil {
+		names = m.Names()
+	}
+	return respond(c, names)
+}
+
+// deprecateLegacy marks responses of the unversioned routes as deprecated,
+// pointing to their /v1 successor and announcing the configured Sunset.
+func (s *Server) deprecateLegacy(c *fiber.Ctx) error {
+	path := c.Path()
+	if strings.HasPrefix(path, "/v1/") || strings.HasPrefix(path, "/v2/") ||
+		path == "/v1" || path == "/v2" || strings.HasPrefix(path, "/auth/") {
+		return c.Next()
+	}
+
+	c.Set("Deprecation", "true")
+	c.Set(fiber.HeaderLink, fmt.Sprintf("</v1%s>; rel=\"successor-version\"", strings.TrimSuffix(path, "/")))
+	if sunset, err := time.Parse(time.DateOnly, s.config().Sunset); err == nil {
+		c.Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+	}
+	return c.Next()
+}
+
+// install adds the routes of a database to app, as of the given API
+// version: version 1 has the users endpoints and the generic collection
+// API under /api, version 2 only the generic API, under /collections.
+func (s *Server) install(app fiber.Router, version int) {
+	app.Get("/", func(c *fiber.Ctx) error {
+		return c.SendString("Welcome to the database server")
+	})
+	app.Get("/healthz", s.healthz)
+
+	if version == 1 {
+		s.installUsers(app)
+		s.installCollections(app.Group("/api"))
+	} else {
+		s.installCollections(app.Group("/collections"))
+	}
+	s.installFeatures(app)
+}
+
+// installUsers adds the endpoints of the users collection of version 1.
+func (s *Server) installUsers(app fiber.Router) {
+	app.Post("/addUser", s.toLeader, func(c *fiber.Ctx) error {
+		record, err := s.decode(c, "users")
+		if err != nil {
+			return err
+		}
+
+		if err := s.store(c).Write("users", fieldString(record, "Name"), record); err != nil {
+			return writeError(c, err)
+		}
+
+		return respond(c.Status(201), record)
+	})
+
+	app.Delete("/deleteUser/:name", s.toLeader, func(c *fiber.Ctx) error {
+		name := param(c, "name")
+
+		if name == "" {
+			return c.Status(400).SendString("Name parameter is required")
+		}
+
+		if err := s.store(c).Delete("users", name); err != nil {
+			return c.Status(500).SendString("Error deleting user data")
+		}
+
+		return c.SendString("User deleted successfully")
+	})
+
+	app.Delete("/deleteAllUsers", s.toLeader, func(c *fiber.Ctx) error {
+		if err := s.store(c).Delete("users", ""); err != nil {
+			return c.Status(500).SendString("Error deleting all user data")
+		}
+
+		return c.SendString("All users deleted successfully")
+	})
+
+	app.Get("/getUser/:name", s.toLeader, func(c *fiber.Ctx) error {
+		name := param(c, "name")
+
+		if name == "" {
+			return c.Status(400).SendString("Name parameter is required")
+		}
+
+		user := s.newRecord(s.store(c), "users")
+		if err := s.store(c).Read("users", name, user); err != nil {
+			// Log the error and return a detailed message
+			return c.Status(500).SendString(fmt.Sprintf("Error retrieving user data: %v", err))
+		}
+
+		return respond(c, s.present(s.store(c), "users", user))
+	})
+
+	app.Get("/getAllUsers", s.toLeader, func(c *fiber.Ctx) error {
+		allUsers, err := s.readAll(s.store(c), "users")
+		if err != nil {
+			return c.Status(500).SendString("Error retrieving all users")
+		}
+
+		return respondList(c, allUsers)
+	})
+
+	// Route to download the entire database
+	app.Get("/downloadDB", func(c *fiber.Ctx) error {
+		if acceptsParquet(c) {
+			c.Attachment("users_database.parquet")
+			return respondParquet(c, s.store(c), "users")
+		}
+
+		// CSV exports are generated from the records instead of zipping files
+		if acceptsCSV(c) {
+			allUsers, err := s.readAll(s.store(c), "users")
+			if err != nil {
+				return c.Status(500).SendString("Error retrieving all users")
+			}
+
+			c.Attachment("users_database.csv")
+			return respondList(c, allUsers)
+		}
+
+		// Define source folder and target zip file
+		sourceFolder := "./users"
+		zipFile := "./users_database.zip"
+
+		// Create the zip file
+		err := zipFolder(sourceFolder, zipFile)
+		if err != nil {
+			return c.Status(500).SendString("Failed to zip the database")
+		}
+
+		// Serve the zip file
+		return c.Download(zipFile)
+	})
+}
+
+// installFeatures adds the routes every version shares.
+func (s *Server) installFeatures(app fiber.Router) {
+	app.Get("/views/:name", func(c *fiber.Ctx) error {
+		result, err := s.store(c).ReadView(param(c, "name"))
+		if err != nil {
+			return c.Status(404).SendString(fmt.Sprintf("Error retrieving view: %v", err))
+		}
+
+		return respond(c, result)
+	})
+
+	// Change stream: /watch/users?filter[Company]=Google&ops=update,delete
+	app.Get("/watch/:collection", s.watch)
+
+	// The same changes by long polling, for proxies cutting streams:
+	// /changes/users?since=<Next of the last poll>&wait=30s
+	app.Get("/changes/:collection", s.poll)
+
+	// Time series: POST appends the body at ?t=, GET reads
+	// ?from=&to=, downsampled with ?step=1h&agg=max
+	app.Post("/series/:series", s.appendPoint)
+	app.Get("/series/:series", s.readRange)
+
+	// Graph relations between records: PUT and DELETE link and unlink,
+	// GET traverses: /graph/users/ada?relation=FOLLOWS&min=2&depth=2
+	app.Put("/graph/:collection/:id/:relation/:to/:toID", s.link)
+	app.Delete("/graph/:collection/:id/:relation/:to/:toID", s.unlink)
+	app.Get("/graph/:collection/:id", s.traverse)
+
+	// Resource names only, read from the directory listing:
+	// /keys/users?prefix=a&from=&to=&reverse=true&limit=10
+	app.Get("/keys/:collection", func(c *fiber.Ctx) error {
+		store, collection, err := s.collection(c)
+		if err != nil {
+			return err
+		}
+
+		keys, err := store.ListKeys(collection, jsondb.ListOptions{
+			Prefix:  c.Query("prefix"),
+			From:    c.Query("from"),
+			To:      c.Query("to"),
+			Reverse: c.QueryBool("reverse"),
+			Limit:   c.QueryInt("limit"),
+		})
+		if err != nil {
+			return c.Status(500).SendString(fmt.Sprintf("Error listing keys: %v", err))
+		}
+
+		return respond(c, keys)
+	})
+
+	// Advisory locks: POST takes the lock for ?ttl= (30s by default) and
+	// returns its token, DELETE releases it given the token.
+	app.Post("/locks/:collection/:resource", func(c *fiber.Ctx) error {
+		store, collection, err := s.collection(c)
+		if err != nil {
+			return err
+		}
+
+		ttl := 30 * time.Second
+		if t := c.Query("ttl"); t != "" {
+			if ttl, err = time.ParseDuration(t); err != nil {
+				return c.Status(400).SendString(fmt.Sprintf("Invalid ttl: %v", err))
+			}
+		}
+
+		h, err := store.Lock(collection, param(c, "resource"), ttl)
+		switch {
+		case err == jsondb.ErrLocked:
+			return c.Status(409).SendString(err.Error())
+		case err != nil:
+			return c.Status(400).SendString(fmt.Sprintf("Error taking lock: %v", err))
+		}
+
+		return respond(c.Status(201), h)
+	})
+
+	app.Delete("/locks/:collection/:resource", func(c *fiber.Ctx) error {
+		store, collection, err := s.collection(c)
+		if err != nil {
+			return err
+		}
+
+		token := c.Get("X-Lock-Token", c.Query("token"))
+		err = store.Unlock(jsondb.LockHandle{Collection: collection, Resource: param(c, "resource"), Token: token})
+		switch {
+		case err == jsondb.ErrLockNotHeld:
+			return c.Status(409).SendString(err.Error())
+		case err != nil:
+			return c.Status(400).SendString(fmt.Sprintf("Error releasing lock: %v", err))
+		}
+
+		return c.SendStatus(204)
+	})
+
+	// Topics: POST publishes, subscribers read /topics/:topic?subscriber=
+	// as server-sent events or /topics/:topic/ws as a WebSocket.
+	app.Post("/topics/:topic", s.publish)
+	app.Get("/topics/:topic", s.subscribe)
+	app.Post("/topics/:topic/commit", s.commit)
+	app.Get("/topics/:topic/ws", s.socketUpgrade, websocket.New(s.subscribeSocket))
+
+	// Transactions: POST {"Changes": [{"Op": "write", "Collection",
+	// "Resource", "Data"}, {"Op": "delete", ...}]} commits them together.
+	app.Post("/transactions", s.toLeader, s.transact)
+
+	// Offline-first clients: POST {"Replica", "Checkpoint", "Changes"}
+	app.Post("/sync/:collection", s.syncCollection)
+
+	admin := app.Group("/admin", s.requireAdmin)
+
+	// Time-limited links to GET a path without credentials:
+	// {"URL": "/api/users?format=csv", "TTL": "2h"}
+	admin.Post("/sign", s.signURL)
+
+	// Access log: /admin/access-log?from=&to=&user=&status=&path=&limit=
+	admin.Get("/access-log", s.readAccessLog)
+
+	admin.Get("/jobs", func(c *fiber.Ctx) error {
+		return respond(c, s.store(c).Scheduler().Jobs())
+	})
+
+	admin.Get("/jobs/:name", func(c *fiber.Ctx) error {
+		runs, err := s.store(c).Scheduler().History(param(c, "name"))
+		if err != nil && !os.IsNotExist(err) {
+			return c.Status(500).SendString(fmt.Sprintf("Error retrieving job history: %v", err))
+		}
+
+		return respond(c, runs)
+	})
+
+	admin.Post("/jobs/:name/run", func(c *fiber.Ctx) error {
+		if err := s.store(c).Scheduler().RunNow(param(c, "name")); err != nil {
+			return c.Status(409).SendString(err.Error())
+		}
+
+		return c.SendStatus(202)
+	})
+
+	admin.Post("/reload", s.reload)
+
+	admin.Get("/recovery", func(c *fiber.Ctx) error {
+		return respond(c, s.store(c).Recovery())
+	})
+
+	admin.Get("/disk", func(c *fiber.Ctx) error {
+		return respond(c, s.store(c).DiskStatus())
+	})
+
+	admin.Get("/perf", func(c *fiber.Ctx) error {
+		return respond(c, s.store(c).PerfStats())
+	})
+
+	admin.Get("/querycache", func(c *fiber.Ctx) error {
+		return respond(c, s.store(c).QueryCacheStats())
+	})
+
+	admin.Get("/coalesce", func(c *fiber.Ctx) error {
+		return respond(c, s.store(c).CoalesceStats())
+	})
+
+	// Most accessed records of a collection, ?top=20 by default
+	admin.Get("/hotkeys/:collection", func(c *fiber.Ctx) error {
+		top := c.QueryInt("top", 20)
+		return respond(c, s.store(c).HotKeys(param(c, "collection"), top))
+	})
+
+	admin.Get("/memory", func(c *fiber.Ctx) error {
+		return respond(c, s.store(c).MemoryStats())
+	})
+
+	// Capacity report: records and bytes by collection, indexes, caches,
+	// the system namespace and free disk space.
+	admin.Get("/stats", func(c *fiber.Ctx) error {
+		stats, err := s.store(c).DBStats()
+		if err != nil {
+			return c.Status(500).SendString(fmt.Sprintf("Error collecting statistics: %v", err))
+		}
+		return respond(c, stats)
+	})
+
+	// Recent changes; ?follow=true streams operations as they happen,
+	// with reads on ?reads=true. Filtered by ?collection= and ?ops=.
+	admin.Get("/oplog", s.oplog)
+
+	// Merkle tree of a collection: ?prefix= walks down to the records two
+	// databases disagree on, as jsondb.DiffMerkle does.
+	admin.Get("/merkle/:collection", func(c *fiber.Ctx) error {
+		store, collection, err := s.collection(c)
+		if err != nil {
+			return err
+		}
+		node, err := store.MerkleNode(collection, c.Query("prefix"))
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		return respond(c, node)
+	})
+
+	// Signed exports for legal holds, checked with dbctl verify-export
+	admin.Post("/exports", s.exportSigned)
+
+	// Circuit breakers of the archive store, the replicator and the
+	// read-through upstream; also summed up by /healthz.
+	admin.Get("/breakers", func(c *fiber.Ctx) error {
+		return respond(c, s.store(c).Breakers())
+	})
+
+	// Collection aliases. PUT {"Target": "users_v2"} to /admin/aliases/users
+	// creates the alias or swaps its target at once.
+	admin.Get("/aliases", func(c *fiber.Ctx) error {
+		return respond(c, s.store(c).Aliases())
+	})
+	admin.Put("/aliases/:alias", func(c *fiber.Ctx) error {
+		var body struct{ Target string }
+		if err := parseBody(c, &body); err != nil {
+			return c.Status(400).SendString(fmt.Sprintf("Error parsing request body: %v", err))
+		}
+		if err := s.store(c).SetAlias(param(c, "alias"), body.Target); err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		return respond(c, body)
+	})
+	admin.Delete("/aliases/:alias", func(c *fiber.Ctx) error {
+		err := s.store(c).RemoveAlias(param(c, "alias"))
+		if os.IsNotExist(err) {
+			return c.Status(404).SendString(fmt.Sprintf("Alias '%s' not found", param(c, "alias")))
+		}
+		if err != nil {
+			return writeError(c, err)
+		}
+		return c.SendStatus(204)
+	})
+
+	// Records purged by retention policies; POST /admin/jobs/retention-<collection>/run
+	// enforces one now.
+	admin.Get("/retention", func(c *fiber.Ctx) error {
+		return respond(c, s.store(c).RetentionStats())
+	})
+
+	// Outcome of the data quality checks by collection; the reports kept
+	// of a collection, newest first, and POST to check it now.
+	admin.Get("/quality", func(c *fiber.Ctx) error {
+		return respond(c, s.store(c).QualityStats())
+	})
+
+	admin.Get("/quality/:collection", func(c *fiber.Ctx) error {
+		reports, err := s.store(c).QualityReports(param(c, "collection"))
+		if err != nil {
+			return writeError(c, err)
+		}
+		return respond(c, reports)
+	})
+
+	admin.Post("/quality/:collection", func(c *fiber.Ctx) error {
+		report, err := s.store(c).CheckQuality(param(c, "collection"))
+		if err != nil {
+			return writeError(c, err)
+		}
+		return respond(c, report)
+	})
+
+	// Locks held and waited for. DELETE forces the release of a stuck one,
+	// the advisory lock on ?resource= or else the collection lock, if it
+	// has been held for at least ?min_age= (30s by default).
+	admin.Get("/locks", func(c *fiber.Ctx) error {
+		locks, err := s.store(c).Locks()
+		if err != nil {
+			return c.Status(500).SendString(fmt.Sprintf("Error listing locks: %v", err))
+		}
+		return respond(c, locks)
+	})
+
+	admin.Delete("/locks/:collection", func(c *fiber.Ctx) error {
+		minAge := 30 * time.Second
+		if v := c.Query("min_age"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return c.Status(400).SendString(fmt.Sprintf("Invalid min_age '%s'", v))
+			}
+			minAge = d
+		}
+
+		err := s.store(c).ForceRelease(param(c, "collection"), c.Query("resource"), minAge)
+		switch {
+		case err == jsondb.ErrLockNotHeld:
+			return c.Status(404).SendString(err.Error())
+		case err == jsondb.ErrInvalidName:
+			return c.Status(400).SendString(err.Error())
+		case err != nil:
+			return c.Status(409).SendString(err.Error())
+		}
+		return c.SendStatus(204)
+	})
+
+	// Collection manifests: PUT validates the configuration against the
+	// collection's records before storing it.
+	admin.Get("/collections", func(c *fiber.Ctx) error {
+		return respond(c, s.store(c).ConfiguredCollections())
+	})
+
+	admin.Get("/collections/:collection", func(c *fiber.Ctx) error {
+		return respond(c, s.store(c).CollectionConfig(param(c, "collection")))
+	})
+
+	admin.Put("/collections/:collection", func(c *fiber.Ctx) error {
+		var cfg jsondb.CollectionConfig
+		if err := parseBody(c, &cfg); err != nil {
+			return c.Status(400).SendString(fmt.Sprintf("Error parsing request body: %v", err))
+		}
+
+		err := s.store(c).ConfigureCollection(param(c, "collection"), cfg)
+		switch {
+		case errors.Is(err, jsondb.ErrConstraint):
+			return c.Status(409).SendString(err.Error())
+		case err != nil:
+			return c.Status(400).SendString(fmt.Sprintf("Error configuring collection: %v", err))
+		}
+
+		return respond(c, cfg)
+	})
+
+	// Records that listings found corrupt, skipped or quarantined by the
+	// Corrupt policy.
+	admin.Get("/corrupt/:collection", func(c *fiber.Ctx) error {
+		incidents, err := s.store(c).Corrupted(param(c, "collection"))
+		if err != nil {
+			return writeError(c, err)
+		}
+		return respond(c, incidents)
+	})
+}
+
+// installCollections adds the generic collection API to api, typed by
+// RegisterType. Names starting with "_" address system collections and
+// require admin scope. Listing takes filter parameters:
+// /api/users?filter[Address][near]=48.85,2.35,50km
+func (s *Server) installCollections(api fiber.Router) {
+	s.installAttachments(api)
+
+	api.Get("/:collection", s.cacheHeaders, s.partition, s.toLeader, func(c *fiber.Ctx) error {
+		store, collection, err := s.collection(c)
+		if err != nil {
+			return err
+		}
+
+		if acceptsParquet(c) {
+			return respondParquet(c, store, collection)
+		}
+
+		q, err := parseFilter(c)
+		if err == nil {
+			q.Limits, err = parseLimits(c, s.config().QueryLimits)
+		}
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+
+		// Unfiltered listings read the whole collection, as ReadAll does.
+		filtered := len(q.Where) > 0 || q.Geo != nil
+		if !filtered {
+			q.Limits = unlimited
+		}
+		if !filtered && s.rawResponse(c, collection, csvContentType) {
+			return respondSpooled(c, store, collection, q)
+		}
+
+		var records []interface{}
+		var limited string
+		if filtered {
+			records, limited, err = s.query(store, collection, q)
+		} else {
+			records, err = s.readAll(store, collection)
+		}
+		if errors.Is(err, jsondb.ErrMemoryBudget) && q.Geo == nil && responseCodec(c, csvContentType) == fiber.MIMEApplicationJSON {
+			return respondSpooled(c, store, collection, q)
+		}
+		if errors.Is(err, jsondb.ErrQueryLimit) {
+			return c.Status(422).SendString(err.Error())
+		}
+		if errors.Is(err, jsondb.ErrMemoryBudget) || errors.Is(err, jsondb.ErrDeadlock) || errors.Is(err, jsondb.ErrLockTimeout) {
+			return writeError(c, err)
+		}
+		if err != nil {
+			return c.Status(500).SendString(fmt.Sprintf("Error retrieving records: %v", err))
+		}
+
+		if limited != "" {
+			c.Set(limitedHeader, limited)
+		}
+		return respondList(c, records)
+	})
+
+	api.Get("/:collection/:resource", s.cacheHeaders, s.writeHeaders, s.partition, s.toLeader, func(c *fiber.Ctx) error {
+		store, collection, err := s.collection(c)
+		if err != nil {
+			return err
+		}
+
+		b, stale, err := store.ReadRawStale(collection, param(c, "resource"))
+		if err == jsondb.ErrBreakerOpen {
+			return c.Status(503).SendString(err.Error())
+		}
+		if stale != nil {
+			// Served from the stale-if-error cache as storage failed
+			c.Set("X-Stale", "true")
+			c.Set(fiber.HeaderAge, strconv.Itoa(int(stale.Age.Seconds())))
+		}
+		if err == nil && s.rawResponse(c, collection) {
+			c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+			return c.Send(b)
+		}
+
+		record := s.newRecord(store, collection)
+		if err == nil {
+			err = store.DecodeRecord(collection, b, record)
+		}
+		if os.IsNotExist(err) {
+			// Fall back to the archive for records moved out of the collection
+			if store.ReadArchived(collection, param(c, "resource"), record) == nil {
+				c.Set("X-Archived", "true")
+				err = nil
+			}
+		}
+		if err != nil {
+			return c.Status(404).SendString(fmt.Sprintf("Error retrieving record: %v", err))
+		}
+
+		return respond(c, s.present(store, collection, record))
+	})
+
+	// Routes on a record start with recordRoutePrefix, which keeps them
+	// apart from the subdocument routes below.
+	api.Get("/:collection/:resource/~path", s.cacheHeaders, s.writeHeaders, s.partition, s.toLeader, func(c *fiber.Ctx) error {
+		store, collection, err := s.collection(c)
+		if err != nil {
+			return err
+		}
+
+		value, err := store.Extract(collection, param(c, "resource"), c.Query("expr"))
+		switch {
+		case err == jsondb.ErrPathNotFound, os.IsNotExist(err):
+			return c.Status(404).SendString(err.Error())
+		case err != nil:
+			return c.Status(400).SendString(fmt.Sprintf("Error extracting value: %v", err))
+		}
+
+		return respond(c, value)
+	})
+
+	// Kept versions of a record, in collections configured with Versions.
+	api.Get("/:collection/:resource/~versions", s.cacheHeaders, s.partition, s.toLeader, func(c *fiber.Ctx) error {
+		store, collection, err := s.collection(c)
+		if err != nil {
+			return err
+		}
+
+		versions, err := store.Versions(collection, param(c, "resource"))
+		if err != nil {
+			return c.Status(500).SendString(fmt.Sprintf("Error listing versions: %v", err))
+		}
+		if versions == nil {
+			versions = []jsondb.RecordVersion{}
+		}
+		return respond(c, versions)
+	})
+
+	// The changes from a kept version to the current record, as an RFC
+	// 6902 JSON Patch.
+	api.Get("/:collection/:resource/~diff", s.cacheHeaders, s.partition, s.toLeader, func(c *fiber.Ctx) error {
+		store, collection, err := s.collection(c)
+		if err != nil {
+			return err
+		}
+		resource := param(c, "resource")
+
+		version, err := strconv.Atoi(c.Query("version"))
+		if err != nil || version < 1 {
+			return c.Status(400).SendString("Invalid or missing version")
+		}
+
+		var old interface{}
+		err = store.ReadVersion(collection, resource, version, &old)
+		if err == jsondb.ErrNoVersion {
+			return c.Status(404).SendString(err.Error())
+		}
+		if err != nil {
+			return c.Status(500).SendString(fmt.Sprintf("Error reading version: %v", err))
+		}
+
+		b, err := store.ReadRaw(collection, resource)
+		if err != nil {
+			return c.Status(404).SendString(fmt.Sprintf("Error retrieving record: %v", err))
+		}
+		current, err := jsondb.DecodeValue(b)
+		if err != nil {
+			return c.Status(500).SendString(fmt.Sprintf("Error decoding record: %v", err))
+		}
+
+		patch, err := jsondb.DiffDocuments(old, current)
+		if err != nil {
+			return c.Status(500).SendString(fmt.Sprintf("Error comparing versions: %v", err))
+		}
+		return c.JSON(patch, "application/json-patch+json")
+	})
+
+	// Subdocuments: /api/users/John/Address/City addresses one nested field.
+	api.Get("/:collection/:resource/*", s.cacheHeaders, s.writeHeaders, s.partition, s.toLeader, func(c *fiber.Ctx) error {
+		// The wildcard also matches an empty subpath; leave those to the
+		// whole-record route.
+		if len(subpath(c)) == 0 {
+			return c.Next()
+		}
+		if err := checkSubpath(c); err != nil {
+			return err
+		}
+
+		store, collection, err := s.collection(c)
+		if err != nil {
+			return err
+		}
+
+		var raw json.RawMessage
+		if err := store.Read(collection, param(c, "resource"), &raw); err != nil {
+			return c.Status(404).SendString(fmt.Sprintf("Error retrieving record: %v", err))
+		}
+
+		doc, err := jsondb.DecodeValue(raw)
+		if err != nil {
+			return c.Status(500).SendString(fmt.Sprintf("Error decoding record: %v", err))
+		}
+
+		value, ok := jsondb.ValueAt(doc, subpath(c))
+		if !ok {
+			return c.Status(404).SendString(jsondb.ErrPathNotFound.Error())
+		}
+
+		return respond(c, value)
+	})
+
+	api.Put("/:collection/:resource/*", s.writeHeaders, s.partition, s.toLeader, func(c *fiber.Ctx) error {
+		// The wildcard also matches an empty subpath; leave those to the
+		// whole-record route.
+		if len(subpath(c)) == 0 {
+			return c.Next()
+		}
+		if err := checkSubpath(c); err != nil {
+			return err
+		}
+
+		store, collection, err := s.collection(c)
+		if err != nil {
+			return err
+		}
+
+		var value interface{}
+		if err := parseBody(c, &value); err != nil {
+			return c.Status(400).SendString(fmt.Sprintf("Error parsing request body: %v", err))
+		}
+
+		var updated map[string]interface{}
+		err = store.Update(collection, param(c, "resource"), func(doc map[string]interface{}) error {
+			if err := jsondb.SetValueAt(doc, subpath(c), value); err != nil {
+				return err
+			}
+			updated = doc
+			return s.checkType(collection, doc)
+		})
+
+		switch {
+		case os.IsNotExist(err):
+			return c.Status(404).SendString(fmt.Sprintf("Error retrieving record: %v", err))
+		case err == jsondb.ErrInvalidSubpath, err == jsondb.ErrInvalidName:
+			return c.Status(400).SendString(err.Error())
+		case err != nil:
+			if e, ok := err.(*fiber.Error); ok {
+				return e
+			}
+			return writeError(c, err)
+		}
+
+		return respond(c, updated)
+	})
+
+	api.Put("/:collection/:resource", s.writeHeaders, s.partition, s.toLeader, func(c *fiber.Ctx) error {
+		store, collection, err := s.collection(c)
+		if err != nil {
+			return err
+		}
+
+		if s.rawBody(c, collection) {
+			return s.writeRaw(c, store, collection)
+		}
+
+		record, err := s.decode(c, collection)
+		if err != nil {
+			return err
+		}
+
+		if err := store.Write(collection, param(c, "resource"), record); err != nil {
+			return writeError(c, err)
+		}
+
+		return respond(c, s.present(store, collection, record))
+	})
+
+	api.Delete("/:collection/:resource", s.partition, s.toLeader, func(c *fiber.Ctx) error {
+		store, collection, err := s.collection(c)
+		if err != nil {
+			return err
+		}
+
+		if err := store.Delete(collection, param(c, "resource")); err != nil {
+			return c.Status(404).SendString(fmt.Sprintf("Error deleting record: %v", err))
+		}
+
+		return c.SendStatus(204)
+	})
+
+	// Several records at once, read under one lock:
+	// {"Resources": ["a", "b"]} returns those Found, by resource, and the
+	// Missing ones.
+	api.Post("/:collection/_mget", s.partition, s.toLeader, func(c *fiber.Ctx) error {
+		store, collection, err := s.collection(c)
+		if err != nil {
+			return err
+		}
+
+		var req struct{ Resources []string }
+		if err := parseBody(c, &req); err != nil {
+			return c.Status(400).SendString(fmt.Sprintf("Error parsing request body: %v", err))
+		}
+
+		records, err := store.ReadMany(collection, req.Resources)
+		if err != nil {
+			return writeError(c, err)
+		}
+
+		res := struct {
+			Found   map[string]interface{}
+			Missing []string
+		}{Found: make(map[string]interface{}, len(records)), Missing: []string{}}
+		raw := s.rawResponse(c, collection)
+		for _, resource := range req.Resources {
+			b, ok := records[resource]
+			switch {
+			case !ok:
+				res.Missing = append(res.Missing, resource)
+			case raw:
+				res.Found[resource] = b
+			default:
+				record := s.newRecord(store, collection)
+				if err := store.DecodeRecord(collection, b, record); err != nil {
+					return c.Status(500).SendString(fmt.Sprintf("Error decoding '%s': %v", resource, err))
+				}
+				res.Found[resource] = s.present(store, collection, record)
+			}
+		}
+		return respond(c, res)
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http/httptest"
+	"testing"
+
+	"database/jsondb"
+)
+
+// testAdminToken is the admin token of the servers newTestServer starts.
+const testAdminToken = "test-admin-token"
+
+// newTestServer starts a server for cfg on a database in a temporary
+// directory, closed with the test, with testAdminToken as its admin token
+// unless cfg sets one.
+func newTestServer(t *testing.T, cfg Config) *Server {
+	t.Helper()
+	cfg.Dir = t.TempDir()
+	if cfg.AdminToken == "" {
+		cfg.AdminToken = testAdminToken
+	}
+	db, err := jsondb.New(cfg.Dir, &jsondb.Options{Logger: jsondb.NewStdLogger(log.New(io.Discard, "", 0), jsondb.LogError)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewServer(db, cfg)
+}
+
+// response is what a request to a test server got back.
+type response struct {
+	Status int
+	Header map[string][]string
+	Body   []byte
+}
+
+// decode parses the body of r into v.
+func (r response) decode(t *testing.T, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(r.Body, v); err != nil {
+		t.Fatalf("Decoding %q: %v", r.Body, err)
+	}
+}
+
+// do sends a request to s, with body encoded as JSON unless it is nil, and
+// headers given as name and value pairs.
+func do(t *testing.T, s *Server, method, target string, body interface{}, headers ...string) response {
+	t.Helper()
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req := httptest.NewRequest(method, target, r)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	resp, err := s.app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response{Status: resp.StatusCode, Header: resp.Header, Body: b}
+}
+
+// bearer returns the Authorization header pair of token, for do.
+func bearer(token string) []string {
+	return []string{"Authorization", "Bearer " + token}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"database/jsondb"
+)
+
+// SignedURLConfig configures the signed URLs /admin/sign hands out. A
+// signed URL lets anyone holding it GET that exact path and query, with
+// admin scope, until it expires, without an API key or session.
+type SignedURLConfig struct {
+	// Secret is the HMAC key; empty disables signed URLs.
+	Secret string
+
+	// KeyVersion is mixed into the key, so bumping it revokes every URL
+	// signed before.
+	KeyVersion int
+
+	// MaxLifetime caps how long a URL stays valid, such as "1h" or "7d";
+	// 24 hours by default.
+	MaxLifetime string
+}
+
+func (c SignedURLConfig) maxLifetime() time.Duration {
+	if d, err := jsondb.ParseAge(c.MaxLifetime); err == nil && d > 0 {
+		return d
+	}
+	return 24 * time.Hour
+}
+
+// signature returns the signature of path and query, which must hold the
+// exp parameter and not sig.
+func (c SignedURLConfig) signature(path string, query url.Values) string {
+	key := hmac.New(sha256.New, []byte(c.Secret))
+	fmt.Fprintf(key, "signed-url-v%d", c.KeyVersion)
+
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	fmt.Fprintf(mac, "GET\n%s\n%s", path, query.Encode())
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkSignature reports whether the request carries a valid signature;
+// it is only called for requests with a sig parameter.
+func (s *Server) checkSignature(c *fiber.Ctx) error {
+	cfg := s.config().SignedURLs
+	if cfg.Secret == "" {
+		return fiber.NewError(403, "Signed URLs are not enabled")
+	}
+	if c.Method() != fiber.MethodGet && c.Method() != fiber.MethodHead {
+		return fiber.NewError(403, "Signed URLs only allow GET")
+	}
+
+	query, err := url.ParseQuery(string(c.Request().URI().QueryString()))
+	if err != nil {
+		return fiber.NewError(403, "Invalid signed URL")
+	}
+	sig := query.Get("sig")
+	query.Del("sig")
+
+	exp, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if err != nil {
+		return fiber.NewError(403, "Invalid signed URL")
+	}
+	if expires := time.Unix(exp, 0); time.Now().After(expires) || time.Until(expires) > cfg.maxLifetime() {
+		return fiber.NewError(403, "Signed URL expired")
+	}
+
+	expected := cfg.signature(string(c.Request().URI().Path()), query)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return fiber.NewError(403, "Invalid signed URL")
+	}
+	return nil
+}
+
+// signRequest is the body of /admin/sign: the path and query to sign and
+// how long the URL stays valid.
+type signRequest struct {
+	URL string
+	TTL string
+}
+
+// signURL returns URL with the exp and sig parameters that make it a
+// signed URL.
+func (s *Server) signURL(c *fiber.Ctx) error {
+	cfg := s.config().SignedURLs
+	if cfg.Secret == "" {
+		return c.Status(404).SendString("Signed URLs are not enabled")
+	}
+
+	var req signRequest
+	if err := parseBody(c, &req); err != nil {
+		return c.Status(400).SendString(fmt.Sprintf("Error parsing request body: %v", err))
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil || u.IsAbs() || len(u.Path) == 0 || u.Path[0] != '/' {
+		return c.Status(400).SendString("URL must be a path on this server")
+	}
+
+	ttl := time.Hour
+	if req.TTL != "" {
+		if ttl, err = jsondb.ParseAge(req.TTL); err != nil || ttl <= 0 {
+			return c.Status(400).SendString(fmt.Sprintf("Invalid TTL '%s'", req.TTL))
+		}
+	}
+	if ttl > cfg.maxLifetime() {
+		return c.Status(400).SendString(fmt.Sprintf("TTL exceeds the maximum lifetime of %v", cfg.maxLifetime()))
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	query := u.Query()
+	query.Del("sig")
+	query.Set("exp", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("sig", cfg.signature(u.Path, query))
+	u.RawQuery = query.Encode()
+
+	return respond(c, fiber.Map{"URL": u.String(), "Expires": expires.UTC()})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signed returns the URL /admin/sign of s hands out for target.
+func signed(t *testing.T, s *Server, target, ttl string) string {
+	t.Helper()
+	r := do(t, s, "POST", "/admin/sign", signRequest{URL: target, TTL: ttl}, bearer(testAdminToken)...)
+	if r.Status != 200 {
+		t.Fatalf("Signing %s: %d %s", target, r.Status, r.Body)
+	}
+	var body struct{ URL string }
+	r.decode(t, &body)
+	return body.URL
+}
+
+func TestSignedURL(t *testing.T) {
+	s := newTestServer(t, Config{SignedURLs: SignedURLConfig{Secret: "secret"}})
+	u := signed(t, s, "/admin/jobs?limit=5", "1h")
+
+	if r := do(t, s, "GET", "/admin/jobs?limit=5", nil); r.Status != 403 {
+		t.Fatalf("Unsigned admin request: %d, want 403", r.Status)
+	}
+	if r := do(t, s, "GET", u, nil); r.Status != 200 {
+		t.Errorf("GET of the signed URL: %d %s", r.Status, r.Body)
+	}
+	if r := do(t, s, "HEAD", u, nil); r.Status != 200 {
+		t.Errorf("HEAD of the signed URL: %d", r.Status)
+	}
+	for _, method := range []string{"POST", "PUT", "DELETE"} {
+		if r := do(t, s, method, u, nil); r.Status != 403 {
+			t.Errorf("%s of the signed URL: %d, want 403", method, r.Status)
+		}
+	}
+
+	tampered := []string{
+		strings.Replace(u, "limit=5", "limit=6", 1),
+		u + "&format=csv",
+		strings.Replace(u, "/admin/jobs", "/admin/access-log", 1),
+		strings.Replace(u, "limit=5&", "", 1),
+	}
+	for _, bad := range tampered {
+		if bad == u {
+			t.Fatalf("Tampering left %s as it was", u)
+		}
+		if r := do(t, s, "GET", bad, nil); r.Status != 403 {
+			t.Errorf("GET of tampered %s: %d, want 403", bad, r.Status)
+		}
+	}
+}
+
+func TestSignedURLExpiry(t *testing.T) {
+	cfg := SignedURLConfig{Secret: "secret", MaxLifetime: "2h"}
+	s := newTestServer(t, Config{SignedURLs: cfg})
+
+	// sign signs /admin/jobs by hand, to expire at exp.
+	sign := func(cfg SignedURLConfig, exp time.Time) string {
+		query := url.Values{"exp": {strconv.FormatInt(exp.Unix(), 10)}}
+		query.Set("sig", cfg.signature("/admin/jobs", query))
+		return "/admin/jobs?" + query.Encode()
+	}
+
+	if r := do(t, s, "GET", sign(cfg, time.Now().Add(time.Hour)), nil); r.Status != 200 {
+		t.Errorf("GET of a valid URL: %d %s", r.Status, r.Body)
+	}
+	if r := do(t, s, "GET", sign(cfg, time.Now().Add(-time.Minute)), nil); r.Status != 403 {
+		t.Errorf("GET of an expired URL: %d, want 403", r.Status)
+	}
+	if r := do(t, s, "GET", sign(cfg, time.Now().Add(3*time.Hour)), nil); r.Status != 403 {
+		t.Errorf("GET of a URL beyond the maximum lifetime: %d, want 403", r.Status)
+	}
+	if r := do(t, s, "POST", "/admin/sign", signRequest{URL: "/admin/jobs", TTL: "3h"}, bearer(testAdminToken)...); r.Status != 400 {
+		t.Errorf("Signing beyond the maximum lifetime: %d, want 400", r.Status)
+	}
+
+	revoked := cfg
+	revoked.KeyVersion = 1
+	if r := do(t, s, "GET", sign(revoked, time.Now().Add(time.Hour)), nil); r.Status != 403 {
+		t.Errorf("GET of a URL signed with another key version: %d, want 403", r.Status)
+	}
+}
+
+func TestSignedURLDisabled(t *testing.T) {
+	s := newTestServer(t, Config{})
+	cfg := SignedURLConfig{Secret: ""}
+	query := url.Values{"exp": {strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)}}
+	query.Set("sig", cfg.signature("/admin/jobs", query))
+
+	if r := do(t, s, "GET", "/admin/jobs?"+query.Encode(), nil); r.Status != 403 {
+		t.Errorf("GET of a signed URL with signing disabled: %d, want 403", r.Status)
+	}
+	if r := do(t, s, "POST", "/admin/sign", signRequest{URL: "/admin/jobs"}, bearer(testAdminToken)...); r.Status != 404 {
+		t.Errorf("Signing with signing disabled: %d, want 404", r.Status)
+	}
+}
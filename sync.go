@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+
+	"database/jsondb"
+)
+
+// syncReplica names the server in the version vectors of synced records.
+const syncReplica = "server"
+
+// syncCollection exchanges changes with an offline-first client: the body
+// is a jsondb.SyncRequest with the client's changes since its last sync,
+// the answer the server's changes since the client's checkpoint.
+func (s *Server) syncCollection(c *fiber.Ctx) error {
+	store, collection, err := s.collection(c)
+	if err != nil {
+		return err
+	}
+
+	var req jsondb.SyncRequest
+	if err := parseBody(c, &req); err != nil {
+		return c.Status(400).SendString(fmt.Sprintf("Error parsing request body: %v", err))
+	}
+	if req.Replica == "" || req.Replica == syncReplica {
+		return c.Status(400).SendString("Replica must name the client")
+	}
+
+	resp, err := store.Sync(collection, syncReplica, req)
+	if err != nil {
+		return writeError(c, err)
+	}
+	return respond(c, resp)
+}
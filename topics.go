@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+
+	"database/jsondb"
+)
+
+// publish appends the JSON request body to a topic.
+func (s *Server) publish(c *fiber.Ctx) error {
+	var payload json.RawMessage
+	if err := json.Unmarshal(c.Body(), &payload); err != nil {
+		return c.Status(400).SendString("Request body must be JSON")
+	}
+
+	m, err := s.store(c).Publish(param(c, "topic"), payload)
+	if err != nil {
+		return c.Status(400).SendString(fmt.Sprintf("Error publishing message: %v", err))
+	}
+
+	return respond(c.Status(201), m)
+}
+
+// commit advances a subscriber's cursor to ?id=.
+func (s *Server) commit(c *fiber.Ctx) error {
+	err := s.store(c).Commit(param(c, "topic"), c.Query("subscriber"), c.Query("id"))
+	if err != nil {
+		return c.Status(400).SendString(fmt.Sprintf("Error committing cursor: %v", err))
+	}
+
+	return c.SendStatus(204)
+}
+
+// subscribe streams the messages of a topic to ?subscriber= as server-sent
+// events, with the message ID as event id. Messages are delivered again
+// until committed; an EventSource reconnecting with Last-Event-ID commits
+// everything up to it.
+func (s *Server) subscribe(c *fiber.Ctx) error {
+	store, topic, subscriber := s.store(c), param(c, "topic"), c.Query("subscriber")
+
+	if last := c.Get("Last-Event-ID"); last != "" {
+		if err := store.Commit(topic, subscriber, last); err != nil {
+			return c.Status(400).SendString(fmt.Sprintf("Error committing cursor: %v", err))
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	messages, err := store.Subscribe(ctx, topic, subscriber)
+	if err != nil {
+		cancel()
+		return c.Status(400).SendString(fmt.Sprintf("Error subscribing: %v", err))
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer cancel()
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+
+		fmt.Fprint(w, ": connected\n\n")
+
+		for {
+			if err := w.Flush(); err != nil {
+				return
+			}
+
+			select {
+			case m, ok := <-messages:
+				if !ok {
+					return
+				}
+
+				b, err := json.Marshal(m)
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(w, "id: %s\nevent: message\ndata: %s\n\n", m.ID, b)
+
+			case t := <-heartbeat.C:
+				fmt.Fprintf(w, "event: heartbeat\ndata: %d\n\n", t.Unix())
+			}
+		}
+	})
+	return nil
+}
+
+// socketCommit is what WebSocket subscribers send to commit a message.
+type socketCommit struct {
+	Commit string
+}
+
+// subscribeSocket streams the messages of a topic to ?subscriber= over a
+// WebSocket. Clients commit a message by sending {"Commit": "<id>"}.
+func (s *Server) subscribeSocket(conn *websocket.Conn) {
+	topic, err := url.PathUnescape(conn.Params("topic"))
+	if err != nil {
+		topic = conn.Params("topic")
+	}
+	subscriber := conn.Query("subscriber")
+
+	db, ok := conn.Locals(storeLocal).(*jsondb.Driver)
+	if !ok {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "Missing store"))
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages, err := db.Subscribe(ctx, topic, subscriber)
+	if err != nil {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()))
+		return
+	}
+
+	// Commits arrive on the read side; a read error means the client left.
+	go func() {
+		defer cancel()
+		for {
+			var msg socketCommit
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if err := db.Commit(topic, subscriber, msg.Commit); err != nil {
+				return
+			}
+		}
+	}()
+
+	for m := range messages {
+		if err := conn.WriteJSON(m); err != nil {
+			return
+		}
+	}
+}
+
+// storeLocal is the key under which socketUpgrade keeps the store of the
+// handshake for subscribeSocket, which has no request context of its own.
+const storeLocal = "store"
+
+// socketUpgrade lets only WebSocket handshakes through to subscribeSocket,
+// with the store of the request, bound to its roles.
+func (s *Server) socketUpgrade(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return fiber.ErrUpgradeRequired
+	}
+	c.Locals(storeLocal, s.store(c))
+	return c.Next()
+}
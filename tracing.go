@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"database/jsondb"
+)
+
+// TracingConfig selects where OpenTelemetry spans are exported.
+type TracingConfig struct {
+	// Exporter is "stdout", "otlp" or empty to disable tracing.
+	Exporter string
+
+	// Endpoint is the host:port of the OTLP/HTTP collector.
+	Endpoint string
+
+	// Insecure sends OTLP spans over plain HTTP.
+	Insecure bool
+
+	// ServiceName names this server in traces.
+	ServiceName string
+}
+
+// setupTracing installs the global tracer provider described by cfg. The
+// returned function flushes and stops it.
+func setupTracing(cfg TracingConfig) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch cfg.Exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "otlp":
+		opts := []otlptracehttp.Option{}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		return nil, fmt.Errorf("Unknown trace exporter '%s'", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	name := cfg.ServiceName
+	if name == "" {
+		name = "jsondb"
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", name))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return provider.Shutdown, nil
+}
+
+// traceRequests starts a span for every request, continuing the trace of
+// the caller if it sent trace headers, and stores it in the user context.
+func traceRequests(c *fiber.Ctx) error {
+	ctx := otel.GetTextMapPropagator().Extract(c.UserContext(), headerCarrier{c})
+	// Values from c are only valid during the request; the span outlives it.
+	method := strings.Clone(c.Method())
+	ctx, span := otel.Tracer("database").Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", method),
+			attribute.String("url.path", strings.Clone(c.Path())),
+		))
+	defer span.End()
+
+	c.SetUserContext(ctx)
+	err := c.Next()
+
+	status := c.Response().StatusCode()
+	if e, ok := err.(*fiber.Error); ok {
+		status = e.Code
+	}
+
+	span.SetName(method + " " + c.Route().Path)
+	span.SetAttributes(
+		attribute.String("http.route", c.Route().Path),
+		attribute.Int("http.response.status_code", status),
+	)
+	if status >= 500 {
+		span.SetStatus(codes.Error, fmt.Sprint(status))
+	}
+	return err
+}
+
+// headerCarrier adapts request and response headers for propagators.
+type headerCarrier struct {
+	c *fiber.Ctx
+}
+
+func (h headerCarrier) Get(key string) string { return h.c.Get(key) }
+func (h headerCarrier) Set(key, value string) { h.c.Set(key, value) }
+
+func (h headerCarrier) Keys() []string {
+	var keys []string
+	h.c.Request().Header.VisitAll(func(k, _ []byte) {
+		keys = append(keys, string(k))
+	})
+	return keys
+}
+
+// outgoing marks a request this server makes on behalf of the request of
+// ctx, setting its headers with set: the trace context, for the callee to
+// continue the trace, and the instance ID of db.
+func outgoing(ctx context.Context, db *jsondb.Driver, set func(key, value string)) {
+	otel.GetTextMapPropagator().Inject(ctx, headerSetter(set))
+	set(jsondb.InstanceHeader, db.InstanceID())
+}
+
+// headerSetter adapts the headers of an outgoing request for propagators,
+// which only set them.
+type headerSetter func(key, value string)
+
+func (h headerSetter) Get(string) string     { return "" }
+func (h headerSetter) Set(key, value string) { h(key, value) }
+func (h headerSetter) Keys() []string        { return nil }
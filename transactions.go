@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"database/jsondb"
+)
+
+// txRequest is the body of POST /transactions: the changes to commit
+// together, each a write of Data or a delete.
+type txRequest struct {
+	Changes []txChange
+}
+
+type txChange struct {
+	Op         string
+	Collection string
+	Resource   string
+	Data       json.RawMessage `json:",omitempty"`
+}
+
+// transact begins a transaction, adds the changes of the request body to
+// it and commits it: they all take effect or none does. Writes to typed
+// collections are checked against their type first.
+func (s *Server) transact(c *fiber.Ctx) error {
+	if s.ring != nil {
+		return c.Status(501).SendString("Transactions are not supported on a partitioned cluster")
+	}
+
+	var req txRequest
+	if err := json.Unmarshal(c.Body(), &req); err != nil {
+		return c.Status(400).SendString(fmt.Sprintf("Error parsing request body: %v", err))
+	}
+	if len(req.Changes) == 0 {
+		return c.Status(400).SendString("Transaction has no changes")
+	}
+
+	store := s.store(c)
+	tx, err := store.Begin()
+	if err != nil {
+		return c.Status(500).SendString(fmt.Sprintf("Error starting transaction: %v", err))
+	}
+	defer tx.Rollback()
+
+	for i, ch := range req.Changes {
+		if strings.HasPrefix(ch.Collection, "_") {
+			return c.Status(403).SendString(jsondb.ErrReservedCollection.Error())
+		}
+
+		switch strings.ToLower(ch.Op) {
+		case jsondb.OpWrite:
+			if err := s.checkTxWrite(ch); err != nil {
+				return err
+			}
+			err = tx.WriteRaw(ch.Collection, ch.Resource, ch.Data)
+		case jsondb.OpDelete:
+			err = tx.Delete(ch.Collection, ch.Resource)
+		default:
+			return c.Status(400).SendString(fmt.Sprintf("Unknown op '%s' in change %d", ch.Op, i))
+		}
+		if err == jsondb.ErrInvalidJSON {
+			return c.Status(400).SendString(fmt.Sprintf("Error in change %d: %v", i, err))
+		}
+		if err != nil {
+			return writeError(c, err)
+		}
+	}
+
+	err = tx.Commit()
+	if os.IsNotExist(err) {
+		return c.Status(404).SendString(fmt.Sprintf("Error committing transaction: %v", err))
+	}
+	if err != nil {
+		return writeError(c, err)
+	}
+	return respond(c, fiber.Map{"ID": tx.ID(), "Changes": len(req.Changes)})
+}
+
+// checkTxWrite checks the record of a write against the type registered
+// for its collection.
+func (s *Server) checkTxWrite(ch txChange) error {
+	if _, typed := s.recordType(ch.Collection); !typed {
+		return nil
+	}
+	doc, err := jsondb.DecodeValue(ch.Data)
+	if err != nil {
+		return fiber.NewError(400, fmt.Sprintf("Error parsing record '%s/%s': %v", ch.Collection, ch.Resource, err))
+	}
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return fiber.NewError(400, jsondb.ErrInvalidJSON.Error())
+	}
+	return s.checkType(ch.Collection, m)
+}
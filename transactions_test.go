@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestTransact(t *testing.T) {
+	s := newTestServer(t, Config{})
+	admin := bearer(testAdminToken)
+	if err := s.db.Write("users", "ann", map[string]string{"Name": "Ann"}); err != nil {
+		t.Fatal(err)
+	}
+
+	move := txRequest{Changes: []txChange{
+		{Op: "write", Collection: "archive", Resource: "ann", Data: json.RawMessage(`{"Name":"Ann"}`)},
+		{Op: "delete", Collection: "users", Resource: "ann"},
+	}}
+	if r := do(t, s, "POST", "/v1/transactions", move, admin...); r.Status != 200 {
+		t.Fatalf("Transaction: %d %s", r.Status, r.Body)
+	}
+	if err := s.db.Read("archive", "ann", &map[string]string{}); err != nil {
+		t.Errorf("Reading the written record: %v", err)
+	}
+
+	// Deleting ann again fails the transaction, and its write with it.
+	if r := do(t, s, "POST", "/v1/transactions", txRequest{Changes: []txChange{
+		{Op: "write", Collection: "archive", Resource: "bob", Data: json.RawMessage(`{"Name":"Bob"}`)},
+		{Op: "delete", Collection: "users", Resource: "ann"},
+	}}, admin...); r.Status != 404 {
+		t.Errorf("Transaction deleting a missing record: %d, want 404", r.Status)
+	}
+	if err := s.db.Read("archive", "bob", &map[string]string{}); !os.IsNotExist(err) {
+		t.Errorf("Reading the write of the failed transaction: %v, want not found", err)
+	}
+
+	for name, bad := range map[string]txRequest{
+		"no changes":     {},
+		"unknown op":     {Changes: []txChange{{Op: "rename", Collection: "users", Resource: "ann"}}},
+		"invalid record": {Changes: []txChange{{Op: "write", Collection: "users", Resource: "ann", Data: json.RawMessage(`[1]`)}}},
+	} {
+		if r := do(t, s, "POST", "/v1/transactions", bad, admin...); r.Status != 400 {
+			t.Errorf("Transaction with %s: %d, want 400", name, r.Status)
+		}
+	}
+	if r := do(t, s, "POST", "/v1/transactions", txRequest{Changes: []txChange{
+		{Op: "write", Collection: "_system", Resource: "x", Data: json.RawMessage(`{}`)},
+	}}, admin...); r.Status != 403 {
+		t.Errorf("Transaction writing the system namespace: %d, want 403", r.Status)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"database/jsondb"
+)
+
+// heartbeatInterval is how often an idle change stream sends a heartbeat,
+// so proxies keep the connection open and clients notice dead servers.
+const heartbeatInterval = 15 * time.Second
+
+// eventFilter selects the change events a watcher is interested in.
+type eventFilter struct {
+	ops   map[string]bool
+	query jsondb.Query
+}
+
+// watchFilter reads ?ops=update,delete and the filter parameters read by
+// parseFilter.
+func watchFilter(c *fiber.Ctx) (eventFilter, error) {
+	var f eventFilter
+
+	if ops := c.Query("ops"); ops != "" {
+		f.ops = make(map[string]bool)
+		for _, op := range strings.Split(ops, ",") {
+			f.ops[strings.TrimSpace(op)] = true
+		}
+	}
+
+	var err error
+	f.query, err = parseFilter(c)
+	return f, err
+}
+
+// match reports whether e passes the filter. Events without a document,
+// such as deleting a whole collection, only pass filters without fields.
+func (f eventFilter) match(e jsondb.Event) bool {
+	if f.ops != nil && !f.ops[e.Op] {
+		return false
+	}
+	if len(f.query.Where) == 0 && f.query.Geo == nil {
+		return true
+	}
+
+	doc, err := jsondb.DecodeValue(e.Data)
+	if err != nil {
+		return false
+	}
+	m, ok := doc.(map[string]interface{})
+	return ok && f.query.Match(m)
+}
+
+// watch streams the changes of a collection as server-sent events. Each
+// event carries its resume token as id, so EventSource clients resume
+// automatically through Last-Event-ID; others can pass ?resume=.
+func (s *Server) watch(c *fiber.Ctx) error {
+	store, collection, err := s.collection(c)
+	if err != nil {
+		return err
+	}
+
+	filter, err := watchFilter(c)
+	if err != nil {
+		return c.Status(400).SendString(err.Error())
+	}
+	resume := c.Get("Last-Event-ID")
+	if token := c.Query("resume"); token != "" {
+		resume = token
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := store.Watch(ctx, collection, resume)
+	switch {
+	case err == jsondb.ErrResumeExpired:
+		cancel()
+		return c.Status(410).SendString(err.Error())
+	case err != nil:
+		cancel()
+		return c.Status(500).SendString(fmt.Sprintf("Error watching collection: %v", err))
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer cancel()
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+
+		// Tell the client the stream is open before the first change.
+		fmt.Fprint(w, ": connected\n\n")
+
+		for {
+			if err := w.Flush(); err != nil {
+				return
+			}
+
+			select {
+			case e, ok := <-events:
+				if !ok {
+					return // dropped for falling behind; the client resumes
+				}
+				if !filter.match(e) {
+					continue
+				}
+
+				b, err := json.Marshal(e)
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.Token(), e.Op, b)
+
+			case t := <-heartbeat.C:
+				fmt.Fprintf(w, "event: heartbeat\ndata: %d\n\n", t.Unix())
+			}
+		}
+	})
+	return nil
+}
+
+// maxPollWait bounds how long a long poll waits for changes.
+const maxPollWait = 2 * time.Minute
+
+// pollBatch is the most events a long poll answers at once.
+const pollBatch = 1000
+
+// poll serves the changes of a collection by long polling, for clients
+// behind proxies that cut streams: it answers as soon as there are events
+// after the resume token ?since=, or once ?wait= (30s by default, 2m at
+// most) passes without any, with the events and the token to poll from
+// next, the same tokens as the stream's. Without ?since= it waits for the
+// changes made from now on.
+func (s *Server) poll(c *fiber.Ctx) error {
+	store, collection, err := s.collection(c)
+	if err != nil {
+		return err
+	}
+
+	filter, err := watchFilter(c)
+	if err != nil {
+		return c.Status(400).SendString(err.Error())
+	}
+	wait := 30 * time.Second
+	if v := c.Query("wait"); v != "" {
+		if wait, err = time.ParseDuration(v); err != nil {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return c.Status(400).SendString(fmt.Sprintf("Invalid wait '%s'", v))
+			}
+			wait = time.Duration(n) * time.Second
+		}
+	}
+	if wait > maxPollWait {
+		wait = maxPollWait
+	}
+
+	next := c.Query("since")
+	if next == "" {
+		next = store.ChangeToken()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := store.Watch(ctx, collection, next)
+	switch {
+	case err == jsondb.ErrResumeExpired:
+		return c.Status(410).SendString(err.Error())
+	case err != nil:
+		return c.Status(500).SendString(fmt.Sprintf("Error watching collection: %v", err))
+	}
+
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	matched := []jsondb.Event{}
+	more := true
+	for more && len(matched) == 0 {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				more = false // dropped for falling behind; the client polls again
+				continue
+			}
+			next = e.Token()
+			if filter.match(e) {
+				matched = append(matched, e)
+			}
+		case <-timeout.C:
+			more = false
+		}
+	}
+
+	// Take the events already there along
+	for more && len(matched) < pollBatch {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				more = false
+				continue
+			}
+			next = e.Token()
+			if filter.match(e) {
+				matched = append(matched, e)
+			}
+		default:
+			more = false
+		}
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	return respond(c, fiber.Map{"Events": matched, "Next": next})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+
+	"database/jsondb"
+)
+
+// actorHeader names who a request acts for, such as the user of a
+// service; it is recorded as claimed, not checked, and never as the
+// writer.
+const actorHeader = "X-Actor"
+
+// identifyActor binds the request context to its actor, for collections
+// with TrackWrites to record as the writer: the user logged in, or else
+// the client address. The X-Actor header is kept apart, as claimed.
+func identifyActor(c *fiber.Ctx) error {
+	actor, _ := c.Locals(userLocal).(string)
+	if actor == "" {
+		actor = c.IP()
+	}
+	ctx := jsondb.WithActor(c.UserContext(), actor)
+	if claimed := c.Get(actorHeader); claimed != "" {
+		ctx = jsondb.WithClaimedActor(ctx, claimed)
+	}
+	c.SetUserContext(ctx)
+	return c.Next()
+}
+
+// writeHeaders gives successful reads and writes of records of
+// collections with TrackWrites the version, last writer and last write
+// time of the record, so client logs show who overwrote a change.
+func (s *Server) writeHeaders(c *fiber.Ctx) error {
+	if err := c.Next(); err != nil {
+		return err
+	}
+
+	status := c.Response().StatusCode()
+	if status != fiber.StatusOK && status != fiber.StatusCreated {
+		return nil
+	}
+	store, collection, err := s.collection(c)
+	if err != nil {
+		return nil
+	}
+	info, err := store.WriteInfo(collection, param(c, "resource"))
+	if err != nil || info.Version == 0 {
+		return nil
+	}
+
+	c.Set("X-Record-Version", strconv.FormatInt(info.Version, 10))
+	if info.Writer != "" {
+		c.Set("X-Last-Writer", info.Writer)
+	}
+	if info.ClaimedWriter != "" {
+		c.Set("X-Last-Writer-Claimed", info.ClaimedWriter)
+	}
+	c.Set(fiber.HeaderLastModified, info.Modified.Format(http.TimeFormat))
+	return nil
+}